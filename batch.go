@@ -0,0 +1,85 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// GenerateSignatures Returns the signature of every file in paths, keyed by
+// path, hashing up to parallelism files at once with GenerateSignature.
+// A parallelism <= 0 uses one worker per CPU, a blockSize <= 0 the default
+// block size. Files that fail do not stop the batch: the signatures of the
+// others are returned along with the errors of the failed files joined
+// together.
+//并行计算多个文件的签名
+func GenerateSignatures(paths []string, blockSize, parallelism int) (map[string][]BlockHash, error) {
+	config := &Config{BlockSize: blockSize}
+	return config.GenerateSignatures(paths, parallelism, false)
+}
+
+// GenerateSignatures Returns the signature of every file in paths using the
+// configuration. With failFast no further file is started after the first
+// error; otherwise every file is hashed and all the errors are joined.
+func (c *Config) GenerateSignatures(paths []string, parallelism int, failFast bool) (map[string][]BlockHash, error) {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	signatures := make(map[string][]BlockHash, len(paths))
+	//按 paths 的顺序保存错误，保证结果稳定
+	errs := make([]error, len(paths))
+	var mu sync.Mutex
+	var failed atomic.Bool
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(parallelism, len(paths)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				sig, err := c.generateFileSignature(paths[i])
+				if err != nil {
+					errs[i] = err
+					failed.Store(true)
+					continue
+				}
+				mu.Lock()
+				signatures[paths[i]] = sig
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range paths {
+		if failFast && failed.Load() {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return signatures, errors.Join(errs...)
+}
+
+// Returns the signature of the file at path.
+func (c *Config) generateFileSignature(path string) ([]BlockHash, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	sig, err := c.GenerateSignature(bufio.NewReader(file))
+	if err != nil {
+		return nil, fmt.Errorf("rsync: %s: %w", path, err)
+	}
+	return sig, nil
+}
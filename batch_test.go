@@ -0,0 +1,65 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for batch signature generation
+package rsync
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_GenerateSignatures(t *testing.T) {
+	paths := []string{
+		"test-data/golang-original.bmp",
+		"test-data/golang-modified.bmp",
+		"test-data/text-original.txt",
+		"test-data/text-modified.txt",
+	}
+	config := &Config{BlockSize: 512}
+
+	for _, parallelism := range []int{0, 1, 3, 10} {
+		signatures, err := GenerateSignatures(paths, 512, parallelism)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(signatures) != len(paths) {
+			t.Errorf("expected %d signatures, found %d", len(paths), len(signatures))
+		}
+		for _, path := range paths {
+			content, _ := os.ReadFile(path)
+			if !reflect.DeepEqual(signatures[path], config.CalculateBlockHashes(content)) {
+				t.Errorf("parallelism %d: signature of %s differs from CalculateBlockHashes", parallelism, path)
+			}
+		}
+	}
+}
+
+func Test_GenerateSignaturesErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	paths := []string{"test-data/text-original.txt", missing, "test-data/text-modified.txt", missing + "2"}
+
+	//单个文件出错不影响其他文件
+	signatures, err := GenerateSignatures(paths, 0, 2)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v, found %v", fs.ErrNotExist, err)
+	}
+	if len(signatures) != 2 || signatures[paths[0]] == nil || signatures[paths[2]] == nil {
+		t.Errorf("expected the signatures of the readable files, found %d", len(signatures))
+	}
+
+	//出错后不再开始新的文件
+	signatures, err = (&Config{}).GenerateSignatures([]string{missing, paths[0], paths[2]}, 1, true)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected %v, found %v", fs.ErrNotExist, err)
+	}
+	if len(signatures) > 1 {
+		t.Errorf("expected fail fast to stop the batch, found %d signatures", len(signatures))
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"math"
+)
+
+const (
+	// minRecommendedBlockSize Block size recommended for files of up to
+	// 700*700 bytes, BLOCK_SIZE in rsync.
+	//推荐的最小块大小
+	minRecommendedBlockSize = 700
+	// maxRecommendedBlockSize Largest block size recommended, MAX_BLOCK_SIZE
+	// in rsync since protocol 30.
+	//推荐的最大块大小
+	maxRecommendedBlockSize = 1 << 17
+	// tuneSampleSize Length of the leading part of the basis and the modified
+	// content TuneBlockSize computes differences for.
+	//选择块大小时使用的样本长度
+	tuneSampleSize = 4 << 20
+)
+
+// RecommendBlockSize Returns a block size for a file of fileSize bytes with
+// the heuristic of rsync (sum_sizes_sqroot in generator.c): the square root of
+// the size, rounded down to a multiple of 8, clamped to [700, 128 KiB]. It
+// balances the signature, which shrinks as blocks grow, against the data
+// resent around every change, which grows with them: with blocks of sqrt(n)
+// bytes both are about sqrt(n) for a file of n bytes changed in one place.
+//按文件大小的平方根推荐块大小，与 rsync 相同
+func RecommendBlockSize(fileSize int) int {
+	if fileSize <= minRecommendedBlockSize*minRecommendedBlockSize {
+		return minRecommendedBlockSize
+	}
+	size := int(math.Sqrt(float64(fileSize))) &^ 7
+	return min(size, maxRecommendedBlockSize)
+}
+
+// TuneBlockSize Returns the block size, out of RecommendBlockSize(len(modified))
+// and the sizes 2 and 4 times smaller and larger, with the smallest estimated
+// transfer for recreating modified from basis: the weak and strong hashes of
+// the signature plus the encoded operations. Only the first 4 MiB of both are
+// compared, so the estimate assumes changes spread like in that sample. The
+// other settings of the configuration, such as chunking, are kept.
+//在样本上尝试几个块大小，选择估计传输量最小的
+func (c *Config) TuneBlockSize(basis, modified []byte) int {
+	recommended := RecommendBlockSize(len(modified))
+	basis = basis[:min(len(basis), tuneSampleSize)]
+	modified = modified[:min(len(modified), tuneSampleSize)]
+
+	var tuned Config
+	if c != nil {
+		tuned = *c
+	}
+	tuned.Progress = nil
+	best, bestCost := recommended, math.MaxInt
+	for _, size := range []int{recommended / 4, recommended / 2, recommended, recommended * 2, recommended * 4} {
+		tuned.BlockSize = size
+		var cost int
+		for _, h := range tuned.CalculateBlockHashes(basis) {
+			cost += 4 + len(h.strongHash)
+		}
+		for _, op := range tuned.Diff(basis, modified) {
+			cost += tuned.encodedLen(op)
+		}
+		//相同时选择较大的块
+		if cost < bestCost || (cost == bestCost && size > best) {
+			best, bestCost = size, cost
+		}
+	}
+	return best
+}
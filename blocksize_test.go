@@ -0,0 +1,49 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the block size selection
+package rsync
+
+import (
+	"testing"
+)
+
+func Test_RecommendBlockSize(t *testing.T) {
+	cases := []struct{ fileSize, blockSize int }{
+		{0, 700},
+		{700 * 700, 700},
+		{1000 * 1000, 1000},
+		{1 << 20, 1024},
+		{1234567, 1104},
+		{100000000, 10000},
+		{1 << 40, 1 << 17},
+	}
+	for _, test := range cases {
+		if size := RecommendBlockSize(test.fileSize); size != test.blockSize {
+			t.Errorf("expected block size %d for %d bytes, found %d", test.blockSize, test.fileSize, size)
+		}
+	}
+}
+
+func Test_TuneBlockSize(t *testing.T) {
+	original := randomContent(1<<20, 67)
+	config := &Config{}
+
+	//没有修改时签名决定传输量，选择最大的块
+	if size := config.TuneBlockSize(original, original); size != 4096 {
+		t.Errorf("expected the largest block size for identical content, found %d", size)
+	}
+	//分散的修改选择较小的块
+	modified := append([]byte(nil), original...)
+	for offset := 0; offset < len(modified); offset += 3000 {
+		modified[offset]++
+	}
+	if size := config.TuneBlockSize(original, modified); size >= 1024 {
+		t.Errorf("expected a small block size for scattered changes, found %d", size)
+	}
+	if size := (*Config)(nil).TuneBlockSize(nil, nil); size < 175 || size > 2800 {
+		t.Errorf("expected a block size around 700 for empty content, found %d", size)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import "math/bits"
+
+// bloomBitsPerBlock Bits of the bloom filter per block of the signature,
+// rounded up to a power of two. With bloomHashes bits set in a single word
+// about 1% of the windows without a match pass the filter.
+//布隆过滤器中每个块的位数
+const bloomBitsPerBlock = 16
+
+// bloomHashes Number of bits set in the filter for every weak hash.
+const bloomHashes = 3
+
+// bloomFilter A blocked bloom filter over weak hashes: the bits of a weak hash
+// all fall in one 64-bit word, so a test reads a single word.
+//弱hash的布隆过滤器，每个弱hash的位都在同一个字中
+type bloomFilter struct {
+	words []uint64
+	//取乘积的高位作为字的下标
+	shift uint
+}
+
+// Returns a filter holding the weak hashes of hashes.
+func newBloomFilter(hashes []BlockHash) *bloomFilter {
+	words := max(len(hashes)*bloomBitsPerBlock/64, 1)
+	//字数取 2 的幂，下标直接取高位
+	n := bits.Len(uint(words - 1))
+	f := &bloomFilter{words: make([]uint64, 1<<n), shift: uint(64 - n)}
+	for _, h := range hashes {
+		i, mask := f.position(h.weakHash)
+		f.words[i] |= mask
+	}
+	return f
+}
+
+// Returns the word of weak and the bits it sets there, taken from a
+// multiplicative hash of weak, whose high bits are the best mixed.
+func (f *bloomFilter) position(weak uint32) (uint64, uint64) {
+	h := uint64(weak) * 0x9e3779b97f4a7c15
+	var mask uint64
+	for k := 0; k < bloomHashes; k++ {
+		mask |= 1 << (h >> (20 + 6*k) & 63)
+	}
+	return h >> f.shift, mask
+}
+
+// Reports whether weak may be the weak hash of a block of the signature.
+func (f *bloomFilter) has(weak uint32) bool {
+	i, mask := f.position(weak)
+	return f.words[i]&mask == mask
+}
+
+// bloomMatcher The default matcher behind a bloom filter of weak hashes.
+//先经过布隆过滤器的默认查找方式
+type bloomMatcher struct {
+	filter *bloomFilter
+	index  *blockIndex
+}
+
+// Returns the default matcher of hashes behind a bloom filter.
+func (c *Config) newBloomMatcher(hashes []BlockHash) *bloomMatcher {
+	return &bloomMatcher{filter: newBloomFilter(hashes), index: c.newBlockIndex(hashes)}
+}
+
+// Match Returns the block equal to block, looking the bucket of weak up only
+// when the filter may hold weak.
+func (m *bloomMatcher) Match(weak uint32, block []byte, previous int) *BlockHash {
+	if !m.filter.has(weak) {
+		return nil
+	}
+	return m.index.Match(weak, block, previous)
+}
@@ -0,0 +1,89 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the bloom filter prescreen
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func Test_BloomFilter(t *testing.T) {
+	hashes := (&Config{BlockSize: 16}).CalculateBlockHashes(randomContent(16*10000, 56))
+	filter := newBloomFilter(hashes)
+	for _, h := range hashes {
+		if !filter.has(h.weakHash) {
+			t.Fatalf("expected the filter to hold %v", h)
+		}
+	}
+	//其他弱hash大多被过滤
+	var passed int
+	random := rand.New(rand.NewSource(57))
+	for i := 0; i < 100000; i++ {
+		if filter.has(random.Uint32()) {
+			passed++
+		}
+	}
+	if rate := float64(passed) / 100000; rate > 0.05 {
+		t.Errorf("expected few false positives, found %.3f", rate)
+	}
+	if empty := newBloomFilter(nil); empty.has(0) || len(empty.words) != 1 {
+		t.Errorf("expected an empty filter of one word")
+	}
+
+	original := randomContent(64*500, 58)
+	modified := modifiedContent(original, 20, 59)
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		config := &Config{BlockSize: 64, Chunking: chunking}
+		bloom := &Config{BlockSize: 64, Chunking: chunking, BloomFilter: true}
+		expected := config.Diff(original, modified)
+		if ops := bloom.Diff(original, modified); !reflect.DeepEqual(ops, expected) {
+			t.Errorf("%v: expected the same operations with a bloom filter", chunking)
+		}
+		var delta bytes.Buffer
+		if err := bloom.ComputeDelta(bytes.NewReader(modified), bloom.CalculateBlockHashes(original), &delta); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decodeOps(t, delta.Bytes()), encodedOps(t, expected)) {
+			t.Errorf("%v: expected the same streaming delta with a bloom filter", chunking)
+		}
+	}
+	bloom := &Config{BlockSize: 64, BloomFilter: true}
+	var parallel []RSyncOp
+	bloom.calculateDifferencesParallel(context.Background(), modified, bloom.CalculateBlockHashes(original), func(op RSyncOp) error {
+		parallel = append(parallel, op)
+		return nil
+	}, 4)
+	if !reflect.DeepEqual(parallel, (&Config{BlockSize: 64}).Diff(original, modified)) {
+		t.Errorf("expected the same parallel operations with a bloom filter")
+	}
+}
+
+func Benchmark_BloomFilter(b *testing.B) {
+	//二十五万个块，目标数据几乎全部不同
+	original := randomContent(64<<20, 60)
+	modified := append(randomContent(4<<20, 61), original[:64<<10]...)
+	hashes := (&Config{BlockSize: 256}).CalculateBlockHashes(original)
+	for _, bloom := range []bool{false, true} {
+		name := "Map"
+		if bloom {
+			name = "Bloom"
+		}
+		//索引只构建一次，与签名一起加载
+		config := &Config{BlockSize: 256, BloomFilter: bloom}
+		matcher := config.DefaultMatcher(hashes)
+		config.Matcher = func([]BlockHash) Matcher { return matcher }
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(modified)))
+			for i := 0; i < b.N; i++ {
+				config.calculateDifferences(context.Background(), modified, hashes, func(RSyncOp) error { return nil })
+			}
+		})
+	}
+}
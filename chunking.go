@@ -0,0 +1,313 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// ChunkingMode How content is split into blocks.
+//分块方式
+type ChunkingMode int
+
+const (
+	// FixedChunking 固定长度的块，每个块 BlockSize 字节，差异计算时逐字节 rolling
+	FixedChunking ChunkingMode = iota
+	// ContentDefinedChunking 根据内容决定块的边界，块的平均长度约为 BlockSize。
+	// An insertion only moves the boundaries next to it, so the following
+	// blocks still match. The target is split the same way and its blocks are
+	// looked up as a whole instead of rolling byte by byte.
+	ContentDefinedChunking
+	// LineChunking 每个块是一行，以换行符结尾，超过 BlockSize 的行按 BlockSize 切分。
+	// Meant for text such as source code and configuration files: editing a
+	// line only changes its own block, and the target is split into lines
+	// and looked up as a whole like ContentDefinedChunking. Signatures hold a
+	// block per line, so MinMatch helps against runs of tiny matched lines.
+	LineChunking
+)
+
+// gearTable Random values mixed into the content-defined chunking hash, one per
+// byte value. Generated with splitmix64 from a fixed seed: both sides of a sync
+// must use the same table, so it must never change.
+//分块哈希使用的随机表
+var gearTable = func() (table [256]uint64) {
+	x := uint64(0x5253594e43)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Returns the configured chunking mode.
+func (c *Config) chunking() ChunkingMode {
+	if c == nil {
+		return FixedChunking
+	}
+	return c.Chunking
+}
+
+// Returns the largest block the configured chunking can produce.
+//最大块长度
+func (c *Config) maxBlockSize() int {
+	if c.chunking() == ContentDefinedChunking {
+		return 4 * c.blockSize()
+	}
+	return c.blockSize()
+}
+
+// Returns the length of the first block of window, which holds at least
+// maxBlockSize bytes unless it is the end of the content.
+// Content-defined boundaries are placed where the top bits of a gear rolling
+// hash over the last 64 bytes are all zero, after at least BlockSize/4 bytes
+// and at most 4*BlockSize bytes. Line boundaries follow a newline byte, after
+// at most BlockSize bytes.
+//返回窗口中第一个块的长度
+func (c *Config) nextBlockLen(window []byte) int {
+	blockSize := c.blockSize()
+	if c.chunking() == LineChunking {
+		end := min(blockSize, len(window))
+		//块在换行符之后结束
+		if i := bytes.IndexByte(window[:end], '\n'); i >= 0 {
+			return i + 1
+		}
+		return end
+	}
+	if c.chunking() != ContentDefinedChunking {
+		return min(blockSize, len(window))
+	}
+	end := min(len(window), c.maxBlockSize())
+	minSize := max(blockSize/4, 1)
+	//边界出现的概率约为 1/2^maskBits
+	maskBits := max(bits.Len(uint(blockSize))-1, 1)
+	var h uint64
+	for i := 0; i < end; i++ {
+		h = (h << 1) + gearTable[window[i]]
+		if i+1 >= minSize && h>>(64-maskBits) == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// Returns the end offset of every block of content when blocks have variable
+// length, or nil with fixed blocks.
+//返回变长块的结束位置
+func (c *Config) chunkBounds(content []byte) []int {
+	if c.chunking() == FixedChunking {
+		return nil
+	}
+	maxBlockSize := c.maxBlockSize()
+	var bounds []int
+	for offset := 0; offset < len(content); {
+		offset += c.nextBlockLen(content[offset:min(offset+maxBlockSize, len(content))])
+		bounds = append(bounds, offset)
+	}
+	return bounds
+}
+
+// Returns the end offset of every block of basis when blocks have variable
+// length, or nil with fixed blocks. Only the offsets are kept in memory.
+func (c *Config) chunkBoundsAt(basis io.ReaderAt) ([]int64, error) {
+	if c.chunking() == FixedChunking {
+		return nil, nil
+	}
+	var bounds []int64
+	var offset int64
+	err := c.readBlocks(io.NewSectionReader(basis, 0, math.MaxInt64), func(block []byte) error {
+		offset += int64(len(block))
+		bounds = append(bounds, offset)
+		return nil
+	})
+	return bounds, err
+}
+
+// Reads r block by block with the configured chunking, passing each block to fn.
+// The block is only valid until fn returns.
+//按配置的分块方式逐块读取
+func (c *Config) readBlocks(r io.Reader, fn func(block []byte) error) error {
+	if c.chunking() == FixedChunking {
+		block := make([]byte, c.blockSize())
+		for {
+			n, err := io.ReadFull(r, block)
+			//最后一个块可能不足 blockSize
+			if n > 0 {
+				if err := fn(block[:n]); err != nil {
+					return err
+				}
+			}
+			switch err {
+			case nil:
+			case io.EOF, io.ErrUnexpectedEOF:
+				return nil
+			default:
+				return err
+			}
+		}
+	}
+
+	maxBlockSize := c.maxBlockSize()
+	br := bufio.NewReaderSize(r, maxBlockSize)
+	for {
+		window, err := br.Peek(maxBlockSize)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(window) == 0 {
+			return nil
+		}
+		n := c.nextBlockLen(window)
+		if err := fn(window[:n]); err != nil {
+			return err
+		}
+		br.Discard(n)
+	}
+}
+
+// Returns the bytes of blockCount blocks of content starting at blockIndex,
+// with the block end offsets returned by chunkBounds, or nil for fixed blocks.
+//返回连续若干个块的数据
+func (c *Config) blocksContent(content []byte, bounds []int, blockIndex, blockCount int) ([]byte, error) {
+	blockSize := c.blockSize()
+	blocksNumber := len(bounds)
+	if bounds == nil {
+		blocksNumber = getBlocksNumber(content, blockSize)
+	}
+	if blockIndex < 0 || blockCount < 1 || blockIndex >= blocksNumber || blockCount > blocksNumber-blockIndex {
+		return nil, fmt.Errorf("%w: blocks %d to %d for %d bytes of content", ErrBlockIndexOutOfRange, blockIndex, blockIndex+blockCount-1, len(content))
+	}
+	if bounds == nil {
+		//最后一个块可能不足 blockSize
+		initialByte := blockIndex * blockSize
+		endingByte := min(initialByte+blockCount*blockSize, len(content))
+		return content[initialByte:endingByte], nil
+	}
+	var initialByte int
+	if blockIndex > 0 {
+		initialByte = bounds[blockIndex-1]
+	}
+	return content[initialByte:bounds[blockIndex+blockCount-1]], nil
+}
+
+// Scans content for variable length blocks of hashes: content is split with
+// the same chunking as the signature and every block is looked up as a whole,
+// see scan.
+//变长块的查找，目标数据按同样的方式分块后整块查找
+func (c *Config) scanChunks(ctx context.Context, content []byte, hashes []BlockHash, match func(blockHash *BlockHash, start, end int) error, literal func(start, end int) error) error {
+	matcher := c.newMatcher(hashes)
+	maxBlockSize := c.maxBlockSize()
+
+	var offset, previousMatch, nextCheck, matched int
+	previous := -1
+	for offset < len(content) {
+		if offset >= nextCheck {
+			if err := c.checkpoint(ctx, offset, len(content)); err != nil {
+				return err
+			}
+			if err := c.checkBail(offset, matched); err != nil {
+				return err
+			}
+			nextCheck = offset + checkInterval
+		}
+		endingByte := offset + c.nextBlockLen(content[offset:min(offset+maxBlockSize, len(content))])
+		block := content[offset:endingByte]
+		if blockHash := c.lookupBlock(matcher, previous, block); blockHash != nil {
+			if previousMatch < offset {
+				if err := literal(previousMatch, offset); err != nil {
+					return err
+				}
+			}
+			if err := match(blockHash, offset, endingByte); err != nil {
+				return err
+			}
+			previousMatch = endingByte
+			matched += endingByte - offset
+			previous = blockHash.index
+		} else {
+			previous = -1
+		}
+		offset = endingByte
+	}
+
+	if err := c.checkBail(len(content), matched); err != nil {
+		return err
+	}
+	if previousMatch < len(content) {
+		return literal(previousMatch, len(content))
+	}
+	return nil
+}
+
+// Passes the operations for variable length blocks of target to emit.
+// Consecutive unmatched blocks are merged into DATA operations of up to
+// streamBufferSize bytes.
+//流式的变长块差异计算
+func (c *Config) computeChunkDelta(target io.Reader, sig []BlockHash, emit func(RSyncOp) error) error {
+	matcher := c.newMatcher(sig)
+	runs := c.newBlockRuns(c.limitOps(emit))
+
+	var literal []byte
+	previous := -1
+	//已扫描和已匹配的字节数，下一次检查的位置
+	var offset, matched, nextCheck int
+	err := c.readBlocks(target, func(block []byte) error {
+		if offset >= nextCheck {
+			if err := c.checkBail(offset, matched); err != nil {
+				return err
+			}
+			nextCheck = offset + checkInterval
+		}
+		offset += len(block)
+		blockHash := c.lookupBlock(matcher, previous, block)
+		if blockHash == nil {
+			previous = -1
+			literal = append(literal, block...)
+			if len(literal) < streamBufferSize {
+				return nil
+			}
+		}
+		if len(literal) > 0 {
+			if err := runs.add(RSyncOp{opCode: DATA, data: literal}); err != nil {
+				return err
+			}
+			literal = literal[:0]
+		}
+		if blockHash == nil {
+			return nil
+		}
+		previous = blockHash.index
+		matched += len(block)
+		return runs.add(RSyncOp{opCode: BLOCK, blockIndex: blockHash.index, basis: blockHash.basis, data: block})
+	})
+	if err == nil {
+		err = c.checkBail(offset, matched)
+	}
+	if err != nil {
+		return err
+	}
+	if len(literal) > 0 {
+		if err := runs.add(RSyncOp{opCode: DATA, data: literal}); err != nil {
+			return err
+		}
+	}
+	return runs.flush()
+}
+
+// Returns the hash of the signature block equal to block, or nil, preferring
+// the block following previous as explained for followingBlock.
+//按弱hash和强hash查找整块
+func (c *Config) lookupBlock(matcher *blockIndex, previous int, block []byte) *BlockHash {
+	return matcher.Match(c.weakHash(block), block, previous)
+}
@@ -0,0 +1,201 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for variable length chunking
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ContentDefinedChunkingBounds(t *testing.T) {
+	config := &Config{BlockSize: 256, Chunking: ContentDefinedChunking}
+	content := randomContent(1<<20, 3)
+	bounds := config.chunkBounds(content)
+
+	var previous int
+	for i, end := range bounds {
+		length := end - previous
+		if length > 4*256 || (length < 256/4 && i < len(bounds)-1) {
+			t.Fatalf("block %d has length %d outside of [%d, %d]", i, length, 256/4, 4*256)
+		}
+		previous = end
+	}
+	if previous != len(content) {
+		t.Fatalf("blocks end at %d, expected %d", previous, len(content))
+	}
+	if average := len(content) / len(bounds); average < 128 || average > 1024 {
+		t.Errorf("average block length %d is far from the block size", average)
+	}
+}
+
+func Test_ContentDefinedChunkingInsertion(t *testing.T) {
+	original := randomContent(256*1024, 4)
+	//开头插入一个字节，固定长度的块全部错位
+	modified := append([]byte{'!'}, original...)
+
+	fixed := &Config{BlockSize: 512}
+	cdc := &Config{BlockSize: 512, Chunking: ContentDefinedChunking}
+	literal := func(config *Config) int {
+		var n int
+		for _, op := range config.Diff(original, modified) {
+			n += len(op.data)
+		}
+		return n
+	}
+	if n := literal(cdc); n > 4*512 {
+		t.Errorf("content defined chunking sent %d literal bytes for a single byte insertion", n)
+	}
+	//固定长度的块依靠 rolling 也只发送少量数据，但两者都必须正确
+	for _, config := range []*Config{fixed, cdc} {
+		result, err := config.Patch(original, config.Diff(original, modified))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, modified) {
+			t.Errorf("rsync did not work as expected with chunking %d", config.Chunking)
+		}
+	}
+}
+
+func Test_ContentDefinedChunkingPipelines(t *testing.T) {
+	original, _ := os.ReadFile("test-data/golang-original.bmp")
+	modified, _ := os.ReadFile("test-data/golang-modified.bmp")
+	config := &Config{BlockSize: 1024, Chunking: ContentDefinedChunking}
+
+	//流式签名与内存中的签名一致
+	hashes := config.CalculateBlockHashes(original)
+	streamed, err := config.GenerateSignature(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hashes, streamed) {
+		t.Errorf("streaming signature differs from in-memory signature")
+	}
+	if !reflect.DeepEqual(hashes, config.CalculateBlockHashesParallel(original)) {
+		t.Errorf("parallel signature differs from serial signature")
+	}
+
+	//通道
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, hashes, opsChannel)
+	result, err := config.ApplyOps(original, opsChannel, len(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, modified) {
+		t.Errorf("ApplyOps did not work as expected with content defined chunking")
+	}
+
+	//流式差异，从 ReaderAt 组装
+	var delta bytes.Buffer
+	if err := config.ComputeDelta(bytes.NewReader(modified), hashes, &delta); err != nil {
+		t.Fatal(err)
+	}
+	ops := make(chan RSyncOp)
+	go ReadOps(&delta, ops)
+	var out bytes.Buffer
+	if err := config.ApplyOpsAt(bytes.NewReader(original), ops, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), modified) {
+		t.Errorf("streaming delta did not work as expected with content defined chunking")
+	}
+}
+
+func Test_FNVWeakHash(t *testing.T) {
+	original, _ := os.ReadFile("test-data/golang-original.bmp")
+	modified, _ := os.ReadFile("test-data/golang-modified.bmp")
+	config := &Config{BlockSize: 4096, Chunking: ContentDefinedChunking, WeakHash: FNVWeakHash}
+
+	sig := config.CalculateSignature(original)
+	if sig.WeakHash != "fnv-1a" {
+		t.Errorf("expected weak hash fnv-1a, found %q", sig.WeakHash)
+	}
+	result, err := config.Patch(original, config.Diff(original, modified))
+	if err != nil || !bytes.Equal(result, modified) {
+		t.Fatalf("diff and patch did not work with FNV weak hashes: %v", err)
+	}
+	var decoded Signature
+	if data, err := sig.MarshalBinary(); err != nil || decoded.UnmarshalBinary(data) != nil || decoded.WeakHash != sig.WeakHash {
+		t.Errorf("weak hash did not survive a round trip: %v", err)
+	}
+
+	//弱hash不一致，或者需要滚动计算时报告错误
+	others := []*Config{
+		{BlockSize: 4096, Chunking: ContentDefinedChunking},
+		{BlockSize: 4096, WeakHash: FNVWeakHash},
+	}
+	for _, other := range others {
+		if _, err := other.SignatureDiffers(modified, sig); err == nil {
+			t.Errorf("expected an error with %+v", other)
+		}
+	}
+	if s := WeakHashKind(7).String(); s != "WeakHashKind(7)" {
+		t.Errorf("unexpected name %q", s)
+	}
+}
+
+func Test_LineChunking(t *testing.T) {
+	config := &Config{BlockSize: 64, Chunking: LineChunking}
+	long := strings.Repeat("x", 150)
+	content := []byte("first\n\nsecond line\n" + long + "\nlast without newline")
+	var blocks []string
+	var previous int
+	for _, end := range config.chunkBounds(content) {
+		blocks = append(blocks, string(content[previous:end]))
+		previous = end
+	}
+	expected := []string{"first\n", "\n", "second line\n", long[:64], long[64:128], long[128:] + "\n", "last without newline"}
+	if !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("expected blocks %q, found %q", expected, blocks)
+	}
+
+	//编辑一行只影响这一行所在的块
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, fmt.Sprintf("line %d: %x\n", i, randomContent(i%40, int64(i))))
+	}
+	original := []byte(strings.Join(lines, ""))
+	edited := append(append(append([]string(nil), lines[:10]...), "an inserted line\n"), lines[10:]...)
+	edited[20] = "a changed line\n"
+	modified := []byte(strings.Join(edited, ""))
+	config = &Config{BlockSize: 1024, Chunking: LineChunking}
+	hashes := config.CalculateBlockHashes(original)
+	ops := config.Diff(original, modified)
+	var literal []byte
+	for _, op := range ops {
+		if op.opCode == DATA {
+			literal = append(literal, op.data...)
+		}
+	}
+	if string(literal) != "an inserted line\na changed line\n" {
+		t.Errorf("expected only the edited lines as DATA, found %q", literal)
+	}
+	if result, err := config.Patch(original, ops); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("rsync did not work as expected with line chunking: %v", err)
+	}
+
+	//流式签名与差异
+	streamed, err := config.GenerateSignature(bytes.NewReader(original))
+	if err != nil || !reflect.DeepEqual(streamed, hashes) {
+		t.Errorf("streaming signature differs from in-memory signature: %v", err)
+	}
+	var delta bytes.Buffer
+	if err := config.ComputeDelta(bytes.NewReader(modified), hashes, &delta); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodeOps(t, delta.Bytes()), encodedOps(t, ops)) {
+		t.Errorf("expected the same streaming delta with line chunking")
+	}
+	if err := config.ValidateSignature(&Signature{BlockSize: 1024, Hashes: hashes}); err != nil {
+		t.Errorf("expected a valid signature of lines, found %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
+)
+
+// Config Parameters shared by both sides of a sync.
+// The zero value is ready to use and falls back to the package defaults.
+// Signature generation, difference calculation and reconstruction must use
+// equivalent configurations, otherwise blocks will not match.
+//同步参数配置，双方必须一致
+type Config struct {
+	// BlockSize 块大小，<= 0 时使用默认的 BlockSize
+	BlockSize int
+	// Alignment Stride of the block boundaries for formats made of fixed size
+	// records, such as databases or disk images, where data only moves by
+	// whole records. BlockSize is rounded up to a multiple of it, so blocks of
+	// the basis start at multiples of Alignment, and differences only accept
+	// a block starting at a multiple of Alignment in the modified content. The
+	// window still rolls byte by byte in between, but unaligned windows are
+	// never looked up, which saves the lookups and the false matches of
+	// misaligned records. Only fixed size blocks are aligned. <= 1 aligns
+	// nothing.
+	//块边界的步长，块大小向上取整为它的倍数，只在对齐的位置匹配块
+	Alignment int
+	// StrongHash 强hash构造函数，为 nil 时使用 md5.New
+	StrongHash func() hash.Hash
+	// StrongHashName Name of StrongHash recorded in signatures, such as
+	// "sha256", so a signature computed with another strong hash is rejected.
+	// Ignored when StrongHash is nil, which is named "md5"; empty leaves a
+	// custom strong hash unnamed and unchecked.
+	//强hash的名称，记录在签名中用于检查
+	StrongHashName string
+	// StrongHashLen Number of leading bytes of the strong hash kept in each
+	// BlockHash. Shorter hashes shrink the signature but raise the chance that
+	// two different blocks sharing a weak hash are taken as a match, which
+	// silently corrupts the result: with n bytes a bucket hit is wrongly
+	// accepted with probability about 2^(-8n). <= 0 keeps the full hash.
+	//强hash截断长度，<= 0 时保留完整的强hash
+	StrongHashLen int
+	// HashKey Secret shared by both sides for authenticated syncs. When set,
+	// strong hashes and the whole-file hash are HMACs keyed with it, over
+	// StrongHash or SHA-256 when StrongHash is nil, so whoever can tamper with
+	// signatures or operations but does not know the key cannot forge blocks
+	// that match, and VerifyResult authenticates the reconstruction. Sides
+	// with different keys match no block at all.
+	//共享密钥，设置后强hash与整个文件的hash使用 HMAC
+	HashKey []byte
+	// Dedup Collapses blocks with identical hashes into the entry of the first
+	// one when computing a signature, see DedupBlockHashes.
+	//签名中相同的块只保留第一个
+	Dedup bool
+	// Chunking 分块方式，默认为固定长度的块
+	Chunking ChunkingMode
+	// Progress Optional callback invoked while computing differences with the
+	// number of bytes of the modified content scanned so far and its total
+	// length. It is throttled to one call per 64 KiB scanned, plus a final call
+	// once the scan completes.
+	//进度回调，为 nil 时不报告
+	Progress func(bytesProcessed, totalBytes int)
+	// MaxDataOp Largest payload of a single DATA operation. Longer unmatched
+	// regions are split into several DATA operations, which bounds the memory
+	// held by any one operation on both sides.
+	//DATA 操作的最大长度，<= 0 时不限制
+	MaxDataOp int
+	// MaxBucketDepth Largest number of signature blocks sharing a weak hash
+	// that are compared one by one with a window hitting their bucket. Deeper
+	// buckets, common with repetitive or adversarial content, are indexed by
+	// strong hash instead, which bounds the cost of every hit. <= 0 selects
+	// 16.
+	//逐个比较强hash的桶深度上限，更深的桶按强hash索引
+	MaxBucketDepth int
+	// Matcher Builds the Matcher that looks up the blocks of hashes, the
+	// signature differences are computed against, in place of
+	// DefaultMatcher. It is called once per computation. nil selects the
+	// default.
+	//自定义的块查找方式，nil 时使用 DefaultMatcher
+	Matcher func(hashes []BlockHash) Matcher
+	// BloomFilter Checks the weak hash of every window against a bloom filter
+	// of the weak hashes of the signature, built along with the bucket map,
+	// before looking the bucket up. A window without a match then costs a few
+	// bit tests in a single word instead of a map lookup, which pays off for
+	// signatures of millions of blocks and mostly changed content. It is part
+	// of DefaultMatcher, which a custom Matcher may wrap.
+	//查找桶之前先用弱hash的布隆过滤器筛选
+	BloomFilter bool
+	// MaxOps Largest number of operations computed or applied, a safety
+	// valve against content crafted to produce huge numbers of tiny
+	// operations. Past it differences stop and reconstruction fails with
+	// ErrTooManyOps.
+	//操作体的最大数量，<= 0 时不限制
+	MaxOps int
+	// MaxOutputSize Largest modified content, in bytes, that reconstruction
+	// produces or allocates, a guard for endpoints applying operations from
+	// untrusted senders: a larger file size, HEADER or output fails with
+	// ErrOutputTooLarge before the memory is allocated or the bytes written.
+	//组装结果的最大长度，<= 0 时不限制
+	MaxOutputSize int64
+	// CopyData Copies the payload of every DATA operation computed by
+	// CalculateDifferences and Diff into a buffer of its own, taken from a pool,
+	// instead of sharing memory with the modified content. The operations then
+	// stay valid when the content changes, and RSyncOp.Release hands the
+	// buffers back for reuse.
+	//DATA 数据使用缓冲池中的副本，不与原数据共享内存
+	CopyData bool
+	// MinMatch Smallest number of matched bytes worth a block reference when
+	// both sides of the match are unmatched. Shorter runs of blocks between two
+	// DATA operations are sent as part of one larger DATA operation instead,
+	// trading a slightly larger delta for fewer operations.
+	//前后都是 DATA 的匹配块短于 MinMatch 字节时并入 DATA，<= 0 时不合并
+	MinMatch int
+	// BailRatio Largest fraction of the modified content scanned so far, from
+	// 0 to 1, left unmatched before differences give up with ErrTooDifferent,
+	// since sending the whole content is then cheaper than a delta mostly
+	// made of DATA. It is checked every 64 KiB scanned and once the scan
+	// completes; operations sent before must be discarded. <= 0 never gives
+	// up.
+	//未匹配数据的比例超过 BailRatio 时放弃计算差异，<= 0 时不放弃
+	BailRatio float64
+	// Header Sends a HEADER operation before the others, describing the
+	// delta with the length of the modified content, the block size and the
+	// name of the strong hash, so ApplyOps needs no file size and a delta
+	// applied with another configuration fails. ComputeDelta streams content
+	// of unknown length and sends none.
+	//先发送描述差异的 HEADER 操作体
+	Header bool
+	// CompressData Compresses DATA payloads with compress/flate when encoding
+	// operations with ComputeDelta or WriteOps. Decoding needs no setting since
+	// compressed payloads are flagged in the encoding.
+	//编码时压缩 DATA 数据
+	CompressData bool
+	// ChecksumData Appends a CRC-32 of the payload to every DATA operation
+	// encoded with ComputeDelta or WriteOps, so a payload corrupted in transit
+	// fails to decode with ErrDataChecksum instead of silently corrupting the
+	// result. Like compression it is flagged in the encoding, so decoding needs
+	// no setting and streams without checksums stay as compact.
+	//编码时在 DATA 数据后附加 CRC-32 校验和
+	ChecksumData bool
+	// WeakModulus Modulus of the two sums of the rolling weak hash, from 1 to
+	// 1<<32; 0 selects M. Sums modulo at most 1<<16 are both kept whole in the
+	// 32 bit weak hash, larger ones are spread more evenly but folded together.
+	// A prime such as 65521, as in Adler-32, mixes small blocks better.
+	//弱hash的模数，0 时使用 M，最大为 1<<32
+	WeakModulus uint64
+	// WeakHash Weak hash grouping blocks into buckets. Only RollingWeakHash
+	// can roll byte by byte, so other weak hashes need
+	// ContentDefinedChunking or LineChunking.
+	//弱hash的种类，默认为可以滚动的弱hash
+	WeakHash WeakHashKind
+	// SkipStrongHash UNSAFE: takes any block sharing the weak hash of a window
+	// as a match, without computing or comparing strong hashes, and leaves
+	// them out of signatures. Weak hashes collide often, and every collision
+	// silently corrupts the result, so this is only for trusted local syncs
+	// where speed matters more than correctness. Verify the result with
+	// VerifyResult.
+	//不安全：只比较弱hash，签名中不保存强hash
+	SkipStrongHash bool
+	// SelfCopy Also matches blocks of the modified content against the
+	// modified content scanned before them, at multiples of the block size,
+	// and sends repeats as COPY operations referencing the earlier bytes. It
+	// shrinks deltas of content repeating itself more than the basis, but the
+	// side applying the operations must keep the modified content it
+	// reconstructed, so it needs SelfCopy too. Only fixed size blocks of
+	// CalculateDifferences and Diff are matched, not ComputeDelta.
+	//在已扫描的数据中查找相同的块，以 COPY 引用，组装时保留已组装的数据
+	SelfCopy bool
+	// OnCheckpoint Optional callback invoked by ApplyOpsWriter and Patcher
+	// every 1 MiB written with the Checkpoint to resume from with
+	// ResumePatcher or ResumeOpsWriter if the patch is interrupted. The
+	// checkpoint counts bytes passed to the writer, so flush or sync it before
+	// storing the checkpoint.
+	//组装时定期报告检查点，为 nil 时不报告
+	OnCheckpoint func(Checkpoint)
+	// Sparse Skips the zeros of the reconstructed content with Seek instead of
+	// writing them, in pieces of 4 KiB aligned in the output, when the writer
+	// given to ApplyOpsWriter or NewPatcher is an io.WriteSeeker such as an
+	// *os.File, leaving holes in sparse files like disk images. Skipped bytes
+	// keep what the writer already held there, so it must be empty past its
+	// current offset. Writers that cannot seek are written normally.
+	//稀疏输出：全零数据用 Seek 跳过，写入的文件必须为空
+	Sparse bool
+}
+
+// defaultConfig is used by the package level functions.
+//包级函数使用的默认配置
+var defaultConfig = *NewDefaultConfig()
+
+// NewDefaultConfig Returns the configuration used by the package level
+// functions, ready for production use: blocks of BlockSize bytes, rolling weak
+// hashes modulo M and, with StrongHash left nil, MD5 strong hashes, or
+// HMAC-SHA256 once HashKey is set. A zero Config falls back to the same
+// defaults. Fields can be overridden before use.
+//创建默认配置
+func NewDefaultConfig() *Config {
+	return &Config{
+		BlockSize:   BlockSize,
+		WeakModulus: M,
+	}
+}
+
+// Returns the configured block size, or the package default, rounded up to a
+// multiple of Alignment.
+func (c *Config) blockSize() int {
+	if c == nil {
+		return BlockSize
+	}
+	size := c.BlockSize
+	if size <= 0 {
+		size = BlockSize
+	}
+	stride := c.alignment()
+	return (size + stride - 1) / stride * stride
+}
+
+// Returns the configured alignment of the blocks, 1 when there is none.
+func (c *Config) alignment() int {
+	if c == nil || c.Alignment <= 1 {
+		return 1
+	}
+	return c.Alignment
+}
+
+// Returns the configured weak hash modulus, or M.
+func (c *Config) weakModulus() uint64 {
+	if c == nil || c.WeakModulus == 0 {
+		return M
+	}
+	if c.WeakModulus > 1<<32 {
+		return 1 << 32
+	}
+	return c.WeakModulus
+}
+
+// Calls the progress callback, if any.
+func (c *Config) reportProgress(bytesProcessed, totalBytes int) {
+	if c != nil && c.Progress != nil {
+		c.Progress(bytesProcessed, totalBytes)
+	}
+}
+
+// Returns a new instance of the configured strong hash.
+func (c *Config) newStrongHash() hash.Hash {
+	if c != nil && len(c.HashKey) > 0 {
+		if c.StrongHash == nil {
+			return hmac.New(sha256.New, c.HashKey)
+		}
+		return hmac.New(c.StrongHash, c.HashKey)
+	}
+	if c == nil || c.StrongHash == nil {
+		return md5.New()
+	}
+	return c.StrongHash()
+}
+
+// Returns the name of the configured strong hash, or "" when unknown.
+// The key of an HMAC is never part of the name.
+func (c *Config) strongHashName() string {
+	if c != nil && len(c.HashKey) > 0 {
+		if c.StrongHash == nil {
+			return "hmac-sha256"
+		}
+		if c.StrongHashName == "" {
+			return ""
+		}
+		return "hmac-" + c.StrongHashName
+	}
+	if c == nil || c.StrongHash == nil {
+		return "md5"
+	}
+	return c.StrongHashName
+}
+
+// StrongHashSize Returns the length in bytes of the strong hash stored in
+// every BlockHash, so serialized signatures can be sized correctly.
+//强hash的字节长度
+func (c *Config) StrongHashSize() int {
+	if c != nil && c.SkipStrongHash {
+		return 0
+	}
+	size := c.newStrongHash().Size()
+	if c != nil && c.StrongHashLen > 0 && c.StrongHashLen < size {
+		return c.StrongHashLen
+	}
+	return size
+}
@@ -0,0 +1,544 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sort"
+)
+
+// Diff Returns all the operations needed to recreate modified from original,
+// using the default block size.
+// Unlike the channel API every operation is held in memory at once; DATA
+// operations share memory with modified, so the result costs little more than
+// the slice headers, but modified must stay unchanged while the ops are used
+// unless Config.CopyData is set.
+//同步计算不同，返回所有操作体
+func Diff(original, modified []byte) []RSyncOp {
+	return defaultConfig.Diff(original, modified)
+}
+
+// Diff Returns all the operations needed to recreate modified from original,
+// using the configured block size. When the scan gives up with
+// ErrTooDifferent, past Config.BailRatio, the operations of FullOps are
+// returned instead.
+func (c *Config) Diff(original, modified []byte) []RSyncOp {
+	var ops []RSyncOp
+	err := c.calculateDifferences(context.Background(), modified, c.CalculateBlockHashes(original), func(op RSyncOp) error {
+		ops = append(ops, op)
+		return nil
+	})
+	if errors.Is(err, ErrTooDifferent) {
+		for i := range ops {
+			ops[i].Release()
+		}
+		return c.FullOps(modified)
+	}
+	return ops
+}
+
+// FullOps Returns the operations sending content whole, using the default
+// configuration: a single FULL operation, which ApplyOps, Patch and the
+// other applications write as is without reading the basis. A sender falling
+// back to a full transfer, such as after ErrTooDifferent, so needs no other
+// path than a delta on the receiving side.
+//整个发送目标数据的操作体
+func FullOps(content []byte) []RSyncOp {
+	return defaultConfig.FullOps(content)
+}
+
+// FullOps Returns the operations sending content whole with the
+// configuration, preceded by a HEADER with Config.Header. The payload of the
+// FULL operation shares memory with content, unless Config.CopyData is set
+// which gives it a copy of its own.
+func (c *Config) FullOps(content []byte) []RSyncOp {
+	var ops []RSyncOp
+	c.emitHeader(func(op RSyncOp) error {
+		ops = append(ops, op)
+		return nil
+	}, len(content))
+	if c != nil && c.CopyData {
+		content = bytes.Clone(content)
+	}
+	return append(ops, RSyncOp{opCode: FULL, data: content})
+}
+
+// EstimateDeltaSize Returns the number of bytes the delta recreating
+// modified from original would take once encoded with WriteOps, using
+// blockSize, to decide whether a delta is worth it against sending modified
+// whole. The scan is the same as Diff but only counts bytes, without keeping
+// any operation.
+//估算差异编码后的字节数，不保存操作体
+func EstimateDeltaSize(original, modified []byte, blockSize int) int {
+	config := &Config{BlockSize: blockSize}
+	return config.EstimateDeltaSize(original, modified)
+}
+
+// EstimateDeltaSize Returns the encoded size of the delta recreating modified
+// from original with the configuration. Checksums of Config.ChecksumData are
+// counted, compression is not, so with Config.CompressData the actual delta
+// may be smaller. Past Config.BailRatio it is the size of FullOps.
+func (c *Config) EstimateDeltaSize(original, modified []byte) int {
+	//只统计长度，不需要复制 DATA 数据
+	config := Config{}
+	if c != nil {
+		config = *c
+	}
+	config.CopyData = false
+	var size int
+	err := config.calculateDifferences(context.Background(), modified, config.CalculateBlockHashes(original), func(op RSyncOp) error {
+		size += config.encodedLen(op)
+		return nil
+	})
+	//放弃计算差异时整个发送
+	if errors.Is(err, ErrTooDifferent) {
+		size = 0
+		for _, op := range config.FullOps(modified) {
+			size += config.encodedLen(op)
+		}
+	}
+	return size
+}
+
+// DiffSeq Returns an iterator over the operations needed to recreate modified
+// from original, using the default block size, to range over instead of
+// collecting them with Diff or receiving them from a channel. Operations are
+// computed as the loop asks for them, and breaking out of the loop stops the
+// scan.
+//以迭代器返回操作体
+func DiffSeq(original, modified []byte) iter.Seq[RSyncOp] {
+	return defaultConfig.DiffSeq(original, modified)
+}
+
+// DiffSeq Returns an iterator over the operations needed to recreate modified
+// from original using the configured block size.
+func (c *Config) DiffSeq(original, modified []byte) iter.Seq[RSyncOp] {
+	seq := c.DifferencesSeq(context.Background(), modified, c.CalculateBlockHashes(original))
+	return seq.All()
+}
+
+// errStopped Stops a scan once the loop over an OpSeq is left.
+var errStopped = errors.New("rsync: iteration stopped")
+
+// OpSeq Operations computed as they are iterated over, with the error that
+// ended the scan, if any, reported by Err once the loop is done, like
+// bufio.Scanner.
+//迭代计算的操作体，结束后通过 Err 报告错误
+type OpSeq struct {
+	config  *Config
+	ctx     context.Context
+	content []byte
+	hashes  []BlockHash
+	err     error
+}
+
+// DifferencesSeq Returns the operations needed to recreate content like
+// CalculateDifferencesContext, using the default block size, to range over
+// with OpSeq.All instead of a channel.
+//以迭代器计算不同
+func DifferencesSeq(ctx context.Context, content []byte, hashes []BlockHash) *OpSeq {
+	return defaultConfig.DifferencesSeq(ctx, content, hashes)
+}
+
+// DifferencesSeq Returns the operations needed to recreate content using the
+// configured block size.
+func (c *Config) DifferencesSeq(ctx context.Context, content []byte, hashes []BlockHash) *OpSeq {
+	return &OpSeq{config: c, ctx: ctx, content: content, hashes: hashes}
+}
+
+// All Returns an iterator computing the operations. Every loop over it scans
+// the content again from the start.
+//迭代所有操作体
+func (s *OpSeq) All() iter.Seq[RSyncOp] {
+	return func(yield func(RSyncOp) bool) {
+		err := s.config.calculateDifferences(s.ctx, s.content, s.hashes, func(op RSyncOp) error {
+			if !yield(op) {
+				return errStopped
+			}
+			return nil
+		})
+		//提前退出循环不是错误
+		if err == errStopped {
+			err = nil
+		}
+		s.err = err
+	}
+}
+
+// Err Returns the error that ended the last loop over All, such as a
+// signature that does not fit the configuration or ctx.Err(), or nil.
+//返回迭代结束的原因
+func (s *OpSeq) Err() error {
+	return s.err
+}
+
+// Patch Applies operations returned by Diff to original, using the default
+// block size, and returns the modified content.
+//同步组装数据
+func Patch(original []byte, ops []RSyncOp) ([]byte, error) {
+	return defaultConfig.Patch(original, ops)
+}
+
+// Patch Applies operations to original using the configured block size and
+// returns the modified content. With a HEADER the result must have the length
+// it announces.
+func (c *Config) Patch(original []byte, ops []RSyncOp) ([]byte, error) {
+	var result []byte
+	bounds := c.chunkBounds(original)
+	//HEADER 中的目标长度，没有时为 -1
+	length := -1
+	for i, op := range ops {
+		if op.opCode == HEADER {
+			if err := c.checkHeader(op, i == 0); err != nil {
+				return nil, err
+			}
+			//长度不可信，预先分配的空间有上限
+			result = make([]byte, 0, c.headerCapacity(op.length))
+			length = op.length
+			continue
+		}
+		if op.opCode == COPY {
+			if err := c.checkOutputSize(int64(len(result) + op.length)); err != nil {
+				return nil, err
+			}
+		}
+		chunk, err := c.opContent(original, bounds, result, op)
+		if err == nil {
+			err = c.checkOutputSize(int64(len(result) + len(chunk)))
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, chunk...)
+	}
+	if length >= 0 && len(result) != length {
+		return nil, fmt.Errorf("rsync: reconstructed %d bytes, expected %d", len(result), length)
+	}
+	return result, nil
+}
+
+// InvertDelta Returns the operations that recreate basis from the content
+// produced by applying ops to basis, using the default configuration, so a
+// change can be rolled back. Both directions can then be stored, as in
+// versioned storage keeping forward and backward deltas.
+//计算反向的操作，用于回滚
+func InvertDelta(basis []byte, ops []RSyncOp) ([]RSyncOp, error) {
+	return defaultConfig.InvertDelta(basis, ops)
+}
+
+// InvertDelta Returns the operations that recreate basis from the result of
+// ops using the configuration. The result is rebuilt and diffed against basis,
+// so the bytes of basis that ops replaced end up in DATA operations while the
+// rest reference blocks of the result.
+func (c *Config) InvertDelta(basis []byte, ops []RSyncOp) ([]RSyncOp, error) {
+	modified, err := c.Patch(basis, ops)
+	if err != nil {
+		return nil, err
+	}
+	return c.Diff(modified, basis), nil
+}
+
+// errDiffers Stops the scan of SignatureDiffers at the first operation that
+// does not copy the basis in order.
+var errDiffers = errors.New("rsync: content differs")
+
+// FilesDiffer Reports whether target differs from basis, without computing any
+// operation, scanning target for the blocks of basis of blockSize bytes.
+// Contents of different lengths differ; otherwise the scan stops as soon as
+// the first DATA region, or a block out of order, would be emitted.
+//判断两个数据是否不同，不计算操作体
+func FilesDiffer(basis, target []byte, blockSize int) bool {
+	config := &Config{BlockSize: blockSize}
+	return config.FilesDiffer(basis, target)
+}
+
+// FilesDiffer Reports whether target differs from basis using the
+// configuration, see SignatureDiffers. As with any delta, blocks sharing both
+// hashes are taken as equal.
+func (c *Config) FilesDiffer(basis, target []byte) bool {
+	if len(basis) != len(target) {
+		return true
+	}
+	//不去重，每个位置的块都已知
+	hashes := c.allBlockHashes(basis)
+	differ, err := c.SignatureDiffers(target, &Signature{Hashes: hashes, Blocks: len(hashes)})
+	return err != nil || differ
+}
+
+// SignatureDiffers Reports whether target differs from the content of sig,
+// using the default configuration, without building a delta.
+//根据签名判断数据是否不同
+func SignatureDiffers(target []byte, sig *Signature) (bool, error) {
+	return defaultConfig.SignatureDiffers(target, sig)
+}
+
+// SignatureDiffers Reports whether target differs from the content of sig
+// using the configuration. When known, the length of the basis and then its
+// whole-file hash decide. Otherwise target is scanned for blocks and the scan
+// stops at the first operation that would not copy the next blocks of the
+// basis, such as the first DATA, so no operation is kept. As with any delta,
+// blocks sharing both hashes are taken as equal.
+// A block left out by Config.Dedup repeats one of the earlier blocks, but the
+// signature does not tell which, so without a whole-file hash the scan only
+// checks that it is one of them. A signature without Signature.Blocks whose
+// indexes run from 0 without gap is taken as complete, so when in doubt about
+// the length the contents are reported as different.
+func (c *Config) SignatureDiffers(target []byte, sig *Signature) (bool, error) {
+	if err := c.checkSignatureConfig(sig); err != nil {
+		return false, err
+	}
+	//签名中出现的块下标，去重时省略的位置没有
+	listed := make(map[int]bool, len(sig.Hashes))
+	basisLen, knownLen := 0, true
+	blocks := sig.Blocks
+	for _, h := range sig.Hashes {
+		if h.basis != 0 {
+			continue
+		}
+		listed[h.index] = true
+		basisLen += h.length
+		knownLen = knownLen && h.length > 0
+		if sig.Blocks == 0 {
+			blocks = max(blocks, h.index+1)
+		}
+	}
+	//没有省略的块时 basisLen 是原数据的长度，否则只是下限
+	complete := blocks == len(listed)
+	if knownLen && (len(target) < basisLen || complete && len(target) != basisLen) {
+		return true, nil
+	}
+	if len(sig.FileHash) > 0 {
+		return !bytes.Equal(c.FileHash(target), sig.FileHash), nil
+	}
+
+	//原数据中的下一个块
+	var next int
+	follows := func(index int) bool {
+		//省略的位置是之前某个块的重复
+		ok := index == next || !listed[next] && index < next
+		next++
+		return ok
+	}
+	err := c.calculateDifferences(context.Background(), target, sig.Hashes, func(op RSyncOp) error {
+		if op.opCode == HEADER {
+			return nil
+		}
+		if op.basis != 0 || (op.opCode != BLOCK && op.opCode != BLOCKRUN) {
+			return errDiffers
+		}
+		count := 1
+		if op.opCode == BLOCKRUN {
+			count = op.blockCount
+		}
+		for i := 0; i < count; i++ {
+			if !follows(op.blockIndex + i) {
+				return errDiffers
+			}
+		}
+		return nil
+	})
+	if err == errDiffers {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	//所有的块都按顺序出现
+	return next != blocks, nil
+}
+
+// deltaSegment A part of the content produced by a delta: either a range of
+// the basis or literal data.
+//操作结果中的一段：引用基础数据的一个区间，或者字面数据
+type deltaSegment struct {
+	//在结果中的起点
+	start int
+	//引用的基础数据区间，data 为 nil 时有效
+	basisStart, basisEnd int
+	data                 []byte
+}
+
+// ComposeDeltas Returns the operations that recreate C from A, given first
+// from A to B and second from B to C, without rebuilding B, using the default
+// block size. basisLen is the length of A. Incremental backups can so be
+// chained into a single delta.
+//合并两个连续的差异：A→B 与 B→C 合并为 A→C
+func ComposeDeltas(first, second []RSyncOp, basisLen int) ([]RSyncOp, error) {
+	return defaultConfig.ComposeDeltas(first, second, basisLen)
+}
+
+// ComposeDeltas Returns the operations that recreate C from A using the
+// configured block size. The blocks of B referenced by second are resolved
+// through first: the parts that were DATA in first become DATA, the parts that
+// were blocks of A become blocks of A again.
+// Since A itself is not available, a block of B covering only part of a block
+// of A cannot be expressed and is reported as an error; this happens when the
+// DATA of first does not keep blocks aligned. Only fixed size blocks are
+// supported, the blocks of variable length depend on the content of A.
+func (c *Config) ComposeDeltas(first, second []RSyncOp, basisLen int) ([]RSyncOp, error) {
+	if c.chunking() != FixedChunking {
+		return nil, errors.New("rsync: deltas with variable length blocks cannot be composed")
+	}
+	segments, length, err := c.deltaSegments(first, basisLen)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := c.blockSize()
+	var composed composedOps
+	for _, op := range second {
+		var from, to int
+		switch op.opCode {
+		case DATA, HEADER, FULL:
+			composed.add(op)
+			continue
+		case IDENTICAL:
+			from, to = 0, length
+		case COPY:
+			return nil, errors.New("rsync: deltas with COPY operations cannot be composed")
+		case BLOCK, BLOCKRUN:
+			if op.basis != 0 {
+				return nil, otherBasisError(op)
+			}
+			count := 1
+			if op.opCode == BLOCKRUN {
+				count = op.blockCount
+			}
+			from = op.blockIndex * blockSize
+			if op.blockIndex < 0 || count < 1 || from >= length {
+				return nil, fmt.Errorf("%w: block %d of the intermediate content", ErrBlockIndexOutOfRange, op.blockIndex)
+			}
+			to = min(from+count*blockSize, length)
+		default:
+			return nil, fmt.Errorf("rsync: unknown op code %d", op.opCode)
+		}
+		if err := c.composeRange(&composed, segments, basisLen, from, to); err != nil {
+			return nil, err
+		}
+	}
+	return composed.ops, nil
+}
+
+// Returns the segments of the content produced by ops applied to a basis of
+// basisLen bytes, with the length of that content.
+//计算操作结果的各段及总长度
+func (c *Config) deltaSegments(ops []RSyncOp, basisLen int) ([]deltaSegment, int, error) {
+	blockSize := c.blockSize()
+	var segments []deltaSegment
+	var length int
+	for _, op := range ops {
+		segment := deltaSegment{start: length}
+		switch op.opCode {
+		case HEADER:
+			continue
+		case DATA, FULL:
+			if len(op.data) == 0 {
+				continue
+			}
+			segment.data = op.data
+			length += len(op.data)
+		case IDENTICAL:
+			if basisLen == 0 {
+				continue
+			}
+			segment.basisEnd = basisLen
+			length += basisLen
+		case COPY:
+			return nil, 0, errors.New("rsync: deltas with COPY operations cannot be composed")
+		case BLOCK, BLOCKRUN:
+			if op.basis != 0 {
+				return nil, 0, otherBasisError(op)
+			}
+			count := 1
+			if op.opCode == BLOCKRUN {
+				count = op.blockCount
+			}
+			segment.basisStart = op.blockIndex * blockSize
+			if op.blockIndex < 0 || count < 1 || segment.basisStart >= basisLen {
+				return nil, 0, fmt.Errorf("%w: block %d of the basis", ErrBlockIndexOutOfRange, op.blockIndex)
+			}
+			segment.basisEnd = min(segment.basisStart+count*blockSize, basisLen)
+			length += segment.basisEnd - segment.basisStart
+		default:
+			return nil, 0, fmt.Errorf("rsync: unknown op code %d", op.opCode)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, length, nil
+}
+
+// Adds to composed the operations recreating the range [from, to) of the
+// content described by segments.
+//将结果中 [from, to) 区间对应的操作追加到 composed
+func (c *Config) composeRange(composed *composedOps, segments []deltaSegment, basisLen, from, to int) error {
+	blockSize := c.blockSize()
+	//找到包含 from 的段
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].start > from }) - 1
+	for ; from < to; i++ {
+		segment := segments[i]
+		segmentEnd := segment.start + len(segment.data) + segment.basisEnd - segment.basisStart
+		end := min(to, segmentEnd)
+		if segment.data != nil {
+			composed.add(RSyncOp{opCode: DATA, data: segment.data[from-segment.start : end-segment.start]})
+		} else {
+			basisFrom := segment.basisStart + from - segment.start
+			basisTo := segment.basisStart + end - segment.start
+			//只能引用完整的块
+			if basisFrom%blockSize != 0 || (basisTo%blockSize != 0 && basisTo != basisLen) {
+				return fmt.Errorf("rsync: bytes %d to %d of the basis do not cover whole blocks", basisFrom, basisTo)
+			}
+			count := (basisTo - basisFrom + blockSize - 1) / blockSize
+			composed.add(RSyncOp{opCode: BLOCKRUN, blockIndex: basisFrom / blockSize, blockCount: count})
+		}
+		from = end
+	}
+	return nil
+}
+
+// composedOps The operations of a composed delta, with adjacent DATA and
+// consecutive blocks merged.
+//合并后的操作，相邻的 DATA 和连续的块合并为一个
+type composedOps struct {
+	ops []RSyncOp
+	//最后一个 DATA 的数据是否在自己的缓冲区中，可以直接追加
+	owned bool
+}
+
+// Appends op, merging it with the last operation when they are both DATA or
+// consecutive blocks. A single block is kept as a BLOCK operation.
+// The payload of the first DATA merged into is copied once into a buffer of
+// its own, so the deltas composed are left untouched, and the next ones are
+// appended to it.
+//追加操作，合并相邻的 DATA 和连续的块
+func (c *composedOps) add(op RSyncOp) {
+	if op.opCode == BLOCK {
+		op = RSyncOp{opCode: BLOCKRUN, blockIndex: op.blockIndex, blockCount: 1}
+	}
+	if n := len(c.ops); n > 0 {
+		last := &c.ops[n-1]
+		switch {
+		case last.opCode == DATA && op.opCode == DATA:
+			//第一次合并时复制，之后直接追加
+			if !c.owned {
+				last.data = append(make([]byte, 0, 2*(len(last.data)+len(op.data))), last.data...)
+				c.owned = true
+			}
+			last.data = append(last.data, op.data...)
+			return
+		case (last.opCode == BLOCK || last.opCode == BLOCKRUN) && op.opCode == BLOCKRUN && last.blockIndex+max(last.blockCount, 1) == op.blockIndex:
+			*last = RSyncOp{opCode: BLOCKRUN, blockIndex: last.blockIndex, blockCount: max(last.blockCount, 1) + op.blockCount}
+			return
+		}
+	}
+	if op.opCode == BLOCKRUN && op.blockCount == 1 {
+		op = RSyncOp{opCode: BLOCK, blockIndex: op.blockIndex}
+	}
+	c.ops = append(c.ops, op)
+	c.owned = false
+}
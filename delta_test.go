@@ -0,0 +1,491 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the synchronous API
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_DiffPatch(t *testing.T) {
+	pairs := []filePair{{"golang-original.bmp", "golang-modified.bmp"}, {"text-original.txt", "text-modified.txt"}}
+
+	for _, pair := range pairs {
+		original, _ := os.ReadFile("test-data/" + pair.original)
+		modified, _ := os.ReadFile("test-data/" + pair.modified)
+
+		config := &Config{BlockSize: 512}
+		result, err := config.Patch(original, config.Diff(original, modified))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, modified) {
+			t.Errorf("diff and patch did not work as expected for %v", pair)
+		}
+	}
+}
+
+func Test_PatchMalformed(t *testing.T) {
+	if _, err := Patch([]byte("abc"), []RSyncOp{{opCode: BLOCK, blockIndex: 9}}); err == nil {
+		t.Errorf("expected an error for a block index out of range")
+	}
+}
+
+func Test_HeaderLength(t *testing.T) {
+	original := []byte("abc")
+	delta, err := MarshalDelta([]RSyncOp{{opCode: HEADER, length: math.MaxInt, blockSize: BlockSize}, {opCode: DATA, data: original}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//长度来自发送方，不能按它分配内存
+	ops, err := UnmarshalDelta(delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Patch(original, ops); err == nil {
+		t.Errorf("expected an error from Patch for a header longer than the content")
+	}
+	opsChannel := make(chan RSyncOp)
+	errs := make(chan error, 1)
+	go func() { errs <- ReadOps(bytes.NewReader(encodeOps(t, ops)), opsChannel) }()
+	if _, err := ApplyOps(original, opsChannel, -1); err == nil {
+		t.Errorf("expected an error from ApplyOps for a header longer than the content")
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	limited := &Config{MaxOutputSize: 1 << 20}
+	if _, err := limited.ApplyOps(original, opsChannelOf(ops...), -1); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("expected ErrOutputTooLarge, found %v", err)
+	}
+
+	//长度一致时结果不变
+	ops[0].length = len(original)
+	if result, err := Patch(nil, ops); err != nil || !bytes.Equal(result, original) {
+		t.Errorf("expected the content of a consistent header: %v", err)
+	}
+	if result, err := ApplyOps(nil, opsChannelOf(ops...), -1); err != nil || !bytes.Equal(result, original) {
+		t.Errorf("expected ApplyOps to follow a consistent header: %v", err)
+	}
+}
+
+func Test_InvertDelta(t *testing.T) {
+	pairs := []filePair{{"golang-original.bmp", "golang-modified.bmp"}, {"text-original.txt", "text-modified.txt"}}
+
+	for _, pair := range pairs {
+		original, _ := os.ReadFile("test-data/" + pair.original)
+		modified, _ := os.ReadFile("test-data/" + pair.modified)
+
+		config := &Config{BlockSize: 64}
+		inverse, err := config.InvertDelta(original, config.Diff(original, modified))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := config.Patch(modified, inverse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, original) {
+			t.Errorf("inverse delta did not restore the original for %v", pair)
+		}
+	}
+
+	if _, err := InvertDelta([]byte("abc"), []RSyncOp{{opCode: BLOCK, blockIndex: 9}}); err == nil {
+		t.Errorf("expected an error for a block index out of range")
+	}
+}
+
+// Encodes ops with the wire format.
+func encodeOps(t *testing.T, ops []RSyncOp) []byte {
+	var buf bytes.Buffer
+	for _, op := range ops {
+		if err := writeOp(&buf, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func Test_DiffDeterministic(t *testing.T) {
+	//重复的内容让多个块落在同一个桶中
+	original := bytes.Repeat(randomContent(4096, 8), 4)
+	modified := modifiedContent(original, 10, 9)
+
+	configs := []*Config{
+		{BlockSize: 64},
+		{BlockSize: 64, Dedup: true},
+		{BlockSize: 64, Chunking: ContentDefinedChunking},
+		{BlockSize: 64, MinMatch: 128, MaxDataOp: 100},
+	}
+	for _, config := range configs {
+		expected := encodeOps(t, config.Diff(original, modified))
+		for i := 0; i < 5; i++ {
+			if delta := encodeOps(t, config.Diff(original, modified)); !bytes.Equal(delta, expected) {
+				t.Fatalf("run %d produced a different delta with %+v", i, config)
+			}
+		}
+
+		//并行计算的签名得到同样的结果
+		opsChannel := make(chan RSyncOp)
+		go config.CalculateDifferences(modified, config.CalculateBlockHashesParallel(original), opsChannel)
+		var ops []RSyncOp
+		for op := range opsChannel {
+			ops = append(ops, op)
+		}
+		if !bytes.Equal(encodeOps(t, ops), expected) {
+			t.Errorf("parallel signature produced a different delta with %+v", config)
+		}
+	}
+}
+
+func Fuzz_DiffPatch(f *testing.F) {
+	pairs := []filePair{{"golang-original.bmp", "golang-modified.bmp"}, {"text-original.txt", "text-modified.txt"}}
+	for _, pair := range pairs {
+		original, _ := os.ReadFile("test-data/" + pair.original)
+		modified, _ := os.ReadFile("test-data/" + pair.modified)
+		f.Add(original, modified, uint8(64))
+	}
+	f.Add([]byte{}, []byte("abc"), uint8(1))
+	f.Add([]byte("abcabc"), []byte{}, uint8(3))
+
+	f.Fuzz(func(t *testing.T, original, modified []byte, blockSize uint8) {
+		for _, config := range []*Config{{BlockSize: int(blockSize)}, {BlockSize: int(blockSize), Chunking: ContentDefinedChunking}} {
+			result, err := config.Patch(original, config.Diff(original, modified))
+			if err != nil {
+				t.Fatalf("block size %d chunking %d: %v", blockSize, config.Chunking, err)
+			}
+			if !bytes.Equal(result, modified) {
+				t.Fatalf("block size %d chunking %d: patch did not recreate modified", blockSize, config.Chunking)
+			}
+
+			var delta bytes.Buffer
+			if err := config.ComputeDelta(bytes.NewReader(modified), config.CalculateBlockHashes(original), &delta); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(decodeOps(t, delta.Bytes())...), &out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), modified) {
+				t.Fatalf("block size %d chunking %d: streaming delta did not recreate modified", blockSize, config.Chunking)
+			}
+		}
+	})
+}
+
+func Test_ComposeDeltas(t *testing.T) {
+	config := &Config{BlockSize: 64}
+	a := randomContent(64*40+10, 21)
+	//插入和替换都保持块对齐
+	b := append(append(append([]byte{}, a[:640]...), randomContent(128, 22)...), a[640:]...)
+	copy(b[1280:], randomContent(64, 23))
+	c := append(append([]byte{}, b[:1920]...), randomContent(192, 24)...)
+	c = append(c, b[64:640]...)
+
+	first := config.Diff(a, b)
+	second := config.Diff(b, c)
+	composed, err := config.ComposeDeltas(first, second, len(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := config.Patch(a, composed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, c) {
+		t.Errorf("composed delta did not recreate the final content")
+	}
+	for i := 1; i < len(composed); i++ {
+		if composed[i].opCode == DATA && composed[i-1].opCode == DATA {
+			t.Errorf("consecutive DATA operations at %d were not merged", i)
+		}
+	}
+
+	//IDENTICAL 在任意一边都可以合并
+	identical := []RSyncOp{{opCode: IDENTICAL}}
+	for _, pair := range [][2][]RSyncOp{{identical, second}, {first, identical}} {
+		composed, err := config.ComposeDeltas(pair[0], pair[1], len(a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := config.Patch(a, composed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//不对齐的插入使 B 的块只覆盖 A 的部分块
+	shifted := append([]byte("x"), a...)
+	if _, err := config.ComposeDeltas(config.Diff(a, shifted), config.Diff(shifted, shifted[64:]), len(a)); err == nil {
+		t.Errorf("expected an error for blocks not aligned with the basis")
+	}
+	if _, err := config.ComposeDeltas([]RSyncOp{{opCode: BLOCK, blockIndex: 99}}, nil, len(a)); err == nil {
+		t.Errorf("expected an error for a block index out of range")
+	}
+
+	//相邻的 DATA 合并为一个，不修改原来的操作
+	var pieces []RSyncOp
+	var literal []byte
+	for i := 0; i < 1000; i++ {
+		piece := []byte{byte(i), byte(i >> 8)}
+		pieces = append(pieces, RSyncOp{opCode: DATA, data: piece})
+		literal = append(literal, piece...)
+	}
+	composed, err = config.ComposeDeltas(nil, pieces, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(composed) != 1 || !bytes.Equal(composed[0].data, literal) {
+		t.Errorf("expected a single DATA operation of %d bytes, found %d operations", len(literal), len(composed))
+	}
+	if !bytes.Equal(pieces[0].data, []byte{0, 0}) || cap(pieces[0].data) != 2 {
+		t.Errorf("expected the composed deltas to be left untouched")
+	}
+}
+
+func Benchmark_ComposeDeltas(b *testing.B) {
+	config := &Config{BlockSize: 64}
+	pieces := make([]RSyncOp, 10000)
+	for i := range pieces {
+		pieces[i] = RSyncOp{opCode: DATA, data: randomContent(100, int64(i))}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		config.ComposeDeltas(nil, pieces, 0)
+	}
+}
+
+func Test_FilesDiffer(t *testing.T) {
+	original := randomContent(1000, 61)
+	modified := modifiedContent(original, 10, 62)
+	changed := append([]byte(nil), original...)
+	changed[len(changed)/2] ^= 1
+
+	cases := []struct {
+		basis, target []byte
+		differ        bool
+	}{
+		{original, original, false},
+		{original, modified, true},
+		{original, changed, true},
+		{original, original[:len(original)-1], true},
+		{nil, nil, false},
+		{original, nil, true},
+	}
+	config := &Config{BlockSize: 64}
+	for i, c := range cases {
+		if differ := FilesDiffer(c.basis, c.target, 64); differ != c.differ {
+			t.Errorf("case %d: FilesDiffer returned %v", i, differ)
+		}
+		sig := config.CalculateSignature(c.basis)
+		//没有文件hash和块长度时逐块扫描
+		unknown := &Signature{Hashes: append([]BlockHash(nil), sig.Hashes...)}
+		for j := range unknown.Hashes {
+			unknown.Hashes[j].length = 0
+		}
+		for _, sig := range []*Signature{sig, unknown} {
+			differ, err := config.SignatureDiffers(c.target, sig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if differ != c.differ {
+				t.Errorf("case %d: SignatureDiffers returned %v with %d byte file hash", i, differ, len(sig.FileHash))
+			}
+		}
+	}
+
+	//块的顺序不同
+	swapped := append(append([]byte(nil), original[64:128]...), original[:64]...)
+	swapped = append(swapped, original[128:]...)
+	if differ, _ := config.SignatureDiffers(swapped, &Signature{Hashes: config.CalculateBlockHashes(original)}); !differ {
+		t.Errorf("expected swapped blocks to differ")
+	}
+	if _, err := config.SignatureDiffers(original, &Signature{BlockSize: 32}); err == nil {
+		t.Errorf("expected an error for a signature built with another block size")
+	}
+
+	//去重的签名中省略了重复的块
+	dedup := &Config{BlockSize: 4, Dedup: true}
+	content := []byte("AAAABBBBAAAA")
+	sig := dedup.CalculateSignature(content)
+	scanned := *sig
+	scanned.FileHash = nil
+	for _, sig := range []*Signature{sig, &scanned} {
+		if differ, err := dedup.SignatureDiffers(content, sig); err != nil || differ {
+			t.Errorf("expected identical content to match its deduplicated signature with %d byte file hash: %v", len(sig.FileHash), err)
+		}
+	}
+	for _, target := range []string{"AAAAAAAABBBB", "AAAABBBBAAAAAAAA", "AAAABBBB", "AAAABBBBCCCC"} {
+		if differ, _ := dedup.SignatureDiffers([]byte(target), &scanned); !differ {
+			t.Errorf("expected %q to differ from a deduplicated signature", target)
+		}
+	}
+	//省略的块是哪一个只有文件hash能确定
+	if differ, _ := dedup.SignatureDiffers([]byte("AAAABBBBBBBB"), sig); !differ {
+		t.Errorf("expected the file hash to tell a different repeated block")
+	}
+	if dedup.FilesDiffer(content, content) || !dedup.FilesDiffer(content, []byte("AAAABBBBBBBB")) {
+		t.Errorf("expected FilesDiffer to handle repeated blocks")
+	}
+}
+
+func Test_DiffSeq(t *testing.T) {
+	original := randomContent(4096, 81)
+	modified := modifiedContent(original, 10, 82)
+	config := &Config{BlockSize: 64}
+
+	var ops []RSyncOp
+	for op := range config.DiffSeq(original, modified) {
+		ops = append(ops, op)
+	}
+	if expected := config.Diff(original, modified); !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %v, found %v", expected, ops)
+	}
+
+	//提前退出循环
+	var n int
+	for range config.DiffSeq(original, modified) {
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected the loop to stop after 2 ops, found %d", n)
+	}
+
+	seq := config.DifferencesSeq(context.Background(), modified, config.CalculateBlockHashes(original))
+	for range seq.All() {
+		break
+	}
+	if err := seq.Err(); err != nil {
+		t.Errorf("expected no error when leaving the loop early, found %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	seq = config.DifferencesSeq(ctx, modified, config.CalculateBlockHashes(original))
+	for range seq.All() {
+		t.Errorf("expected no op once cancelled")
+	}
+	if err := seq.Err(); err != context.Canceled {
+		t.Errorf("expected context.Canceled, found %v", err)
+	}
+	seq = (&Config{BlockSize: 32}).DifferencesSeq(context.Background(), modified, []BlockHash{{index: 0}})
+	for range seq.All() {
+	}
+	if seq.Err() == nil {
+		t.Errorf("expected an error for a block without a strong hash")
+	}
+}
+
+func Test_EstimateDeltaSize(t *testing.T) {
+	original := randomContent(100000, 1)
+	for _, percent := range []int{0, 5, 50} {
+		modified := modifiedContent(original, percent, 2)
+		estimate := EstimateDeltaSize(original, modified, 512)
+		config := &Config{BlockSize: 512}
+		if encoded := encodeOps(t, config.Diff(original, modified)); estimate != len(encoded) {
+			t.Errorf("%d%%: expected %d bytes, found %d", percent, len(encoded), estimate)
+		}
+		var wire bytes.Buffer
+		config.ChecksumData = true
+		if err := config.WriteOps(&wire, opsChannelOf(config.Diff(original, modified)...)); err != nil {
+			t.Fatal(err)
+		}
+		if estimate := config.EstimateDeltaSize(original, modified); estimate != wire.Len() {
+			t.Errorf("%d%% with checksums: expected %d bytes, found %d", percent, wire.Len(), estimate)
+		}
+	}
+
+	//完全不同的数据不值得计算差异
+	unrelated := randomContent(100000, 3)
+	if estimate := EstimateDeltaSize(original, unrelated, 512); estimate <= len(unrelated) {
+		t.Errorf("expected more than %d bytes for unrelated content, found %d", len(unrelated), estimate)
+	}
+	if estimate := EstimateDeltaSize(original, original, 512); estimate >= 16 {
+		t.Errorf("expected a few bytes for identical content, found %d", estimate)
+	}
+}
+
+func Test_FullOps(t *testing.T) {
+	original := randomContent(64*100, 66)
+	modified := randomContent(64*100, 67)
+	config := &Config{BlockSize: 64, BailRatio: 0.5}
+
+	//放弃计算差异时整个发送
+	ops := config.Diff(original, modified)
+	if len(ops) != 1 || ops[0].opCode != FULL || !bytes.Equal(ops[0].data, modified) {
+		t.Fatalf("expected a single FULL operation, found %v", ops)
+	}
+	if s := ops[0].String(); !strings.HasPrefix(s, "FULL len=6400 hex=") {
+		t.Errorf("unexpected string %q", s)
+	}
+	if estimate := config.EstimateDeltaSize(original, modified); estimate != len(encodeOps(t, ops)) {
+		t.Errorf("expected the size of the FULL operation, found %d", estimate)
+	}
+	//相似的数据仍然计算差异
+	if ops := config.Diff(original, modifiedContent(original, 1, 68)); ops[0].opCode == FULL {
+		t.Errorf("expected a delta for similar content")
+	}
+
+	//所有的组装方式都不读取原数据
+	if result, err := config.Patch(nil, ops); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("Patch: expected the modified content: %v", err)
+	}
+	if result, err := config.ApplyOps(original, opsChannelOf(ops...), len(modified)); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("ApplyOps: expected the modified content: %v", err)
+	}
+	var written bytes.Buffer
+	if err := config.ApplyOpsWriter(original, opsChannelOf(ops...), &written); err != nil || !bytes.Equal(written.Bytes(), modified) {
+		t.Errorf("ApplyOpsWriter: expected the modified content: %v", err)
+	}
+	written.Reset()
+	if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(ops...), &written); err != nil || !bytes.Equal(written.Bytes(), modified) {
+		t.Errorf("ApplyOpsAt: expected the modified content: %v", err)
+	}
+	if result, err := config.ApplyOpsInPlace(append([]byte(nil), original...), ops); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("ApplyOpsInPlace: expected the modified content: %v", err)
+	}
+
+	//编码时与 DATA 一样可以压缩和校验
+	for _, wire := range []*Config{nil, {CompressData: true, ChecksumData: true}} {
+		full := FullOps(bytes.Repeat([]byte("full"), 1000))
+		delta, err := wire.MarshalDelta(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err := UnmarshalDelta(delta); err != nil || !reflect.DeepEqual(decoded, full) {
+			t.Errorf("%+v: expected the FULL operation back: %v", wire, err)
+		}
+	}
+
+	//HEADER 在前，CopyData 时不共享内存
+	header := &Config{BlockSize: 64, Header: true, CopyData: true}
+	ops = header.FullOps(modified)
+	if len(ops) != 2 || ops[0].opCode != HEADER || ops[0].length != len(modified) || &ops[1].data[0] == &modified[0] {
+		t.Errorf("expected a HEADER and a copy of the content, found %v", ops)
+	}
+	if result, err := header.ApplyOps(nil, opsChannelOf(ops...), -1); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("expected the length of the header: %v", err)
+	}
+
+	//FULL 之后的差异可以合并
+	final := modifiedContent(modified, 5, 69)
+	composed, err := config.ComposeDeltas(config.FullOps(modified), (&Config{BlockSize: 64}).Diff(modified, final), len(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := config.Patch(original, composed); err != nil || !bytes.Equal(result, final) {
+		t.Errorf("expected the composed delta to recreate the final content: %v", err)
+	}
+}
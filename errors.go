@@ -0,0 +1,34 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"errors"
+	"io"
+)
+
+// Errors callers can tell apart with errors.Is. The errors returned wrap them
+// with the details of the failure, along with ErrOutputTooLarge,
+// ErrTooManyOps, ErrNotInPlace, ErrChecksumMismatch, ErrDataChecksum and the
+// ErrSignature errors of Signature.Validate.
+//可以用 errors.Is 区分的错误
+var (
+	// ErrBlockIndexOutOfRange Returned when an operation references blocks
+	// the basis does not have, usually because it was computed against
+	// another basis or block size.
+	//操作体引用的块超出原数据的范围
+	ErrBlockIndexOutOfRange = errors.New("rsync: block index out of range")
+	// ErrSignatureMismatch Returned when a signature was computed with another
+	// configuration than the one computing differences against it, such as
+	// another block size or strong hash, so none of its blocks could match.
+	//签名与配置不一致
+	ErrSignatureMismatch = errors.New("rsync: signature does not match the configuration")
+	// ErrShortRead Returned when a signature, an operation or a basis ends
+	// before the bytes it announces. It is io.ErrUnexpectedEOF, which decoding
+	// has always returned.
+	//数据在声明的长度之前结束
+	ErrShortRead = io.ErrUnexpectedEOF
+)
@@ -0,0 +1,67 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the errors callers can tell apart
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+)
+
+func Test_Errors(t *testing.T) {
+	original := randomContent(64*10, 70)
+	config := &Config{BlockSize: 64}
+	sig := config.CalculateSignature(original)
+	encodedSig, err := sig.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedOp, err := RSyncOp{opCode: DATA, data: []byte("data")}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outOfRange := []RSyncOp{{opCode: BLOCK, blockIndex: 10}}
+
+	cases := []struct {
+		name     string
+		err      error
+		expected error
+	}{
+		{"Patch", func() error {
+			_, err := config.Patch(original, outOfRange)
+			return err
+		}(), ErrBlockIndexOutOfRange},
+		{"ApplyOpsAt", config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(outOfRange...), io.Discard), ErrBlockIndexOutOfRange},
+		{"copyChunksAt", copyChunksAt(bytes.NewReader(original), []int64{100, 700}, 0, 2, make([]byte, 64), io.Discard), ErrShortRead},
+		{"ComposeDeltas", func() error {
+			_, err := config.ComposeDeltas([]RSyncOp{{opCode: BLOCK, blockIndex: 0}}, outOfRange, len(original))
+			return err
+		}(), ErrBlockIndexOutOfRange},
+		{"CalculateSignatureDifferences", (&Config{BlockSize: 128}).CalculateSignatureDifferences(context.Background(), original, sig, make(chan RSyncOp)), ErrSignatureMismatch},
+		{"Scan", (&Config{BlockSize: 32}).Scan(context.Background(), original, sig.Hashes, nil, nil), ErrSignatureMismatch},
+		{"CalculateDifferencesContext", (&Config{BlockSize: 64, StrongHashLen: 8}).CalculateDifferencesContext(context.Background(), original, sig.Hashes, make(chan RSyncOp)), ErrSignatureMismatch},
+		{"ComputeDelta", (&Config{BlockSize: 64, StrongHash: sha256.New}).ComputeDelta(bytes.NewReader(original), sig.Hashes, io.Discard), ErrSignatureMismatch},
+		{"Signature.UnmarshalBinary", new(Signature).UnmarshalBinary(encodedSig[:len(encodedSig)-3]), ErrShortRead},
+		{"RSyncOp.UnmarshalBinary", new(RSyncOp).UnmarshalBinary(encodedOp[:len(encodedOp)-1]), ErrShortRead},
+		{"ReadOps", ReadOps(bytes.NewReader(encodedOp[:2]), make(chan RSyncOp, 1)), ErrShortRead},
+		{"MaxOutputSize", func() error {
+			_, err := (&Config{BlockSize: 64, MaxOutputSize: 100}).Patch(original, []RSyncOp{{opCode: BLOCKRUN, blockIndex: 0, blockCount: 2}})
+			return err
+		}(), ErrOutputTooLarge},
+	}
+	for _, test := range cases {
+		if !errors.Is(test.err, test.expected) {
+			t.Errorf("%s: expected %v, found %v", test.name, test.expected, test.err)
+		}
+	}
+	if !errors.Is(ErrShortRead, io.ErrUnexpectedEOF) {
+		t.Errorf("expected ErrShortRead to be io.ErrUnexpectedEOF")
+	}
+}
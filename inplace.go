@@ -0,0 +1,140 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotInPlace Returned by CheckInPlace and ApplyOpsInPlace when an operation
+// reads bytes of the basis that an earlier operation overwrites, so the delta
+// cannot be applied over the basis.
+var ErrNotInPlace = errors.New("rsync: delta cannot be applied in place")
+
+// CheckInPlace Reports whether ops can be applied over basis itself with
+// ApplyOpsInPlace, using the default block size. It returns nil when they can,
+// an error wrapping ErrNotInPlace when they cannot, and the error of the
+// sequential application for operations that do not fit basis at all.
+//检查差异能否直接在原数据上组装
+func CheckInPlace(basis []byte, ops []RSyncOp) error {
+	return defaultConfig.CheckInPlace(basis, ops)
+}
+
+// CheckInPlace Reports whether ops can be applied over basis using the
+// configured block size.
+// The modified content is written from the start, so when an operation is
+// applied every byte before its output offset has been overwritten. A delta
+// is safe in place when no BLOCK or BLOCKRUN reads the basis before the offset
+// it is written at, that is every block moves towards the start or stays
+// where it is, and IDENTICAL only comes first. DATA and COPY do not read the
+// basis.
+func (c *Config) CheckInPlace(basis []byte, ops []RSyncOp) error {
+	_, err := c.placeInPlace(basis, ops)
+	return err
+}
+
+// Returns the length of the modified content when ops can be applied over
+// basis, see CheckInPlace.
+//检查每个操作体读取的原数据是否已被覆盖
+func (c *Config) placeInPlace(basis []byte, ops []RSyncOp) (int, error) {
+	bounds := c.chunkBounds(basis)
+	var offset, count int
+	//HEADER 中的目标长度，没有时为 -1
+	length := -1
+	for i, op := range ops {
+		if err := c.countOp(&count); err != nil {
+			return 0, err
+		}
+		if op.opCode == HEADER {
+			if err := c.checkHeader(op, i == 0); err != nil {
+				return 0, err
+			}
+			length = op.length
+			continue
+		}
+		if op.opCode == COPY {
+			if c == nil || !c.SelfCopy {
+				return 0, errors.New("rsync: COPY operation without Config.SelfCopy")
+			}
+			if op.offset < 0 || op.length < 1 || op.offset >= offset {
+				return 0, fmt.Errorf("rsync: copy of %d bytes at %d out of range of %d reconstructed bytes", op.length, op.offset, offset)
+			}
+			offset += op.length
+			continue
+		}
+		chunk, err := c.opContent(basis, bounds, nil, op)
+		if err != nil {
+			return 0, err
+		}
+		//读取的原数据从 from 开始
+		from := -1
+		switch op.opCode {
+		case BLOCK, BLOCKRUN:
+			from = c.blocksStart(bounds, op.blockIndex)
+		case IDENTICAL:
+			from = 0
+		}
+		if from >= 0 && from < offset && len(chunk) > 0 {
+			return 0, fmt.Errorf("%w: %v reads byte %d after the modified content overwrote it up to %d", ErrNotInPlace, op, from, offset)
+		}
+		offset += len(chunk)
+	}
+	if length >= 0 && offset != length {
+		return 0, fmt.Errorf("rsync: reconstructed %d bytes, expected %d", offset, length)
+	}
+	if err := c.checkOutputSize(int64(offset)); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// Returns the offset of the block at blockIndex in the basis, with the block
+// end offsets returned by chunkBounds.
+func (c *Config) blocksStart(bounds []int, blockIndex int) int {
+	if bounds == nil {
+		return blockIndex * c.blockSize()
+	}
+	if blockIndex == 0 {
+		return 0
+	}
+	return bounds[blockIndex-1]
+}
+
+// ApplyOpsInPlace Applies ops over basis itself with the default block size,
+// for updates of the same file, without a second buffer for the modified
+// content. See CheckInPlace.
+//直接在原数据上组装
+func ApplyOpsInPlace(basis []byte, ops []RSyncOp) ([]byte, error) {
+	return defaultConfig.ApplyOpsInPlace(basis, ops)
+}
+
+// ApplyOpsInPlace Applies ops over basis with the configured block size and
+// returns the modified content, which shares the memory of basis. The
+// operations are checked with CheckInPlace first: when they cannot be applied
+// in place the error wraps ErrNotInPlace and basis is left untouched, and
+// Patch applies them with a buffer of its own instead. When the modified
+// content is longer than cap(basis) it is reconstructed in a new slice.
+func (c *Config) ApplyOpsInPlace(basis []byte, ops []RSyncOp) ([]byte, error) {
+	size, err := c.placeInPlace(basis, ops)
+	if err != nil {
+		return nil, err
+	}
+	result := basis
+	if size > cap(basis) {
+		result = make([]byte, size)
+	}
+	result = result[:size]
+	bounds := c.chunkBounds(basis)
+	var offset int
+	for _, op := range ops {
+		//已经检查过，不会出错
+		chunk, _ := c.opContent(basis, bounds, result[:offset], op)
+		//copy 可以处理重叠的数据
+		offset += copy(result[offset:], chunk)
+	}
+	return result, nil
+}
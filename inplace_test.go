@@ -0,0 +1,72 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the application of operations in place
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func Test_ApplyOpsInPlace(t *testing.T) {
+	original := randomContent(64*100, 53)
+	config := &Config{BlockSize: 64}
+	cases := []struct {
+		name     string
+		modified []byte
+		safe     bool
+	}{
+		{"identical", original, true},
+		{"deleted", editContent(original, deleteAt(1000, 300)), true},
+		{"replaced", editContent(original, replaceAt(3000, "replaced")), true},
+		{"truncated", original[:5000], true},
+		{"appended", append(append([]byte(nil), original...), "appended"...), true},
+		{"inserted", editContent(original, insertAt(1000, "inserted")), false},
+		{"reversed halves", append(append([]byte(nil), original[3200:]...), original[:3200]...), false},
+	}
+	for _, test := range cases {
+		ops := config.Diff(original, test.modified)
+		err := config.CheckInPlace(original, ops)
+		if test.safe != (err == nil) {
+			t.Errorf("%s: expected safe %v, found %v", test.name, test.safe, err)
+		}
+		if err != nil && !errors.Is(err, ErrNotInPlace) {
+			t.Errorf("%s: expected ErrNotInPlace, found %v", test.name, err)
+		}
+
+		basis := append([]byte(nil), original...)
+		result, err := config.ApplyOpsInPlace(basis, ops)
+		if !test.safe {
+			if !errors.Is(err, ErrNotInPlace) || !bytes.Equal(basis, original) {
+				t.Errorf("%s: expected ErrNotInPlace with the basis untouched, found %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(result, test.modified) {
+			t.Errorf("%s: ApplyOpsInPlace did not work as expected: %v", test.name, err)
+			continue
+		}
+		//不超过原数据的容量时共享内存
+		if shared := len(result) > 0 && &result[0] == &basis[0]; shared != (len(result) <= cap(basis)) {
+			t.Errorf("%s: expected the result to share the basis only when it fits", test.name)
+		}
+	}
+
+	//COPY 读取已经组装的数据
+	selfCopy := &Config{BlockSize: 64, SelfCopy: true}
+	ops := []RSyncOp{{opCode: DATA, data: []byte("ab")}, {opCode: COPY, offset: 0, length: 6}, {opCode: BLOCK, blockIndex: 50}}
+	expected := append([]byte("abababab"), original[3200:3264]...)
+	if result, err := selfCopy.ApplyOpsInPlace(append([]byte(nil), original...), ops); err != nil || !bytes.Equal(result, expected) {
+		t.Errorf("expected COPY to apply in place: %v", err)
+	}
+	if err := config.CheckInPlace(original, ops); err == nil {
+		t.Errorf("expected an error for COPY without SelfCopy")
+	}
+	if err := config.CheckInPlace(original, []RSyncOp{{opCode: BLOCK, blockIndex: 100}}); err == nil || errors.Is(err, ErrNotInPlace) {
+		t.Errorf("expected an error for a block out of range, found %v", err)
+	}
+}
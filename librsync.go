@@ -0,0 +1,155 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Signature layout of librsync, as written by rdiff signature:
+//
+//	magic       4 bytes big-endian
+//	block len   4 bytes big-endian
+//	strong len  4 bytes big-endian
+//	blocks      until the end of the data:
+//	  weak      4 bytes big-endian rollsum
+//	  strong    strong len bytes
+//
+// Supported magic values:
+//
+//	0x72730136  MD4 strong sums, named "md4"
+//	0x72730137  BLAKE2b-256 strong sums, named "blake2b-256"
+//
+// librsync has no MD5 variant, and the RabinKarp variants, 0x72730146 and
+// 0x72730147, use a weak hash this package does not compute. The standard
+// library implements neither MD4 nor BLAKE2b, so the configuration exchanging
+// such signatures must supply the strong hash, for instance from
+// golang.org/x/crypto/md4 or golang.org/x/crypto/blake2b, with the name above
+// in Config.StrongHashName and the strong len in Config.StrongHashLen.
+//librsync 的签名格式
+
+const (
+	// librsyncMD4Magic librsync 使用 MD4 的签名
+	librsyncMD4Magic = 0x72730136
+	// librsyncBlake2Magic librsync 使用 BLAKE2b 的签名
+	librsyncBlake2Magic = 0x72730137
+	// librsyncCharOffset librsync 的 rollsum 给每个字节加上的值
+	librsyncCharOffset = 31
+)
+
+// librsyncStrongHashes Names of the strong hashes of the librsync magics.
+var librsyncStrongHashes = map[uint32]string{
+	librsyncMD4Magic:    "md4",
+	librsyncBlake2Magic: "blake2b-256",
+}
+
+// WriteLibrsyncSignature Writes sig to w in the signature format of librsync,
+// so rdiff can compute a delta from it. The strong hash of sig must be one
+// librsync knows, and its weak hashes the rolling weak hash with the default
+// modulus M, which differs from the librsync rollsum only by a constant
+// depending on the length of the block. Signatures with deduplicated or
+// variable length blocks cannot be written.
+//以 librsync 的格式写入签名
+func WriteLibrsyncSignature(w io.Writer, sig *Signature) error {
+	var magic uint32
+	for m, name := range librsyncStrongHashes {
+		if sig.StrongHash == name {
+			magic = m
+		}
+	}
+	if magic == 0 {
+		return fmt.Errorf("rsync: librsync signatures have no %q strong hash", sig.StrongHash)
+	}
+	if (sig.WeakModulus != 0 && sig.WeakModulus != M) || (sig.WeakHash != "" && sig.WeakHash != RollingWeakHash.String()) {
+		return errors.New("rsync: librsync signatures need the rolling weak hash modulo M")
+	}
+	if sig.BlockSize <= 0 || sig.BlockSize > math.MaxUint32 {
+		return fmt.Errorf("rsync: block size %d out of range", sig.BlockSize)
+	}
+	strongLen, err := strongHashLen(sig.Hashes)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	var buf [12]byte
+	binary.BigEndian.PutUint32(buf[0:], magic)
+	binary.BigEndian.PutUint32(buf[4:], uint32(sig.BlockSize))
+	binary.BigEndian.PutUint32(buf[8:], uint32(strongLen))
+	bw.Write(buf[:])
+	for i, h := range sig.Hashes {
+		//块按顺序排列，只有最后一个块可以短于块大小
+		length := h.length
+		if length == 0 {
+			length = sig.BlockSize
+		}
+		if h.index != i || length > sig.BlockSize || (length < sig.BlockSize && i < len(sig.Hashes)-1) {
+			return fmt.Errorf("rsync: block %d cannot be written to a librsync signature", h.index)
+		}
+		if len(h.strongHash) != strongLen {
+			return fmt.Errorf("rsync: block %d has a %d byte strong hash, expected %d", h.index, len(h.strongHash), strongLen)
+		}
+		binary.BigEndian.PutUint32(buf[:4], librsyncWeakHash(h.weakHash, length, 1))
+		bw.Write(buf[:4])
+		bw.Write(h.strongHash)
+	}
+	return bw.Flush()
+}
+
+// ReadLibrsyncSignature Reads a signature in the signature format of
+// librsync, such as one written by rdiff signature, block by block until r
+// is exhausted. The lengths of the blocks are unknown and the weak hashes
+// assume full blocks, so a last block shorter than the block size never
+// matches and is sent as DATA instead.
+//读取 librsync 格式的签名
+func ReadLibrsyncSignature(r io.Reader) (*Signature, error) {
+	br := bufio.NewReader(r)
+	var header [12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	magic := binary.BigEndian.Uint32(header[0:])
+	name, ok := librsyncStrongHashes[magic]
+	if !ok {
+		return nil, fmt.Errorf("rsync: unsupported librsync signature magic %#08x", magic)
+	}
+	blockSize := binary.BigEndian.Uint32(header[4:])
+	strongLen := binary.BigEndian.Uint32(header[8:])
+	if blockSize == 0 || blockSize > math.MaxInt32 {
+		return nil, fmt.Errorf("rsync: block size %d out of range", blockSize)
+	}
+	if strongLen > 255 {
+		return nil, fmt.Errorf("rsync: strong hash of %d bytes is too long", strongLen)
+	}
+	sig := &Signature{BlockSize: int(blockSize), WeakModulus: M, StrongHash: name, WeakHash: RollingWeakHash.String()}
+	for index := 0; ; index++ {
+		block := make([]byte, 4+strongLen)
+		if _, err := io.ReadFull(br, block); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		weak := librsyncWeakHash(binary.BigEndian.Uint32(block), int(blockSize), -1)
+		sig.Hashes = append(sig.Hashes, BlockHash{index: index, weakHash: weak, strongHash: block[4:]})
+	}
+	return sig, nil
+}
+
+// Converts the rolling weak hash modulo M of a block of length bytes to the
+// librsync rollsum with sign 1, and back with sign -1. The rollsum adds
+// librsyncCharOffset to every byte, which adds it length times to the first
+// sum and length*(length+1)/2 times to the second one.
+//rolling 弱hash与 librsync rollsum 之间的转换
+func librsyncWeakHash(weak uint32, length int, sign int) uint32 {
+	n := uint64(length)
+	a := uint64(sign) * librsyncCharOffset * n
+	b := uint64(sign) * librsyncCharOffset * (n * (n + 1) / 2)
+	return composeWeakHash((uint64(weak&0xffff)+a)%M, (uint64(weak>>16)+b)%M, M)
+}
@@ -0,0 +1,104 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the librsync signature format
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// Returns the librsync rollsum of block, computed as librsync does.
+func librsyncRollsum(block []byte) uint32 {
+	var s1, s2 uint16
+	for _, v := range block {
+		s1 += uint16(v) + librsyncCharOffset
+		s2 += s1
+	}
+	return uint32(s2)<<16 | uint32(s1)
+}
+
+func Test_LibrsyncSignature(t *testing.T) {
+	original := randomContent(1000, 31)
+	modified := editContent(original, insertAt(100, "inserted"), deleteAt(500, 10))
+	//标准库没有 MD4，用 md5 代替
+	config := &Config{BlockSize: 64, StrongHash: md5.New, StrongHashName: "md4", StrongHashLen: 8}
+	sig := config.CalculateSignature(original)
+
+	var buf bytes.Buffer
+	if err := WriteLibrsyncSignature(&buf, sig); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if len(data) != 12+len(sig.Hashes)*12 {
+		t.Fatalf("expected %d bytes, found %d", 12+len(sig.Hashes)*12, len(data))
+	}
+	if magic, blockLen, strongLen := binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:]), binary.BigEndian.Uint32(data[8:]); magic != 0x72730136 || blockLen != 64 || strongLen != 8 {
+		t.Errorf("unexpected header %#x %d %d", magic, blockLen, strongLen)
+	}
+	//包括最后一个较短的块
+	for i := range sig.Hashes {
+		block := original[i*64 : min((i+1)*64, len(original))]
+		entry := data[12+i*12:]
+		if weak := binary.BigEndian.Uint32(entry); weak != librsyncRollsum(block) {
+			t.Errorf("block %d: expected rollsum %#x, found %#x", i, librsyncRollsum(block), weak)
+		}
+		if !bytes.Equal(entry[4:12], sig.Hashes[i].StrongHash()) {
+			t.Errorf("block %d: unexpected strong hash", i)
+		}
+	}
+
+	decoded, err := ReadLibrsyncSignature(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BlockSize != 64 || decoded.StrongHash != "md4" || len(decoded.Hashes) != len(sig.Hashes) {
+		t.Fatalf("unexpected signature %+v", decoded)
+	}
+	for i, h := range decoded.Hashes[:len(decoded.Hashes)-1] {
+		if h.WeakHash() != sig.Hashes[i].WeakHash() || !bytes.Equal(h.StrongHash(), sig.Hashes[i].StrongHash()) {
+			t.Errorf("block %d: expected %v, found %v", i, sig.Hashes[i], h)
+		}
+	}
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateSignatureDifferences(context.Background(), modified, decoded, opsChannel)
+	if result, err := config.ApplyOps(original, opsChannel, len(modified)); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("sync with a librsync signature did not work as expected: %v", err)
+	}
+}
+
+func Test_LibrsyncSignatureErrors(t *testing.T) {
+	original := randomContent(1000, 32)
+	for name, config := range map[string]*Config{
+		"md5":     {BlockSize: 64},
+		"modulus": {BlockSize: 64, StrongHash: md5.New, StrongHashName: "md4", WeakModulus: 65521},
+		"dedup":   {BlockSize: 64, StrongHash: md5.New, StrongHashName: "md4", Dedup: true},
+	} {
+		content := original
+		if config.Dedup {
+			//第三个块与第一个相同，去重后块下标不连续
+			content = append(append(append([]byte(nil), original[:128]...), original[:64]...), original[128:]...)
+		}
+		if err := WriteLibrsyncSignature(io.Discard, config.CalculateSignature(content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	header := binary.BigEndian.AppendUint32(nil, 0x72730146)
+	header = binary.BigEndian.AppendUint32(header, 64)
+	header = binary.BigEndian.AppendUint32(header, 8)
+	truncated := append(append([]byte(nil), header...), 1, 2, 3)
+	binary.BigEndian.PutUint32(truncated, librsyncBlake2Magic)
+	for name, data := range map[string][]byte{"rabinkarp": header, "truncated header": header[:6], "truncated block": truncated} {
+		if _, err := ReadLibrsyncSignature(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+// Matcher Looks up the blocks of a signature while differences are computed.
+// Set Config.Matcher to try another strategy than the default weak then
+// strong hash lookup, such as a prescreen in front of DefaultMatcher.
+//查找签名中的块
+type Matcher interface {
+	// Match Returns the block of the signature equal to block, or nil.
+	// weak is the configured weak hash of block, kept up to date as the
+	// window rolls. previous is the index of the block matched right before
+	// block, or -1, so runs of consecutive blocks can be preferred. The
+	// returned block must hold the same bytes as block: it is trusted and
+	// not compared again. CalculateDifferencesParallel calls Match from
+	// several goroutines at once.
+	Match(weak uint32, block []byte, previous int) *BlockHash
+}
+
+// DefaultMatcher Returns the Matcher used when Config.Matcher is nil for the
+// blocks hashes: blocks are grouped into buckets by weak hash, compared by
+// strong hash within a bucket, with buckets deeper than Config.MaxBucketDepth
+// indexed by strong hash, and the block following previous is preferred.
+// With Config.BloomFilter the buckets are behind a bloom filter.
+// Building it takes a pass over hashes; a Config.Matcher returning the same
+// Matcher every time reuses it for several computations against the same
+// signature.
+//默认的块查找方式
+func (c *Config) DefaultMatcher(hashes []BlockHash) Matcher {
+	if c != nil && c.BloomFilter {
+		return c.newBloomMatcher(hashes)
+	}
+	return c.newBlockIndex(hashes)
+}
+
+// Returns the configured Matcher for hashes. A custom Matcher is wrapped in a
+// blockIndex of its own, so the rolling scans call the default one without
+// an interface call for every window.
+func (c *Config) newMatcher(hashes []BlockHash) *blockIndex {
+	if c != nil && c.Matcher != nil {
+		return &blockIndex{custom: c.Matcher(hashes)}
+	}
+	if c != nil && c.BloomFilter {
+		return &blockIndex{custom: c.newBloomMatcher(hashes)}
+	}
+	return c.newBlockIndex(hashes)
+}
+
+// Match Returns the block equal to block, trying the block following
+// previous first, then the bucket of weak. Most windows have no bucket, which
+// is checked here so the check can be inlined.
+func (x *blockIndex) Match(weak uint32, block []byte, previous int) *BlockHash {
+	if x.custom != nil || x.buckets[weak] != nil {
+		return x.match(weak, block, previous)
+	}
+	return nil
+}
+
+// Returns the block equal to block once the bucket of weak is known to
+// exist, see Match.
+func (x *blockIndex) match(weak uint32, block []byte, previous int) *BlockHash {
+	if x.custom != nil {
+		return x.custom.Match(weak, block, previous)
+	}
+	//优先匹配上一个块的下一个块
+	if blockHash := x.config.followingBlock(x.hashes, previous, weak, block); blockHash != nil {
+		return blockHash
+	}
+	if blockFound, blockHash := x.config.matchIndexed(x, weak, x.buckets[weak], block); blockFound {
+		return blockHash
+	}
+	return nil
+}
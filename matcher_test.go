@@ -0,0 +1,96 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for custom block matchers
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// evenMatcher Matches only the blocks with an even index, through the default
+// matcher.
+type evenMatcher struct {
+	Matcher
+}
+
+func (m evenMatcher) Match(weak uint32, block []byte, previous int) *BlockHash {
+	if blockHash := m.Matcher.Match(weak, block, previous); blockHash != nil && blockHash.Index()%2 == 0 {
+		return blockHash
+	}
+	return nil
+}
+
+// countingMatcher Counts the lookups of the matcher it wraps, from any
+// goroutine.
+type countingMatcher struct {
+	Matcher
+	lookups *atomic.Int64
+}
+
+func (m countingMatcher) Match(weak uint32, block []byte, previous int) *BlockHash {
+	m.lookups.Add(1)
+	return m.Matcher.Match(weak, block, previous)
+}
+
+func Test_Matcher(t *testing.T) {
+	original := randomContent(64*200, 54)
+	modified := modifiedContent(original, 10, 55)
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		base := &Config{BlockSize: 64, Chunking: chunking}
+		expected := base.Diff(original, modified)
+
+		//包装默认实现时结果不变
+		var lookups atomic.Int64
+		wrapped := &Config{BlockSize: 64, Chunking: chunking}
+		wrapped.Matcher = func(hashes []BlockHash) Matcher {
+			return countingMatcher{wrapped.DefaultMatcher(hashes), &lookups}
+		}
+		if ops := wrapped.Diff(original, modified); !reflect.DeepEqual(ops, expected) || lookups.Load() == 0 {
+			t.Errorf("%v: expected the default operations through a wrapping matcher", chunking)
+		}
+		var delta bytes.Buffer
+		if err := wrapped.ComputeDelta(bytes.NewReader(modified), wrapped.CalculateBlockHashes(original), &delta); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decodeOps(t, delta.Bytes()), encodedOps(t, expected)) {
+			t.Errorf("%v: expected the default streaming delta through a wrapping matcher", chunking)
+		}
+
+		//只匹配偶数块
+		even := &Config{BlockSize: 64, Chunking: chunking}
+		even.Matcher = func(hashes []BlockHash) Matcher {
+			return evenMatcher{even.DefaultMatcher(hashes)}
+		}
+		ops := even.Diff(original, modified)
+		for _, op := range ops {
+			if op.opCode == BLOCK && op.blockIndex%2 != 0 {
+				t.Errorf("%v: expected only even blocks, found %v", chunking, op)
+			}
+		}
+		if result, err := even.Patch(original, ops); err != nil || !bytes.Equal(result, modified) {
+			t.Errorf("%v: expected the operations of a custom matcher to apply: %v", chunking, err)
+		}
+	}
+
+	//并行计算同样使用
+	var lookups atomic.Int64
+	config := &Config{BlockSize: 64}
+	config.Matcher = func(hashes []BlockHash) Matcher {
+		return countingMatcher{config.DefaultMatcher(hashes), &lookups}
+	}
+	var parallel []RSyncOp
+	config.calculateDifferencesParallel(context.Background(), modified, config.CalculateBlockHashes(original), func(op RSyncOp) error {
+		parallel = append(parallel, op)
+		return nil
+	}, 4)
+	if !reflect.DeepEqual(parallel, (&Config{BlockSize: 64}).Diff(original, modified)) || lookups.Load() == 0 {
+		t.Errorf("expected the parallel computation to use the matcher")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"io"
+	"os"
+)
+
+// MappedFile A read-only file mapped into memory, to be used as the basis of
+// ApplyOpsAt without loading it into a []byte: ApplyOpsAt then copies blocks
+// straight from the mapping. Where mapping is not available, or fails, reads
+// fall back to the file itself.
+// The file must not be truncated while it is mapped.
+//映射到内存的只读文件
+type MappedFile struct {
+	file *os.File
+	//映射的内容，为 nil 时直接读取文件
+	data []byte
+	size int64
+}
+
+// OpenMapped Opens the file at path and maps it into memory.
+//打开文件并映射到内存
+func OpenMapped(path string) (*MappedFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	m := &MappedFile{file: file, size: info.Size()}
+	//空文件不能映射；映射失败时退回普通读取
+	if m.size > 0 && int64(int(m.size)) == m.size {
+		if data, err := mmapFile(file, int(m.size)); err == nil {
+			m.data = data
+		}
+	}
+	return m, nil
+}
+
+// ReadAt Reads len(p) bytes at offset off, from the mapping when available.
+func (m *MappedFile) ReadAt(p []byte, off int64) (int, error) {
+	if m.data == nil {
+		return m.file.ReadAt(p, off)
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size Returns the size of the file when it was opened.
+func (m *MappedFile) Size() int64 {
+	return m.size
+}
+
+// Mapped Reports whether the file is mapped into memory, rather than read with
+// the fallback.
+func (m *MappedFile) Mapped() bool {
+	return m.data != nil
+}
+
+// Close Unmaps and closes the file.
+//解除映射并关闭文件
+func (m *MappedFile) Close() error {
+	var err error
+	if m.data != nil {
+		err = munmapFile(m.data)
+		m.data = nil
+	}
+	if closeErr := m.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
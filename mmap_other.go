@@ -0,0 +1,23 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package rsync
+
+import (
+	"errors"
+	"os"
+)
+
+// Mapping is not supported on this platform, files are read instead.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// Never called since mmapFile always fails.
+func munmapFile(data []byte) error {
+	return nil
+}
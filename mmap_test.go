@@ -0,0 +1,82 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for memory-mapped basis files
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func Test_MappedFile(t *testing.T) {
+	original, _ := os.ReadFile("test-data/golang-original.bmp")
+	modified, _ := os.ReadFile("test-data/golang-modified.bmp")
+	config := &Config{BlockSize: 1024}
+
+	m, err := OpenMapped("test-data/golang-original.bmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if runtime.GOOS == "linux" && !m.Mapped() {
+		t.Errorf("expected the file to be mapped")
+	}
+	if m.Size() != int64(len(original)) {
+		t.Errorf("expected size %d, found %d", len(original), m.Size())
+	}
+
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, config.CalculateBlockHashes(original), opsChannel)
+	var out bytes.Buffer
+	if err := config.ApplyOpsAt(m, opsChannel, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), modified) {
+		t.Errorf("ApplyOpsAt did not work as expected with a mapped basis")
+	}
+
+	//读到末尾
+	p := make([]byte, 10)
+	if n, err := m.ReadAt(p, m.Size()-4); n != 4 || err != io.EOF || !bytes.Equal(p[:4], original[len(original)-4:]) {
+		t.Errorf("unexpected read at the end: %d, %v", n, err)
+	}
+	if _, err := m.ReadAt(p, m.Size()); err != io.EOF {
+		t.Errorf("expected %v, found %v", io.EOF, err)
+	}
+}
+
+func Test_MappedFileFallback(t *testing.T) {
+	//空文件不能映射，退回普通读取
+	path := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mapped() {
+		t.Errorf("expected an empty file not to be mapped")
+	}
+	var out bytes.Buffer
+	if err := ApplyOpsAt(m, opsChannelOf(RSyncOp{opCode: DATA, data: []byte("new")}), &out); err != nil || out.String() != "new" {
+		t.Errorf("unexpected result %q: %v", out.String(), err)
+	}
+	if err := ApplyOpsAt(m, opsChannelOf(RSyncOp{opCode: BLOCK}), io.Discard); err == nil {
+		t.Errorf("expected an error for a block of an empty basis")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenMapped(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
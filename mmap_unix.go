@@ -0,0 +1,23 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package rsync
+
+import (
+	"os"
+	"syscall"
+)
+
+// Maps the first size bytes of file read-only.
+func mmapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// Unmaps data returned by mmapFile.
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,357 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// minParallelChunk Smallest part of the content worth a goroutine of its own.
+//并行计算不同时每个协程扫描的最小长度
+const minParallelChunk = 256 * 1024
+
+// blockMatch A block of the signature found in the content.
+//扫描时找到的匹配块
+type blockMatch struct {
+	//匹配块在数据中的起点和终点
+	start, end int
+	//匹配块的下标和所在的原数据
+	index, basis int
+}
+
+// CalculateDifferencesParallel Computes the operations needed to recreate
+// content like CalculateDifferencesContext, using the default block size, but
+// scans parts of content concurrently. The operations are identical to the
+// serial ones, and Config.BailRatio and Config.MaxOps fail after the same
+// operations, although only once the whole content is scanned.
+//并行计算不同
+func CalculateDifferencesParallel(ctx context.Context, content []byte, hashes []BlockHash, opsChannel chan RSyncOp) error {
+	return defaultConfig.CalculateDifferencesParallel(ctx, content, hashes, opsChannel)
+}
+
+// CalculateDifferencesParallel Computes the operations needed to recreate
+// content using the configured block size, spreading the scan across
+// runtime.NumCPU() goroutines. The channel is always closed on return.
+//
+// content is cut into consecutive parts at block boundaries, without overlap,
+// and every part is scanned from its first byte as if a match had just ended
+// there. The serial scan may enter a part elsewhere, when a match straddles
+// the seam. Since the next position of a scan only depends on the current
+// one, the serial scan joins the part's scan as soon as it reaches a position
+// that scan visited, that is any position not inside one of its matches; until
+// then the parts are merged by scanning serially from the seam.
+func (c *Config) CalculateDifferencesParallel(ctx context.Context, content []byte, hashes []BlockHash, opsChannel chan RSyncOp) error {
+	defer close(opsChannel)
+	workers := min(runtime.NumCPU(), len(content)/minParallelChunk)
+	return c.calculateDifferencesParallel(ctx, content, hashes, channelEmit(ctx, opsChannel), workers)
+}
+
+// Scans content with up to workers goroutines, one per part, and passes every
+// resulting operation to emit. Variable length blocks are scanned serially,
+// since every block is looked up independently anyway, and so is content
+// matched against itself with Config.SelfCopy.
+func (c *Config) calculateDifferencesParallel(ctx context.Context, content []byte, hashes []BlockHash, emit func(RSyncOp) error, workers int) error {
+	blockSize := c.blockSize()
+	stride := c.alignment()
+	if workers < 1 {
+		workers = 1
+	}
+	chunkSize := max((len(content)+workers-1)/workers, blockSize)
+	//每一段从块的边界开始
+	chunkSize = (chunkSize + blockSize - 1) / blockSize * blockSize
+	if c.chunking() != FixedChunking || (c != nil && c.SelfCopy) || chunkSize >= len(content) {
+		return c.calculateDifferences(ctx, content, hashes, emit)
+	}
+	if err := c.checkBlockHashes(hashes); err != nil {
+		return err
+	}
+	matcher := c.newMatcher(hashes)
+
+	var starts []int
+	for start := 0; start < len(content); start += chunkSize {
+		starts = append(starts, start)
+	}
+	results := make([][]blockMatch, len(starts))
+	errs := make([]error, len(starts))
+	var wg sync.WaitGroup
+	for i, start := range starts {
+		wg.Add(1)
+		go func(i, start int) {
+			defer wg.Done()
+			results[i], errs[i] = c.scanMatches(ctx, content, matcher, start, min(start+chunkSize, len(content)))
+		}(i, start)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	//合并各段的结果
+	var matches []blockMatch
+	var position int
+	for i, start := range starts {
+		end := min(start+chunkSize, len(content))
+		chunkMatches := results[i]
+		for position < end {
+			//跳过起点在 position 之前的匹配块，如果 position 在其中则不是这一段扫描过的位置
+			for len(chunkMatches) > 0 && chunkMatches[0].start < position {
+				if chunkMatches[0].end > position {
+					break
+				}
+				chunkMatches = chunkMatches[1:]
+			}
+			if len(chunkMatches) == 0 || chunkMatches[0].start >= position {
+				//这一段扫描过 position，之后的结果与串行扫描相同
+				matches = append(matches, chunkMatches...)
+				position = end
+				if n := len(chunkMatches); n > 0 {
+					position = max(end, chunkMatches[n-1].end)
+				}
+				break
+			}
+			//串行扫描一步，未对齐的位置不查找
+			if position%stride != 0 {
+				position++
+			} else if blockHash := c.lookupBlock(matcher, -1, content[position:min(position+blockSize, len(content))]); blockHash != nil {
+				matches = append(matches, blockMatch{start: position, end: position + blockSize, index: blockHash.index, basis: blockHash.basis})
+				position += blockSize
+			} else {
+				position++
+			}
+		}
+	}
+	c.followMatches(content, hashes, matches)
+	return c.emitMatches(content, matches, emit)
+}
+
+// Prefers the block following the previous match for every match right after
+// another, as the serial scan does with followingBlock. The parts are scanned
+// without knowing the match before them, so this is done once merged.
+//与串行扫描一样，优先匹配上一个匹配块的下一个块
+func (c *Config) followMatches(content []byte, hashes []BlockHash, matches []blockMatch) {
+	for i := 1; i < len(matches); i++ {
+		if matches[i].start != matches[i-1].end {
+			continue
+		}
+		block := content[matches[i].start:min(matches[i].end, len(content))]
+		if blockHash := c.followingBlock(hashes, matches[i-1].index, c.weakHash(block), block); blockHash != nil {
+			matches[i].index, matches[i].basis = blockHash.index, blockHash.basis
+		}
+	}
+}
+
+// Returns the matches of a scan of content starting at from, as the serial scan
+// right after a match, and going on while the window starts before to.
+//扫描 [from, to) 内开始的匹配块
+func (c *Config) scanMatches(ctx context.Context, content []byte, matcher *blockIndex, from, to int) ([]blockMatch, error) {
+	blockSize := c.blockSize()
+	stride := c.alignment()
+	rolling := c.newRollingHash()
+	var matches []blockMatch
+	isRolling := false
+	nextCheck := from
+	for offset := from; offset < to; {
+		if offset >= nextCheck {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			nextCheck = offset + checkInterval
+		}
+		endingByte := min(offset+blockSize, len(content))
+		block := content[offset:endingByte]
+		if !isRolling {
+			rolling.Init(block)
+			isRolling = true
+		} else if len(block) == blockSize {
+			rolling.Roll(content[offset-1], content[endingByte-1])
+		} else {
+			rolling.Shrink(content[offset-1])
+		}
+		if stride > 1 && offset%stride != 0 {
+			offset++
+			continue
+		}
+		weak := rolling.Sum()
+		if blockHash := matcher.Match(weak, block, -1); blockHash != nil {
+			matches = append(matches, blockMatch{start: offset, end: offset + blockSize, index: blockHash.index, basis: blockHash.basis})
+			offset += blockSize
+			isRolling = false
+			continue
+		}
+		offset++
+	}
+	return matches, nil
+}
+
+// Passes the operations for the matches found in content to emit, with the
+// unmatched data between them. Config.BailRatio is checked at the offsets the
+// serial scan checks it, in the same order with the operations, so it fails
+// at the same point.
+//根据匹配块生成操作体
+func (c *Config) emitMatches(content []byte, matches []blockMatch, emit func(RSyncOp) error) error {
+	if c != nil && c.CopyData {
+		emit = copyDataEmit(emit)
+	}
+	emit = c.limitOps(emit)
+	if err := c.emitHeader(emit, len(content)); err != nil {
+		return err
+	}
+	runs := c.newBlockRuns(emit)
+	var previousMatch, nextCheck, matched int
+	//串行扫描经过匹配块之外的每个位置以及匹配块的起点，每 checkInterval 字节检查一次
+	checkBail := func(to int) error {
+		for nextCheck <= to {
+			offset := max(nextCheck, previousMatch)
+			if err := c.checkBail(offset, matched); err != nil {
+				return err
+			}
+			nextCheck = offset + checkInterval
+		}
+		return nil
+	}
+	for _, m := range matches {
+		if err := checkBail(m.start); err != nil {
+			return err
+		}
+		if previousMatch < m.start {
+			if err := runs.add(RSyncOp{opCode: DATA, data: content[previousMatch:m.start]}); err != nil {
+				return err
+			}
+		}
+		block := content[m.start:min(m.end, len(content))]
+		if err := runs.add(RSyncOp{opCode: BLOCK, blockIndex: m.index, basis: m.basis, data: block}); err != nil {
+			return err
+		}
+		matched += len(block)
+		previousMatch = m.end
+	}
+	if previousMatch < len(content) {
+		if err := checkBail(len(content) - 1); err != nil {
+			return err
+		}
+	}
+	if err := c.checkBail(len(content), matched); err != nil {
+		return err
+	}
+	if previousMatch < len(content) {
+		if err := runs.add(RSyncOp{opCode: DATA, data: content[previousMatch:]}); err != nil {
+			return err
+		}
+	}
+	if err := runs.flush(); err != nil {
+		return err
+	}
+	c.reportProgress(len(content), len(content))
+	return nil
+}
+
+// PlaceOps Sets the output offset of every operation, see
+// RSyncOp.OutputOffset, using the default block size, and returns the length
+// of the modified content, so ops can be applied in any order.
+//计算每个操作体在组装后数据中的偏移量
+func PlaceOps(basis []byte, ops []RSyncOp) (int64, error) {
+	return defaultConfig.PlaceOps(basis, ops)
+}
+
+// PlaceOps Sets the output offset of every operation using the configured
+// block size and returns the length of the modified content. It checks every
+// operation against basis like the sequential application, and the length
+// against the HEADER, if any. COPY operations read the modified content being
+// reconstructed, so they are rejected.
+func (c *Config) PlaceOps(basis []byte, ops []RSyncOp) (int64, error) {
+	bounds := c.chunkBounds(basis)
+	var offset int64
+	//HEADER 中的目标长度，没有时为 -1
+	length := int64(-1)
+	for i := range ops {
+		if ops[i].opCode == COPY {
+			return 0, errors.New("rsync: COPY operations can only be applied in order")
+		}
+		if ops[i].opCode == HEADER {
+			if err := c.checkHeader(ops[i], i == 0); err != nil {
+				return 0, err
+			}
+			length = int64(ops[i].length)
+		}
+		chunk, err := c.opContent(basis, bounds, nil, ops[i])
+		if err != nil {
+			return 0, err
+		}
+		ops[i].outputOffset = offset
+		offset += int64(len(chunk))
+	}
+	if length >= 0 && offset != length {
+		return 0, fmt.Errorf("rsync: reconstructed %d bytes, expected %d", offset, length)
+	}
+	return offset, nil
+}
+
+// ApplyOpsParallel Applies ops to basis using the default block size, writing
+// the content of every operation at its output offset with WriteAt, from
+// runtime.NumCPU() goroutines and in no particular order.
+//并行组装，每个操作体按偏移量写入
+func ApplyOpsParallel(basis []byte, ops []RSyncOp, w io.WriterAt) error {
+	return defaultConfig.ApplyOpsParallel(basis, ops, w)
+}
+
+// ApplyOpsParallel Applies ops to basis with the configured block size,
+// writing them concurrently at their offsets. The offsets are set first with
+// PlaceOps, and when w has a Truncate method, such as an *os.File, it is sized
+// to the length of the modified content before any write. Other writers must
+// not hold more than the modified content. On error some operations may have
+// been written already.
+func (c *Config) ApplyOpsParallel(basis []byte, ops []RSyncOp, w io.WriterAt) error {
+	size, err := c.PlaceOps(basis, ops)
+	if err == nil {
+		err = c.checkOutputSize(size)
+	}
+	if err != nil {
+		return err
+	}
+	//预先分配完整的长度
+	if t, ok := w.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(size); err != nil {
+			return err
+		}
+	}
+	bounds := c.chunkBounds(basis)
+	workers := max(min(runtime.NumCPU(), len(ops)), 1)
+	next := make(chan int)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for n := range next {
+				if errs[i] != nil {
+					continue
+				}
+				//偏移量已经检查过，不会出错
+				chunk, _ := c.opContent(basis, bounds, nil, ops[n])
+				_, errs[i] = w.WriteAt(chunk, ops[n].outputOffset)
+			}
+		}(i)
+	}
+	for n := range ops {
+		next <- n
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
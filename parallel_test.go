@@ -0,0 +1,203 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the parallel computation of differences
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_CalculateDifferencesParallel(t *testing.T) {
+	random := randomContent(8192, 11)
+	//重复的内容让匹配块跨过各段的边界
+	repeated := bytes.Repeat(randomContent(100, 12), 80)
+	pairs := []struct{ original, modified []byte }{
+		{random, modifiedContent(random, 10, 13)},
+		{random, append([]byte("xyz"), random...)},
+		{repeated, modifiedContent(repeated, 5, 14)},
+		{repeated, append([]byte("a"), repeated[:len(repeated)-37]...)},
+		{random, randomContent(5000, 15)},
+	}
+
+	for _, pair := range pairs {
+		for _, config := range []*Config{{BlockSize: 16}, {BlockSize: 64}, {BlockSize: 64, MinMatch: 200, MaxDataOp: 100}} {
+			hashes := config.CalculateBlockHashes(pair.original)
+			expected := encodeOps(t, config.Diff(pair.original, pair.modified))
+			for _, workers := range []int{1, 2, 3, 4, 7, 16} {
+				var ops []RSyncOp
+				err := config.calculateDifferencesParallel(context.Background(), pair.modified, hashes, func(op RSyncOp) error {
+					ops = append(ops, op)
+					return nil
+				}, workers)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(encodeOps(t, ops), expected) {
+					t.Errorf("%d workers with %+v produced a different delta than the serial scan", workers, config)
+				}
+			}
+		}
+	}
+
+	//公开的接口关闭通道
+	content := randomContent(1000, 16)
+	opsChannel := make(chan RSyncOp)
+	go CalculateDifferencesParallel(context.Background(), content, CalculateBlockHashes(content), opsChannel)
+	result, err := ApplyOps(content, opsChannel, len(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, content) {
+		t.Errorf("parallel differences did not recreate the content")
+	}
+}
+
+func Test_CalculateDifferencesParallelBail(t *testing.T) {
+	original := randomContent(300000, 18)
+	//前面未匹配的数据让串行扫描中途放弃，整体的比例却低于 BailRatio
+	changedStart := append(randomContent(100000, 19), original[100000:]...)
+	changedEnd := append(original[:200000:200000], randomContent(100000, 20)...)
+	modifiedList := [][]byte{changedStart, changedEnd, modifiedContent(original, 200, 21)}
+
+	for _, modified := range modifiedList {
+		for _, config := range []*Config{
+			{BlockSize: 64, BailRatio: 0.2},
+			{BlockSize: 64, BailRatio: 0.5},
+			{BlockSize: 64, BailRatio: 0.9},
+			{BlockSize: 64, MaxOps: 100},
+			{BlockSize: 64, BailRatio: 0.5, MaxOps: 3},
+		} {
+			hashes := config.CalculateBlockHashes(original)
+			var expected []RSyncOp
+			expectedErr := config.calculateDifferences(context.Background(), modified, hashes, func(op RSyncOp) error {
+				expected = append(expected, op)
+				return nil
+			})
+			for _, workers := range []int{2, 4, 7} {
+				var ops []RSyncOp
+				err := config.calculateDifferencesParallel(context.Background(), modified, hashes, func(op RSyncOp) error {
+					ops = append(ops, op)
+					return nil
+				}, workers)
+				if errors.Is(err, ErrTooDifferent) != errors.Is(expectedErr, ErrTooDifferent) || errors.Is(err, ErrTooManyOps) != errors.Is(expectedErr, ErrTooManyOps) {
+					t.Errorf("%d workers with %+v: expected %v, found %v", workers, config, expectedErr, err)
+				}
+				if !bytes.Equal(encodeOps(t, ops), encodeOps(t, expected)) {
+					t.Errorf("%d workers with %+v sent different operations than the serial scan", workers, config)
+				}
+			}
+		}
+	}
+}
+
+func Test_CalculateDifferencesParallelCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	content := randomContent(4096, 17)
+	err := (&Config{BlockSize: 16}).calculateDifferencesParallel(ctx, content, nil, func(RSyncOp) error { return nil }, 4)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+// bufferAt A WriterAt over a byte slice, safe for concurrent writes.
+type bufferAt struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if end := int(off) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	return copy(b.data[off:], p), nil
+}
+
+func Test_ApplyOpsParallel(t *testing.T) {
+	original := randomContent(100000, 14)
+	modified := modifiedContent(original, 10, 15)
+
+	for _, config := range []*Config{{BlockSize: 512}, {Chunking: ContentDefinedChunking, BlockSize: 512}} {
+		ops := config.Diff(original, modified)
+		size, err := config.PlaceOps(original, ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(modified)) {
+			t.Errorf("expected %d bytes, found %d", len(modified), size)
+		}
+		//每个操作体的偏移量与顺序组装一致
+		var offset int64
+		for _, op := range ops {
+			if op.OutputOffset() != offset {
+				t.Fatalf("%v: expected offset %d, found %d", op, offset, op.OutputOffset())
+			}
+			chunk, _ := config.opContent(original, config.chunkBounds(original), nil, op)
+			offset += int64(len(chunk))
+		}
+
+		var out bufferAt
+		if err := config.ApplyOpsParallel(original, ops, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.data, modified) {
+			t.Errorf("parallel apply did not work as expected with %+v", config)
+		}
+	}
+
+	//文件预先分配到完整长度，原有的多余数据被截断
+	path := filepath.Join(t.TempDir(), "modified")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 2*len(modified)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := ApplyOpsParallel(original, Diff(original, modified), f); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := os.ReadFile(path); !bytes.Equal(result, modified) {
+		t.Errorf("parallel apply to a file did not work as expected")
+	}
+
+	for name, ops := range map[string][]RSyncOp{
+		"copy":         {{opCode: DATA, data: []byte("ab")}, {opCode: COPY, offset: 0, length: 2}},
+		"out of range": {{opCode: BLOCK, blockIndex: 1000}},
+	} {
+		if err := ApplyOpsParallel(original, ops, &bufferAt{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func Test_PlaceOpsHeaderLength(t *testing.T) {
+	basis := []byte("abcdefghij")
+	config := &Config{BlockSize: 4}
+	header := RSyncOp{opCode: HEADER, length: 6, blockSize: 4}
+
+	if size, err := config.PlaceOps(basis, []RSyncOp{header, {opCode: BLOCK}, {opCode: DATA, data: []byte("xy")}}); err != nil || size != 6 {
+		t.Errorf("expected 6 bytes, found %d: %v", size, err)
+	}
+	for name, ops := range map[string][]RSyncOp{
+		"long":   {header, {opCode: BLOCK}, {opCode: DATA, data: []byte("xyz")}},
+		"short":  {header, {opCode: BLOCK}},
+		"second": {{opCode: BLOCK}, header},
+	} {
+		if _, err := config.PlaceOps(basis, ops); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// sparseHoleSize Size of the pieces of the output checked for zeros with
+// Config.Sparse, a common file system block size.
+//稀疏输出时检查全零数据的片段长度
+const sparseHoleSize = 4096
+
+// zeroHole A piece of zeros to compare output with.
+var zeroHole [sparseHoleSize]byte
+
+// checkpointBytes Bytes written between two calls of Config.OnCheckpoint.
+//两次报告检查点之间写入的字节数
+const checkpointBytes = 1 << 20
+
+// Checkpoint How far a patch went, to resume it with ResumePatcher after an
+// interruption instead of starting over.
+//组装的检查点
+type Checkpoint struct {
+	// Ops 已经组装的操作体数量
+	Ops int
+	// Offset 已经写入的字节数
+	Offset int64
+}
+
+// Patcher Applies operations one at a time to a basis, writing the modified
+// content to a writer, for protocols where operations arrive over time rather
+// than through a channel.
+//逐个组装操作体
+type Patcher struct {
+	config *Config
+	basis  []byte
+	bounds []int
+	w      io.Writer
+	//已经写入的字节数
+	offset int64
+	//HEADER 中的目标长度，没有时为 -1
+	length int64
+	//Config.Sparse 时可以跳过全零数据的 w，以及尚未跳过的全零字节数
+	sparse io.WriteSeeker
+	hole   int64
+	//Config.SelfCopy 时保留已经写入的数据，供 COPY 引用
+	output []byte
+	//收到的操作体数量，以及成功组装的数量
+	count   int
+	applied int
+	//恢复组装时只重放不写入的操作体数量，以及检查点的偏移量
+	skip         int
+	resumeOffset int64
+	//上一次报告检查点时的偏移量
+	lastCheckpoint int64
+	//VerifyBasis 设置的签名中的块，以及已经校验过的块
+	verify   map[int]BlockHash
+	verified map[int]bool
+	//第一次出错后不再写入
+	err    error
+	closed bool
+}
+
+// NewPatcher Returns a Patcher applying operations to basis with the default
+// block size and writing the modified content to w.
+//创建组装器
+func NewPatcher(basis []byte, w io.Writer) *Patcher {
+	return defaultConfig.NewPatcher(basis, w)
+}
+
+// NewPatcher Returns a Patcher applying operations to basis with the
+// configured block size. With Config.Sparse, zeros are skipped when w can seek.
+func (c *Config) NewPatcher(basis []byte, w io.Writer) *Patcher {
+	p := &Patcher{config: c, basis: basis, bounds: c.chunkBounds(basis), w: w, length: -1}
+	if ws, ok := w.(io.WriteSeeker); ok && c != nil && c.Sparse {
+		//管道等无法定位的文件照常写入
+		if _, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			p.sparse = ws
+		}
+	}
+	return p
+}
+
+// ResumePatcher Returns a Patcher resuming at cp a patch of basis
+// interrupted after returning cp from Checkpoint or passing it to
+// Config.OnCheckpoint, using the default block size.
+//从检查点恢复组装
+func ResumePatcher(basis []byte, w io.Writer, cp Checkpoint) *Patcher {
+	return defaultConfig.ResumePatcher(basis, w, cp)
+}
+
+// ResumePatcher Returns a Patcher resuming a patch at cp with the configured
+// block size. The operations must be sent again from the first one, in the
+// same order: the first cp.Ops are replayed without writing anything, which
+// also rebuilds the output kept for COPY with Config.SelfCopy, and the
+// following ones are written to w, which must be positioned at cp.Offset,
+// such as a file opened again and seeked there.
+func (c *Config) ResumePatcher(basis []byte, w io.Writer, cp Checkpoint) *Patcher {
+	p := c.NewPatcher(basis, w)
+	p.skip, p.resumeOffset = cp.Ops, cp.Offset
+	p.lastCheckpoint = cp.Offset
+	return p
+}
+
+// Checkpoint Returns how far the patch went: the operations applied and the
+// bytes passed to the writer, not counting operations still being replayed
+// by a resumed Patcher.
+//返回当前的检查点
+func (p *Patcher) Checkpoint() Checkpoint {
+	if p.skip > 0 {
+		return Checkpoint{Ops: p.applied + p.skip, Offset: p.resumeOffset}
+	}
+	return Checkpoint{Ops: p.applied, Offset: p.offset}
+}
+
+// Apply Writes the content of op, checking that it fits in the basis.
+// After an error every call returns the same error.
+//组装一个操作体
+func (p *Patcher) Apply(op RSyncOp) error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.closed {
+		return errors.New("rsync: apply on a closed patcher")
+	}
+	if err := p.config.countOp(&p.count); err != nil {
+		p.err = err
+		return err
+	}
+	if op.opCode == COPY && (p.config == nil || !p.config.SelfCopy) {
+		p.err = errors.New("rsync: COPY operation without Config.SelfCopy")
+		return p.err
+	}
+	if op.opCode == HEADER {
+		if err := p.config.checkHeader(op, p.count == 1); err != nil {
+			p.err = err
+			return err
+		}
+		p.length = int64(op.length)
+	}
+	//重叠的 COPY 会分配 length 字节
+	if op.opCode == COPY {
+		if err := p.checkLength(p.offset + int64(op.length)); err != nil {
+			p.err = err
+			return err
+		}
+	}
+	chunk, err := p.config.opContent(p.basis, p.bounds, p.output, op)
+	if err == nil {
+		err = p.checkLength(p.offset + int64(len(chunk)))
+	}
+	if err == nil && p.verify != nil {
+		err = p.verifyBlocks(op)
+	}
+	if err == nil && p.skip > 0 {
+		err = p.replay(chunk)
+	} else if err == nil {
+		err = p.write(chunk)
+	}
+	if err != nil {
+		p.err = err
+		return err
+	}
+	p.offset += int64(len(chunk))
+	p.applied++
+	//定期报告检查点
+	if p.skip == 0 && p.config != nil && p.config.OnCheckpoint != nil && p.offset-p.lastCheckpoint >= checkpointBytes {
+		p.lastCheckpoint = p.offset
+		p.config.OnCheckpoint(p.Checkpoint())
+	}
+	return nil
+}
+
+// Checks that the output can grow to size bytes, within Config.MaxOutputSize
+// and the length of the HEADER, if any.
+//检查输出长度不超过上限和 HEADER 中的长度
+func (p *Patcher) checkLength(size int64) error {
+	if p.length >= 0 && size > p.length {
+		return fmt.Errorf("rsync: operations exceed file size %d", p.length)
+	}
+	return p.config.checkOutputSize(size)
+}
+
+// BasisBlockError A block of the basis referenced by an operation that does
+// not match the signature the operations were computed from, meaning the basis
+// changed since, as reported by a Patcher after VerifyBasis.
+//原数据中与签名不一致的块
+type BasisBlockError struct {
+	// Index 块下标
+	Index int
+}
+
+func (e *BasisBlockError) Error() string {
+	return fmt.Sprintf("rsync: block %d of the basis does not match the signature", e.Index)
+}
+
+// VerifyBasis Makes the Patcher check every block of the basis that an
+// operation references against sig, the signature of the basis the operations
+// were computed from, before writing it. The first block that differs fails
+// Apply with a *BasisBlockError. Every block is hashed once, however many
+// operations reference it. It must be called before the first Apply.
+//组装时校验引用的原数据块
+func (p *Patcher) VerifyBasis(sig *Signature) error {
+	if err := p.config.checkSignatureConfig(sig); err != nil {
+		return err
+	}
+	p.verify = make(map[int]BlockHash, len(sig.Hashes))
+	p.verified = make(map[int]bool)
+	for _, h := range sig.Hashes {
+		p.verify[h.index] = h
+	}
+	return nil
+}
+
+// Checks the blocks of the basis referenced by op against the signature.
+// Blocks missing from a deduplicated signature are not checked.
+//校验操作体引用的原数据块
+func (p *Patcher) verifyBlocks(op RSyncOp) error {
+	first, count := op.blockIndex, 1
+	switch op.opCode {
+	case BLOCKRUN:
+		count = op.blockCount
+	case IDENTICAL:
+		first, count = 0, len(p.bounds)
+		if p.bounds == nil {
+			count = getBlocksNumber(p.basis, p.config.blockSize())
+		}
+	case BLOCK:
+	default:
+		return nil
+	}
+	for i := first; i < first+count; i++ {
+		expected, ok := p.verify[i]
+		if !ok || p.verified[i] {
+			continue
+		}
+		block, err := p.config.blocksContent(p.basis, p.bounds, i, 1)
+		if err != nil {
+			return err
+		}
+		found := p.config.newBlockHash(i, block)
+		if found.weakHash != expected.weakHash || !bytes.Equal(found.strongHash, expected.strongHash) || (expected.length > 0 && found.length != expected.length) {
+			return &BasisBlockError{Index: i}
+		}
+		p.verified[i] = true
+	}
+	return nil
+}
+
+// Replays the content of an operation applied before the checkpoint.
+//重放检查点之前的操作体，不写入
+func (p *Patcher) replay(chunk []byte) error {
+	if p.config != nil && p.config.SelfCopy {
+		p.output = append(p.output, chunk...)
+	}
+	p.skip--
+	if offset := p.offset + int64(len(chunk)); offset > p.resumeOffset || (p.skip == 0 && offset != p.resumeOffset) {
+		return fmt.Errorf("rsync: operations replayed to %d bytes do not match the checkpoint at %d", offset, p.resumeOffset)
+	}
+	return nil
+}
+
+// Writes chunk to w, skipping the pieces of zeros when sparse.
+func (p *Patcher) write(chunk []byte) error {
+	if p.config != nil && p.config.SelfCopy {
+		p.output = append(p.output, chunk...)
+	}
+	if p.sparse == nil {
+		_, err := p.w.Write(chunk)
+		return err
+	}
+	for written := int64(0); len(chunk) > 0; {
+		//按输出中 sparseHoleSize 对齐的片段检查
+		n := min(len(chunk), sparseHoleSize-int((p.offset+written)%sparseHoleSize))
+		piece := chunk[:n]
+		if bytes.Equal(piece, zeroHole[:n]) {
+			p.hole += int64(n)
+		} else {
+			if err := p.skipHole(0); err != nil {
+				return err
+			}
+			if _, err := p.w.Write(piece); err != nil {
+				return err
+			}
+		}
+		chunk = chunk[n:]
+		written += int64(n)
+	}
+	return nil
+}
+
+// Seeks past the pending zeros but the last keep bytes, which are written.
+//跳过尚未写入的全零数据，最后 keep 个字节照常写入
+func (p *Patcher) skipHole(keep int64) error {
+	if p.hole == 0 {
+		return nil
+	}
+	if _, err := p.sparse.Seek(p.hole-keep, io.SeekCurrent); err != nil {
+		return err
+	}
+	p.hole = 0
+	_, err := p.w.Write(zeroHole[:keep])
+	return err
+}
+
+// Offset Returns the number of bytes of modified content written so far.
+//已经写入的字节数
+func (p *Patcher) Offset() int64 {
+	return p.offset
+}
+
+// Close Ends the patch, returning the first error met by Apply, if any, or
+// an error when the content is shorter than its HEADER announced.
+// Later calls to Apply fail. When zeros end the content and were skipped with
+// Config.Sparse, the last one is written so the file gets its full size.
+//结束组装
+func (p *Patcher) Close() error {
+	if !p.closed && p.err == nil && p.skip > 0 {
+		p.err = fmt.Errorf("rsync: %d operations before the checkpoint are missing", p.skip)
+	}
+	if !p.closed && p.err == nil && p.length >= 0 && p.offset != p.length {
+		p.err = fmt.Errorf("rsync: reconstructed %d bytes, expected %d", p.offset, p.length)
+	}
+	if !p.closed && p.err == nil && p.sparse != nil {
+		p.err = p.skipHole(1)
+	}
+	p.closed = true
+	return p.err
+}
@@ -0,0 +1,259 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the incremental patcher
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func Test_Patcher(t *testing.T) {
+	original, _ := os.ReadFile("test-data/text-original.txt")
+	modified, _ := os.ReadFile("test-data/text-modified.txt")
+
+	for _, config := range []*Config{{BlockSize: 16}, {BlockSize: 16, Chunking: ContentDefinedChunking}} {
+		var out bytes.Buffer
+		p := config.NewPatcher(original, &out)
+		//操作体逐个到达
+		for _, op := range config.Diff(original, modified) {
+			if err := p.Apply(op); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), modified) {
+			t.Errorf("Patcher did not work as expected with %+v", config)
+		}
+		if p.Offset() != int64(len(modified)) {
+			t.Errorf("expected offset %d, found %d", len(modified), p.Offset())
+		}
+		if err := p.Apply(RSyncOp{opCode: DATA, data: []byte("x")}); err == nil {
+			t.Errorf("expected an error after Close")
+		}
+	}
+}
+
+func Test_PatcherErrors(t *testing.T) {
+	var out bytes.Buffer
+	p := (&Config{BlockSize: 2}).NewPatcher([]byte("abcdef"), &out)
+	if err := p.Apply(RSyncOp{opCode: BLOCK, blockIndex: 1}); err != nil {
+		t.Fatal(err)
+	}
+	//越界的块，之后的调用返回同一个错误
+	err := p.Apply(RSyncOp{opCode: BLOCK, blockIndex: 3})
+	if err == nil {
+		t.Fatalf("expected an error for a block index out of range")
+	}
+	if again := p.Apply(RSyncOp{opCode: BLOCK}); again != err {
+		t.Errorf("expected %v, found %v", err, again)
+	}
+	if closeErr := p.Close(); closeErr != err {
+		t.Errorf("expected %v from Close, found %v", err, closeErr)
+	}
+	if out.String() != "cd" || p.Offset() != 2 {
+		t.Errorf("expected %q at offset 2, found %q at offset %d", "cd", out.String(), p.Offset())
+	}
+
+	errWrite := errors.New("write failed")
+	p = NewPatcher([]byte("abcdef"), failingWriter{errWrite})
+	if err := p.Apply(RSyncOp{opCode: DATA, data: []byte("x")}); err != errWrite {
+		t.Errorf("expected %v, found %v", errWrite, err)
+	}
+}
+
+func Test_PatcherHeaderLength(t *testing.T) {
+	config := &Config{BlockSize: 4}
+	header := RSyncOp{opCode: HEADER, length: 6, blockSize: 4}
+
+	var out bytes.Buffer
+	p := config.NewPatcher([]byte("abcdefghij"), &out)
+	for _, op := range []RSyncOp{header, {opCode: BLOCK}, {opCode: DATA, data: []byte("xy")}} {
+		if err := p.Apply(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); err != nil || out.String() != "abcdxy" {
+		t.Errorf("expected %q, found %q: %v", "abcdxy", out.String(), err)
+	}
+
+	//超过 HEADER 中的长度时 Apply 失败，不写入
+	out.Reset()
+	p = config.NewPatcher([]byte("abcdefghij"), &out)
+	p.Apply(header)
+	p.Apply(RSyncOp{opCode: BLOCK})
+	if err := p.Apply(RSyncOp{opCode: DATA, data: []byte("xyz")}); err == nil {
+		t.Errorf("expected an error for operations longer than the header")
+	}
+	if out.String() != "abcd" {
+		t.Errorf("expected %q, found %q", "abcd", out.String())
+	}
+
+	//少于 HEADER 中的长度时 Close 失败
+	p = config.NewPatcher([]byte("abcdefghij"), io.Discard)
+	p.Apply(header)
+	p.Apply(RSyncOp{opCode: BLOCK})
+	if err := p.Close(); err == nil {
+		t.Errorf("expected an error for operations shorter than the header")
+	}
+}
+
+// countingFile Counts the bytes written to a file.
+type countingFile struct {
+	*os.File
+	written int
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	f.written += len(p)
+	return f.File.Write(p)
+}
+
+func Test_PatcherSparse(t *testing.T) {
+	config := &Config{BlockSize: 512, Sparse: true}
+	data := randomContent(3000, 41)
+	zeros := make([]byte, 5*sparseHoleSize+100)
+	original := append(append(append([]byte{}, data...), zeros...), data...)
+	//全零数据出现在 DATA 和块中，也出现在末尾
+	modified := append(append(append(append([]byte{}, zeros...), data[:1000]...), original...), zeros...)
+
+	file, err := os.CreateTemp(t.TempDir(), "sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	out := &countingFile{File: file}
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, config.CalculateBlockHashes(original), opsChannel)
+	if err := config.ApplyOpsWriter(original, opsChannel, out); err != nil {
+		t.Fatal(err)
+	}
+	result, err := os.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, modified) {
+		t.Fatalf("sparse output of %d bytes does not match the modified content of %d bytes", len(result), len(modified))
+	}
+	if out.written > len(modified)-2*len(zeros)+2*sparseHoleSize {
+		t.Errorf("wrote %d of %d bytes, expected the zeros to be skipped", out.written, len(modified))
+	}
+
+	//无法定位的输出照常写入
+	var buf bytes.Buffer
+	opsChannel = make(chan RSyncOp)
+	go config.CalculateDifferences(modified, config.CalculateBlockHashes(original), opsChannel)
+	if err := config.ApplyOpsWriter(original, opsChannel, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), modified) {
+		t.Errorf("output to a writer that cannot seek does not match the modified content")
+	}
+}
+
+// cutWriter Fails once limit bytes were written to buf.
+type cutWriter struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (w cutWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errors.New("connection lost")
+	}
+	return w.buf.Write(p)
+}
+
+func Test_ResumeOpsWriter(t *testing.T) {
+	original := randomContent(3<<20, 101)
+	modified := modifiedContent(original, 5, 102)
+	modified = append(modified, modified[:1<<20]...)
+
+	for _, config := range []*Config{{BlockSize: 4096}, {BlockSize: 4096, SelfCopy: true}} {
+		ops := config.Diff(original, modified)
+		var checkpoints []Checkpoint
+		config.OnCheckpoint = func(cp Checkpoint) {
+			checkpoints = append(checkpoints, cp)
+		}
+
+		//写到一半连接中断
+		var out bytes.Buffer
+		if err := config.ApplyOpsWriter(original, opsChannelOf(ops...), cutWriter{&out, len(modified) * 2 / 3}); err == nil {
+			t.Fatalf("expected the interrupted patch to fail")
+		}
+		if len(checkpoints) < 2 {
+			t.Fatalf("expected checkpoints every MiB, found %v", checkpoints)
+		}
+		cp := checkpoints[len(checkpoints)-1]
+		if cp.Offset < 1<<20 || cp.Offset > int64(out.Len()) {
+			t.Fatalf("checkpoint %+v past the %d bytes written", cp, out.Len())
+		}
+
+		//从检查点恢复，丢弃检查点之后写入的数据
+		out.Truncate(int(cp.Offset))
+		if err := config.ResumeOpsWriter(original, opsChannelOf(ops...), &out, cp); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), modified) {
+			t.Errorf("SelfCopy %v: resumed patch did not recreate the modified content", config.SelfCopy)
+		}
+
+		p := config.ResumePatcher(original, io.Discard, cp)
+		if got := p.Checkpoint(); got != cp {
+			t.Errorf("expected a resumed patcher at %+v, found %+v", cp, got)
+		}
+		if err := p.Close(); err == nil {
+			t.Errorf("expected an error for ops missing before the checkpoint")
+		}
+		if err := config.ResumeOpsWriter(original, opsChannelOf(ops...), io.Discard, Checkpoint{Ops: cp.Ops, Offset: cp.Offset + 1}); err == nil {
+			t.Errorf("expected an error for a checkpoint that does not match the ops")
+		}
+	}
+}
+
+func Test_ApplyOpsVerified(t *testing.T) {
+	original := randomContent(10000, 51)
+	modified := editContent(original, replaceAt(5000, "changed"))
+	for _, config := range []*Config{{BlockSize: 256}, {BlockSize: 256, Chunking: ContentDefinedChunking}} {
+		sig := config.CalculateSignature(original)
+		ops := config.Diff(original, modified)
+		var out bytes.Buffer
+		if err := config.ApplyOpsVerified(original, sig, opsChannelOf(ops...), &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), modified) {
+			t.Errorf("verified apply did not work as expected with %+v", config)
+		}
+	}
+
+	//签名之后原数据被修改
+	config := &Config{BlockSize: 256}
+	sig := config.CalculateSignature(original)
+	changed := append([]byte(nil), original...)
+	changed[2000] ^= 1
+	for name, ops := range map[string][]RSyncOp{
+		"blocks":    config.Diff(original, modified),
+		"identical": {{opCode: IDENTICAL}},
+	} {
+		err := config.ApplyOpsVerified(changed, sig, opsChannelOf(ops...), io.Discard)
+		if e, ok := err.(*BasisBlockError); !ok || e.Index != 2000/256 {
+			t.Errorf("%s: expected block %d to be reported, found %v", name, 2000/256, err)
+		}
+	}
+	//没有引用被修改的块时不报错
+	ops := []RSyncOp{{opCode: BLOCKRUN, blockIndex: 0, blockCount: 7}, {opCode: DATA, data: []byte("x")}}
+	if err := config.ApplyOpsVerified(changed, sig, opsChannelOf(ops...), io.Discard); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := ApplyOpsVerified(original, sig, opsChannelOf(ops...), io.Discard); err == nil {
+		t.Errorf("expected an error for a signature with another block size")
+	}
+}
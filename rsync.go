@@ -8,13 +8,21 @@
 package rsync
 
 import (
-	"crypto/md5"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"runtime"
+	"sync"
 )
 
 const (
-	// BlockSize 默认块大小
+	// BlockSize 默认块大小，可通过 Config.BlockSize 覆盖
 	//BlockSize = 1024 * 644
-	BlockSize = 2
+	BlockSize = 4096
 	// M 65536 弱哈希算法取模
 	M = 1 << 16
 )
@@ -27,151 +35,971 @@ type BlockHash struct {
 	strongHash []byte
 	//弱哈希值
 	weakHash uint32
+	//块的长度，变长分块时各不相同
+	length int
+	//MergeSignatures 合并的签名中块所在的原数据
+	basis int
 }
 
-// There are two kind of operations: BLOCK and DATA.
+// Index Returns the index of the block in the original content.
+func (b BlockHash) Index() int {
+	return b.index
+}
+
+// StrongHash Returns the strong hash of the block.
+func (b BlockHash) StrongHash() []byte {
+	return b.strongHash
+}
+
+// WeakHash Returns the rolling weak hash of the block.
+func (b BlockHash) WeakHash() uint32 {
+	return b.weakHash
+}
+
+// Length Returns the length of the block in bytes.
+func (b BlockHash) Length() int {
+	return b.length
+}
+
+// Basis Returns the position of the basis holding the block in the signatures
+// given to MergeSignatures, or 0 for a signature of a single basis.
+func (b BlockHash) Basis() int {
+	return b.basis
+}
+
+// String Formats the block for debugging, with the first bytes of its strong
+// hash.
+//调试输出
+func (b BlockHash) String() string {
+	return fmt.Sprintf("block idx=%d len=%d weak=%#08x strong=%s", b.index, b.length, b.weakHash, shortHex(b.strongHash, 4))
+}
+
+// shortHexBytes Number of leading bytes shown by shortHex.
+const shortHexBytes = 16
+
+// Returns the hex encoding of the first n bytes of data, followed by "..."
+// when data is longer.
+func shortHex(data []byte, n int) string {
+	if len(data) <= n {
+		return hex.EncodeToString(data)
+	}
+	return hex.EncodeToString(data[:n]) + "..."
+}
+
+// There are seven kind of operations: BLOCK, BLOCKRUN, DATA, IDENTICAL, COPY, HEADER and FULL.
 // If a block match is found on the server, a BLOCK operation is sent over the channel along with the block index.
+// Consecutive block matches are merged into a single BLOCKRUN operation carrying the first index and the count.
 // Modified data between two block matches is sent like a DATA operation.
+// When the whole content equals the basis, a single IDENTICAL operation is sent instead.
+// With Config.SelfCopy, bytes repeating earlier modified content are sent like a COPY operation
+// carrying the offset and length of the earlier bytes in the modified content.
+// With Config.Header, a HEADER operation first describes the delta: the length of the
+// modified content, the block size and the name of the strong hash.
+// When the modified content is sent whole, see FullOps, a single FULL operation carries it
+// and the basis is not read.
 //常量
 const (
 	// BLOCK 整块数据
 	BLOCK = iota
 	// DATA 单独修改数据
 	DATA
+	// BLOCKRUN 连续的多个整块数据
+	BLOCKRUN
+	// IDENTICAL 与原数据完全相同，直接复制整个原数据
+	IDENTICAL
+	// COPY 复制已经组装的数据
+	COPY
+	// HEADER 描述差异：目标长度、块大小以及强hash名称
+	HEADER
+	// FULL 整个目标数据，组装时不读取原数据
+	FULL
 )
 
 // RSyncOp An rsync operation (typically to be sent across the network). It can be either a block of raw data or a block index.
+// DATA operations computed in the same process are zero-copy: their payload is a subslice of the
+// modified content, so the modified content must stay unchanged until the operations are applied,
+// encoded or dropped. Config.CopyData gives every payload a buffer of its own instead; decoded
+// operations always own their payload.
 //rsync数据体
 type RSyncOp struct {
 	//操作类型
 	opCode int
-	//如果是DATA 那么保存数据
+	//如果是DATA 或 FULL 那么保存数据
 	data []byte
-	//如果是BLOCK 保存块下标
+	//如果是BLOCK 保存块下标，如果是BLOCKRUN 保存第一个块的下标
 	blockIndex int
+	//如果是BLOCKRUN 保存连续块的数量
+	blockCount int
+	//如果是BLOCK 或 BLOCKRUN 保存块所在的原数据，见 MergeSignatures
+	basis int
+	//如果是COPY 保存已组装数据中的起点和长度，如果是HEADER 在 length 保存目标长度
+	offset, length int
+	//如果是HEADER 保存块大小和强hash名称
+	blockSize int
+	hash      string
+	//PlaceOps 计算的在组装后数据中的偏移量
+	outputOffset int64
+	//data 来自 dataPool，可以通过 Release 归还
+	pooled bool
+}
+
+// OutputOffset Returns where the content of the operation starts in the
+// modified content, as set by PlaceOps, or 0 before. It is not encoded.
+//操作体在组装后数据中的偏移量
+func (op RSyncOp) OutputOffset() int64 {
+	return op.outputOffset
 }
 
-// CalculateBlockHashes Returns weak and strong hashes for a given slice.
+// Basis Returns the basis the blocks of a BLOCK or BLOCKRUN operation come
+// from, their position in the signatures given to MergeSignatures, or 0.
+//块所在的原数据
+func (op RSyncOp) Basis() int {
+	return op.basis
+}
+
+// String Formats the operation for debugging, such as "BLOCK idx=5" or
+// "DATA len=12 hex=...", showing the first bytes of DATA payloads.
+//调试输出
+func (op RSyncOp) String() string {
+	switch op.opCode {
+	case BLOCK, BLOCKRUN:
+		s := fmt.Sprintf("BLOCK idx=%d", op.blockIndex)
+		if op.opCode == BLOCKRUN {
+			s = fmt.Sprintf("BLOCKRUN idx=%d count=%d", op.blockIndex, op.blockCount)
+		}
+		if op.basis != 0 {
+			s += fmt.Sprintf(" basis=%d", op.basis)
+		}
+		return s
+	case DATA:
+		return fmt.Sprintf("DATA len=%d hex=%s", len(op.data), shortHex(op.data, shortHexBytes))
+	case IDENTICAL:
+		return "IDENTICAL"
+	case COPY:
+		return fmt.Sprintf("COPY offset=%d len=%d", op.offset, op.length)
+	case HEADER:
+		return fmt.Sprintf("HEADER len=%d block=%d hash=%s", op.length, op.blockSize, op.hash)
+	case FULL:
+		return fmt.Sprintf("FULL len=%d hex=%s", len(op.data), shortHex(op.data, shortHexBytes))
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", op.opCode)
+	}
+}
+
+// CalculateBlockHashes Returns weak and strong hashes for a given slice,
+// using the default block size.
 //计算每个块的哈希值
 //参数：全部数据内容
 //返回：每个块组成的列表
 func CalculateBlockHashes(content []byte) []BlockHash {
-	blockHashes := make([]BlockHash, getBlocksNumber(content))
+	return defaultConfig.CalculateBlockHashes(content)
+}
+
+// CalculateBlockHashes Returns weak and strong hashes for a given slice,
+// using the configured block size. The last block may be shorter than the
+// block size; content shorter than one block, such as a small configuration
+// file, gets a single block covering all of it.
+// The hashes do not record the configuration: functions taking them check
+// them as a Signature of unknown configuration, which catches another strong
+// hash size or block lengths that do not fit, but not another block size that
+// cuts blocks of the same lengths. CalculateSignature records the
+// configuration, and Signature.Differences and Signature.ApplyOps take it
+// from the signature instead of a Config, so it cannot mismatch.
+func (c *Config) CalculateBlockHashes(content []byte) []BlockHash {
+	return c.dedup(c.allBlockHashes(content))
+}
+
+// Returns the hashes of every block of content, before Config.Dedup.
+//计算每个块的哈希值，不去重
+func (c *Config) allBlockHashes(content []byte) []BlockHash {
+	if bounds := c.chunkBounds(content); bounds != nil {
+		//变长的块
+		blockHashes := make([]BlockHash, len(bounds))
+		var initialByte int
+		for i, endingByte := range bounds {
+			blockHashes[i] = c.newBlockHash(i, content[initialByte:endingByte])
+			initialByte = endingByte
+		}
+		return blockHashes
+	}
+	blockSize := c.blockSize()
+	blockHashes := make([]BlockHash, getBlocksNumber(content, blockSize))
 	for i := range blockHashes {
-		initialByte := i * BlockSize
-		endingByte := min((i+1)*BlockSize, len(content))
+		initialByte := i * blockSize
+		endingByte := min((i+1)*blockSize, len(content))
 		// 确认每个块的定位
 		block := content[initialByte:endingByte]
-		//计算此块的弱hash
-		weak, _, _ := weakHash(block)
 		//保存到块哈希数组中
-		blockHashes[i] = BlockHash{
-			index:      i,
-			strongHash: strongHash(block),
-			weakHash:   weak,
-		}
+		blockHashes[i] = c.newBlockHash(i, block)
 	}
 	return blockHashes
 }
 
-// Returns the number of blocks for a given slice of content.
-//计算文件需要块的数量
-func getBlocksNumber(content []byte) int {
-	blockNumber := len(content) / BlockSize
-	if len(content)%BlockSize != 0 {
+// CalculateBlockHashesParallel Returns the same hashes as CalculateBlockHashes,
+// spreading the work across runtime.NumCPU() goroutines.
+//并行计算每个块的哈希值
+func CalculateBlockHashesParallel(content []byte) []BlockHash {
+	return defaultConfig.CalculateBlockHashesParallel(content)
+}
+
+// CalculateBlockHashesParallel Returns the same hashes as CalculateBlockHashes
+// using the configured block size, spreading the work across
+// runtime.NumCPU() goroutines.
+func (c *Config) CalculateBlockHashesParallel(content []byte) []BlockHash {
+	blockSize := c.blockSize()
+	bounds := c.chunkBounds(content)
+	blocksNumber := len(bounds)
+	if bounds == nil {
+		blocksNumber = getBlocksNumber(content, blockSize)
+	}
+	workers := min(runtime.NumCPU(), blocksNumber)
+	if workers <= 1 {
+		return c.CalculateBlockHashes(content)
+	}
+	blockHashes := make([]BlockHash, blocksNumber)
+
+	//每个协程负责一段连续的块，结果写入各自的下标
+	var wg sync.WaitGroup
+	perWorker := (len(blockHashes) + workers - 1) / workers
+	for first := 0; first < len(blockHashes); first += perWorker {
+		last := min(first+perWorker, len(blockHashes))
+		wg.Add(1)
+		go func(first, last int) {
+			defer wg.Done()
+			for i := first; i < last; i++ {
+				block, _ := c.blocksContent(content, bounds, i, 1)
+				blockHashes[i] = c.newBlockHash(i, block)
+			}
+		}(first, last)
+	}
+	wg.Wait()
+	return c.dedup(blockHashes)
+}
+
+// Returns the weak and strong hashes of the block at the given index.
+//计算单个块的弱hash和强hash
+func (c *Config) newBlockHash(index int, block []byte) BlockHash {
+	weak, strong := c.blockHashes(block)
+	return BlockHash{
+		index:      index,
+		strongHash: strong,
+		weakHash:   weak,
+		length:     len(block),
+	}
+}
+
+// Returns the weak and strong hashes of block, the same as weakHash and
+// strongHash, reading block once: every slice of 1024 bytes is added to the
+// rolling sums and written to the strong hash while it is still in cache,
+// instead of hashing the whole block twice.
+//一次读取同时计算弱hash和强hash
+func (c *Config) blockHashes(block []byte) (uint32, []byte) {
+	if c.weakHashKind() != RollingWeakHash || (c != nil && c.SkipStrongHash) {
+		return c.weakHash(block), c.strongHash(block)
+	}
+	m := c.weakModulus()
+	h := c.newStrongHash()
+	var a, b uint64
+	for offset := 0; offset < len(block); {
+		//与 weakSums 一样每 1024 个字节取一次模
+		end := min(offset+1024, len(block))
+		slice := block[offset:end]
+		for _, v := range slice {
+			a += uint64(v)
+			b += a
+		}
+		a, b = a%m, b%m
+		h.Write(slice)
+		offset = end
+	}
+	sum := h.Sum(nil)
+	if c != nil && c.StrongHashLen > 0 && c.StrongHashLen < len(sum) {
+		sum = sum[:c.StrongHashLen]
+	}
+	return composeWeakHash(a, b, m), sum
+}
+
+// BlockCount Returns the number of fixed size blocks the signature of
+// contentLen bytes is made of, rounding up for a final partial block.
+// Returns 0 for empty content. Like everywhere else in the package a
+// blockSize <= 0 selects the default block size.
+//计算文件需要块的数量，可用于预分配或显示进度
+func BlockCount(contentLen, blockSize int) int {
+	if contentLen <= 0 {
+		return 0
+	}
+	if blockSize <= 0 {
+		blockSize = BlockSize
+	}
+	blockNumber := contentLen / blockSize
+	if contentLen%blockSize != 0 {
 		blockNumber += 1
 	}
 	return blockNumber
 }
 
-// ApplyOps Applies operations from the channel to the original content.
-// Returns the modified content.
+// Returns the number of blocks for a given slice of content.
+//计算文件需要块的数量
+func getBlocksNumber(content []byte, blockSize int) int {
+	return BlockCount(len(content), blockSize)
+}
+
+// ApplyOps Applies operations from the channel to the original content,
+// using the default block size.
+// Returns the modified content, or an error if an operation does not fit in
+// the original content or in fileSize.
 //根据通道接收到的信息，将数据组装发送
 //参数：文件内容，数据操作体 通道， 本地文件大小
 //返回:组装后的数据
-func ApplyOps(content []byte, ops chan RSyncOp, fileSize int) []byte {
-	result := make([]byte, fileSize)
+func ApplyOps(content []byte, ops chan RSyncOp, fileSize int) ([]byte, error) {
+	return defaultConfig.ApplyOps(content, ops, fileSize)
+}
 
+// ApplyOps Applies operations from the channel to the original content,
+// using the configured block size. Signature.ApplyOps takes the block size
+// from the signature of content instead.
+// When the operations start with a HEADER, sent with Config.Header, fileSize
+// can be -1 and the length in the header sizes the result; otherwise both
+// must agree.
+// On error the remaining operations are drained so the sender is not blocked.
+func (c *Config) ApplyOps(content []byte, ops chan RSyncOp, fileSize int) ([]byte, error) {
+	return c.applyOps([][]byte{content}, ops, fileSize)
+}
+
+// ApplyOpsMulti Applies operations computed against a signature merged by
+// MergeSignatures, taking the blocks of every BLOCK and BLOCKRUN operation
+// from the basis at the same position in bases as its signature, using the
+// default block size.
+//根据多个原数据组装
+func ApplyOpsMulti(bases [][]byte, ops chan RSyncOp, fileSize int) ([]byte, error) {
+	return defaultConfig.ApplyOpsMulti(bases, ops, fileSize)
+}
+
+// ApplyOpsMulti Applies operations computed against a merged signature to
+// bases, using the configured block size, like ApplyOps. IDENTICAL refers to
+// the first basis.
+func (c *Config) ApplyOpsMulti(bases [][]byte, ops chan RSyncOp, fileSize int) ([]byte, error) {
+	if len(bases) == 0 {
+		drainOps(ops)
+		return nil, errors.New("rsync: no basis")
+	}
+	return c.applyOps(bases, ops, fileSize)
+}
+
+// Applies operations to one or more bases, see ApplyOps and ApplyOpsMulti.
+func (c *Config) applyOps(bases [][]byte, ops chan RSyncOp, fileSize int) ([]byte, error) {
+	var count int
+	//HEADER 中的长度不可信，不按它预先分配
+	capacity := fileSize
+	first, ok := <-ops
+	if ok && first.opCode == HEADER {
+		err := c.countOp(&count)
+		if err == nil {
+			err = c.checkHeader(first, true)
+		}
+		if err == nil && fileSize >= 0 && fileSize != first.length {
+			err = fmt.Errorf("rsync: file size %d differs from the %d bytes of the header", fileSize, first.length)
+		}
+		if err != nil {
+			drainOps(ops)
+			return nil, err
+		}
+		fileSize = first.length
+		capacity = c.headerCapacity(fileSize)
+	}
+	if fileSize < 0 {
+		drainOps(ops)
+		return nil, fmt.Errorf("rsync: invalid file size %d", fileSize)
+	}
+	//分配之前检查
+	if err := c.checkOutputSize(int64(fileSize)); err != nil {
+		drainOps(ops)
+		return nil, err
+	}
+	result := make([]byte, 0, capacity)
+	bounds := make([][]int, len(bases))
+	for i, basis := range bases {
+		bounds[i] = c.chunkBounds(basis)
+	}
+
+	apply := func(op RSyncOp) error {
+		if err := c.countOp(&count); err != nil {
+			return err
+		}
+		if op.opCode == HEADER {
+			return c.checkHeader(op, false)
+		}
+		//重叠的 COPY 会分配 length 字节
+		if op.opCode == COPY && op.length > fileSize-len(result) {
+			return fmt.Errorf("rsync: operations exceed file size %d", fileSize)
+		}
+		if op.basis < 0 || op.basis >= len(bases) {
+			return fmt.Errorf("rsync: operation references basis %d of %d", op.basis, len(bases))
+		}
+		basis := op.basis
+		op.basis = 0
+		chunk, err := c.opContent(bases[basis], bounds[basis], result, op)
+		if err != nil {
+			return err
+		}
+		//结果不能超过声明的文件大小
+		if len(chunk) > fileSize-len(result) {
+			return fmt.Errorf("rsync: operations exceed file size %d", fileSize)
+		}
+		result = append(result, chunk...)
+		return nil
+	}
+	//第一个操作体已经取出
+	if ok && first.opCode != HEADER {
+		if err := apply(first); err != nil {
+			drainOps(ops)
+			return nil, err
+		}
+	}
 	//遍历通道接收到的数据
-	var offset int
 	for op := range ops {
-		switch op.opCode {
-		case BLOCK:
-			//copy：目标文件，源文件
-			copy(result[offset:offset+BlockSize], content[op.blockIndex*BlockSize:op.blockIndex*BlockSize+BlockSize])
-			offset += BlockSize
-		//DATA是不定长的
-		case DATA:
-			copy(result[offset:], op.data)
-			offset += len(op.data)
+		if err := apply(op); err != nil {
+			drainOps(ops)
+			return nil, err
 		}
 	}
-	return result
+	if len(result) != fileSize {
+		return nil, fmt.Errorf("rsync: reconstructed %d bytes, expected %d", len(result), fileSize)
+	}
+	return result, nil
+}
+
+// ApplyOpsWriter Applies operations from the channel to the original content,
+// using the default block size, and writes the modified content to w as the
+// operations arrive. Unlike ApplyOps the result is never held in memory and
+// its size does not need to be known up front.
+//组装数据并直接写入 w
+func ApplyOpsWriter(content []byte, ops chan RSyncOp, w io.Writer) error {
+	return defaultConfig.ApplyOpsWriter(content, ops, w)
+}
+
+// ApplyOpsWriter Applies operations from the channel to the original content
+// using the configured block size, writing the modified content to w.
+// On error the remaining operations are drained so the sender is not blocked.
+func (c *Config) ApplyOpsWriter(content []byte, ops chan RSyncOp, w io.Writer) error {
+	return c.ResumeOpsWriter(content, ops, w, Checkpoint{})
 }
 
-// CalculateDifferences Computes all the operations needed to recreate content.
+// ApplyOpsVerified Applies operations from the channel to the original
+// content like ApplyOpsWriter, using the default block size, but checks every
+// block of content an operation references against sig, the signature of
+// content the operations were computed from, as Patcher.VerifyBasis does. A
+// content changed since sig was computed fails with a *BasisBlockError naming
+// the first changed block instead of producing a corrupted result.
+//组装时校验引用的原数据块
+func ApplyOpsVerified(content []byte, sig *Signature, ops chan RSyncOp, w io.Writer) error {
+	return defaultConfig.ApplyOpsVerified(content, sig, ops, w)
+}
+
+// ApplyOpsVerified Applies operations from the channel to the original
+// content using the configured block size, checking the referenced blocks
+// against sig, and writes the modified content to w.
+// On error the remaining operations are drained so the sender is not blocked.
+func (c *Config) ApplyOpsVerified(content []byte, sig *Signature, ops chan RSyncOp, w io.Writer) error {
+	p := c.NewPatcher(content, w)
+	if err := p.VerifyBasis(sig); err != nil {
+		drainOps(ops)
+		return err
+	}
+	for op := range ops {
+		if err := p.Apply(op); err != nil {
+			drainOps(ops)
+			return err
+		}
+	}
+	return p.Close()
+}
+
+// ResumeOpsWriter Resumes at cp, like ResumePatcher, an ApplyOpsWriter that
+// was interrupted, using the default block size. The channel must send every
+// operation again from the first one.
+//从检查点恢复组装并写入 w
+func ResumeOpsWriter(content []byte, ops chan RSyncOp, w io.Writer, cp Checkpoint) error {
+	return defaultConfig.ResumeOpsWriter(content, ops, w, cp)
+}
+
+// ResumeOpsWriter Resumes an interrupted ApplyOpsWriter at cp using the
+// configured block size.
+func (c *Config) ResumeOpsWriter(content []byte, ops chan RSyncOp, w io.Writer, cp Checkpoint) error {
+	p := c.ResumePatcher(content, w, cp)
+	for op := range ops {
+		if err := p.Apply(op); err != nil {
+			drainOps(ops)
+			return err
+		}
+	}
+	return p.Close()
+}
+
+// Returns the bytes an operation contributes to the modified content, with
+// the block end offsets returned by chunkBounds and output, the modified
+// content reconstructed so far, which COPY operations reference. output is
+// nil when it is not kept.
+//返回一个操作体对应的数据
+func (c *Config) opContent(content []byte, bounds []int, output []byte, op RSyncOp) ([]byte, error) {
+	//其他原数据中的块需要 ApplyOpsMulti
+	if op.basis != 0 {
+		return nil, otherBasisError(op)
+	}
+	switch op.opCode {
+	case BLOCK:
+		return c.blocksContent(content, bounds, op.blockIndex, 1)
+	case BLOCKRUN:
+		return c.blocksContent(content, bounds, op.blockIndex, op.blockCount)
+	//DATA是不定长的
+	case DATA:
+		return op.data, nil
+	case IDENTICAL:
+		return content, nil
+	//FULL 忽略原数据
+	case FULL:
+		return op.data, nil
+	case COPY:
+		return copyContent(output, op)
+	//HEADER 不产生数据
+	case HEADER:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("rsync: unknown op code %d", op.opCode)
+	}
+}
+
+// Returns the error for an operation referencing another basis than the only
+// one it is applied to.
+func otherBasisError(op RSyncOp) error {
+	return fmt.Errorf("rsync: %v references basis %d, applied to a single basis", op, op.basis)
+}
+
+// Returns the bytes a COPY operation contributes after output. The copied
+// bytes may overlap the bytes being produced, repeating the end of output.
+//返回 COPY 操作复制的数据，可以与复制出的数据重叠
+func copyContent(output []byte, op RSyncOp) ([]byte, error) {
+	if op.offset < 0 || op.length < 1 || op.offset >= len(output) {
+		return nil, fmt.Errorf("rsync: copy of %d bytes at %d out of range of %d reconstructed bytes", op.length, op.offset, len(output))
+	}
+	if end := op.offset + op.length; end <= len(output) {
+		return output[op.offset:end], nil
+	}
+	//重叠时按 len(output)-offset 的周期重复
+	chunk := make([]byte, op.length)
+	n := copy(chunk, output[op.offset:])
+	for n < len(chunk) {
+		n += copy(chunk[n:], chunk[:n])
+	}
+	return chunk, nil
+}
+
+// Discards every remaining operation of the channel.
+//丢弃通道中剩余的操作，避免发送方阻塞
+func drainOps(ops chan RSyncOp) {
+	for range ops {
+	}
+}
+
+// CalculateDifferences Computes all the operations needed to recreate content,
+// using the default block size.
 // All these operations are sent through a channel of RSyncOp.
+// DATA operations share memory with content, so changing content while they
+// are in use changes them too; set Config.CopyData to get independent copies.
 //计算不同
 //不返回，将处理的数据放入通道
 //参数：本地文件内容， 传送过来的块哈希数组， 空操作通道
 func CalculateDifferences(content []byte, hashes []BlockHash, opsChannel chan RSyncOp) {
+	defaultConfig.CalculateDifferences(content, hashes, opsChannel)
+}
 
-	//构建一个哈希map，<下标，哈希块列表>？ 链表结构？
-	hashesMap := make(map[uint32][]BlockHash)
+// CalculateDifferences Computes all the operations needed to recreate content,
+// using the configured block size.
+// If hashes do not fit the configuration no operation is sent; use
+// CalculateDifferencesContext to get the error, or Signature.Differences to
+// take the configuration from a Signature.
+// Every send blocks until received, so a goroutine running it leaks when the
+// receiver stops early, for instance on an error, without draining the
+// channel. Servers should use StartDifferences, or cancel the context of
+// CalculateDifferencesContext, instead.
+func (c *Config) CalculateDifferences(content []byte, hashes []BlockHash, opsChannel chan RSyncOp) {
+	c.CalculateDifferencesContext(context.Background(), content, hashes, opsChannel)
+}
+
+// CalculateDifferencesContext Computes all the operations needed to recreate
+// content like CalculateDifferences, using the default block size, but stops
+// and returns ctx.Err() once ctx is cancelled.
+// The channel is always closed on return, so ApplyOps never waits forever.
+//可取消的计算不同
+func CalculateDifferencesContext(ctx context.Context, content []byte, hashes []BlockHash, opsChannel chan RSyncOp) error {
+	return defaultConfig.CalculateDifferencesContext(ctx, content, hashes, opsChannel)
+}
+
+// CalculateDifferencesContext Computes all the operations needed to recreate
+// content using the configured block size, stopping once ctx is cancelled.
+func (c *Config) CalculateDifferencesContext(ctx context.Context, content []byte, hashes []BlockHash, opsChannel chan RSyncOp) error {
 	defer close(opsChannel)
+	return c.calculateDifferences(ctx, content, hashes, channelEmit(ctx, opsChannel))
+}
 
-	//遍历每个哈希块数组
+// CalculateSignatureDifferences Computes the operations needed to recreate
+// content from the basis described by sig, using the default configuration.
+// When content has the whole-file hash of the basis, a single IDENTICAL
+// operation is sent and the scan is skipped. When only its start has it, as
+// for a growing log, all the blocks of the basis are sent as one run followed
+// by the rest of content as DATA, without scanning either.
+// The channel is always closed on return.
+//根据签名计算不同，与原数据相同时只发送 IDENTICAL
+func CalculateSignatureDifferences(ctx context.Context, content []byte, sig *Signature, opsChannel chan RSyncOp) error {
+	return defaultConfig.CalculateSignatureDifferences(ctx, content, sig, opsChannel)
+}
+
+// CalculateSignatureDifferences Computes the operations needed to recreate
+// content from the basis described by sig using the configuration, stopping
+// once ctx is cancelled. Returns an error without sending any operation if sig
+// was computed with another block size or weak hash modulus; see
+// Signature.Config to take them from sig instead.
+func (c *Config) CalculateSignatureDifferences(ctx context.Context, content []byte, sig *Signature, opsChannel chan RSyncOp) error {
+	defer close(opsChannel)
+	//块大小或弱hash不一致时所有的块都无法匹配
+	if err := c.checkSignatureConfig(sig); err != nil {
+		return err
+	}
+	emit := channelEmit(ctx, opsChannel)
+	//整个文件的强hash相同，不需要扫描
+	if len(sig.FileHash) > 0 && bytes.Equal(c.FileHash(content), sig.FileHash) {
+		c.reportProgress(len(content), len(content))
+		if err := c.emitHeader(emit, len(content)); err != nil {
+			return err
+		}
+		return emit(RSyncOp{opCode: IDENTICAL})
+	}
+	//原数据是 content 的前缀，只追加了数据
+	if size := c.appendedSize(content, sig); size > 0 {
+		c.reportProgress(len(content), len(content))
+		return c.emitAppended(emit, content, sig.Hashes, size)
+	}
+	return c.calculateDifferences(ctx, content, sig.Hashes, emit)
+}
+
+// Returns the length of the basis described by sig when content starts with
+// it and goes on past it, 0 otherwise. The basis must be described block by
+// block, with known lengths, and have a whole-file hash. The last block is
+// compared first, so most other changes are rejected without hashing the
+// whole basis.
+//原数据是 content 的前缀时返回原数据的长度，否则返回 0
+func (c *Config) appendedSize(content []byte, sig *Signature) int {
+	if len(sig.FileHash) == 0 || len(sig.Hashes) == 0 {
+		return 0
+	}
+	var size int
+	for i, h := range sig.Hashes {
+		//去重或合并后的签名，或者块长度未知
+		if h.index != i || h.basis != 0 || h.length <= 0 {
+			return 0
+		}
+		size += h.length
+	}
+	if size >= len(content) {
+		return 0
+	}
+	last := sig.Hashes[len(sig.Hashes)-1]
+	block := content[size-last.length : size]
+	if last.weakHash != c.weakHash(block) {
+		return 0
+	}
+	if found, _ := c.matchBucket(sig.Hashes[len(sig.Hashes)-1:], block); !found {
+		return 0
+	}
+	if !bytes.Equal(c.FileHash(content[:size]), sig.FileHash) {
+		return 0
+	}
+	return size
+}
+
+// Sends the operations for content starting with the basis of hashes, size
+// bytes long: every block of the basis, merged into a run, then the rest of
+// content as DATA.
+//发送原数据的全部块，之后的数据作为 DATA
+func (c *Config) emitAppended(emit func(RSyncOp) error, content []byte, hashes []BlockHash, size int) error {
+	if c != nil && c.CopyData {
+		emit = copyDataEmit(emit)
+	}
+	emit = c.limitOps(emit)
+	if err := c.emitHeader(emit, len(content)); err != nil {
+		return err
+	}
+	runs := c.newBlockRuns(emit)
+	var offset int
 	for _, h := range hashes {
-		key := h.weakHash
-		//用弱hash做key，值为哈希块
-		//数组+链表！！todo：Test
-		hashesMap[key] = append(hashesMap[key], h)
+		if err := runs.add(RSyncOp{opCode: BLOCK, blockIndex: h.index, data: content[offset : offset+h.length]}); err != nil {
+			return err
+		}
+		offset += h.length
+	}
+	if err := runs.add(RSyncOp{opCode: DATA, data: content[size:]}); err != nil {
+		return err
+	}
+	return runs.flush()
+}
+
+// opStreamBuffer Operations buffered by an OpStream ahead of the receiver.
+//OpStream 通道的缓冲长度
+const opStreamBuffer = 64
+
+// OpStream Operations computed by a goroutine of their own and sent through a
+// buffered channel, which never leaks the goroutine: once Close returns the
+// goroutine has exited, whether the channel was drained or not.
+//在单独的协程中计算不同，Close 之后协程一定已经退出
+type OpStream struct {
+	ops chan RSyncOp
+	//调用方传入的 ctx，用于区分 Close 引起的取消
+	parent context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// StartDifferences Starts computing the operations needed to recreate content
+// like CalculateDifferencesContext, using the default block size, and returns
+// the stream receiving them. The caller must call Close, typically deferred.
+//启动计算不同，调用方必须 Close
+func StartDifferences(ctx context.Context, content []byte, hashes []BlockHash) *OpStream {
+	return defaultConfig.StartDifferences(ctx, content, hashes)
+}
+
+// StartDifferences Starts computing the operations needed to recreate content
+// using the configured block size. The computation stops when ctx is
+// cancelled or the stream is closed.
+func (c *Config) StartDifferences(ctx context.Context, content []byte, hashes []BlockHash) *OpStream {
+	s := &OpStream{ops: make(chan RSyncOp, opStreamBuffer), parent: ctx, done: make(chan struct{})}
+	ctx, s.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(s.done)
+		s.err = c.CalculateDifferencesContext(ctx, content, hashes, s.ops)
+	}()
+	return s
+}
+
+// Ops Returns the channel receiving the operations, closed once they are all
+// sent or the computation stopped, to pass to ApplyOps or WriteOps.
+//接收操作体的通道
+func (s *OpStream) Ops() chan RSyncOp {
+	return s.ops
+}
+
+// Close Stops the computation if still running, waits for its goroutine to
+// exit and returns the error that stopped it, if any, not counting the stop
+// requested by Close itself. It may be called several times.
+//停止计算并等待协程退出
+func (s *OpStream) Close() error {
+	s.cancel()
+	<-s.done
+	if s.err == context.Canceled && s.parent.Err() == nil {
+		return nil
+	}
+	return s.err
+}
+
+// Passes the HEADER operation of content of the given length to emit when
+// enabled by Config.Header.
+//按配置发送 HEADER
+func (c *Config) emitHeader(emit func(RSyncOp) error, length int) error {
+	if c == nil || !c.Header {
+		return nil
+	}
+	return emit(RSyncOp{opCode: HEADER, length: length, blockSize: c.blockSize(), hash: c.strongHashName()})
+}
+
+// Checks a HEADER operation against the configuration. first tells whether it
+// is the first operation, the only place for a HEADER.
+//检查 HEADER 与配置是否一致
+func (c *Config) checkHeader(op RSyncOp, first bool) error {
+	if !first {
+		return errors.New("rsync: HEADER operation after the first operation")
+	}
+	if op.blockSize != c.blockSize() {
+		return fmt.Errorf("rsync: delta computed with block size %d, configured %d", op.blockSize, c.blockSize())
+	}
+	if name := c.strongHashName(); op.hash != "" && name != "" && op.hash != name {
+		return fmt.Errorf("rsync: delta computed with strong hash %q, configured %q", op.hash, name)
+	}
+	return c.checkOutputSize(int64(op.length))
+}
+
+// Returns an emit function sending operations to opsChannel until ctx is
+// cancelled.
+func channelEmit(ctx context.Context, opsChannel chan RSyncOp) func(RSyncOp) error {
+	return func(op RSyncOp) error {
+		//接收方不再读取时也能响应取消
+		select {
+		case opsChannel <- op:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checkInterval Number of scanned bytes between two checks of the context
+// and two progress reports.
+//每扫描多少字节检查一次是否取消并报告进度
+const checkInterval = 64 * 1024
+
+// Reports progress and checks ctx, every checkInterval bytes of a scan.
+func (c *Config) checkpoint(ctx context.Context, offset, total int) error {
+	c.reportProgress(offset, total)
+	return ctx.Err()
+}
+
+// ErrTooDifferent Returned once more than Config.BailRatio of the modified
+// content scanned is unmatched: the caller should send the whole content,
+// see FullOps.
+var ErrTooDifferent = errors.New("rsync: content too different from the basis")
+
+// Checks the unmatched part of the scanned bytes against Config.BailRatio,
+// once matched of them are matched.
+//检查未匹配数据的比例
+func (c *Config) checkBail(scanned, matched int) error {
+	if c == nil || c.BailRatio <= 0 || scanned == 0 {
+		return nil
+	}
+	if literal := scanned - matched; float64(literal) > c.BailRatio*float64(scanned) {
+		return fmt.Errorf("%w: %d of %d scanned bytes unmatched", ErrTooDifferent, literal, scanned)
+	}
+	return nil
+}
+
+// Scans content for blocks of hashes and passes every resulting operation to emit.
+// Stops at the first error returned by emit or when ctx is cancelled.
+//计算不同的核心逻辑，每个操作交给 emit 处理
+func (c *Config) calculateDifferences(ctx context.Context, content []byte, hashes []BlockHash, emit func(RSyncOp) error) error {
+	if err := c.checkBlockHashes(hashes); err != nil {
+		return err
 	}
+	if c != nil && c.CopyData {
+		emit = copyDataEmit(emit)
+	}
+	emit = c.limitOps(emit)
+	if err := c.emitHeader(emit, len(content)); err != nil {
+		return err
+	}
+	//连续的块合并为 BLOCKRUN
+	runs := c.newBlockRuns(emit)
+	//SelfCopy 时已扫描数据中的块
+	var self *selfBlocks
+	if c != nil && c.SelfCopy && c.chunking() == FixedChunking {
+		self = c.newSelfBlocks(content)
+	}
+	err := c.scan(ctx, content, hashes, self, func(blockHash *BlockHash, start, end int) error {
+		return runs.add(RSyncOp{opCode: BLOCK, blockIndex: blockHash.index, basis: blockHash.basis, data: content[start:end]})
+	}, func(source, start, end int) error {
+		return runs.add(RSyncOp{opCode: COPY, offset: source, length: end - start})
+	}, func(start, end int) error {
+		return runs.add(RSyncOp{opCode: DATA, data: content[start:end]})
+	})
+	if err != nil {
+		return err
+	}
+	if err := runs.flush(); err != nil {
+		return err
+	}
+	c.reportProgress(len(content), len(content))
+	return nil
+}
+
+// Scans content for fixed size blocks of hashes, rolling the weak hash byte
+// by byte, and for earlier blocks of content itself with self, see scan.
+//逐字节 rolling 查找固定长度的块
+func (c *Config) scanBlocks(ctx context.Context, content []byte, hashes []BlockHash, self *selfBlocks, match func(blockHash *BlockHash, start, end int) error, copyBlock func(source, start, end int) error, literal func(start, end int) error) error {
+	blockSize := c.blockSize()
+	stride := c.alignment()
+	matcher := c.newMatcher(hashes)
 
 	//移动下标  前一个匹配块的尾部
 	var offset, previousMatch int
-	//弱hash 3个数值
-	var aweak, bweak, weak uint32
+	//下一次检查取消的位置，已匹配的字节数
+	var nextCheck, matched int
+	//弱hash
+	rolling := c.newRollingHash()
 	//标记
 	var dirty, isRolling bool
+	//上一个窗口匹配的块，没有匹配时为 -1
+	previous := -1
 
 	for offset < len(content) {
+		if offset >= nextCheck {
+			if err := c.checkpoint(ctx, offset, len(content)); err != nil {
+				return err
+			}
+			if err := c.checkBail(offset, matched); err != nil {
+				return err
+			}
+			nextCheck = offset + checkInterval
+		}
 		//一个块的尾部
-		endingByte := min(offset+BlockSize, len(content)-1)
+		endingByte := min(offset+blockSize, len(content))
 		block := content[offset:endingByte]
 		//如果不用rolling
 		if !isRolling {
-			//弱hash的三个值
-			weak, aweak, bweak = weakHash(block)
+			rolling.Init(block)
 			//如果没找到对应的块  下一次进行rolling
 			isRolling = true
 			//如果一直找不到会一直rolling，直到找个能对应的块，两个能对应的块之间都是DATA
+		} else if offset-1+blockSize < len(content) {
+			//rolling操作 窗口整体右移一个字节，计算下一个step 1 的hash值
+			rolling.Roll(content[offset-1], content[endingByte-1])
 		} else {
-			//rolling操作 计算下一个step 1 的hash值
-			aweak = (aweak - uint32(content[offset-1]) + uint32(content[endingByte-1])) % M
-			bweak = (bweak - (uint32(endingByte-offset) * uint32(content[offset-1])) + aweak) % M
-			weak = aweak + (1 << 16 * bweak)
+			//到达数据末尾，窗口收缩一个字节
+			rolling.Shrink(content[offset-1])
+		}
+		//未对齐的位置不查找
+		if stride > 1 && offset%stride != 0 {
+			dirty = true
+			offset++
+			continue
 		}
 		//如果在hashmap中找到了弱hash对应的块， 弱hash找用hashmap
-		if l := hashesMap[weak]; l != nil {
-			//强hash找用遍历
-			blockFound, blockHash := searchStrongHash(l, strongHash(block))
-			//如果从hash块队列中找到了强hash块
-			if blockFound {
-				//如果是DATA
-				if dirty {
-					//将一个数组操作体放入操作管道中
-					opsChannel <- RSyncOp{opCode: DATA, data: content[previousMatch:offset]}
-					dirty = false
-				}
+		weak := rolling.Sum()
+		//先按弱hash找桶，再比较强hash，优先匹配上一个块的下一个块
+		if blockHash := matcher.Match(weak, block, previous); blockHash != nil {
+			//如果是DATA
+			if dirty {
 				//将一个数组操作体放入操作管道中
-				opsChannel <- RSyncOp{opCode: BLOCK, blockIndex: blockHash.index}
-				previousMatch = endingByte
-				// 找到了就不用rolling
-				isRolling = false
-				offset += BlockSize
-				continue
+				if err := literal(previousMatch, offset); err != nil {
+					return err
+				}
+				dirty = false
+			}
+			//将一个数组操作体放入操作管道中
+			if err := match(blockHash, offset, endingByte); err != nil {
+				return err
+			}
+			previousMatch = endingByte
+			matched += endingByte - offset
+			previous = blockHash.index
+			// 找到了就不用rolling
+			isRolling = false
+			offset += blockSize
+			continue
+		}
+		previous = -1
+		//在已扫描的数据中查找
+		if source := self.find(offset, weak); source >= 0 {
+			if dirty {
+				if err := literal(previousMatch, offset); err != nil {
+					return err
+				}
+				dirty = false
+			}
+			if err := copyBlock(source, offset, endingByte); err != nil {
+				return err
 			}
+			previousMatch = endingByte
+			matched += endingByte - offset
+			isRolling = false
+			offset += blockSize
+			continue
 		}
 		//如果找不到弱hash对应的块 将下一轮搜索的块标记为DATA
 		dirty = true
@@ -179,39 +1007,690 @@ func CalculateDifferences(content []byte, hashes []BlockHash, opsChannel chan RS
 		offset++
 	}
 
+	if err := c.checkBail(len(content), matched); err != nil {
+		return err
+	}
 	//如果最后一个块不对应,那么把所有DATA放入
 	if dirty {
-		opsChannel <- RSyncOp{opCode: DATA, data: content[previousMatch:]}
+		if err := literal(previousMatch, len(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrTooManyOps Returned once more than Config.MaxOps operations are computed
+// or applied.
+var ErrTooManyOps = errors.New("rsync: too many operations")
+
+// Wraps emit so it fails with ErrTooManyOps past Config.MaxOps operations.
+//限制操作体的数量
+func (c *Config) limitOps(emit func(RSyncOp) error) func(RSyncOp) error {
+	if c == nil || c.MaxOps <= 0 {
+		return emit
+	}
+	var count int
+	return func(op RSyncOp) error {
+		if err := c.countOp(&count); err != nil {
+			return err
+		}
+		return emit(op)
+	}
+}
+
+// ErrOutputTooLarge Returned when reconstruction would produce more than
+// Config.MaxOutputSize bytes.
+var ErrOutputTooLarge = errors.New("rsync: output too large")
+
+// Checks a size of the modified content against Config.MaxOutputSize.
+//检查组装结果的长度
+func (c *Config) checkOutputSize(size int64) error {
+	if c != nil && c.MaxOutputSize > 0 && size > c.MaxOutputSize {
+		return fmt.Errorf("%w: %d bytes, more than %d", ErrOutputTooLarge, size, c.MaxOutputSize)
+	}
+	return nil
+}
+
+// maxHeaderCapacity Largest buffer preallocated from the length of a HEADER
+// when Config.MaxOutputSize is unset. The length comes from the sender, so
+// longer content grows the buffer as the operations arrive instead.
+//未设置 MaxOutputSize 时按 HEADER 预先分配的最大长度
+const maxHeaderCapacity = 64 << 20
+
+// Returns the capacity to preallocate for the length of a HEADER, already
+// checked against Config.MaxOutputSize.
+func (c *Config) headerCapacity(length int) int {
+	if c != nil && c.MaxOutputSize > 0 {
+		return length
+	}
+	return min(length, maxHeaderCapacity)
+}
+
+// Counts one more operation, failing with ErrTooManyOps past Config.MaxOps.
+func (c *Config) countOp(count *int) error {
+	*count++
+	if c != nil && c.MaxOps > 0 && *count > c.MaxOps {
+		return fmt.Errorf("%w: more than %d", ErrTooManyOps, c.MaxOps)
+	}
+	return nil
+}
+
+// maxPooledData Largest DATA buffer kept in dataPool for reuse.
+//归还到缓冲池的最大缓冲区
+const maxPooledData = 1 << 20
+
+// dataPool Buffers holding copies of DATA payloads, see Config.CopyData.
+//DATA 数据的缓冲池
+var dataPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// Wraps emit so DATA operations carry a pooled copy of their payload instead
+// of sharing memory with the scanned content.
+//DATA 数据复制到缓冲池的缓冲区中
+func copyDataEmit(emit func(RSyncOp) error) func(RSyncOp) error {
+	return func(op RSyncOp) error {
+		if op.opCode == DATA {
+			buf := dataPool.Get().(*[]byte)
+			op.data = append((*buf)[:0], op.data...)
+			op.pooled = true
+		}
+		return emit(op)
+	}
+}
+
+// Release Returns the payload of a DATA operation computed with
+// Config.CopyData to a pool, so later differences can reuse it. The operation
+// must not be used afterwards. It does nothing for other operations.
+//归还 DATA 数据的缓冲区
+func (op *RSyncOp) Release() {
+	if !op.pooled {
+		return
+	}
+	if cap(op.data) <= maxPooledData {
+		data := op.data[:0]
+		dataPool.Put(&data)
+	}
+	op.data = nil
+	op.pooled = false
+}
+
+// blockRuns Merges consecutive BLOCK operations into BLOCKRUN operations,
+// and COPY operations of consecutive bytes into one, and splits DATA
+// operations longer than maxData before passing them to emit.
+// BLOCK operations passed to add carry the matched bytes in data, which are
+// only used to absorb runs shorter than minMatch into the surrounding DATA.
+//合并连续的块，拆分过长的DATA
+type blockRuns struct {
+	emit func(RSyncOp) error
+	//尚未发送的连续块，blockCount 为 0 表示没有
+	run RSyncOp
+	//DATA 的最大长度，<= 0 表示不限制
+	maxData int
+	//前后都是 DATA 且短于 minMatch 字节的连续块并入 DATA，<= 0 表示不合并
+	minMatch int
+	//minMatch > 0 时尚未发送的 DATA
+	literal []byte
+	//run 覆盖的字节数，以及前 minMatch 个字节
+	runLen  int
+	runData []byte
+	//run 之前紧接着已经发送的 DATA
+	afterData bool
+	//尚未发送的 COPY，length 为 0 表示没有
+	copy RSyncOp
+}
+
+// Returns a blockRuns passing operations to emit with the configured
+// MaxDataOp and MinMatch.
+func (c *Config) newBlockRuns(emit func(RSyncOp) error) *blockRuns {
+	runs := &blockRuns{emit: emit}
+	if c != nil {
+		runs.maxData = c.MaxDataOp
+		runs.minMatch = c.MinMatch
+	}
+	return runs
+}
+
+// Adds the next operation, holding BLOCK operations back until the run ends.
+// With minMatch, DATA operations are held back too until the next run is long
+// enough to be kept.
+func (r *blockRuns) add(op RSyncOp) error {
+	if op.opCode == COPY {
+		if r.copy.length > 0 && op.offset == r.copy.offset+r.copy.length {
+			r.copy.length += op.length
+			return nil
+		}
+		if err := r.flush(); err != nil {
+			return err
+		}
+		r.copy = op
+		return nil
+	}
+	//COPY 之后的操作，先发送 COPY
+	if r.copy.length > 0 {
+		if err := r.flushCopy(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case op.opCode == BLOCK && r.run.blockCount > 0 && op.basis == r.run.basis && op.blockIndex == r.run.blockIndex+r.run.blockCount:
+		r.run.blockCount++
+		r.cover(op.data)
+		return nil
+	case op.opCode == BLOCK:
+		//前一个 run 后面紧接着块，不能并入 DATA
+		if r.run.blockCount > 0 {
+			if err := r.flush(); err != nil {
+				return err
+			}
+		}
+		r.run = RSyncOp{opCode: BLOCKRUN, blockIndex: op.blockIndex, blockCount: 1, basis: op.basis}
+		r.runLen, r.runData = 0, r.runData[:0]
+		r.cover(op.data)
+		return nil
+	case op.opCode == DATA && r.minMatch > 0:
+		if r.run.blockCount > 0 {
+			if r.runLen < r.minMatch && (len(r.literal) > 0 || r.afterData) {
+				//过短的 run 并入前后的 DATA
+				r.literal = append(r.literal, r.runData...)
+				r.run = RSyncOp{}
+			} else if err := r.flush(); err != nil {
+				return err
+			}
+		}
+		r.literal = append(r.literal, op.data...)
+		//限制缓存的 DATA 长度
+		if len(r.literal) >= streamBufferSize {
+			if err := r.emitData(r.literal); err != nil {
+				return err
+			}
+			r.literal = nil
+			r.afterData = true
+		}
+		return nil
+	}
+	if err := r.flush(); err != nil {
+		return err
+	}
+	if op.opCode == DATA {
+		return r.emitData(op.data)
+	}
+	return r.emit(op)
+}
+
+// Records the bytes of a block added to the pending run.
+func (r *blockRuns) cover(block []byte) {
+	r.runLen += len(block)
+	if len(r.runData) < r.minMatch {
+		r.runData = append(r.runData, block...)
+	}
+}
+
+// Sends data as DATA operations of at most maxData bytes.
+func (r *blockRuns) emitData(data []byte) error {
+	if r.maxData > 0 {
+		for len(data) > r.maxData {
+			if err := r.emit(RSyncOp{opCode: DATA, data: data[:r.maxData]}); err != nil {
+				return err
+			}
+			data = data[r.maxData:]
+		}
+	}
+	return r.emit(RSyncOp{opCode: DATA, data: data})
+}
+
+// Sends the pending DATA and run, the run as a single BLOCK operation if it
+// has only one block.
+func (r *blockRuns) flush() error {
+	if len(r.literal) > 0 {
+		//发送后的数据属于操作体，不再复用
+		if err := r.emitData(r.literal); err != nil {
+			return err
+		}
+		r.literal = nil
+	}
+	r.afterData = false
+	if r.copy.length > 0 {
+		return r.flushCopy()
+	}
+	run := r.run
+	r.run = RSyncOp{}
+	switch {
+	case run.blockCount == 0:
+		return nil
+	case run.blockCount == 1:
+		return r.emit(RSyncOp{opCode: BLOCK, blockIndex: run.blockIndex, basis: run.basis})
+	default:
+		return r.emit(run)
+	}
+}
+
+// Sends the pending COPY operation.
+func (r *blockRuns) flushCopy() error {
+	op := r.copy
+	r.copy = RSyncOp{}
+	return r.emit(op)
+}
+
+// selfBlocks The blocks of the modified content scanned so far, at multiples
+// of the block size, for Config.SelfCopy.
+//SelfCopy 时已扫描数据中的块
+type selfBlocks struct {
+	config    *Config
+	content   []byte
+	blockSize int
+	//弱hash -> 块的起点
+	hashes map[uint32][]int
+	//下一个加入的块的起点
+	next int
+}
+
+// Returns the blocks of content, none of which is indexed yet.
+func (c *Config) newSelfBlocks(content []byte) *selfBlocks {
+	return &selfBlocks{config: c, content: content, blockSize: c.blockSize(), hashes: make(map[uint32][]int)}
+}
+
+// Returns the start of a block ending before offset holding the same bytes as
+// the block at offset, of weak hash weak, or -1. Short blocks never match.
+//查找 offset 之前与 offset 处的块相同的块
+func (s *selfBlocks) find(offset int, weak uint32) int {
+	if s == nil || offset+s.blockSize > len(s.content) {
+		return -1
+	}
+	for ; s.next+s.blockSize <= offset; s.next += s.blockSize {
+		key := s.config.weakHash(s.content[s.next : s.next+s.blockSize])
+		s.hashes[key] = append(s.hashes[key], s.next)
+	}
+	block := s.content[offset : offset+s.blockSize]
+	for _, start := range s.hashes[weak] {
+		if bytes.Equal(s.content[start:start+s.blockSize], block) {
+			return start
+		}
 	}
+	return -1
+}
+
+// Groups block hashes into buckets keyed by weak hash.
+//构建一个哈希map，<弱hash，哈希块列表>
+func buildHashesMap(hashes []BlockHash) map[uint32][]BlockHash {
+	hashesMap := make(map[uint32][]BlockHash)
+	//遍历每个哈希块数组
+	for _, h := range hashes {
+		key := h.weakHash
+		//用弱hash做key，值为哈希块
+		hashesMap[key] = append(hashesMap[key], h)
+	}
+	return hashesMap
+}
+
+// defaultMaxBucketDepth Bucket depth past which buckets are indexed by strong
+// hash when Config.MaxBucketDepth is not set.
+//默认的桶深度上限
+const defaultMaxBucketDepth = 16
+
+// blockIndex The blocks of a signature grouped into buckets by weak hash, as
+// returned by buildHashesMap, with the buckets deeper than the configured
+// maximum also indexed by strong hash, so a window hitting one costs a map
+// lookup instead of a comparison with every block of the bucket.
+//按弱hash分桶的块，过深的桶再按强hash索引
+type blockIndex struct {
+	//Config.Matcher 返回的自定义实现，其余字段为空
+	custom  Matcher
+	config  *Config
+	hashes  []BlockHash
+	buckets map[uint32][]BlockHash
+	//强hash -> 桶中第一个有这个强hash的块
+	deep map[uint32]map[string]*BlockHash
+}
+
+// Returns the index of hashes, with buckets deeper than Config.MaxBucketDepth
+// indexed by strong hash, unless SkipStrongHash leaves nothing to index.
+//构建块索引
+func (c *Config) newBlockIndex(hashes []BlockHash) *blockIndex {
+	index := &blockIndex{config: c, hashes: hashes, buckets: buildHashesMap(hashes)}
+	if c != nil && c.SkipStrongHash {
+		return index
+	}
+	maxDepth := defaultMaxBucketDepth
+	if c != nil && c.MaxBucketDepth > 0 {
+		maxDepth = c.MaxBucketDepth
+	}
+	for weak, l := range index.buckets {
+		if len(l) <= maxDepth {
+			continue
+		}
+		strong := make(map[string]*BlockHash, len(l))
+		for i := range l {
+			//与逐个比较一样，相同的强hash取第一个块
+			if key := string(l[i].strongHash); strong[key] == nil {
+				strong[key] = &l[i]
+			}
+		}
+		if index.deep == nil {
+			index.deep = make(map[uint32]map[string]*BlockHash)
+		}
+		index.deep[weak] = strong
+	}
+	return index
+}
+
+// Returns the block of the bucket l of weak equal to block like matchBucket,
+// with a single lookup when the bucket is indexed by strong hash.
+//在桶中查找与 block 相同的块，过深的桶按强hash查找
+func (c *Config) matchIndexed(x *blockIndex, weak uint32, l []BlockHash, block []byte) (bool, *BlockHash) {
+	if strong := x.deep[weak]; strong != nil {
+		blockHash := strong[string(c.strongHash(block))]
+		return blockHash != nil, blockHash
+	}
+	return c.matchBucket(l, block)
 }
 
 // Searches for a given strong hash among all strong hashes in this bucket.
 //从hash块队列中遍历每个块的强hash值  一一比对
+// The returned pointer references the element of l itself.
 func searchStrongHash(l []BlockHash, hashValue []byte) (bool, *BlockHash) {
-	for _, blockHash := range l {
-		if string(blockHash.strongHash) == string(hashValue) {
-			return true, &blockHash
+	for i := range l {
+		//长度不同的强hash不可能相同
+		if len(l[i].strongHash) == len(hashValue) && bytes.Equal(l[i].strongHash, hashValue) {
+			return true, &l[i]
 		}
 	}
 	return false, nil
 }
 
-// Returns a strong hash for a given block of data
-func strongHash(v []byte) []byte {
-	h := md5.New()
+// Returns the block of the bucket l equal to block, comparing strong hashes
+// unless SkipStrongHash is set, in which case the first block of the same
+// length is taken on trust.
+//在桶中查找与 block 相同的块
+func (c *Config) matchBucket(l []BlockHash, block []byte) (bool, *BlockHash) {
+	if c == nil || !c.SkipStrongHash {
+		return searchStrongHash(l, c.strongHash(block))
+	}
+	for i := range l {
+		//长度未知（版本 1 的签名）时也接受
+		if l[i].length == len(block) || l[i].length == 0 {
+			return true, &l[i]
+		}
+	}
+	return false, nil
+}
+
+// Returns the block following previous, the index of the block matched right
+// before block, when it matches block too, or nil. Checked before the bucket
+// of weak so a run of blocks goes on even when the bucket holds other blocks
+// with the same bytes, as in repetitive content, and the run collapses into a
+// single BLOCKRUN. previous is -1 when the bytes before block did not match.
+//优先匹配上一个匹配块的下一个块，使连续的块合并为一个 BLOCKRUN
+func (c *Config) followingBlock(hashes []BlockHash, previous int, weak uint32, block []byte) *BlockHash {
+	next := previous + 1
+	//去重后的签名中下标与位置不一致，不做优先匹配
+	if previous < 0 || next >= len(hashes) || hashes[next].index != next || hashes[next].weakHash != weak {
+		return nil
+	}
+	if found, blockHash := c.matchBucket(hashes[next:next+1], block); found {
+		return blockHash
+	}
+	return nil
+}
+
+// Returns the configured strong hash for a given block of data,
+// truncated to StrongHashSize bytes, or nil with SkipStrongHash.
+//强hash
+func (c *Config) strongHash(v []byte) []byte {
+	if c != nil && c.SkipStrongHash {
+		return nil
+	}
+	h := c.newStrongHash()
 	h.Write(v)
-	return h.Sum(nil)
+	sum := h.Sum(nil)
+	if c != nil && c.StrongHashLen > 0 && c.StrongHashLen < len(sum) {
+		sum = sum[:c.StrongHashLen]
+	}
+	return sum
 }
 
-// Returns a weak hash for a given block of data.
+// Returns a weak hash for a given block of data, with the default modulus M,
+// along with its two sums.
 //弱hash
 func weakHash(v []byte) (uint32, uint32, uint32) {
-	var a, b uint32
-	for i := range v {
-		a += uint32(v[i])
-		b += (uint32(len(v)-1) - uint32(i) + 1) * uint32(v[i])
+	a, b := weakSums(v, M)
+	return composeWeakHash(a, b, M), uint32(a), uint32(b)
+}
+
+// WeakHashKind Which weak hash groups blocks into buckets.
+//弱hash的种类
+type WeakHashKind int
+
+const (
+	// RollingWeakHash 可以逐字节滚动的弱hash，模数见 Config.WeakModulus
+	RollingWeakHash WeakHashKind = iota
+	// FNVWeakHash 32 位的 FNV-1a。
+	// It spreads blocks over buckets more evenly than the rolling hash, so
+	// fewer candidates need a strong hash, but it cannot roll: it is only
+	// accepted with ContentDefinedChunking or LineChunking, where blocks are
+	// looked up whole.
+	FNVWeakHash
+)
+
+// String Returns the name of the weak hash recorded in signatures.
+func (k WeakHashKind) String() string {
+	switch k {
+	case RollingWeakHash:
+		return "rolling"
+	case FNVWeakHash:
+		return "fnv-1a"
+	default:
+		return fmt.Sprintf("WeakHashKind(%d)", int(k))
 	}
-	return (a % M) + (1 << 16 * (b % M)), a % M, b % M
+}
+
+// Returns the configured weak hash.
+func (c *Config) weakHashKind() WeakHashKind {
+	if c == nil {
+		return RollingWeakHash
+	}
+	return c.WeakHash
+}
+
+// Returns the weak hash of block with the configured weak hash and modulus.
+func (c *Config) weakHash(block []byte) uint32 {
+	if c.weakHashKind() == FNVWeakHash {
+		//FNV-1a 的初始值和质数
+		h := uint32(2166136261)
+		for _, v := range block {
+			h ^= uint32(v)
+			h *= 16777619
+		}
+		return h
+	}
+	r := c.newRollingHash()
+	r.Init(block)
+	return r.Sum()
+}
+
+// Returns the two sums of the weak hash of v modulo m:
+// a = sum(v[i]) and b = sum((len(v)-i) * v[i]).
+// b is accumulated as the sum of the successive values of a, as in Adler-32,
+// which counts every byte len(v)-i times without a multiplication.
+//弱hash的两个和，b 累加每一步的 a
+func weakSums(v []byte, m uint64) (a, b uint64) {
+	for offset := 0; offset < len(v); {
+		//每 1024 个字节取一次模，中间值不会溢出
+		end := min(offset+1024, len(v))
+		for _, c := range v[offset:end] {
+			a += uint64(c)
+			b += a
+		}
+		a, b = a%m, b%m
+		offset = end
+	}
+	return a, b
+}
+
+// Combines the two sums of a weak hash modulo m into 32 bits. When both fit
+// in 16 bits b is shifted above a, which gives a + (1<<16 * b) for M;
+// larger sums are folded together, a XOR b rotated by 16 bits, so they overlap.
+//组合弱hash的两个和
+func composeWeakHash(a, b, m uint64) uint32 {
+	if m == M {
+		return uint32(a | b<<16)
+	}
+	width := bits.Len64(m - 1)
+	if width <= 16 {
+		return uint32(a | b<<width)
+	}
+	return uint32(a) ^ bits.RotateLeft32(uint32(b), 16)
+}
+
+// RollingHash The weak hash of a window sliding over some content, updated in
+// constant time as bytes leave and enter the window. Sum always equals the
+// weak hash of the current window.
+// The zero value uses the default modulus M.
+//可以 rolling 的弱hash
+type RollingHash struct {
+	a, b   uint64
+	length int
+	//取模的数，0 表示 M
+	modulus uint64
+}
+
+// NewRollingHash Returns a RollingHash computing its sums modulo modulus,
+// see Config.WeakModulus.
+//创建指定模数的 rolling hash
+func NewRollingHash(modulus uint64) *RollingHash {
+	return &RollingHash{modulus: modulus}
+}
+
+// Returns a RollingHash with the configured modulus.
+func (c *Config) newRollingHash() RollingHash {
+	return RollingHash{modulus: c.weakModulus()}
+}
+
+// Returns the modulus of the sums.
+func (r *RollingHash) mod() uint64 {
+	if r.modulus == 0 {
+		return M
+	}
+	return r.modulus
+}
+
+// Init Starts the window at block.
+//以 block 作为初始窗口
+func (r *RollingHash) Init(block []byte) {
+	r.a, r.b = weakSums(block, r.mod())
+	r.length = len(block)
+}
+
+// Roll Moves the window one byte forward: out leaves the window on the left
+// and in enters it on the right.
+// With the weak hash defined as a = sum(v[i]) and b = sum((length-i) * v[i]),
+// dropping v[0] removes out from a and length*out from b, and every remaining
+// byte gains one unit of weight in b, which adds the new a once more.
+// Every subtraction first adds the modulus so intermediates never wrap around
+// below zero, except for powers of two where wrapping leaves the low bits
+// right.
+//rolling：窗口右移一个字节，a' = a - out + in，b' = b - length*out + a'
+func (r *RollingHash) Roll(out, in byte) {
+	m := r.mod()
+	//模数为 2 的幂时，回绕不影响低位，直接取掩码
+	if m&(m-1) == 0 {
+		r.a = (r.a - uint64(out) + uint64(in)) & (m - 1)
+		r.b = (r.b - uint64(r.length)*uint64(out) + r.a) & (m - 1)
+		return
+	}
+	r.a = (r.a + m - uint64(out)%m + uint64(in)%m) % m
+	r.b = (r.b + m - weightedByte(r.length, out, m) + r.a) % m
+}
+
+// Shrink Removes the first byte out of the window, as happens when the window
+// reaches the end of the content.
+//窗口收缩：a' = a - out，b' = b - length*out
+func (r *RollingHash) Shrink(out byte) {
+	m := r.mod()
+	r.a = (r.a + m - uint64(out)%m) % m
+	r.b = (r.b + m - weightedByte(r.length, out, m)) % m
+	r.length--
+}
+
+// Sum Returns the weak hash of the current window.
+func (r *RollingHash) Sum() uint32 {
+	return composeWeakHash(r.a, r.b, r.mod())
+}
+
+// RollingHashError The first window of some content where the rolling weak
+// hash, or the weak hash of a signature block, differs from the weak hash of
+// the window computed directly, as reported by VerifyRollingHash.
+//rolling 计算的弱hash与直接计算的结果不一致
+type RollingHashError struct {
+	// Offset 窗口在数据中的起点
+	Offset int
+	// Found 滚动计算或签名中的弱hash
+	Found uint32
+	// Expected 直接计算的弱hash
+	Expected uint32
+	// Signature 为 true 时 Found 来自签名
+	Signature bool
+}
+
+func (e *RollingHashError) Error() string {
+	source := "rolling"
+	if e.Signature {
+		source = "signature"
+	}
+	return fmt.Sprintf("rsync: %s weak hash %#08x at offset %d differs from the direct weak hash %#08x", source, e.Found, e.Offset, e.Expected)
+}
+
+// VerifyRollingHash Self-test of the weak hash, with the given block size:
+// rolls it over every window of content exactly as CalculateDifferences does,
+// growing, rolling and shrinking at the end, and checks every value, along
+// with the weak hashes computed by CalculateBlockHashes for aligned windows,
+// against the weak hash of the window computed from scratch. Returns a
+// *RollingHashError for the first window that differs, or nil. It costs
+// blockSize times more than a scan and is meant for tests and debugging.
+//自检：逐个窗口比较 rolling 计算的弱hash和直接计算的结果
+func VerifyRollingHash(content []byte, blockSize int) error {
+	config := &Config{BlockSize: blockSize}
+	return config.VerifyRollingHash(content)
+}
+
+// VerifyRollingHash Checks the rolling weak hash of every window of content
+// against the configured weak hash computed directly.
+func (c *Config) VerifyRollingHash(content []byte) error {
+	if kind := c.weakHashKind(); kind != RollingWeakHash {
+		return fmt.Errorf("rsync: weak hash %v does not roll", kind)
+	}
+	if c.chunking() != FixedChunking {
+		return errors.New("rsync: variable length blocks do not roll")
+	}
+	//签名不去重，块下标与位置一致
+	plain := Config{BlockSize: c.blockSize(), WeakModulus: c.weakModulus()}
+	hashes := plain.CalculateBlockHashes(content)
+	blockSize := plain.blockSize()
+	rolling := plain.newRollingHash()
+	for offset := 0; offset < len(content); offset++ {
+		endingByte := min(offset+blockSize, len(content))
+		switch {
+		case offset == 0:
+			rolling.Init(content[:endingByte])
+		case offset-1+blockSize < len(content):
+			rolling.Roll(content[offset-1], content[endingByte-1])
+		default:
+			rolling.Shrink(content[offset-1])
+		}
+		expected := plain.weakHash(content[offset:endingByte])
+		if found := rolling.Sum(); found != expected {
+			return &RollingHashError{Offset: offset, Found: found, Expected: expected}
+		}
+		if offset%blockSize == 0 {
+			if found := hashes[offset/blockSize].weakHash; found != expected {
+				return &RollingHashError{Offset: offset, Found: found, Expected: expected, Signature: true}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns length*v modulo m, computed without overflowing.
+func weightedByte(length int, v byte, m uint64) uint64 {
+	return uint64(length) % m * uint64(v) % m
 }
 
 // Returns the smaller of a or b.
@@ -7,8 +7,21 @@
 package rsync
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
+	"math/bits"
+	"math/rand"
+	"os"
+	"reflect"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 import "io/ioutil"
 
@@ -34,7 +47,10 @@ func Test_SyncModifiedContent(t *testing.T) {
 		go CalculateDifferences(modified, hashes, opsChannel)
 
 		//从通道取数据块
-		result := ApplyOps(original, opsChannel, len(modified))
+		result, err := ApplyOps(original, opsChannel, len(modified))
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		fmt.Println(result)
 		fmt.Println(modified)
@@ -57,6 +73,37 @@ func Test_WeakHash(t *testing.T) {
 	assertHash(t, "b", content, expectedB, b)
 }
 
+// Returns the two sums of the weak hash of v modulo m as defined, with a
+// multiplication per byte, to check the incremental weakSums against.
+func referenceWeakSums(v []byte, m uint64) (a, b uint64) {
+	for i := range v {
+		a = (a + uint64(v[i])) % m
+		b = (b + uint64(len(v)-i)*uint64(v[i])) % m
+	}
+	return a, b
+}
+
+func Test_WeakSums(t *testing.T) {
+	//全是 0xff 的数据让中间值尽快增大
+	contents := [][]byte{nil, {7}, randomContent(5000, 51), bytes.Repeat([]byte{0xff}, 70000)}
+	for _, content := range contents {
+		for _, m := range []uint64{2, 251, M, 1 << 32} {
+			a, b := weakSums(content, m)
+			if expectedA, expectedB := referenceWeakSums(content, m); a != expectedA || b != expectedB {
+				t.Errorf("%d bytes modulo %d: expected sums %d and %d, found %d and %d", len(content), m, expectedA, expectedB, a, b)
+			}
+		}
+	}
+}
+
+func Benchmark_WeakSums(b *testing.B) {
+	block := randomContent(4096, 52)
+	b.SetBytes(int64(len(block)))
+	for i := 0; i < b.N; i++ {
+		weakSums(block, M)
+	}
+}
+
 func Test_Result(t *testing.T) {
 	//文件队列表
 	files := []filePair{filePair{"text-original.txt", "text-modified.txt"}}
@@ -83,7 +130,10 @@ func Test_Result(t *testing.T) {
 
 		//接收方将通道返回，发送方根据接收方的通道将文件重新组装
 		//其中data是文件的修改部分，block以index的形式复原
-		result := ApplyOps(original, opsChannel, len(modified))
+		result, err := ApplyOps(original, opsChannel, len(modified))
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		fmt.Println(result, modified)
 		//fmt.Println()
@@ -99,3 +149,1807 @@ func assertHash(t *testing.T, name string, content []byte, expected uint32, foun
 		t.Errorf("Incorrent "+name+" hash for %v - Expected %d - Found %d", content, expected, found)
 	}
 }
+
+func Test_SyncConfiguredBlockSize(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+	modified, _ := ioutil.ReadFile("test-data/golang-modified.bmp")
+
+	for _, blockSize := range []int{1, 3, 6, 1024, 4096} {
+		config := &Config{BlockSize: blockSize}
+		hashes := config.CalculateBlockHashes(original)
+		opsChannel := make(chan RSyncOp)
+		go config.CalculateDifferences(modified, hashes, opsChannel)
+
+		result, err := config.ApplyOps(original, opsChannel, len(modified))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != string(modified) {
+			t.Errorf("rsync did not work as expected with block size %d", blockSize)
+		}
+	}
+}
+
+func Test_NewDefaultConfig(t *testing.T) {
+	config := NewDefaultConfig()
+	if config.BlockSize != 4096 || config.blockSize() != (&Config{}).blockSize() || config.weakModulus() != M || config.strongHashName() != "md5" {
+		t.Errorf("unexpected defaults %+v", config)
+	}
+	//包级函数与零值配置使用同样的默认值
+	content := randomContent(10000, 4)
+	if hashes := CalculateBlockHashes(content); len(hashes) != 3 || !reflect.DeepEqual(hashes, config.CalculateBlockHashes(content)) || !reflect.DeepEqual(hashes, (&Config{}).CalculateBlockHashes(content)) {
+		t.Errorf("expected 3 blocks of the default size, found %d", len(hashes))
+	}
+	//可以覆盖默认值
+	config.BlockSize = 1000
+	if hashes := config.CalculateBlockHashes(content); len(hashes) != 10 {
+		t.Errorf("expected 10 blocks, found %d", len(hashes))
+	}
+}
+
+func Test_EditRoundTrip(t *testing.T) {
+	original := randomContent(5000, 21)
+	cases := map[string][]contentEdit{
+		"unchanged":            nil,
+		"insert at 0":          {insertAt(0, "x")},
+		"insert at end":        {insertAt(len(original), "x")},
+		"insert in the middle": {insertAt(2500, "inserted text")},
+		"delete at 0":          {deleteAt(0, 1)},
+		"delete at end":        {deleteAt(len(original)-1, 1)},
+		"delete a block":       {deleteAt(1024, 512)},
+		"replace at 0":         {replaceAt(0, "y")},
+		"replace at end":       {replaceAt(len(original)-3, "end")},
+		"several edits":        {insertAt(10, "a"), deleteAt(700, 30), replaceAt(3000, "bcd"), insertAt(4999, "e")},
+		"delete everything":    {deleteAt(0, len(original))},
+		"replace everything":   {{offset: 0, remove: len(original), insert: randomContent(100, 22)}},
+	}
+	configs := []*Config{{BlockSize: 1}, {BlockSize: 16}, {BlockSize: 512}, {BlockSize: 8192}, {BlockSize: 64, Chunking: ContentDefinedChunking}}
+
+	for name, edits := range cases {
+		modified := editContent(original, edits...)
+		for _, config := range configs {
+			result, err := config.Patch(original, config.Diff(original, modified))
+			if err != nil || !bytes.Equal(result, modified) {
+				t.Errorf("%s with %+v: Diff and Patch did not work as expected: %v", name, config, err)
+			}
+
+			var stats Stats
+			opsChannel := make(chan RSyncOp)
+			go config.CalculateDifferencesStats(context.Background(), modified, config.CalculateBlockHashes(original), opsChannel, &stats)
+			if result, err := config.ApplyOps(original, opsChannel, len(modified)); err != nil || !bytes.Equal(result, modified) {
+				t.Errorf("%s with %+v: ApplyOps did not work as expected: %v", name, config, err)
+			}
+			//固定长度的块只重发编辑附近的数据
+			if config.Chunking == FixedChunking && config.BlockSize < len(original)/4 {
+				var limit int64
+				for _, e := range edits {
+					limit += int64(len(e.insert) + 2*config.BlockSize)
+				}
+				if stats.LiteralBytes > limit {
+					t.Errorf("%s with %+v: expected at most %d literal bytes, found %d", name, config, limit, stats.LiteralBytes)
+				}
+			}
+		}
+	}
+}
+
+// Waits for the number of goroutines to drop to at most n, failing the test
+// if it does not.
+func checkGoroutines(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; runtime.NumGoroutine() > n; i++ {
+		if i == 100 {
+			t.Fatalf("expected at most %d goroutines, found %d", n, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_StartDifferences(t *testing.T) {
+	original := randomContent(1<<20, 33)
+	modified := modifiedContent(original, 50, 34)
+	config := &Config{BlockSize: 64}
+	hashes := config.CalculateBlockHashes(original)
+	before := runtime.NumGoroutine()
+
+	//完整接收
+	stream := config.StartDifferences(context.Background(), modified, hashes)
+	result, err := config.ApplyOps(original, stream.Ops(), len(modified))
+	if err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("sync through a stream did not work as expected: %v", err)
+	}
+	if err := stream.Close(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	//只接收两个操作体就放弃，协程也会退出
+	for i := 0; i < 100; i++ {
+		stream := config.StartDifferences(context.Background(), modified, hashes)
+		<-stream.Ops()
+		<-stream.Ops()
+		if err := stream.Close(); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		stream.Close()
+	}
+	checkGoroutines(t, before)
+
+	//签名不匹配的错误与调用方的取消照常返回
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, stream := range map[string]*OpStream{
+		"signature": (&Config{BlockSize: 32}).StartDifferences(context.Background(), modified, hashes),
+		"canceled":  config.StartDifferences(ctx, modified, hashes),
+	} {
+		if err := stream.Close(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	checkGoroutines(t, before)
+}
+
+func Test_Header(t *testing.T) {
+	original := randomContent(1<<20, 42)
+	modified := modifiedContent(original, 5, 43)
+	config := &Config{BlockSize: 256, Header: true}
+	hashes := config.CalculateBlockHashes(original)
+	header := RSyncOp{opCode: HEADER, length: len(modified), blockSize: 256, hash: "md5"}
+
+	ops := config.Diff(original, modified)
+	if !reflect.DeepEqual(ops[0], header) {
+		t.Errorf("expected %v first, found %v", header, ops[0])
+	}
+	var parallel []RSyncOp
+	config.calculateDifferencesParallel(context.Background(), modified, hashes, func(op RSyncOp) error {
+		parallel = append(parallel, op)
+		return nil
+	}, 4)
+	if !reflect.DeepEqual(parallel, ops) {
+		t.Errorf("expected the parallel operations to start with the header too")
+	}
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateSignatureDifferences(context.Background(), original, config.CalculateSignature(original), opsChannel)
+	if identical := drainedOps(opsChannel); len(identical) != 2 || identical[0].length != len(original) || identical[1].opCode != IDENTICAL {
+		t.Errorf("expected a header and IDENTICAL, found %v", identical)
+	}
+
+	//不需要传入文件大小
+	for _, fileSize := range []int{-1, len(modified)} {
+		if result, err := config.ApplyOps(original, opsChannelOf(ops...), fileSize); err != nil || !bytes.Equal(result, modified) {
+			t.Errorf("file size %d: ApplyOps did not work as expected: %v", fileSize, err)
+		}
+	}
+	var wire, result bytes.Buffer
+	if err := config.WriteOps(&wire, opsChannelOf(ops...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(decodeOps(t, wire.Bytes())...), &result); err != nil || !bytes.Equal(result.Bytes(), modified) {
+		t.Errorf("ApplyOpsAt did not work as expected: %v", err)
+	}
+	if result, err := config.Patch(original, ops); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("Patch did not work as expected: %v", err)
+	}
+
+	//没有 HEADER 时仍然需要文件大小
+	if _, err := ApplyOps(original, opsChannelOf(ops[1:]...), -1); err == nil {
+		t.Errorf("expected an error without a header or file size")
+	}
+	other := &Config{BlockSize: 512}
+	misplaced := append(append([]RSyncOp(nil), ops[1:]...), header)
+	for name, apply := range map[string]func([]RSyncOp) error{
+		"ApplyOps": func(ops []RSyncOp) error {
+			_, err := other.ApplyOps(original, opsChannelOf(ops...), -1)
+			return err
+		},
+		"ApplyOpsAt": func(ops []RSyncOp) error {
+			return other.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(ops...), io.Discard)
+		},
+		"ApplyOpsWriter": func(ops []RSyncOp) error {
+			return other.ApplyOpsWriter(original, opsChannelOf(ops...), io.Discard)
+		},
+		"Patch": func(ops []RSyncOp) error {
+			_, err := other.Patch(original, ops)
+			return err
+		},
+	} {
+		if err := apply(ops); err == nil {
+			t.Errorf("%s: expected an error for a header with another block size", name)
+		}
+		other.BlockSize = 256
+		if err := apply(misplaced); err == nil {
+			t.Errorf("%s: expected an error for a header after the first operation", name)
+		}
+		other.BlockSize = 512
+	}
+	if _, err := config.ApplyOps(original, opsChannelOf(ops...), len(modified)+1); err == nil {
+		t.Errorf("expected an error for a file size differing from the header")
+	}
+}
+
+func Test_DifferencesTrailingByte(t *testing.T) {
+	config := &Config{BlockSize: 4}
+	//两个完整的块加上一个多余的字节
+	content := []byte("abcdefgh!")
+	hashes := config.CalculateBlockHashes(content)
+
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(content, hashes, opsChannel)
+
+	var ops []RSyncOp
+	for op := range opsChannel {
+		ops = append(ops, op)
+	}
+	//三个连续的块合并为一个 BLOCKRUN
+	expected := []RSyncOp{{opCode: BLOCKRUN, blockIndex: 0, blockCount: 3}}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %+v, found %+v", expected, ops)
+	}
+}
+
+func Test_ApplyOpsPartialFinalBlock(t *testing.T) {
+	config := &Config{BlockSize: 4}
+	//最后一个块只有两个字节
+	original := []byte("abcdefghij")
+	modified := []byte("xyij-abcdefghij")
+	hashes := config.CalculateBlockHashes(original)
+
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, hashes, opsChannel)
+
+	result, err := config.ApplyOps(original, opsChannel, len(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != string(modified) {
+		t.Errorf("expected %q, found %q", modified, result)
+	}
+}
+
+func Test_ApplyOpsMalformed(t *testing.T) {
+	original := []byte("abcdefghij")
+	cases := []struct {
+		name     string
+		ops      []RSyncOp
+		fileSize int
+	}{
+		{"block index past content", []RSyncOp{{opCode: BLOCK, blockIndex: 5}}, 2},
+		{"negative block index", []RSyncOp{{opCode: BLOCK, blockIndex: -1}}, 2},
+		{"file size too small", []RSyncOp{{opCode: BLOCK, blockIndex: 0}, {opCode: DATA, data: []byte("xyz")}}, 3},
+		{"file size too large", []RSyncOp{{opCode: DATA, data: []byte("xyz")}}, 4},
+		{"negative file size", []RSyncOp{{opCode: DATA, data: []byte("xyz")}}, -1},
+		{"unknown op code", []RSyncOp{{opCode: 42}}, 0},
+	}
+
+	for _, c := range cases {
+		opsChannel := make(chan RSyncOp)
+		go func(ops []RSyncOp) {
+			defer close(opsChannel)
+			for _, op := range ops {
+				opsChannel <- op
+			}
+		}(c.ops)
+
+		if _, err := (&Config{BlockSize: 2}).ApplyOps(original, opsChannel, c.fileSize); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+}
+
+func Test_ConfiguredStrongHash(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/text-original.txt")
+	modified, _ := ioutil.ReadFile("test-data/text-modified.txt")
+
+	config := &Config{BlockSize: 3, StrongHash: sha256.New}
+	if size := config.StrongHashSize(); size != sha256.Size {
+		t.Errorf("expected strong hash size %d, found %d", sha256.Size, size)
+	}
+	if size := (&Config{}).StrongHashSize(); size != md5.Size {
+		t.Errorf("expected default strong hash size %d, found %d", md5.Size, size)
+	}
+
+	hashes := config.CalculateBlockHashes(original)
+	for _, h := range hashes {
+		if len(h.strongHash) != sha256.Size {
+			t.Fatalf("expected %d bytes of strong hash, found %d", sha256.Size, len(h.strongHash))
+		}
+	}
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, hashes, opsChannel)
+	result, err := config.ApplyOps(original, opsChannel, len(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != string(modified) {
+		t.Errorf("expected %q, found %q", modified, result)
+	}
+}
+
+func Test_TruncatedStrongHash(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+	modified, _ := ioutil.ReadFile("test-data/golang-modified.bmp")
+
+	config := &Config{BlockSize: 1024, StrongHashLen: 4}
+	if size := config.StrongHashSize(); size != 4 {
+		t.Errorf("expected strong hash size 4, found %d", size)
+	}
+	if size := (&Config{StrongHashLen: 64}).StrongHashSize(); size != md5.Size {
+		t.Errorf("expected strong hash size %d, found %d", md5.Size, size)
+	}
+
+	hashes := config.CalculateBlockHashes(original)
+	full := (&Config{BlockSize: 1024}).CalculateBlockHashes(original)
+	for i, h := range hashes {
+		if string(h.strongHash) != string(full[i].strongHash[:4]) {
+			t.Fatalf("block %d: expected truncated hash %x, found %x", i, full[i].strongHash[:4], h.strongHash)
+		}
+	}
+
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, hashes, opsChannel)
+	result, err := config.ApplyOps(original, opsChannel, len(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != string(modified) {
+		t.Errorf("rsync did not work as expected with a truncated strong hash")
+	}
+}
+
+func Test_CalculateDifferencesContextCancelled(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+	modified, _ := ioutil.ReadFile("test-data/golang-modified.bmp")
+	config := &Config{BlockSize: 1024}
+	hashes := config.CalculateBlockHashes(original)
+
+	//取消之前已经开始
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opsChannel := make(chan RSyncOp)
+	if err := config.CalculateDifferencesContext(ctx, modified, hashes, opsChannel); err != context.Canceled {
+		t.Errorf("expected %v, found %v", context.Canceled, err)
+	}
+	if _, ok := <-opsChannel; ok {
+		t.Errorf("expected the channel to be closed")
+	}
+
+	//接收方读取一个操作后放弃
+	ctx, cancel = context.WithCancel(context.Background())
+	opsChannel = make(chan RSyncOp)
+	errs := make(chan error, 1)
+	go func() { errs <- config.CalculateDifferencesContext(ctx, modified, hashes, opsChannel) }()
+	<-opsChannel
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected %v, found %v", context.Canceled, err)
+	}
+	drainOps(opsChannel)
+}
+
+func Test_CalculateBlockHashesParallel(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+
+	for _, blockSize := range []int{7, 1024, 1 << 22} {
+		config := &Config{BlockSize: blockSize}
+		if !reflect.DeepEqual(config.CalculateBlockHashes(original), config.CalculateBlockHashesParallel(original)) {
+			t.Errorf("parallel hashes differ from serial hashes with block size %d", blockSize)
+		}
+	}
+	if len(CalculateBlockHashesParallel(nil)) != 0 {
+		t.Errorf("expected no blocks for empty content")
+	}
+}
+
+// Returns n bytes of reproducible pseudo random content.
+func randomContent(n int, seed int64) []byte {
+	content := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(content)
+	return content
+}
+
+func Benchmark_CalculateBlockHashes(b *testing.B) {
+	content := randomContent(4<<20, 1)
+	config := &Config{BlockSize: 1024}
+	b.SetBytes(int64(len(content)))
+	for i := 0; i < b.N; i++ {
+		config.CalculateBlockHashes(content)
+	}
+}
+
+func Benchmark_CalculateBlockHashesParallel(b *testing.B) {
+	content := randomContent(4<<20, 1)
+	config := &Config{BlockSize: 1024}
+	b.SetBytes(int64(len(content)))
+	for i := 0; i < b.N; i++ {
+		config.CalculateBlockHashesParallel(content)
+	}
+}
+
+func Test_BlockHashes(t *testing.T) {
+	contents := [][]byte{nil, {7}, randomContent(1023, 62), randomContent(1025, 63), randomContent(5000, 64), bytes.Repeat([]byte{0xff}, 70000)}
+	configs := []*Config{nil, {WeakModulus: 251}, {WeakModulus: 1 << 32}, {StrongHashLen: 4}, {StrongHash: sha256.New}, {HashKey: []byte("key")}, {SkipStrongHash: true}, {WeakHash: FNVWeakHash}}
+	for _, config := range configs {
+		for _, content := range contents {
+			weak, strong := config.blockHashes(content)
+			if weak != config.weakHash(content) || !bytes.Equal(strong, config.strongHash(content)) {
+				t.Errorf("%+v, %d bytes: expected the hashes of the two passes", config, len(content))
+			}
+		}
+	}
+}
+
+func Benchmark_BlockHashes(b *testing.B) {
+	config := &Config{}
+	for _, size := range []int{1024, 64 << 10, 1 << 20} {
+		block := randomContent(size, 65)
+		b.Run(fmt.Sprintf("TwoPass/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				config.weakHash(block)
+				config.strongHash(block)
+			}
+		})
+		b.Run(fmt.Sprintf("SinglePass/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				config.blockHashes(block)
+			}
+		})
+	}
+}
+
+// Returns a copy of original with about percent of its bytes replaced, in runs
+// of 64 bytes at random offsets, so the unchanged blocks still match.
+func modifiedContent(original []byte, percent int, seed int64) []byte {
+	const runLength = 64
+	modified := append([]byte(nil), original...)
+	r := rand.New(rand.NewSource(seed))
+	for runs := len(original) * percent / 100 / runLength; runs > 0; runs-- {
+		offset := r.Intn(max(len(modified)-runLength, 1))
+		r.Read(modified[offset:min(offset+runLength, len(modified))])
+	}
+	return modified
+}
+
+// contentEdit An edit of some content at an offset of the original: remove
+// bytes are removed there and insert is inserted in their place.
+type contentEdit struct {
+	offset, remove int
+	insert         []byte
+}
+
+func insertAt(offset int, insert string) contentEdit {
+	return contentEdit{offset: offset, insert: []byte(insert)}
+}
+
+func deleteAt(offset, n int) contentEdit {
+	return contentEdit{offset: offset, remove: n}
+}
+
+func replaceAt(offset int, insert string) contentEdit {
+	return contentEdit{offset: offset, remove: len(insert), insert: []byte(insert)}
+}
+
+// Returns a copy of original with edits applied. Their offsets refer to
+// original, in increasing order, and the edits must not overlap.
+func editContent(original []byte, edits ...contentEdit) []byte {
+	var modified []byte
+	var previous int
+	for _, e := range edits {
+		modified = append(modified, original[previous:e.offset]...)
+		modified = append(modified, e.insert...)
+		previous = e.offset + e.remove
+	}
+	return append(modified, original[previous:]...)
+}
+
+// Runs fn for every combination of content size and percentage of changed
+// bytes, reporting throughput over the modified content.
+func benchmarkPipeline(b *testing.B, fn func(b *testing.B, config *Config, original, modified []byte)) {
+	config := &Config{BlockSize: 1024}
+	for _, size := range []int{64 << 10, 1 << 20, 8 << 20} {
+		original := randomContent(size, 1)
+		for _, percent := range []int{0, 1, 10, 50} {
+			modified := modifiedContent(original, percent, 2)
+			b.Run(fmt.Sprintf("%dKiB/%d%%", size>>10, percent), func(b *testing.B) {
+				b.SetBytes(int64(len(modified)))
+				fn(b, config, original, modified)
+			})
+		}
+	}
+}
+
+func Benchmark_PipelineBlockHashes(b *testing.B) {
+	benchmarkPipeline(b, func(b *testing.B, config *Config, original, modified []byte) {
+		for i := 0; i < b.N; i++ {
+			config.CalculateBlockHashes(original)
+		}
+	})
+}
+
+func Benchmark_PipelineDifferences(b *testing.B) {
+	benchmarkPipeline(b, func(b *testing.B, config *Config, original, modified []byte) {
+		hashes := config.CalculateBlockHashes(original)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			opsChannel := make(chan RSyncOp)
+			go config.CalculateDifferences(modified, hashes, opsChannel)
+			for range opsChannel {
+			}
+		}
+	})
+}
+
+func Benchmark_PipelineApplyOps(b *testing.B) {
+	benchmarkPipeline(b, func(b *testing.B, config *Config, original, modified []byte) {
+		ops := config.Diff(original, modified)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := applyOpsSlice(config, original, ops, len(modified)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func Benchmark_PipelineEndToEnd(b *testing.B) {
+	benchmarkPipeline(b, func(b *testing.B, config *Config, original, modified []byte) {
+		for i := 0; i < b.N; i++ {
+			result, err := config.Patch(original, config.Diff(original, modified))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(result) != len(modified) {
+				b.Fatalf("expected %d bytes, found %d", len(modified), len(result))
+			}
+		}
+	})
+}
+
+func Test_RollingWeakHashMatchesFresh(t *testing.T) {
+	content := randomContent(300, 2)
+
+	for _, blockSize := range []int{1, 2, 5, 64, 299, 300, 512} {
+		var rolling RollingHash
+		rolling.Init(content[:min(blockSize, len(content))])
+		for offset := 1; offset < len(content); offset++ {
+			if offset-1+blockSize < len(content) {
+				rolling.Roll(content[offset-1], content[offset-1+blockSize])
+			} else {
+				rolling.Shrink(content[offset-1])
+			}
+			expected, _, _ := weakHash(content[offset:min(offset+blockSize, len(content))])
+			if rolling.Sum() != expected {
+				t.Fatalf("block size %d offset %d: rolling hash %d differs from fresh hash %d", blockSize, offset, rolling.Sum(), expected)
+			}
+		}
+	}
+}
+
+func Test_DifferencesRollIntoFinalBlock(t *testing.T) {
+	config := &Config{BlockSize: 4}
+	original := []byte("abcdefghij")
+	//末尾的 "ij" 只有在窗口收缩后才能匹配
+	modified := []byte("Xij")
+	hashes := config.CalculateBlockHashes(original)
+
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, hashes, opsChannel)
+	var ops []RSyncOp
+	for op := range opsChannel {
+		ops = append(ops, op)
+	}
+	expected := []RSyncOp{{opCode: DATA, data: []byte("X")}, {opCode: BLOCK, blockIndex: 2}}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %+v, found %+v", expected, ops)
+	}
+}
+
+func Test_RollingWeakHashUnderflow(t *testing.T) {
+	//300 个 0xFF 让 a 超过 M 后取模变小，随后移出的字节大于 a
+	content := append(bytes.Repeat([]byte{0xff}, 300), bytes.Repeat([]byte{0x00}, 300)...)
+	blockSize := 260
+
+	var rolling RollingHash
+	rolling.Init(content[:blockSize])
+	var underflows int
+	for offset := 1; offset+blockSize <= len(content); offset++ {
+		if rolling.a < uint64(content[offset-1]) {
+			underflows++
+		}
+		rolling.Roll(content[offset-1], content[offset-1+blockSize])
+		expected, _, _ := weakHash(content[offset : offset+blockSize])
+		if rolling.Sum() != expected {
+			t.Fatalf("offset %d: rolling hash %d differs from fresh hash %d", offset, rolling.Sum(), expected)
+		}
+	}
+	//确认测试数据确实触发了下溢的情况
+	if underflows == 0 {
+		t.Fatalf("test content never made a smaller than the outgoing byte")
+	}
+
+	//高字节块在 rolling 之后也必须能匹配
+	config := &Config{BlockSize: blockSize}
+	original := content[300-blockSize+40 : 300+40]
+	hashes := config.CalculateBlockHashes(original)
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(content, hashes, opsChannel)
+	var blocks int
+	for op := range opsChannel {
+		if op.opCode == BLOCK {
+			blocks++
+		}
+	}
+	if blocks != 1 {
+		t.Errorf("expected one matching block, found %d", blocks)
+	}
+}
+
+func Test_BlockRuns(t *testing.T) {
+	config := &Config{BlockSize: 4}
+	original := []byte("0000111122223333444455")
+	modified := []byte("11112222--0000--3333444455")
+	ops := config.Diff(original, modified)
+
+	expected := []RSyncOp{
+		{opCode: BLOCKRUN, blockIndex: 1, blockCount: 2},
+		{opCode: DATA, data: []byte("--")},
+		{opCode: BLOCK, blockIndex: 0},
+		{opCode: DATA, data: []byte("--")},
+		{opCode: BLOCKRUN, blockIndex: 3, blockCount: 3},
+	}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %+v, found %+v", expected, ops)
+	}
+	result, err := config.Patch(original, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != string(modified) {
+		t.Errorf("expected %q, found %q", modified, result)
+	}
+
+	//BLOCKRUN 不能超出原始内容
+	for _, op := range []RSyncOp{{opCode: BLOCKRUN, blockIndex: 4, blockCount: 3}, {opCode: BLOCKRUN, blockIndex: 0, blockCount: 0}} {
+		if _, err := config.Patch(original, []RSyncOp{op}); err == nil {
+			t.Errorf("expected an error for %+v", op)
+		}
+	}
+}
+
+func Test_MaxDataOp(t *testing.T) {
+	original := randomContent(8192, 3)
+	//中间插入一大段新数据
+	modified := append(append(append([]byte(nil), original[:4096]...), randomContent(5000, 4)...), original[4096:]...)
+
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		config := &Config{BlockSize: 64, Chunking: chunking, MaxDataOp: 1000}
+		var delta bytes.Buffer
+		if err := config.ComputeDelta(bytes.NewReader(modified), config.CalculateBlockHashes(original), &delta); err != nil {
+			t.Fatal(err)
+		}
+		for name, ops := range map[string][]RSyncOp{"Diff": config.Diff(original, modified), "ComputeDelta": decodeOps(t, delta.Bytes())} {
+			var dataOps int
+			for _, op := range ops {
+				if op.opCode == DATA {
+					dataOps++
+					if len(op.data) > config.MaxDataOp {
+						t.Errorf("chunking %d %s: DATA op of %d bytes", chunking, name, len(op.data))
+					}
+				}
+			}
+			if dataOps < 5 {
+				t.Errorf("chunking %d %s: expected the insertion to be split, found %d DATA ops", chunking, name, dataOps)
+			}
+			result, err := config.Patch(original, ops)
+			if err != nil || !bytes.Equal(result, modified) {
+				t.Errorf("chunking %d %s: sync did not work as expected: %v", chunking, name, err)
+			}
+		}
+	}
+}
+
+func Test_MinMatch(t *testing.T) {
+	config := &Config{BlockSize: 4, MinMatch: 8}
+	original := []byte("0000111122223333444455")
+	//"1111" 前后都是 DATA 且短于 8 字节，并入 DATA；开头的 "0000" 前面没有 DATA，保留
+	modified := []byte("0000ab1111cd22223333ef")
+	expected := []RSyncOp{
+		{opCode: BLOCK, blockIndex: 0},
+		{opCode: DATA, data: []byte("ab1111cd")},
+		{opCode: BLOCKRUN, blockIndex: 2, blockCount: 2},
+		{opCode: DATA, data: []byte("ef")},
+	}
+	var delta bytes.Buffer
+	if err := config.ComputeDelta(bytes.NewReader(modified), config.CalculateBlockHashes(original), &delta); err != nil {
+		t.Fatal(err)
+	}
+	for name, ops := range map[string][]RSyncOp{"Diff": config.Diff(original, modified), "ComputeDelta": decodeOps(t, delta.Bytes())} {
+		if !reflect.DeepEqual(ops, expected) {
+			t.Errorf("%s: expected %+v, found %+v", name, expected, ops)
+		}
+	}
+
+	//较大的随机修改仍能正确还原，且操作数不增加
+	source := randomContent(1<<16, 5)
+	target := modifiedContent(source, 10, 6)
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		plain := &Config{BlockSize: 32, Chunking: chunking}
+		config := &Config{BlockSize: 32, Chunking: chunking, MinMatch: 256, MaxDataOp: 4096}
+		ops := config.Diff(source, target)
+		if len(ops) > len(plain.Diff(source, target)) {
+			t.Errorf("chunking %d: MinMatch produced more ops", chunking)
+		}
+		result, err := config.Patch(source, ops)
+		if err != nil || !bytes.Equal(result, target) {
+			t.Errorf("chunking %d: sync did not work as expected: %v", chunking, err)
+		}
+	}
+}
+
+func Test_BlockCount(t *testing.T) {
+	cases := []struct{ contentLen, blockSize, expected int }{
+		{0, 4, 0},
+		{-1, 4, 0},
+		{1, 4, 1},
+		{8, 4, 2},
+		{9, 4, 3},
+		{4096, 1024, 4},
+		{5, 0, BlockCount(5, BlockSize)},
+		{5, -3, BlockCount(5, BlockSize)},
+	}
+	for _, c := range cases {
+		if found := BlockCount(c.contentLen, c.blockSize); found != c.expected {
+			t.Errorf("BlockCount(%d, %d): expected %d, found %d", c.contentLen, c.blockSize, c.expected, found)
+		}
+	}
+	if found := len((&Config{BlockSize: 4}).CalculateBlockHashes(make([]byte, 9))); found != BlockCount(9, 4) {
+		t.Errorf("BlockCount disagrees with the %d blocks of the signature", found)
+	}
+}
+
+func Test_DifferencesProgress(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+	modified, _ := ioutil.ReadFile("test-data/golang-modified.bmp")
+
+	var calls, last int
+	config := &Config{BlockSize: 1024, Progress: func(bytesProcessed, totalBytes int) {
+		if totalBytes != len(modified) || bytesProcessed < last || bytesProcessed > totalBytes {
+			t.Fatalf("unexpected progress %d/%d after %d", bytesProcessed, totalBytes, last)
+		}
+		calls++
+		last = bytesProcessed
+	}}
+	config.Diff(original, modified)
+
+	if last != len(modified) {
+		t.Errorf("expected a final report of %d bytes, found %d", len(modified), last)
+	}
+	//进度报告需要节流，而不是每个字节一次
+	if limit := len(modified)/checkInterval + 2; calls < 2 || calls > limit {
+		t.Errorf("expected between 2 and %d progress reports, found %d", limit, calls)
+	}
+}
+
+func Test_SearchStrongHashSecondInBucket(t *testing.T) {
+	//同一个弱hash桶里的两个块
+	bucket := []BlockHash{
+		{index: 3, weakHash: 7, strongHash: []byte("first")},
+		{index: 8, weakHash: 7, strongHash: []byte("second")},
+	}
+	found, blockHash := searchStrongHash(bucket, []byte("second"))
+	if !found || blockHash.index != 8 {
+		t.Fatalf("expected block 8, found %v %+v", found, blockHash)
+	}
+	if blockHash != &bucket[1] {
+		t.Errorf("expected a pointer to the bucket element")
+	}
+	if found, _ := searchStrongHash(bucket, []byte("third")); found {
+		t.Errorf("expected no match")
+	}
+}
+
+func Test_EmptyContent(t *testing.T) {
+	content := []byte("some text")
+	for _, config := range []*Config{{BlockSize: 4}, {BlockSize: 4, Chunking: ContentDefinedChunking}} {
+		//空的原始数据：所有数据作为一个 DATA 发送
+		if hashes := config.CalculateBlockHashes(nil); len(hashes) != 0 {
+			t.Errorf("expected no blocks for empty content, found %d", len(hashes))
+		}
+		ops := config.Diff(nil, content)
+		expected := []RSyncOp{{opCode: DATA, data: content}}
+		if !reflect.DeepEqual(ops, expected) {
+			t.Errorf("empty basis: expected %+v, found %+v", expected, ops)
+		}
+		result, err := applyOpsSlice(config, nil, ops, len(content))
+		if err != nil || string(result) != string(content) {
+			t.Errorf("empty basis: expected %q, found %q (%v)", content, result, err)
+		}
+
+		//空的目标数据：没有任何操作
+		if ops := config.Diff(content, nil); len(ops) != 0 {
+			t.Errorf("empty target: expected no ops, found %+v", ops)
+		}
+		result, err = applyOpsSlice(config, content, nil, 0)
+		if err != nil || result == nil || len(result) != 0 {
+			t.Errorf("empty target: expected an empty result, found %v (%v)", result, err)
+		}
+
+		//两者都为空
+		if ops := config.Diff(nil, nil); len(ops) != 0 {
+			t.Errorf("empty inputs: expected no ops, found %+v", ops)
+		}
+		var delta bytes.Buffer
+		if err := config.ComputeDelta(bytes.NewReader(nil), nil, &delta); err != nil || delta.Len() != 0 {
+			t.Errorf("empty inputs: expected an empty delta, found %d bytes (%v)", delta.Len(), err)
+		}
+	}
+}
+
+func Test_IdenticalContent(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+	modified, _ := ioutil.ReadFile("test-data/golang-modified.bmp")
+	config := &Config{BlockSize: 1024}
+	sig := config.CalculateSignature(original)
+
+	calculate := func(content []byte) []RSyncOp {
+		opsChannel := make(chan RSyncOp)
+		go config.CalculateSignatureDifferences(context.Background(), content, sig, opsChannel)
+		var ops []RSyncOp
+		for op := range opsChannel {
+			ops = append(ops, op)
+		}
+		return ops
+	}
+
+	//相同的数据只发送一个 IDENTICAL，不发送任何 DATA
+	ops := calculate(append([]byte(nil), original...))
+	if expected := []RSyncOp{{opCode: IDENTICAL}}; !reflect.DeepEqual(ops, expected) {
+		t.Errorf("expected %+v, found %+v", expected, ops)
+	}
+	result, err := applyOpsSlice(config, original, ops, len(original))
+	if err != nil || !bytes.Equal(result, original) {
+		t.Errorf("ApplyOps did not copy the basis: %v", err)
+	}
+	var out bytes.Buffer
+	if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(ops...), &out); err != nil || !bytes.Equal(out.Bytes(), original) {
+		t.Errorf("ApplyOpsAt did not copy the basis: %v", err)
+	}
+
+	//不同的数据照常扫描
+	ops = calculate(modified)
+	for _, op := range ops {
+		if op.opCode == IDENTICAL {
+			t.Fatalf("unexpected IDENTICAL op for modified content")
+		}
+	}
+	result, err = applyOpsSlice(config, original, ops, len(modified))
+	if err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("sync did not work as expected: %v", err)
+	}
+}
+
+func Test_AppendedContent(t *testing.T) {
+	//最后一个块不足 64 字节
+	original := randomContent(64*100+10, 68)
+	appended := append(append([]byte(nil), original...), randomContent(5000, 69)...)
+	var lookups atomic.Int64
+	config := &Config{BlockSize: 64}
+	config.Matcher = func(hashes []BlockHash) Matcher {
+		return countingMatcher{config.DefaultMatcher(hashes), &lookups}
+	}
+	calculate := func(content []byte, sig *Signature) []RSyncOp {
+		opsChannel := make(chan RSyncOp)
+		go config.CalculateSignatureDifferences(context.Background(), content, sig, opsChannel)
+		return drainedOps(opsChannel)
+	}
+
+	//原数据的全部块加上追加的 DATA，不扫描
+	ops := calculate(appended, config.CalculateSignature(original))
+	expected := []RSyncOp{{opCode: BLOCKRUN, blockIndex: 0, blockCount: 101}, {opCode: DATA, data: appended[len(original):]}}
+	if !reflect.DeepEqual(ops, expected) || lookups.Load() != 0 {
+		t.Errorf("expected a run of the basis and the appended data without a scan, found %v after %d lookups", ops, lookups.Load())
+	}
+	if result, err := config.Patch(original, ops); err != nil || !bytes.Equal(result, appended) {
+		t.Errorf("expected the operations to recreate the appended content: %v", err)
+	}
+
+	//前缀有修改或签名没有整个文件的hash时照常扫描
+	edited := editContent(appended, replaceAt(3000, "edited"))
+	noFileHash := config.CalculateSignature(original)
+	noFileHash.FileHash = nil
+	for _, test := range []struct {
+		content []byte
+		sig     *Signature
+	}{{edited, config.CalculateSignature(original)}, {appended, noFileHash}} {
+		lookups.Store(0)
+		ops := calculate(test.content, test.sig)
+		if lookups.Load() == 0 {
+			t.Errorf("expected a scan")
+		}
+		if result, err := config.Patch(original, ops); err != nil || !bytes.Equal(result, test.content) {
+			t.Errorf("sync did not work as expected: %v", err)
+		}
+	}
+}
+
+func Test_CopyData(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/text-original.txt")
+	modified, _ := ioutil.ReadFile("test-data/text-modified.txt")
+	expected := append([]byte(nil), modified...)
+
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		config := &Config{BlockSize: 8, Chunking: chunking, CopyData: true}
+		content := append([]byte(nil), modified...)
+		ops := config.Diff(original, content)
+		opsChannel := make(chan RSyncOp)
+		go config.CalculateDifferences(content, config.CalculateBlockHashes(original), opsChannel)
+		var channelOps []RSyncOp
+		for op := range opsChannel {
+			channelOps = append(channelOps, op)
+		}
+
+		//修改原数据后操作体不受影响
+		for i := range content {
+			content[i] = '#'
+		}
+		for _, ops := range [][]RSyncOp{ops, channelOps} {
+			result, err := config.Patch(original, ops)
+			if err != nil || !bytes.Equal(result, expected) {
+				t.Errorf("chunking %d: ops changed along with the content: %v", chunking, err)
+			}
+			for i := range ops {
+				ops[i].Release()
+				if ops[i].opCode == DATA && ops[i].data != nil {
+					t.Errorf("chunking %d: released op still holds its data", chunking)
+				}
+			}
+		}
+	}
+
+	//没有 CopyData 时 Release 不归还共享内存
+	ops := Diff(original, modified)
+	for i := range ops {
+		if ops[i].opCode == DATA {
+			data := ops[i].data
+			ops[i].Release()
+			if !bytes.Equal(ops[i].data, data) {
+				t.Errorf("Release changed an op sharing memory with the content")
+			}
+		}
+	}
+}
+
+func Test_ApplyOpsWriter(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+	modified, _ := ioutil.ReadFile("test-data/golang-modified.bmp")
+	config := &Config{BlockSize: 1024}
+
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, config.CalculateBlockHashes(original), opsChannel)
+	var out bytes.Buffer
+	if err := config.ApplyOpsWriter(original, opsChannel, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), modified) {
+		t.Errorf("ApplyOpsWriter did not work as expected")
+	}
+
+	if err := ApplyOpsWriter([]byte("abc"), opsChannelOf(RSyncOp{opCode: BLOCK, blockIndex: 9}), &out); err == nil {
+		t.Errorf("expected an error for a block index out of range")
+	}
+	errWrite := fmt.Errorf("write failed")
+	if err := ApplyOpsWriter([]byte("abc"), opsChannelOf(RSyncOp{opCode: BLOCK}, RSyncOp{opCode: DATA, data: []byte("x")}), failingWriter{errWrite}); err != errWrite {
+		t.Errorf("expected %v, found %v", errWrite, err)
+	}
+}
+
+func Test_WeakModulus(t *testing.T) {
+	content := randomContent(4000, 10)
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+	modified, _ := ioutil.ReadFile("test-data/golang-modified.bmp")
+
+	for _, modulus := range []uint64{0, 2, 251, 4096, 65521, 1 << 16, 1 << 20, 1 << 32} {
+		config := &Config{BlockSize: 3000, WeakModulus: modulus}
+		m := config.weakModulus()
+
+		//逐字节取模的参考值，块长度超过 1024
+		var a, b uint64
+		for i, v := range content[:3000] {
+			a = (a + uint64(v)) % m
+			b = (b + uint64(3000-i)*uint64(v)) % m
+		}
+		if sa, sb := weakSums(content[:3000], m); sa != a || sb != b {
+			t.Errorf("modulus %d: expected sums %d %d, found %d %d", modulus, a, b, sa, sb)
+		}
+
+		for _, blockSize := range []int{5, 1500} {
+			rolling := NewRollingHash(modulus)
+			rolling.Init(content[:blockSize])
+			for offset := 1; offset < len(content); offset++ {
+				if offset-1+blockSize < len(content) {
+					rolling.Roll(content[offset-1], content[offset-1+blockSize])
+				} else {
+					rolling.Shrink(content[offset-1])
+				}
+				expected := config.weakHash(content[offset:min(offset+blockSize, len(content))])
+				if rolling.Sum() != expected {
+					t.Fatalf("modulus %d block size %d offset %d: rolling hash %d differs from fresh hash %d", modulus, blockSize, offset, rolling.Sum(), expected)
+				}
+			}
+		}
+
+		config.BlockSize = 64
+		result, err := config.Patch(original, config.Diff(original, modified))
+		if err != nil || !bytes.Equal(result, modified) {
+			t.Errorf("modulus %d: sync did not work as expected: %v", modulus, err)
+		}
+	}
+
+	//默认模数与 weakHash 一致
+	weak, _, _ := weakHash(content[:100])
+	if (&Config{}).weakHash(content[:100]) != weak {
+		t.Errorf("default modulus differs from weakHash")
+	}
+
+	//签名记录了模数，不一致时报错
+	sig := (&Config{BlockSize: 64, WeakModulus: 65521}).CalculateSignature(original)
+	opsChannel := make(chan RSyncOp, 1)
+	if err := (&Config{BlockSize: 64}).CalculateSignatureDifferences(context.Background(), modified, sig, opsChannel); err == nil {
+		t.Errorf("expected an error for a signature built with another weak hash modulus")
+	}
+}
+
+func Test_ComposeWeakHashConcatOrFold(t *testing.T) {
+	//模数不超过 1<<16 时两个和按模数的位数拼接，互不重叠
+	for _, m := range []uint64{2, 3, 251, 4096, 4097, 65521, 1 << 16} {
+		width := bits.Len64(m - 1)
+		for _, sums := range [][2]uint64{{0, 0}, {m - 1, 0}, {0, m - 1}, {m - 1, m - 1}, {m / 2, m / 3}} {
+			weak := composeWeakHash(sums[0], sums[1], m)
+			if a, b := uint64(weak)&(1<<width-1), uint64(weak)>>width; a != sums[0] || b != sums[1] {
+				t.Errorf("modulus %d: expected sums %d %d, found %d %d", m, sums[0], sums[1], a, b)
+			}
+		}
+	}
+	if composeWeakHash(1, 2, M) != 1+2<<16 {
+		t.Errorf("expected a + (1<<16 * b) for the default modulus")
+	}
+
+	//更大的模数时两个和折叠在一起，会重叠
+	for _, m := range []uint64{1<<16 + 1, 1 << 20, 1<<32 - 5, 1 << 32} {
+		for _, sums := range [][2]uint64{{0, 0}, {m - 1, 0}, {0, m - 1}, {m - 1, m - 1}, {m / 2, m / 3}} {
+			expected := uint32(sums[0]) ^ bits.RotateLeft32(uint32(sums[1]), 16)
+			if weak := composeWeakHash(sums[0], sums[1], m); weak != expected {
+				t.Errorf("modulus %d: expected %#08x for sums %d %d, found %#08x", m, expected, sums[0], sums[1], weak)
+			}
+		}
+	}
+
+	//折叠后 rolling 的结果仍与直接计算一致
+	content := randomContent(5000, 68)
+	for _, m := range []uint64{1 << 20, 1<<32 - 5, 1 << 32} {
+		config := &Config{WeakModulus: m}
+		for _, blockSize := range []int{16, 2000} {
+			rolling := NewRollingHash(m)
+			rolling.Init(content[:blockSize])
+			for offset := 1; offset < len(content); offset++ {
+				if offset-1+blockSize < len(content) {
+					rolling.Roll(content[offset-1], content[offset-1+blockSize])
+				} else {
+					rolling.Shrink(content[offset-1])
+				}
+				if expected := config.weakHash(content[offset:min(offset+blockSize, len(content))]); rolling.Sum() != expected {
+					t.Fatalf("modulus %d block size %d offset %d: rolling hash %d differs from fresh hash %d", m, blockSize, offset, rolling.Sum(), expected)
+				}
+			}
+		}
+	}
+}
+
+func Test_SkipStrongHash(t *testing.T) {
+	original, _ := ioutil.ReadFile("test-data/golang-original.bmp")
+	modified, _ := ioutil.ReadFile("test-data/golang-modified.bmp")
+	config := &Config{BlockSize: 1024, SkipStrongHash: true}
+
+	hashes := config.CalculateBlockHashes(original)
+	for _, h := range hashes {
+		if h.strongHash != nil {
+			t.Fatalf("expected no strong hash for block %d", h.index)
+		}
+	}
+	if size := config.StrongHashSize(); size != 0 {
+		t.Errorf("expected a strong hash size of 0, found %d", size)
+	}
+	data, err := MarshalSignature(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full, _ := MarshalSignature((&Config{BlockSize: 1024}).CalculateBlockHashes(original)); len(data) >= len(full) {
+		t.Errorf("expected a smaller signature, found %d bytes against %d", len(data), len(full))
+	}
+
+	//这两个文件没有弱hash冲突，结果仍然正确
+	result, err := config.Patch(original, config.Diff(original, modified))
+	if err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("sync did not work as expected: %v", err)
+	}
+	var delta bytes.Buffer
+	if err := config.ComputeDelta(bytes.NewReader(modified), hashes, &delta); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := config.Patch(original, decodeOps(t, delta.Bytes())); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("streaming sync did not work as expected: %v", err)
+	}
+
+	//没有强hash的签名不能用于普通的配置
+	opsChannel := make(chan RSyncOp, 1)
+	if err := (&Config{BlockSize: 1024}).CalculateDifferencesContext(context.Background(), modified, hashes, opsChannel); err == nil {
+		t.Errorf("expected an error for a signature without strong hashes")
+	}
+}
+
+func Benchmark_DifferencesStrongHash(b *testing.B) {
+	benchmarkDifferences(b, &Config{BlockSize: 1024})
+}
+
+func Benchmark_DifferencesSkipStrongHash(b *testing.B) {
+	benchmarkDifferences(b, &Config{BlockSize: 1024, SkipStrongHash: true})
+}
+
+func benchmarkDifferences(b *testing.B, config *Config) {
+	original := randomContent(4<<20, 1)
+	modified := modifiedContent(original, 1, 2)
+	hashes := config.CalculateBlockHashes(original)
+	b.SetBytes(int64(len(modified)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		config.calculateDifferences(context.Background(), modified, hashes, func(RSyncOp) error { return nil })
+	}
+}
+
+func Test_CalculateBlockHashesBoundaries(t *testing.T) {
+	const blockSize = 16
+	content := randomContent(4*blockSize+1, 12)
+	config := &Config{BlockSize: blockSize}
+
+	cases := []struct {
+		length, blocks, lastLength int
+	}{
+		{4*blockSize - 1, 4, blockSize - 1},
+		{4 * blockSize, 4, blockSize},
+		{4*blockSize + 1, 5, 1},
+	}
+	for _, c := range cases {
+		hashes := config.CalculateBlockHashes(content[:c.length])
+		if len(hashes) != c.blocks || BlockCount(c.length, blockSize) != c.blocks {
+			t.Errorf("length %d: expected %d blocks, found %d", c.length, c.blocks, len(hashes))
+			continue
+		}
+		//没有多出的空块，最后一个块的哈希与直接计算的一致
+		last := hashes[len(hashes)-1]
+		block := content[(c.blocks-1)*blockSize : c.length]
+		weak, _, _ := weakHash(block)
+		if last.Index() != c.blocks-1 || last.Length() != c.lastLength || last.WeakHash() != weak || !bytes.Equal(last.StrongHash(), config.strongHash(block)) {
+			t.Errorf("length %d: unexpected last block %+v", c.length, last)
+		}
+		if !reflect.DeepEqual(config.CalculateBlockHashesParallel(content[:c.length]), hashes) {
+			t.Errorf("length %d: parallel hashes differ", c.length)
+		}
+	}
+}
+
+func Test_String(t *testing.T) {
+	ops := map[string]RSyncOp{
+		"BLOCK idx=5":            {opCode: BLOCK, blockIndex: 5},
+		"BLOCKRUN idx=2 count=3": {opCode: BLOCKRUN, blockIndex: 2, blockCount: 3},
+		"DATA len=3 hex=616263":  {opCode: DATA, data: []byte("abc")},
+		"DATA len=0 hex=":        {opCode: DATA},
+		"IDENTICAL":              {opCode: IDENTICAL},
+		"COPY offset=8 len=16":   {opCode: COPY, offset: 8, length: 16},
+		"UNKNOWN(9)":             {opCode: 9},
+		//只显示前 16 个字节
+		"DATA len=20 hex=30313233343536373839616263646566...": {opCode: DATA, data: []byte("0123456789abcdefghij")},
+	}
+	for expected, op := range ops {
+		if s := op.String(); s != expected {
+			t.Errorf("expected %q, found %q", expected, s)
+		}
+	}
+	if s := fmt.Sprint([]RSyncOp{{opCode: BLOCK}, {opCode: DATA, data: []byte{1}}}); s != "[BLOCK idx=0 DATA len=1 hex=01]" {
+		t.Errorf("unexpected formatting of a slice: %q", s)
+	}
+
+	h := BlockHash{index: 3, length: 1024, weakHash: 0xabcd, strongHash: []byte{1, 2, 3, 4, 5, 6}}
+	if s, expected := h.String(), "block idx=3 len=1024 weak=0x0000abcd strong=01020304..."; s != expected {
+		t.Errorf("expected %q, found %q", expected, s)
+	}
+}
+
+func Test_SelfCopy(t *testing.T) {
+	original := randomContent(2000, 51)
+	repeated := randomContent(1000, 52)
+	modified := append(append(append([]byte{}, original[:500]...), bytes.Repeat(repeated, 4)...), original[500:]...)
+
+	config := &Config{BlockSize: 64, SelfCopy: true}
+	ops := config.Diff(original, modified)
+	var copies int
+	for _, op := range ops {
+		if op.opCode == COPY {
+			copies += op.length
+		}
+	}
+	//重复的数据大部分以 COPY 发送
+	if copies < 2900 {
+		t.Errorf("expected the repeats to be copied, found %d bytes copied: %v", copies, ops)
+	}
+	if plain := (&Config{BlockSize: 64}).Diff(original, modified); len(encodeOps(t, ops)) >= len(encodeOps(t, plain))-2500 {
+		t.Errorf("expected COPY to shrink the delta")
+	}
+
+	result, err := config.Patch(original, ops)
+	if err != nil || !bytes.Equal(result, modified) {
+		t.Fatalf("Patch did not recreate the modified content: %v", err)
+	}
+	if result, err := config.ApplyOps(original, opsChannelOf(ops...), len(modified)); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("ApplyOps did not recreate the modified content: %v", err)
+	}
+	var out bytes.Buffer
+	if err := config.ApplyOpsWriter(original, opsChannelOf(ops...), &out); err != nil || !bytes.Equal(out.Bytes(), modified) {
+		t.Errorf("ApplyOpsWriter did not recreate the modified content: %v", err)
+	}
+	out.Reset()
+	if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(decodeOps(t, encodeOps(t, ops))...), &out); err != nil || !bytes.Equal(out.Bytes(), modified) {
+		t.Errorf("ApplyOpsAt did not recreate the modified content: %v", err)
+	}
+
+	//组装方没有保留已组装的数据
+	if err := (&Config{BlockSize: 64}).ApplyOpsWriter(original, opsChannelOf(ops...), io.Discard); err == nil {
+		t.Errorf("expected an error for COPY without SelfCopy")
+	}
+	if _, err := config.Patch(original, []RSyncOp{{opCode: DATA, data: []byte("ab")}, {opCode: COPY, offset: 2, length: 1}}); err == nil {
+		t.Errorf("expected an error for a copy past the reconstructed content")
+	}
+
+	//复制的数据可以与复制出的数据重叠
+	result, err = config.Patch(nil, []RSyncOp{{opCode: DATA, data: []byte("abc")}, {opCode: COPY, offset: 1, length: 5}})
+	if err != nil || string(result) != "abcbcbcb" {
+		t.Errorf("expected abcbcbcb, found %q: %v", result, err)
+	}
+}
+
+func Test_FollowingBlock(t *testing.T) {
+	//重复的内容中每个块都落在同一个桶中，第一个匹配之后沿着原数据继续匹配
+	original := bytes.Repeat(randomContent(64, 71), 100)
+	modified := append([]byte("new prefix"), original[640:]...)
+
+	for _, config := range []*Config{{BlockSize: 64}, {BlockSize: 64, SkipStrongHash: true}} {
+		expected := []RSyncOp{{opCode: DATA, data: []byte("new prefix")}, {opCode: BLOCKRUN, blockIndex: 0, blockCount: 90}}
+		if ops := config.Diff(original, modified); !reflect.DeepEqual(ops, expected) {
+			t.Errorf("expected the shared suffix to collapse into one run, found %v", ops)
+		}
+
+		var delta bytes.Buffer
+		if err := config.ComputeDelta(bytes.NewReader(modified), config.CalculateBlockHashes(original), &delta); err != nil {
+			t.Fatal(err)
+		}
+		if ops := decodeOps(t, delta.Bytes()); !reflect.DeepEqual(ops, expected) {
+			t.Errorf("expected the streamed shared suffix to collapse into one run, found %v", ops)
+		}
+
+		var ops []RSyncOp
+		err := config.calculateDifferencesParallel(context.Background(), modified, config.CalculateBlockHashes(original), func(op RSyncOp) error {
+			ops = append(ops, op)
+			return nil
+		}, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ops, expected) {
+			t.Errorf("expected the parallel shared suffix to collapse into one run, found %v", ops)
+		}
+	}
+}
+
+// Reports the number of distinct blocks of real files sharing a weak hash with
+// another block, for every weak hash.
+func Benchmark_SearchStrongHash(b *testing.B) {
+	//模数为 2 时所有的块只落在 4 个桶中，每个匹配都要比较大量的强hash
+	config := &Config{BlockSize: 64, WeakModulus: 2}
+	original := randomContent(64<<10, 35)
+	modified := modifiedContent(original, 10, 36)
+	hashes := config.CalculateBlockHashes(original)
+	bucket := buildHashesMap(hashes)[hashes[len(hashes)-1].weakHash]
+	last := bucket[len(bucket)-1].strongHash
+
+	b.Run("Bucket", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			searchStrongHash(bucket, last)
+		}
+	})
+	b.Run("Diff", func(b *testing.B) {
+		b.SetBytes(int64(len(modified)))
+		for i := 0; i < b.N; i++ {
+			config.calculateDifferences(context.Background(), modified, hashes, func(RSyncOp) error { return nil })
+		}
+	})
+}
+
+func Test_MaxBucketDepth(t *testing.T) {
+	//模数为 2 时桶很深，重复的内容让桶中有相同的块
+	original := append(randomContent(20000, 37), bytes.Repeat(randomContent(64, 38), 50)...)
+	modified := modifiedContent(original, 10, 39)
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		linear := &Config{BlockSize: 64, WeakModulus: 2, Chunking: chunking, MaxBucketDepth: 1 << 30}
+		expected := linear.Diff(original, modified)
+		for _, depth := range []int{0, 1, 100} {
+			config := &Config{BlockSize: 64, WeakModulus: 2, Chunking: chunking, MaxBucketDepth: depth}
+			if depth != 100 && len(config.newBlockIndex(config.CalculateBlockHashes(original)).deep) == 0 {
+				t.Errorf("depth %d: expected deep buckets to be indexed", depth)
+			}
+			ops := config.Diff(original, modified)
+			if !reflect.DeepEqual(ops, expected) {
+				t.Errorf("%v depth %d: expected the same operations as a linear search", chunking, depth)
+			}
+			var delta bytes.Buffer
+			if err := config.ComputeDelta(bytes.NewReader(modified), config.CalculateBlockHashes(original), &delta); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decodeOps(t, delta.Bytes()), encodedOps(t, expected)) {
+				t.Errorf("%v depth %d: expected the same streaming delta as a linear search", chunking, depth)
+			}
+		}
+	}
+}
+
+// Returns ops as decoded after encoding them, so they compare with decoded
+// operations.
+func encodedOps(t *testing.T, ops []RSyncOp) []RSyncOp {
+	return decodeOps(t, encodeOps(t, ops))
+}
+
+func Benchmark_MaxBucketDepth(b *testing.B) {
+	//模数为 2 时所有的块只落在 4 个桶中
+	original := randomContent(256<<10, 40)
+	modified := modifiedContent(original, 10, 41)
+	for name, depth := range map[string]int{"Linear": 1 << 30, "Indexed": 0} {
+		config := &Config{BlockSize: 64, WeakModulus: 2, MaxBucketDepth: depth}
+		hashes := config.CalculateBlockHashes(original)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(modified)))
+			for i := 0; i < b.N; i++ {
+				config.calculateDifferences(context.Background(), modified, hashes, func(RSyncOp) error { return nil })
+			}
+		})
+	}
+}
+
+func Benchmark_WeakHashCollisions(b *testing.B) {
+	var content []byte
+	for _, name := range []string{"golang-original.bmp", "golang-modified.bmp"} {
+		data, _ := os.ReadFile("test-data/" + name)
+		content = append(content, data...)
+	}
+	configs := map[string]*Config{
+		"Rolling":      {BlockSize: 64},
+		"Rolling65521": {BlockSize: 64, WeakModulus: 65521},
+		"FNV":          {BlockSize: 64, WeakHash: FNVWeakHash},
+	}
+	for name, config := range configs {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			var collisions, distinct int
+			for i := 0; i < b.N; i++ {
+				//弱hash -> 不同的块
+				buckets := make(map[uint32]map[string]bool)
+				for offset := 0; offset < len(content); offset += 64 {
+					block := content[offset:min(offset+64, len(content))]
+					weak := config.weakHash(block)
+					if buckets[weak] == nil {
+						buckets[weak] = make(map[string]bool)
+					}
+					buckets[weak][string(block)] = true
+				}
+				collisions, distinct = 0, 0
+				for _, blocks := range buckets {
+					distinct += len(blocks)
+					if len(blocks) > 1 {
+						collisions += len(blocks)
+					}
+				}
+			}
+			b.ReportMetric(float64(collisions), "collisions")
+			b.ReportMetric(float64(collisions)/float64(distinct), "collisions/block")
+		})
+	}
+}
+
+func Test_MaxOps(t *testing.T) {
+	original := randomContent(64*100, 91)
+	//每个块后面插入一个字节，得到大量交替的 BLOCK 和 DATA
+	var modified []byte
+	for offset := 0; offset < len(original); offset += 64 {
+		modified = append(append(modified, original[offset:offset+64]...), 'x')
+	}
+	config := &Config{BlockSize: 64}
+	ops := config.Diff(original, modified)
+	if len(ops) < 200 {
+		t.Fatalf("expected many ops, found %d", len(ops))
+	}
+
+	config.MaxOps = 50
+	hashes := config.CalculateBlockHashes(original)
+	opsChannel := make(chan RSyncOp)
+	errc := make(chan error, 1)
+	go func() { errc <- config.CalculateDifferencesContext(context.Background(), modified, hashes, opsChannel) }()
+	var sent int
+	for range opsChannel {
+		sent++
+	}
+	if err := <-errc; !errors.Is(err, ErrTooManyOps) {
+		t.Errorf("expected ErrTooManyOps, found %v", err)
+	}
+	if sent != config.MaxOps {
+		t.Errorf("expected %d ops before the limit, found %d", config.MaxOps, sent)
+	}
+	if err := config.ComputeDelta(bytes.NewReader(modified), hashes, io.Discard); !errors.Is(err, ErrTooManyOps) {
+		t.Errorf("ComputeDelta: expected ErrTooManyOps, found %v", err)
+	}
+
+	//组装方同样限制
+	if _, err := config.ApplyOps(original, opsChannelOf(ops...), len(modified)); !errors.Is(err, ErrTooManyOps) {
+		t.Errorf("ApplyOps: expected ErrTooManyOps, found %v", err)
+	}
+	if err := config.ApplyOpsWriter(original, opsChannelOf(ops...), io.Discard); !errors.Is(err, ErrTooManyOps) {
+		t.Errorf("ApplyOpsWriter: expected ErrTooManyOps, found %v", err)
+	}
+	if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(ops...), io.Discard); !errors.Is(err, ErrTooManyOps) {
+		t.Errorf("ApplyOpsAt: expected ErrTooManyOps, found %v", err)
+	}
+
+	config.MaxOps = len(ops)
+	if result, err := config.ApplyOps(original, opsChannelOf(ops...), len(modified)); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("expected ops within the limit to apply: %v", err)
+	}
+}
+
+func Test_MaxOutputSize(t *testing.T) {
+	original := randomContent(4096, 92)
+	modified := modifiedContent(original, 10, 93)
+	config := &Config{BlockSize: 64, MaxOutputSize: 1 << 20}
+	ops := config.Diff(original, modified)
+
+	//荒谬的文件大小在分配之前失败
+	if _, err := config.ApplyOps(original, opsChannelOf(ops...), 1<<62); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("ApplyOps: expected ErrOutputTooLarge, found %v", err)
+	}
+	header := RSyncOp{opCode: HEADER, length: 1 << 62, blockSize: 64}
+	withHeader := append([]RSyncOp{header}, ops...)
+	if _, err := config.ApplyOps(original, opsChannelOf(withHeader...), -1); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("ApplyOps with a header: expected ErrOutputTooLarge, found %v", err)
+	}
+	if _, err := config.Patch(original, withHeader); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("Patch with a header: expected ErrOutputTooLarge, found %v", err)
+	}
+	if err := config.ApplyOpsWriter(original, opsChannelOf(withHeader...), io.Discard); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("ApplyOpsWriter with a header: expected ErrOutputTooLarge, found %v", err)
+	}
+
+	//重叠的 COPY 不能分配超过上限的内存
+	selfCopy := &Config{BlockSize: 64, SelfCopy: true, MaxOutputSize: 1 << 20}
+	copies := []RSyncOp{{opCode: DATA, data: []byte("ab")}, {opCode: COPY, offset: 0, length: 1 << 40}}
+	if _, err := selfCopy.Patch(original, copies); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("Patch with a COPY: expected ErrOutputTooLarge, found %v", err)
+	}
+	if err := selfCopy.ApplyOpsWriter(original, opsChannelOf(copies...), io.Discard); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("ApplyOpsWriter with a COPY: expected ErrOutputTooLarge, found %v", err)
+	}
+	if _, err := selfCopy.ApplyOps(original, opsChannelOf(copies...), 1<<20); err == nil {
+		t.Errorf("ApplyOps with a COPY: expected an error")
+	}
+
+	//输出超过上限
+	config.MaxOutputSize = int64(len(modified)) - 1
+	if err := config.ApplyOpsWriter(original, opsChannelOf(ops...), io.Discard); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("ApplyOpsWriter: expected ErrOutputTooLarge, found %v", err)
+	}
+	if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(ops...), io.Discard); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("ApplyOpsAt: expected ErrOutputTooLarge, found %v", err)
+	}
+	if _, err := config.Patch(original, ops); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("Patch: expected ErrOutputTooLarge, found %v", err)
+	}
+	if err := config.ApplyOpsParallel(original, ops, &bufferAt{}); !errors.Is(err, ErrOutputTooLarge) {
+		t.Errorf("ApplyOpsParallel: expected ErrOutputTooLarge, found %v", err)
+	}
+
+	config.MaxOutputSize = int64(len(modified))
+	if result, err := config.ApplyOps(original, opsChannelOf(ops...), len(modified)); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("expected output within the limit to apply: %v", err)
+	}
+	var result bytes.Buffer
+	if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(ops...), &result); err != nil || !bytes.Equal(result.Bytes(), modified) {
+		t.Errorf("ApplyOpsAt: expected output within the limit to apply: %v", err)
+	}
+}
+
+func Test_VerifyRollingHash(t *testing.T) {
+	//全是 0xff 的数据让和尽快增大
+	contents := [][]byte{randomContent(3000, 111), bytes.Repeat([]byte{0xff}, 3000), nil}
+	for _, content := range contents {
+		for _, blockSize := range []int{1, 7, 64, 1024, 4096} {
+			if err := VerifyRollingHash(content, blockSize); err != nil {
+				t.Errorf("block size %d: %v", blockSize, err)
+			}
+			for _, modulus := range []uint64{2, 251, 65521, 1 << 20, 1<<32 - 5, 1 << 32} {
+				config := &Config{BlockSize: blockSize, WeakModulus: modulus, Dedup: true}
+				if err := config.VerifyRollingHash(content); err != nil {
+					t.Errorf("block size %d modulus %d: %v", blockSize, modulus, err)
+				}
+			}
+		}
+	}
+
+	if err := (&Config{WeakHash: FNVWeakHash, Chunking: ContentDefinedChunking}).VerifyRollingHash(contents[0]); err == nil {
+		t.Errorf("expected an error for a weak hash that does not roll")
+	}
+	err := error(&RollingHashError{Offset: 3, Found: 1, Expected: 2, Signature: true})
+	if expected := "rsync: signature weak hash 0x00000001 at offset 3 differs from the direct weak hash 0x00000002"; err.Error() != expected {
+		t.Errorf("expected %q, found %q", expected, err)
+	}
+}
+
+func Test_DataZeroCopy(t *testing.T) {
+	original := randomContent(1024, 121)
+	modified := append(randomContent(100, 122), original...)
+
+	for _, copyData := range []bool{false, true} {
+		config := &Config{BlockSize: 64, CopyData: copyData}
+		target := append([]byte(nil), modified...)
+		ops := config.Diff(original, target)
+		opsChannel := make(chan RSyncOp)
+		go config.CalculateDifferences(target, config.CalculateBlockHashes(original), opsChannel)
+		ops = append(ops, drainedOps(opsChannel)...)
+
+		//修改目标数据后，零拷贝的 DATA 随之改变
+		target[0] ^= 0xff
+		for _, op := range ops {
+			if op.opCode != DATA {
+				continue
+			}
+			if shared := op.data[0] == target[0]; shared == copyData {
+				t.Errorf("CopyData %v: DATA shares memory with the target: %v", copyData, shared)
+			}
+		}
+	}
+}
+
+// Returns every operation received from the channel.
+func drainedOps(opsChannel chan RSyncOp) []RSyncOp {
+	var ops []RSyncOp
+	for op := range opsChannel {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func Test_BlockSizeLargerThanContent(t *testing.T) {
+	original := []byte("key = value\n")
+	pairs := [][]byte{original, []byte("key = other value\n"), []byte("k"), nil, append([]byte("# comment\n"), original...)}
+
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		config := &Config{BlockSize: 4096, Chunking: chunking}
+		hashes := config.CalculateBlockHashes(original)
+		//一个块覆盖整个文件
+		if len(hashes) != 1 || hashes[0].length != len(original) {
+			t.Fatalf("chunking %d: expected a single block of %d bytes, found %v", chunking, len(original), hashes)
+		}
+		for _, modified := range pairs {
+			ops := config.Diff(original, modified)
+			result, err := config.Patch(original, ops)
+			if err != nil || !bytes.Equal(result, modified) {
+				t.Errorf("chunking %d: %q did not round trip: %v", chunking, modified, err)
+			}
+			if bytes.Equal(modified, original) && !reflect.DeepEqual(ops, []RSyncOp{{opCode: BLOCK}}) {
+				t.Errorf("chunking %d: expected the whole file as one block, found %v", chunking, ops)
+			}
+
+			var delta, out bytes.Buffer
+			if err := config.ComputeDelta(bytes.NewReader(modified), hashes, &delta); err != nil {
+				t.Fatal(err)
+			}
+			if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannelOf(decodeOps(t, delta.Bytes())...), &out); err != nil || !bytes.Equal(out.Bytes(), modified) {
+				t.Errorf("chunking %d: %q did not round trip through the stream: %v", chunking, modified, err)
+			}
+			result, err = config.ApplyOps(original, opsChannelOf(ops...), len(modified))
+			if err != nil || !bytes.Equal(result, modified) {
+				t.Errorf("chunking %d: %q did not round trip through ApplyOps: %v", chunking, modified, err)
+			}
+		}
+	}
+	if n := BlockCount(10, 4096); n != 1 {
+		t.Errorf("expected one block, found %d", n)
+	}
+}
+
+func Test_Alignment(t *testing.T) {
+	//一千条 16 字节的记录
+	original := randomContent(16*1000, 64)
+	config := &Config{BlockSize: 50, Alignment: 16}
+	if size := config.blockSize(); size != 64 {
+		t.Fatalf("expected the block size rounded up to 64, found %d", size)
+	}
+	hashes := config.CalculateBlockHashes(original)
+	if len(hashes) != 250 {
+		t.Errorf("expected 250 blocks of 64 bytes, found %d", len(hashes))
+	}
+
+	//错位的数据不匹配，整条记录的移动仍然匹配
+	misaligned := editContent(original, insertAt(0, "12345"))
+	if ops := config.Diff(original, misaligned); len(ops) != 1 || ops[0].opCode != DATA {
+		t.Errorf("expected only DATA for misaligned records, found %d operations", len(ops))
+	}
+	if ops := (&Config{BlockSize: 64}).Diff(original, misaligned); len(ops) < 2 {
+		t.Errorf("expected unaligned matches without Alignment")
+	}
+	modified := editContent(original, insertAt(3200, "sixteen byte rec"), deleteAt(8000, 48), replaceAt(12005, "x"))
+	ops := config.Diff(original, modified)
+	if _, err := config.PlaceOps(original, ops); err != nil {
+		t.Fatal(err)
+	}
+	var blocks int
+	for _, op := range ops {
+		if op.opCode == BLOCK || op.opCode == BLOCKRUN {
+			blocks += max(op.blockCount, 1)
+			if op.OutputOffset()%16 != 0 {
+				t.Errorf("expected aligned blocks, found %v at %d", op, op.OutputOffset())
+			}
+		}
+	}
+	if blocks < 240 {
+		t.Errorf("expected the moved records to match, found %d blocks", blocks)
+	}
+	if result, err := config.Patch(original, ops); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("expected aligned operations to apply: %v", err)
+	}
+
+	//流式与并行计算使用相同的对齐
+	var delta bytes.Buffer
+	if err := config.ComputeDelta(bytes.NewReader(modified), hashes, &delta); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodeOps(t, delta.Bytes()), encodedOps(t, ops)) {
+		t.Errorf("expected the same streaming delta with Alignment")
+	}
+	var parallel []RSyncOp
+	config.calculateDifferencesParallel(context.Background(), modified, hashes, func(op RSyncOp) error {
+		parallel = append(parallel, op)
+		return nil
+	}, 4)
+	if !reflect.DeepEqual(parallel, config.Diff(original, modified)) {
+		t.Errorf("expected the same parallel operations with Alignment")
+	}
+}
+
+func Test_BailRatio(t *testing.T) {
+	original := randomContent(1<<20, 71)
+	different := randomContent(1<<20, 72)
+	similar := modifiedContent(original, 1, 73)
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		var scanned int
+		config := &Config{BlockSize: 1024, Chunking: chunking, BailRatio: 0.5}
+		config.Progress = func(bytesProcessed, totalBytes int) { scanned = bytesProcessed }
+		hashes := config.CalculateBlockHashes(original)
+		calculate := func(content []byte) ([]RSyncOp, error) {
+			opsChannel := make(chan RSyncOp)
+			errs := make(chan error, 1)
+			go func() { errs <- config.CalculateDifferencesContext(context.Background(), content, hashes, opsChannel) }()
+			ops := drainedOps(opsChannel)
+			return ops, <-errs
+		}
+
+		//很早就放弃
+		if _, err := calculate(different); !errors.Is(err, ErrTooDifferent) || scanned > 2*checkInterval {
+			t.Errorf("%v: expected ErrTooDifferent early, found %v after %d bytes", chunking, err, scanned)
+		}
+		if err := config.ComputeDelta(bytes.NewReader(different), hashes, io.Discard); !errors.Is(err, ErrTooDifferent) {
+			t.Errorf("%v: expected ErrTooDifferent from ComputeDelta, found %v", chunking, err)
+		}
+		ops, err := calculate(similar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err := config.Patch(original, ops); err != nil || !bytes.Equal(result, similar) {
+			t.Errorf("%v: sync did not work as expected: %v", chunking, err)
+		}
+	}
+
+	config := &Config{BlockSize: 64, BailRatio: 0.5}
+	err := config.calculateDifferencesParallel(context.Background(), different, config.CalculateBlockHashes(original), func(RSyncOp) error { return nil }, 4)
+	if !errors.Is(err, ErrTooDifferent) {
+		t.Errorf("expected ErrTooDifferent from the parallel computation, found %v", err)
+	}
+	//短数据在扫描结束时检查
+	err = config.Scan(context.Background(), []byte("short and different"), config.CalculateBlockHashes(original), func(*BlockHash, int, int) error { return nil }, func(int, int) error { return nil })
+	if !errors.Is(err, ErrTooDifferent) {
+		t.Errorf("expected ErrTooDifferent once the scan completes, found %v", err)
+	}
+}
+
+// binaryContent Returns n bytes of synthetic binary content: runs of 0x00,
+// runs of 0xFF and random bytes of 0x80 and above, of random lengths.
+func binaryContent(n int, seed int64) []byte {
+	r := rand.New(rand.NewSource(seed))
+	content := make([]byte, 0, n)
+	for len(content) < n {
+		run := make([]byte, min(1+r.Intn(3000), n-len(content)))
+		switch r.Intn(3) {
+		case 0:
+			//全零
+		case 1:
+			for i := range run {
+				run[i] = 0xff
+			}
+		default:
+			for i := range run {
+				run[i] = 0x80 | byte(r.Intn(0x80))
+			}
+		}
+		content = append(content, run...)
+	}
+	return content
+}
+
+func Test_BinaryContent(t *testing.T) {
+	high := randomContent(20000, 75)
+	for i := range high {
+		high[i] |= 0x80
+	}
+	contents := []struct {
+		name    string
+		content []byte
+	}{
+		{"0x00 runs", make([]byte, 20000)},
+		{"0xff runs", bytes.Repeat([]byte{0xff}, 20000)},
+		{"high bytes", high},
+		{"mixed", binaryContent(100000, 74)},
+	}
+	for _, test := range contents {
+		content := test.content
+		//弱hash的两个和与定义一致，rolling 与直接计算一致
+		for _, m := range []uint64{251, 65521, M, 1 << 32} {
+			a, b := weakSums(content[:4096], m)
+			if expectedA, expectedB := referenceWeakSums(content[:4096], m); a != expectedA || b != expectedB {
+				t.Errorf("%s modulo %d: expected sums %d and %d, found %d and %d", test.name, m, expectedA, expectedB, a, b)
+			}
+			if err := (&Config{BlockSize: 700, WeakModulus: m}).VerifyRollingHash(content); err != nil {
+				t.Errorf("%s modulo %d: %v", test.name, m, err)
+			}
+		}
+
+		//插入零字节，替换为高字节，删除
+		modified := editContent(content, insertAt(100, "\x00\x00\x00"), replaceAt(len(content)/2, "\xff\xfe\x80\x00"), deleteAt(len(content)-500, 100))
+		for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+			config := &Config{BlockSize: 512, Chunking: chunking}
+			ops := config.Diff(content, modified)
+			var literal int
+			for _, op := range ops {
+				literal += len(op.data)
+			}
+			if limit := 3 * 2 * config.maxBlockSize(); literal > limit {
+				t.Errorf("%s, %v: expected at most %d literal bytes, found %d", test.name, chunking, limit, literal)
+			}
+			//编码前后的操作体都能重建数据
+			for _, ops := range [][]RSyncOp{ops, encodedOps(t, ops)} {
+				if result, err := config.Patch(content, ops); err != nil || !bytes.Equal(result, modified) {
+					t.Errorf("%s, %v: sync did not work as expected: %v", test.name, chunking, err)
+				}
+			}
+			var delta, out bytes.Buffer
+			if err := config.ComputeDelta(bytes.NewReader(modified), config.CalculateBlockHashes(content), &delta); err != nil {
+				t.Fatal(err)
+			}
+			if err := config.ApplyOpsAt(bytes.NewReader(content), opsChannelOf(decodeOps(t, delta.Bytes())...), &out); err != nil || !bytes.Equal(out.Bytes(), modified) {
+				t.Errorf("%s, %v: streaming sync did not work as expected: %v", test.name, chunking, err)
+			}
+		}
+	}
+}
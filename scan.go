@@ -0,0 +1,50 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"context"
+)
+
+// Scan Finds the blocks of hashes in content with the default block size and
+// reports them to match, and the unmatched regions between them to literal,
+// without building any RSyncOp, for delta formats of one's own.
+//查找匹配块和未匹配的数据，不生成操作体
+func Scan(ctx context.Context, content []byte, hashes []BlockHash, match func(blockHash *BlockHash, start, end int) error, literal func(start, end int) error) error {
+	return defaultConfig.Scan(ctx, content, hashes, match, literal)
+}
+
+// Scan Finds the blocks of hashes in content with the configured block size,
+// chunking and matcher, the scan CalculateDifferences builds its operations
+// from. match is called for every block found at content[start:end], with its
+// hash in the signature, and literal for every unmatched content[start:end]
+// before or between them, in the order of content: together they cover it
+// exactly once. Blocks are reported one by one and unmatched regions whole:
+// BLOCKRUN, MinMatch and MaxDataOp only shape operations. Config.SelfCopy is
+// ignored. Stops at the first error returned by a callback, with
+// ErrTooDifferent past Config.BailRatio or when ctx is cancelled.
+func (c *Config) Scan(ctx context.Context, content []byte, hashes []BlockHash, match func(blockHash *BlockHash, start, end int) error, literal func(start, end int) error) error {
+	if err := c.checkBlockHashes(hashes); err != nil {
+		return err
+	}
+	if err := c.scan(ctx, content, hashes, nil, match, nil, literal); err != nil {
+		return err
+	}
+	c.reportProgress(len(content), len(content))
+	return nil
+}
+
+// Scans content for the blocks of hashes with the configured chunking, and for
+// earlier blocks of content itself with self when not nil, reporting the
+// blocks of hashes to match, the repeated blocks to copyBlock with the start of
+// their earlier copy, and the unmatched regions to literal.
+//按配置的分块方式查找，结果交给回调处理
+func (c *Config) scan(ctx context.Context, content []byte, hashes []BlockHash, self *selfBlocks, match func(blockHash *BlockHash, start, end int) error, copyBlock func(source, start, end int) error, literal func(start, end int) error) error {
+	if c.chunking() != FixedChunking {
+		return c.scanChunks(ctx, content, hashes, match, literal)
+	}
+	return c.scanBlocks(ctx, content, hashes, self, match, copyBlock, literal)
+}
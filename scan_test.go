@@ -0,0 +1,74 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the match scanner
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_Scan(t *testing.T) {
+	original := randomContent(64*300, 65)
+	modified := modifiedContent(original, 20, 66)
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		config := &Config{BlockSize: 64, Chunking: chunking, MinMatch: 200}
+		hashes := config.CalculateBlockHashes(original)
+		bounds := config.chunkBounds(original)
+
+		//按回调的结果重建数据
+		var result []byte
+		var matched, literals int
+		err := config.Scan(context.Background(), modified, hashes, func(blockHash *BlockHash, start, end int) error {
+			if start != len(result) {
+				t.Fatalf("%v: match at %d after %d bytes", chunking, start, len(result))
+			}
+			block, err := config.blocksContent(original, bounds, blockHash.Index(), 1)
+			if err != nil || !bytes.Equal(block, modified[start:end]) {
+				t.Fatalf("%v: block %d does not match content[%d:%d]", chunking, blockHash.Index(), start, end)
+			}
+			result = append(result, block...)
+			matched++
+			return nil
+		}, func(start, end int) error {
+			if start != len(result) || end <= start {
+				t.Fatalf("%v: literal [%d, %d) after %d bytes", chunking, start, end, len(result))
+			}
+			result = append(result, modified[start:end]...)
+			literals++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(result, modified) {
+			t.Errorf("%v: expected the callbacks to cover the content", chunking)
+		}
+		//与操作体中的块数一致
+		var blocks int
+		for _, op := range (&Config{BlockSize: 64, Chunking: chunking}).Diff(original, modified) {
+			if op.opCode == BLOCK || op.opCode == BLOCKRUN {
+				blocks += max(op.blockCount, 1)
+			}
+		}
+		if matched != blocks || literals == 0 {
+			t.Errorf("%v: expected %d matches and some literals, found %d and %d", chunking, blocks, matched, literals)
+		}
+	}
+
+	//回调的错误中止扫描
+	stop := errors.New("stop")
+	var calls int
+	err := Scan(context.Background(), original, CalculateBlockHashes(original), func(*BlockHash, int, int) error {
+		calls++
+		return stop
+	}, func(int, int) error { return nil })
+	if err != stop || calls != 1 {
+		t.Errorf("expected the scan to stop at the first error, found %v after %d calls", err, calls)
+	}
+}
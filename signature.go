@@ -0,0 +1,887 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// Serialized signature layout, version 5:
+//
+//	magic       4 bytes  "RSIG"
+//	version     1 byte   5
+//	strong len  1 byte   length of every strong hash
+//	block size  uvarint  (since version 3, 0 when unknown)
+//	modulus     uvarint  weak hash modulus (since version 3, 0 when unknown)
+//	strong name 1 byte length, name of the strong hash (since version 3)
+//	weak name   1 byte length, name of the weak hash (since version 4)
+//	file hash   1 byte length, whole-file hash (since version 3)
+//	total       uvarint  blocks of the content, see Signature.Blocks
+//	                     (since version 5, 0 when unknown)
+//	count       uvarint  number of blocks
+//	blocks      count times:
+//	  index     uvarint
+//	  length    uvarint  (absent in version 1, decoded as 0)
+//	  weak      4 bytes  big-endian (network byte order)
+//	  strong    strong len bytes, as returned by the strong hash
+//
+// MarshalSignature writes bare block hashes with version 2, which has no
+// fields of its own; Signature.MarshalBinary writes version 5.
+// uvarints are encoding/binary unsigned varints, which are defined byte by
+// byte, so a signature decodes the same on every architecture.
+//签名的序列化格式，带版本号以兼容以后的修改
+
+const (
+	signatureMagic = "RSIG"
+	// blockHashesVersion 只包含块哈希的签名格式版本
+	blockHashesVersion = 2
+	// signatureVersion 当前的签名格式版本
+	signatureVersion = 5
+)
+
+// Signature The block hashes of some content along with a strong hash of the
+// whole content.
+//签名：每个块的哈希值以及整个文件的强hash
+type Signature struct {
+	// BlockSize Block size of the configuration that computed the signature,
+	// checked against the configuration computing differences. 0 means unknown.
+	//计算签名时的块大小，0 表示未知
+	BlockSize int
+	// WeakModulus Weak hash modulus of the configuration that computed the
+	// signature, checked like BlockSize. 0 means unknown.
+	//计算签名时弱hash的模数，0 表示未知
+	WeakModulus uint64
+	// StrongHash Name of the strong hash of the configuration that computed
+	// the signature, see Config.StrongHashName, checked like BlockSize. Empty
+	// means unknown.
+	//计算签名时强hash的名称，空表示未知
+	StrongHash string
+	// WeakHash Name of the weak hash of the configuration that computed the
+	// signature, as returned by WeakHashKind.String, checked like BlockSize.
+	// Empty means unknown.
+	//计算签名时弱hash的名称，空表示未知
+	WeakHash string
+	// Hashes 每个块的哈希值
+	Hashes []BlockHash
+	// Blocks Number of blocks of the content, counting the ones Config.Dedup
+	// left out of Hashes, so a deduplicated signature still tells how many
+	// blocks the content has. 0 means unknown.
+	//数据的块数，包括去重时省略的块，0 表示未知
+	Blocks int
+	// FileHash 整个文件的强hash，不截断
+	FileHash []byte
+}
+
+// ErrChecksumMismatch Returned by VerifyResult when the reconstructed content
+// does not have the expected whole-file hash.
+var ErrChecksumMismatch = errors.New("rsync: reconstructed content does not match the expected checksum")
+
+// CalculateSignature Returns the block hashes of content, like
+// CalculateBlockHashes, along with its whole-file hash, using the default
+// configuration.
+//计算签名，包括整个文件的强hash
+func CalculateSignature(content []byte) *Signature {
+	return defaultConfig.CalculateSignature(content)
+}
+
+// CalculateSignature Returns the block hashes and whole-file hash of content
+// using the configuration.
+func (c *Config) CalculateSignature(content []byte) *Signature {
+	hashes := c.allBlockHashes(content)
+	return &Signature{
+		BlockSize:   c.blockSize(),
+		WeakModulus: c.weakModulus(),
+		StrongHash:  c.strongHashName(),
+		WeakHash:    c.weakHashKind().String(),
+		Hashes:      c.dedup(hashes),
+		Blocks:      len(hashes),
+		FileHash:    c.FileHash(content),
+	}
+}
+
+// Config Returns a copy of base, or of the default configuration when base is
+// nil, with the settings s records: block size, weak hash modulus, weak hash,
+// strong hash and length of the strong hashes. Differences computed or
+// operations applied with it then cannot mismatch the signature. Settings s
+// does not record, such as Chunking, Alignment or HashKey, come from base.
+// Only the name of the strong hash is recorded, so a strong hash other than
+// "md5" or "sha256" must be the StrongHash of base, and an HMAC needs the
+// HashKey of base; otherwise the error wraps ErrSignatureMismatch.
+//根据签名中记录的参数生成配置
+func (s *Signature) Config(base *Config) (*Config, error) {
+	c := NewDefaultConfig()
+	if base != nil {
+		copied := *base
+		c = &copied
+	}
+	if s.BlockSize > 0 {
+		c.BlockSize = s.BlockSize
+	}
+	if s.WeakModulus > 0 {
+		c.WeakModulus = s.WeakModulus
+	}
+	for _, kind := range []WeakHashKind{RollingWeakHash, FNVWeakHash} {
+		if s.WeakHash == kind.String() {
+			c.WeakHash = kind
+		}
+	}
+	if err := c.useStrongHash(s.StrongHash); err != nil {
+		return nil, err
+	}
+	if len(s.Hashes) > 0 {
+		c.StrongHashLen = len(s.Hashes[0].strongHash)
+		c.SkipStrongHash = c.StrongHashLen == 0
+	}
+	//签名中未记录的参数仍需与签名一致
+	if err := c.checkSignatureConfig(s); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Sets the strong hash called name, as returned by strongHashName, unless it
+// is the configured one or name is empty.
+//设置名称对应的强hash
+func (c *Config) useStrongHash(name string) error {
+	if name == "" || name == c.strongHashName() {
+		return nil
+	}
+	hashName, keyed := strings.CutPrefix(name, "hmac-")
+	if keyed != (len(c.HashKey) > 0) {
+		return fmt.Errorf("%w: strong hash %q, configured %q", ErrSignatureMismatch, name, c.strongHashName())
+	}
+	//StrongHash 为 nil 时，没有密钥使用 md5，有密钥使用 HMAC-SHA256
+	switch {
+	case hashName == "md5" && !keyed, hashName == "sha256" && keyed:
+		c.StrongHash, c.StrongHashName = nil, ""
+	case hashName == "md5":
+		c.StrongHash, c.StrongHashName = md5.New, hashName
+	case hashName == "sha256":
+		c.StrongHash, c.StrongHashName = sha256.New, hashName
+	default:
+		return fmt.Errorf("%w: unknown strong hash %q", ErrSignatureMismatch, name)
+	}
+	return nil
+}
+
+// Differences Computes the operations needed to recreate content from the
+// basis described by s, like CalculateSignatureDifferences, with the
+// configuration returned by s.Config(nil), so no setting can mismatch s.
+// The channel is always closed on return.
+//使用签名中记录的参数计算不同
+func (s *Signature) Differences(ctx context.Context, content []byte, opsChannel chan RSyncOp) error {
+	c, err := s.Config(nil)
+	if err != nil {
+		close(opsChannel)
+		return err
+	}
+	return c.CalculateSignatureDifferences(ctx, content, s, opsChannel)
+}
+
+// ApplyOps Applies operations computed against s to content, the basis s
+// describes, like ApplyOps, with the configuration returned by s.Config(nil).
+// On error the remaining operations are drained so the sender is not blocked.
+//使用签名中记录的参数组装
+func (s *Signature) ApplyOps(content []byte, ops chan RSyncOp, fileSize int) ([]byte, error) {
+	c, err := s.Config(nil)
+	if err != nil {
+		drainOps(ops)
+		return nil, err
+	}
+	return c.ApplyOps(content, ops, fileSize)
+}
+
+// MergeSignatures Returns the union of the blocks of sigs, the signatures of
+// several candidate bases such as previous versions of a file, so the
+// differences match blocks of any of them and the delta gets smaller. Every
+// block records the position of its signature in sigs, which BLOCK and
+// BLOCKRUN operations carry and ApplyOpsMulti uses to pick the basis.
+//
+// Block indexes are only meaningful with the block size the bases were cut
+// with, so the signatures must agree on it, as on the weak and strong hashes:
+// a signature computed with another configuration is rejected rather than
+// merged, and the merged signature is then checked against the configuration
+// computing differences like any other. The merged signature has no
+// whole-file hash. The basis of a block is not encoded by MarshalBinary, so
+// signatures are exchanged one per basis and merged where the differences are
+// computed.
+//合并多个原数据的签名
+func MergeSignatures(sigs ...*Signature) (*Signature, error) {
+	if len(sigs) == 0 {
+		return nil, errors.New("rsync: no signature to merge")
+	}
+	first := sigs[0]
+	merged := &Signature{BlockSize: first.BlockSize, WeakModulus: first.WeakModulus, StrongHash: first.StrongHash, WeakHash: first.WeakHash}
+	for basis, sig := range sigs {
+		if sig.BlockSize != first.BlockSize || sig.WeakModulus != first.WeakModulus || sig.StrongHash != first.StrongHash || sig.WeakHash != first.WeakHash {
+			return nil, fmt.Errorf("%w: signature %d was computed with another configuration than signature 0", ErrSignatureMismatch, basis)
+		}
+		for _, h := range sig.Hashes {
+			if h.basis != 0 {
+				return nil, fmt.Errorf("rsync: signature %d is already merged", basis)
+			}
+			h.basis = basis
+			merged.Hashes = append(merged.Hashes, h)
+		}
+	}
+	return merged, nil
+}
+
+// Range A range of bytes of some content.
+//数据中的一段
+type Range struct {
+	// Offset 起点
+	Offset int
+	// Length 长度
+	Length int
+}
+
+// UpdateSignature Returns the signature of content, which is the content sig
+// was computed from with the bytes in changedRanges modified in place and
+// possibly grown or truncated at the end, using the default configuration.
+// Only the blocks overlapping changedRanges, and those that appeared or
+// changed length at the end, are hashed again; the others are copied from
+// sig, so the blocks are identical to a full recomputation. The whole-file
+// hash would take all of content and is left out; compute it with FileHash
+// when needed. sig is not modified.
+//增量更新签名，只重新计算修改过的块
+func UpdateSignature(sig *Signature, content []byte, changedRanges []Range) *Signature {
+	return defaultConfig.UpdateSignature(sig, content, changedRanges)
+}
+
+// UpdateSignature Returns the signature of content updated from sig using the
+// configuration. When the blocks of sig cannot be reused, because sig does not
+// fit the configuration, was deduplicated, or blocks are variable length and
+// move with any change, the whole signature is computed again.
+func (c *Config) UpdateSignature(sig *Signature, content []byte, changedRanges []Range) *Signature {
+	updated := &Signature{
+		BlockSize:   c.blockSize(),
+		WeakModulus: c.weakModulus(),
+		StrongHash:  c.strongHashName(),
+		WeakHash:    c.weakHashKind().String(),
+	}
+	reusable := c.checkSignatureConfig(sig) == nil && c.chunking() == FixedChunking && (c == nil || !c.Dedup)
+	for i, h := range sig.Hashes {
+		//块下标与位置一致，长度已知
+		reusable = reusable && h.index == i && h.length > 0
+	}
+	if !reusable {
+		return c.CalculateSignature(content)
+	}
+	blockSize := c.blockSize()
+	count := getBlocksNumber(content, blockSize)
+	changed := make([]bool, count)
+	for _, r := range changedRanges {
+		from, to := max(r.Offset, 0), min(r.Offset+r.Length, len(content))
+		for i := from / blockSize; i < count && i*blockSize < to; i++ {
+			changed[i] = true
+		}
+	}
+	updated.Hashes = make([]BlockHash, count)
+	updated.Blocks = count
+	for i := range updated.Hashes {
+		block := content[i*blockSize : min((i+1)*blockSize, len(content))]
+		if i < len(sig.Hashes) && !changed[i] && sig.Hashes[i].length == len(block) {
+			updated.Hashes[i] = sig.Hashes[i]
+		} else {
+			updated.Hashes[i] = c.newBlockHash(i, block)
+		}
+	}
+	return updated
+}
+
+// FileHash Returns the whole-file strong hash of content, never truncated,
+// using the default configuration. The side holding the modified content sends
+// it along with the operations so the result can be checked with VerifyResult.
+//整个文件的强hash
+func FileHash(content []byte) []byte {
+	return defaultConfig.FileHash(content)
+}
+
+// FileHash Returns the whole-file hash of content with the configured strong
+// hash.
+func (c *Config) FileHash(content []byte) []byte {
+	h := c.newStrongHash()
+	h.Write(content)
+	return h.Sum(nil)
+}
+
+// VerifyResult Checks the content reconstructed by ApplyOps against the
+// whole-file hash of the modified content, as returned by FileHash or found in
+// the Signature of the modified content, using the default configuration.
+// Returns ErrChecksumMismatch if they differ.
+//校验组装后的数据
+func VerifyResult(result, fileHash []byte) error {
+	return defaultConfig.VerifyResult(result, fileHash)
+}
+
+// VerifyResult Checks reconstructed content against the whole-file hash of
+// the modified content using the configured strong hash.
+func (c *Config) VerifyResult(result, fileHash []byte) error {
+	if !bytes.Equal(c.FileHash(result), fileHash) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// BlockMismatchError The first block of reconstructed content that does not
+// match the signature of the intended content, as reported by
+// VerifyAgainstSignature.
+//组装后的数据中与签名不一致的第一个块
+type BlockMismatchError struct {
+	// Index 块下标
+	Index int
+	// Offset 块在组装后数据中的起点，块超出数据时为数据的长度
+	Offset int
+}
+
+func (e *BlockMismatchError) Error() string {
+	return fmt.Sprintf("rsync: block %d at offset %d does not match the signature", e.Index, e.Offset)
+}
+
+// VerifyAgainstSignature Checks content reconstructed by ApplyOps block by
+// block against targetSig, the signature of the intended content, using the
+// default configuration. Unlike VerifyResult it locates the first wrong block,
+// returned as a *BlockMismatchError, which points at the operation that went
+// wrong. The whole-file hash of targetSig, if any, is checked too.
+//按块校验组装后的数据
+func VerifyAgainstSignature(output []byte, targetSig *Signature) error {
+	return defaultConfig.VerifyAgainstSignature(output, targetSig)
+}
+
+// VerifyAgainstSignature Checks reconstructed content block by block against
+// the signature of the intended content using the configuration, which must
+// fit targetSig. Blocks left out of a signature computed with Config.Dedup
+// are only checked to be some block of the signature, and otherwise covered
+// by the whole-file hash. The number of blocks must be Signature.Blocks when
+// known.
+func (c *Config) VerifyAgainstSignature(output []byte, targetSig *Signature) error {
+	if err := c.checkSignatureConfig(targetSig); err != nil {
+		return err
+	}
+	//不去重，块下标与位置一致
+	hashes := c.allBlockHashes(output)
+	offsets := make([]int, len(hashes)+1)
+	for i, h := range hashes {
+		offsets[i+1] = offsets[i] + h.length
+	}
+	for _, h := range targetSig.Hashes {
+		if h.index >= len(hashes) {
+			return &BlockMismatchError{Index: h.index, Offset: len(output)}
+		}
+		found := hashes[h.index]
+		if found.weakHash != h.weakHash || !bytes.Equal(found.strongHash, h.strongHash) || (h.length > 0 && found.length != h.length) {
+			return &BlockMismatchError{Index: h.index, Offset: offsets[h.index]}
+		}
+	}
+	//块数已知时必须一致
+	if blocks := targetSig.Blocks; blocks > 0 && len(hashes) != blocks {
+		index := min(len(hashes), blocks)
+		return &BlockMismatchError{Index: index, Offset: offsets[index]}
+	}
+	//块数未知时，签名中最后一个块之后的块可能是去重时省略的块，必须是签名中的某个块
+	last := -1
+	for _, h := range targetSig.Hashes {
+		last = max(last, h.index)
+	}
+	if last+1 < len(hashes) {
+		listed := make(map[blockKey]bool, len(targetSig.Hashes))
+		for _, h := range targetSig.Hashes {
+			listed[keyOf(h)] = true
+		}
+		for i := last + 1; i < len(hashes); i++ {
+			if !listed[keyOf(hashes[i])] {
+				return &BlockMismatchError{Index: i, Offset: offsets[i]}
+			}
+		}
+	}
+	if len(targetSig.FileHash) > 0 {
+		return c.VerifyResult(output, targetSig.FileHash)
+	}
+	return nil
+}
+
+// MarshalSignature Serializes block hashes so a signature can be stored and
+// reused for later syncs. All strong hashes must have the same length.
+// Use Signature.MarshalBinary to keep the configuration along with them.
+//序列化签名
+func MarshalSignature(hashes []BlockHash) ([]byte, error) {
+	strongLen, err := strongHashLen(hashes)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(signatureMagic)+2+binary.MaxVarintLen64+len(hashes)*(2*binary.MaxVarintLen64+4+strongLen))
+	buf = append(buf, signatureMagic...)
+	buf = append(buf, blockHashesVersion, byte(strongLen))
+	return appendBlockHashes(buf, hashes, strongLen)
+}
+
+// UnmarshalSignature Deserializes block hashes written by MarshalSignature,
+// or the block hashes of a signature written by Signature.MarshalBinary.
+//反序列化签名
+func UnmarshalSignature(data []byte) ([]BlockHash, error) {
+	var sig Signature
+	if err := sig.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return sig.Hashes, nil
+}
+
+// MarshalBinary Serializes the signature with its configuration and file
+// hash, so it can be checked against the configuration that uses it once
+// deserialized.
+//序列化签名及其配置
+func (s *Signature) MarshalBinary() ([]byte, error) {
+	strongLen, err := strongHashLen(s.Hashes)
+	if err != nil {
+		return nil, err
+	}
+	if s.BlockSize < 0 || s.Blocks < 0 {
+		return nil, fmt.Errorf("rsync: block size %d or block count %d out of range", s.BlockSize, s.Blocks)
+	}
+	if len(s.StrongHash) > 255 || len(s.WeakHash) > 255 {
+		return nil, errors.New("rsync: hash name too long")
+	}
+	if len(s.FileHash) > 255 {
+		return nil, fmt.Errorf("rsync: file hash of %d bytes is too long", len(s.FileHash))
+	}
+	buf := make([]byte, 0, len(signatureMagic)+5+3*binary.MaxVarintLen64+len(s.StrongHash)+len(s.WeakHash)+len(s.FileHash)+len(s.Hashes)*(2*binary.MaxVarintLen64+4+strongLen))
+	buf = append(buf, signatureMagic...)
+	buf = append(buf, signatureVersion, byte(strongLen))
+	buf = binary.AppendUvarint(buf, uint64(s.BlockSize))
+	buf = binary.AppendUvarint(buf, s.WeakModulus)
+	buf = append(buf, byte(len(s.StrongHash)))
+	buf = append(buf, s.StrongHash...)
+	buf = append(buf, byte(len(s.WeakHash)))
+	buf = append(buf, s.WeakHash...)
+	buf = append(buf, byte(len(s.FileHash)))
+	buf = append(buf, s.FileHash...)
+	buf = binary.AppendUvarint(buf, uint64(s.Blocks))
+	return appendBlockHashes(buf, s.Hashes, strongLen)
+}
+
+// UnmarshalBinary Deserializes a signature written by MarshalBinary. Block
+// hashes written by MarshalSignature are accepted too, with the configuration
+// left unknown.
+//反序列化签名及其配置
+func (s *Signature) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, []byte(signatureMagic)) {
+		return errors.New("rsync: not a signature")
+	}
+	r := bytes.NewReader(data[len(signatureMagic):])
+	version, err := r.ReadByte()
+	if err != nil {
+		return ErrShortRead
+	}
+	if version < 1 || version > signatureVersion {
+		return fmt.Errorf("rsync: unsupported signature version %d", version)
+	}
+	strongLen, err := r.ReadByte()
+	if err != nil {
+		return ErrShortRead
+	}
+	var sig Signature
+	if version >= 3 {
+		blockSize, err := binary.ReadUvarint(r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if blockSize > math.MaxInt32 {
+			return fmt.Errorf("rsync: block size %d out of range", blockSize)
+		}
+		sig.BlockSize = int(blockSize)
+		if sig.WeakModulus, err = binary.ReadUvarint(r); err != nil {
+			return unexpectedEOF(err)
+		}
+		name, err := readShortBytes(r)
+		if err != nil {
+			return err
+		}
+		sig.StrongHash = string(name)
+		if version >= 4 {
+			if name, err = readShortBytes(r); err != nil {
+				return err
+			}
+			sig.WeakHash = string(name)
+		}
+		if sig.FileHash, err = readShortBytes(r); err != nil {
+			return err
+		}
+	}
+	if version >= 5 {
+		blocks, err := binary.ReadUvarint(r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if blocks > math.MaxInt32 {
+			return fmt.Errorf("rsync: block count %d out of range", blocks)
+		}
+		sig.Blocks = int(blocks)
+	}
+	if sig.Hashes, err = readBlockHashes(r, version, int(strongLen)); err != nil {
+		return err
+	}
+	*s = sig
+	return nil
+}
+
+// Returns the length shared by the strong hashes of all the blocks.
+func strongHashLen(hashes []BlockHash) (int, error) {
+	var strongLen int
+	if len(hashes) > 0 {
+		strongLen = len(hashes[0].strongHash)
+	}
+	if strongLen > 255 {
+		return 0, fmt.Errorf("rsync: strong hash of %d bytes is too long", strongLen)
+	}
+	return strongLen, nil
+}
+
+// Appends the count and the encoding of every block to buf.
+//编码块的数量以及每个块
+func appendBlockHashes(buf []byte, hashes []BlockHash, strongLen int) ([]byte, error) {
+	buf = binary.AppendUvarint(buf, uint64(len(hashes)))
+	for _, h := range hashes {
+		if len(h.strongHash) != strongLen {
+			return nil, fmt.Errorf("rsync: block %d has a %d byte strong hash, expected %d", h.index, len(h.strongHash), strongLen)
+		}
+		if h.basis != 0 {
+			return nil, fmt.Errorf("rsync: block %d of basis %d: merged signatures cannot be encoded", h.index, h.basis)
+		}
+		buf = binary.AppendUvarint(buf, uint64(h.index))
+		buf = binary.AppendUvarint(buf, uint64(h.length))
+		buf = binary.BigEndian.AppendUint32(buf, h.weakHash)
+		buf = append(buf, h.strongHash...)
+	}
+	return buf, nil
+}
+
+// Reads the blocks written by appendBlockHashes, which must end the data.
+//解码块的数量以及每个块
+func readBlockHashes(r *bytes.Reader, version byte, strongLen int) ([]BlockHash, error) {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	//每个块至少占用 1+4+strongLen 字节，防止伪造的数量导致过量分配
+	if count > uint64(r.Len()/(1+4+strongLen)) {
+		return nil, ErrShortRead
+	}
+
+	hashes := make([]BlockHash, count)
+	for i := range hashes {
+		index, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if index > math.MaxInt32 {
+			return nil, fmt.Errorf("rsync: block index %d out of range", index)
+		}
+		var length uint64
+		if version >= 2 {
+			if length, err = binary.ReadUvarint(r); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if length > math.MaxInt32 {
+				return nil, fmt.Errorf("rsync: block length %d out of range", length)
+			}
+		}
+		var fixed [4]byte
+		if _, err := io.ReadFull(r, fixed[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		strong := make([]byte, strongLen)
+		if _, err := io.ReadFull(r, strong); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		hashes[i] = BlockHash{index: int(index), weakHash: binary.BigEndian.Uint32(fixed[:]), strongHash: strong, length: int(length)}
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("rsync: %d trailing bytes after signature", r.Len())
+	}
+	return hashes, nil
+}
+
+// Reads a field of at most 255 bytes preceded by its length.
+//读取一个字节长度前缀的字段
+func readShortBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrShortRead
+	}
+	field := make([]byte, n)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return field, nil
+}
+
+// blockKey The hashes identifying the content of a block.
+type blockKey struct {
+	weak   uint32
+	strong string
+}
+
+// Returns the key of the content of the block of h.
+func keyOf(h BlockHash) blockKey {
+	return blockKey{h.weakHash, string(h.strongHash)}
+}
+
+// DedupBlockHashes Collapses blocks with identical weak and strong hashes into
+// the entry of the first one, shrinking the signature of content with repeated
+// regions. The differences still reconstruct correctly since any of the
+// identical blocks reproduces the same bytes.
+// Returns the remaining hashes and the fraction of entries removed.
+//去除重复的块，返回剩余的块和去重比例
+func DedupBlockHashes(hashes []BlockHash) ([]BlockHash, float64) {
+	if len(hashes) == 0 {
+		return hashes, 0
+	}
+	seen := make(map[blockKey]bool, len(hashes))
+	unique := make([]BlockHash, 0, len(hashes))
+	for _, h := range hashes {
+		key := keyOf(h)
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, h)
+		}
+	}
+	return unique, 1 - float64(len(unique))/float64(len(hashes))
+}
+
+// BucketStats How the blocks of a signature spread over weak hash buckets.
+// Deep buckets mean many blocks share a weak hash, so every candidate match
+// costs several strong hash comparisons; a larger block size usually helps.
+//弱hash分桶的统计信息
+type BucketStats struct {
+	// Blocks 块的数量
+	Blocks int
+	// Buckets 不同弱hash的数量
+	Buckets int
+	// MaxDepth 最大的桶中块的数量
+	MaxDepth int
+	// Depths 桶的深度 -> 该深度的桶的数量
+	Depths map[int]int
+}
+
+// HashBucketStats Returns the weak hash bucket statistics of a signature, from
+// the same buckets used when computing differences.
+//统计签名中弱hash的分桶情况
+func HashBucketStats(hashes []BlockHash) BucketStats {
+	hashesMap := buildHashesMap(hashes)
+	stats := BucketStats{Blocks: len(hashes), Buckets: len(hashesMap), Depths: make(map[int]int)}
+	for _, bucket := range hashesMap {
+		stats.MaxDepth = max(stats.MaxDepth, len(bucket))
+		stats.Depths[len(bucket)]++
+	}
+	return stats
+}
+
+// Applies DedupBlockHashes when enabled by the configuration.
+func (c *Config) dedup(hashes []BlockHash) []BlockHash {
+	if c == nil || !c.Dedup {
+		return hashes
+	}
+	unique, _ := DedupBlockHashes(hashes)
+	return unique
+}
+
+// Checks that sig was computed with the configured block size, weak hash,
+// weak hash modulus and strong hash, when known, then checks its block hashes.
+//检查签名的块大小、弱hash、弱hash模数和强hash与配置是否一致
+func (c *Config) checkSignatureConfig(sig *Signature) error {
+	if sig.BlockSize > 0 && sig.BlockSize != c.blockSize() {
+		return fmt.Errorf("%w: block size %d, configured %d", ErrSignatureMismatch, sig.BlockSize, c.blockSize())
+	}
+	if sig.WeakModulus > 0 && sig.WeakModulus != c.weakModulus() {
+		return fmt.Errorf("%w: weak hash modulus %d, configured %d", ErrSignatureMismatch, sig.WeakModulus, c.weakModulus())
+	}
+	if name := c.weakHashKind().String(); sig.WeakHash != "" && sig.WeakHash != name {
+		return fmt.Errorf("%w: weak hash %q, configured %q", ErrSignatureMismatch, sig.WeakHash, name)
+	}
+	if name := c.strongHashName(); sig.StrongHash != "" && name != "" && sig.StrongHash != name {
+		return fmt.Errorf("%w: strong hash %q, configured %q", ErrSignatureMismatch, sig.StrongHash, name)
+	}
+	if len(sig.Hashes) > 0 && len(sig.Hashes[0].strongHash) != c.StrongHashSize() {
+		return fmt.Errorf("%w: strong hashes have %d bytes, the configuration keeps %d", ErrSignatureMismatch, len(sig.Hashes[0].strongHash), c.StrongHashSize())
+	}
+	return c.checkSignature(sig.Hashes)
+}
+
+// Checks block hashes passed without their Signature as the blocks of a
+// signature computed with the configuration, the same way as the blocks of
+// a Signature whose configuration is unknown, see checkSignatureConfig.
+//检查没有签名的块哈希，与配置未知的签名相同
+func (c *Config) checkBlockHashes(hashes []BlockHash) error {
+	return c.checkSignatureConfig(&Signature{Hashes: hashes})
+}
+
+// Checks that the block hashes can be matched with the configuration, so a
+// signature built with another block size is rejected before any BLOCK op
+// references blocks that do not exist in the basis.
+// Block lengths are only checked when known (not for version 1 signatures).
+//检查签名中的块下标和块长度与配置是否一致
+func (c *Config) checkSignature(hashes []BlockHash) error {
+	if kind := c.weakHashKind(); kind != RollingWeakHash && c.chunking() == FixedChunking {
+		return fmt.Errorf("rsync: weak hash %v cannot roll, it needs ContentDefinedChunking", kind)
+	}
+	blockSize := c.blockSize()
+	maxBlockSize := c.maxBlockSize()
+	//固定长度的块中，每个原数据只有最后一个块可以不足 blockSize
+	lastIndex, shortIndex := make(map[int]int), make(map[int]int)
+	skipStrong := c != nil && c.SkipStrongHash
+	for _, h := range hashes {
+		//没有强hash的签名只能在 SkipStrongHash 时使用，否则所有的块都无法匹配
+		if !skipStrong && len(h.strongHash) == 0 {
+			return fmt.Errorf("%w: block %d has no strong hash", ErrSignatureMismatch, h.index)
+		}
+		if h.index < 0 {
+			return fmt.Errorf("%w: block %d", ErrSignatureIndex, h.index)
+		}
+		if h.length > maxBlockSize {
+			return fmt.Errorf("%w: block %d has %d bytes, more than the block size %d", ErrSignatureMismatch, h.index, h.length, maxBlockSize)
+		}
+		if last, ok := lastIndex[h.basis]; !ok || h.index > last {
+			lastIndex[h.basis] = h.index
+		}
+		if c.chunking() == FixedChunking && h.length > 0 && h.length < blockSize {
+			if short, ok := shortIndex[h.basis]; ok && short != h.index {
+				return fmt.Errorf("%w: blocks %d and %d are shorter than the block size %d", ErrSignatureMismatch, short, h.index, blockSize)
+			}
+			shortIndex[h.basis] = h.index
+		}
+	}
+	for basis, short := range shortIndex {
+		if lastIndex[basis] > short {
+			return fmt.Errorf("%w: block %d after block %d, shorter than the block size", ErrSignatureMismatch, lastIndex[basis], short)
+		}
+	}
+	return nil
+}
+
+var (
+	// ErrSignatureIndex Returned by Signature.Validate for a block index that
+	// is negative, repeated or out of order.
+	ErrSignatureIndex = errors.New("rsync: invalid signature block index")
+	// ErrSignatureStrongHash Returned by Signature.Validate for a strong hash
+	// of another length than the others, or longer than the named hash.
+	ErrSignatureStrongHash = errors.New("rsync: invalid signature strong hash")
+	// ErrSignatureWeakHash Returned by Signature.Validate for a rolling weak
+	// hash whose sums are not below the weak hash modulus.
+	ErrSignatureWeakHash = errors.New("rsync: invalid signature weak hash")
+	// ErrSignatureLength Returned by Signature.Validate for a block size or
+	// block length that does not fit the content the blocks were cut from.
+	ErrSignatureLength = errors.New("rsync: invalid signature block length")
+)
+
+// strongHashSizes Sizes of the strong hashes known by name, which the strong
+// hashes of a signature may be truncated to but not exceed.
+var strongHashSizes = map[string]int{
+	"md5":         16,
+	"hmac-sha256": 32,
+	"md4":         16,
+	"blake2b-256": 32,
+}
+
+// Validate Checks the internal consistency of the signature before it is
+// trusted, such as one read from a file that may be corrupted or crafted:
+//
+//   - block indexes are unique and increasing, with the gaps left by Dedup
+//     allowed, and start over for every basis of a merged signature;
+//   - strong hashes all have the same length, at most the size of the named
+//     strong hash;
+//   - rolling weak hashes are made of sums below the weak hash modulus;
+//   - block lengths fit the block size and only the last block of a basis is
+//     shorter, so the number of blocks matches the length of the content.
+//
+// The signature does not record how its blocks were cut. Blocks are taken as
+// fixed size unless the weak hash needs content-defined chunks; validate
+// content-defined chunks hashed with the rolling weak hash with
+// Config.ValidateSignature. The error wraps ErrSignatureIndex,
+// ErrSignatureStrongHash, ErrSignatureWeakHash or ErrSignatureLength.
+//检查签名内部是否一致
+func (s *Signature) Validate() error {
+	chunking := FixedChunking
+	if s.WeakHash != "" && s.WeakHash != RollingWeakHash.String() {
+		chunking = ContentDefinedChunking
+	}
+	return s.validate(chunking)
+}
+
+// ValidateSignature Checks the internal consistency of sig like
+// Signature.Validate, with blocks cut by the configured chunking. It does
+// not compare the signature with the configuration.
+func (c *Config) ValidateSignature(sig *Signature) error {
+	return sig.validate(c.chunking())
+}
+
+// Checks the signature with blocks cut by chunking.
+func (s *Signature) validate(chunking ChunkingMode) error {
+	if s.BlockSize < 0 {
+		return fmt.Errorf("%w: block size %d", ErrSignatureLength, s.BlockSize)
+	}
+	maxLength := s.BlockSize
+	if chunking != FixedChunking {
+		maxLength = (&Config{BlockSize: s.BlockSize, Chunking: chunking}).maxBlockSize()
+	}
+	strongLen, _ := strongHashLen(s.Hashes)
+	if size, ok := strongHashSizes[s.StrongHash]; ok && strongLen > size {
+		return fmt.Errorf("%w: %d bytes, more than the %d of %s", ErrSignatureStrongHash, strongLen, size, s.StrongHash)
+	}
+	rolling := s.WeakModulus > 0 && (s.WeakHash == "" || s.WeakHash == RollingWeakHash.String())
+	for i, h := range s.Hashes {
+		if h.index < 0 {
+			return fmt.Errorf("%w: block %d", ErrSignatureIndex, h.index)
+		}
+		//每个原数据中下标递增，原数据按顺序排列
+		if i > 0 {
+			prev := s.Hashes[i-1]
+			if h.basis < prev.basis || (h.basis == prev.basis && h.index <= prev.index) {
+				return fmt.Errorf("%w: block %d after block %d", ErrSignatureIndex, h.index, prev.index)
+			}
+		}
+		if len(h.strongHash) != strongLen {
+			return fmt.Errorf("%w: block %d has %d bytes, expected %d", ErrSignatureStrongHash, h.index, len(h.strongHash), strongLen)
+		}
+		if rolling && !weakHashInRange(h.weakHash, s.WeakModulus) {
+			return fmt.Errorf("%w: block %d has %#08x, modulus %d", ErrSignatureWeakHash, h.index, h.weakHash, s.WeakModulus)
+		}
+		//长度未知（版本 1 的签名）或块大小未知时不检查
+		if h.length == 0 || s.BlockSize == 0 {
+			continue
+		}
+		if h.length > maxLength {
+			return fmt.Errorf("%w: block %d has %d bytes, more than %d", ErrSignatureLength, h.index, h.length, maxLength)
+		}
+		last := i == len(s.Hashes)-1 || s.Hashes[i+1].basis != h.basis
+		if chunking == FixedChunking && h.length < s.BlockSize && !last {
+			return fmt.Errorf("%w: block %d has %d bytes but is not the last one", ErrSignatureLength, h.index, h.length)
+		}
+	}
+	return nil
+}
+
+// Reports whether weak, a rolling weak hash, is made of two sums below m, as
+// composed by composeWeakHash. Moduli wider than 16 bits mix the sums, which
+// cannot be told apart.
+//检查弱hash的两个和是否小于模数
+func weakHashInRange(weak uint32, m uint64) bool {
+	width := bits.Len64(m - 1)
+	if width > 16 {
+		return true
+	}
+	return uint64(weak&(1<<width-1)) < m && uint64(weak>>width) < m
+}
@@ -0,0 +1,693 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for signature serialization
+package rsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_SignatureRoundTrip(t *testing.T) {
+	original, _ := os.ReadFile("test-data/golang-original.bmp")
+
+	for _, config := range []*Config{{BlockSize: 1024}, {BlockSize: 700, StrongHashLen: 6}, {BlockSize: 512, Chunking: ContentDefinedChunking}} {
+		hashes := config.CalculateBlockHashes(original)
+		data, err := MarshalSignature(hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := UnmarshalSignature(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(hashes, decoded) {
+			t.Errorf("signature did not survive a round trip with %+v", config)
+		}
+	}
+}
+
+func Test_SignatureAccessors(t *testing.T) {
+	hashes := (&Config{BlockSize: 4}).CalculateBlockHashes([]byte("abcdefgh"))
+	h := hashes[1]
+	weak, _, _ := weakHash([]byte("efgh"))
+	if h.Index() != 1 || h.WeakHash() != weak || string(h.StrongHash()) != string(defaultConfig.strongHash([]byte("efgh"))) {
+		t.Errorf("unexpected accessor values for %+v", h)
+	}
+}
+
+func Test_UnmarshalSignatureMalformed(t *testing.T) {
+	data, _ := MarshalSignature((&Config{BlockSize: 4}).CalculateBlockHashes([]byte("abcdefghij")))
+	badVersion := append([]byte(nil), data...)
+	badVersion[4] = 99
+	hugeCount := []byte{'R', 'S', 'I', 'G', signatureVersion, 16, 0xff, 0xff, 0xff, 0xff, 0x0f}
+
+	cases := map[string][]byte{
+		"empty":          nil,
+		"bad magic":      []byte("XXXX"),
+		"bad version":    badVersion,
+		"truncated":      data[:len(data)-1],
+		"trailing bytes": append(append([]byte(nil), data...), 0),
+		"huge count":     hugeCount,
+	}
+	for name, c := range cases {
+		if _, err := UnmarshalSignature(c); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func Test_DedupBlockHashes(t *testing.T) {
+	//前半部分全是 0，后半部分是重复的文件头
+	content := append(make([]byte, 4096), bytes.Repeat([]byte("HEADER--"), 512)...)
+	content = append(content, "tail"...)
+	modified := append([]byte("new "), content...)
+	modified = append(modified, make([]byte, 100)...)
+
+	config := &Config{BlockSize: 8}
+	full := config.CalculateBlockHashes(content)
+	unique, ratio := DedupBlockHashes(full)
+	//0 块、HEADER 块和末尾块
+	if len(unique) != 3 {
+		t.Errorf("expected 3 unique blocks, found %d", len(unique))
+	}
+	if expected := 1 - 3/float64(len(full)); ratio != expected {
+		t.Errorf("expected ratio %v, found %v", expected, ratio)
+	}
+
+	deduped := &Config{BlockSize: 8, Dedup: true}
+	if hashes := deduped.CalculateBlockHashes(content); !reflect.DeepEqual(hashes, unique) {
+		t.Errorf("Dedup config did not collapse the signature")
+	}
+	result, err := deduped.Patch(content, deduped.Diff(content, modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, modified) {
+		t.Errorf("rsync did not work as expected with a deduplicated signature")
+	}
+}
+
+func Test_UnmarshalSignatureVersion1(t *testing.T) {
+	//版本 1 没有块长度
+	data := []byte{'R', 'S', 'I', 'G', 1, 2, 1, 5, 0, 0, 1, 2, 0xaa, 0xbb}
+	hashes, err := UnmarshalSignature(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []BlockHash{{index: 5, weakHash: 0x00000102, strongHash: []byte{0xaa, 0xbb}}}
+	if !reflect.DeepEqual(hashes, expected) {
+		t.Errorf("expected %+v, found %+v", expected, hashes)
+	}
+}
+
+func Test_CheckSignatureBlockSize(t *testing.T) {
+	original, _ := os.ReadFile("test-data/golang-original.bmp")
+	modified, _ := os.ReadFile("test-data/golang-modified.bmp")
+	hashes := (&Config{BlockSize: 4096}).CalculateBlockHashes(original)
+
+	for _, config := range []*Config{{BlockSize: 1024}, {BlockSize: 8192}} {
+		opsChannel := make(chan RSyncOp, 1)
+		if err := config.CalculateDifferencesContext(context.Background(), modified, hashes, opsChannel); err == nil {
+			t.Errorf("expected an error for a signature built with another block size than %d", config.BlockSize)
+		}
+		if err := config.ComputeDelta(bytes.NewReader(modified), hashes, io.Discard); err == nil {
+			t.Errorf("expected an error for a signature built with another block size than %d", config.BlockSize)
+		}
+	}
+
+	//下标越界的签名
+	bad := []BlockHash{{index: 0, length: 4}, {index: 1, length: 2}, {index: 7, length: 4}}
+	if err := (&Config{BlockSize: 4}).checkSignature(bad); err == nil {
+		t.Errorf("expected an error for a block after the final short block")
+	}
+	if err := (&Config{BlockSize: 4}).checkSignature([]BlockHash{{index: -1}}); err == nil {
+		t.Errorf("expected an error for a negative block index")
+	}
+	if err := (&Config{BlockSize: 4096}).checkSignature(hashes); err != nil {
+		t.Errorf("unexpected error for a matching signature: %v", err)
+	}
+}
+
+func Test_VerifyResult(t *testing.T) {
+	original, _ := os.ReadFile("test-data/text-original.txt")
+	modified, _ := os.ReadFile("test-data/text-modified.txt")
+	config := &Config{BlockSize: 3, StrongHashLen: 4}
+
+	sig := config.CalculateSignature(original)
+	if !reflect.DeepEqual(sig.Hashes, config.CalculateBlockHashes(original)) {
+		t.Errorf("signature hashes differ from CalculateBlockHashes")
+	}
+	//整个文件的强hash不截断
+	if len(sig.FileHash) != md5.Size {
+		t.Errorf("expected a %d byte file hash, found %d", md5.Size, len(sig.FileHash))
+	}
+
+	//发送方同时发送修改后文件的强hash
+	fileHash := config.FileHash(modified)
+	result, err := config.Patch(original, config.Diff(original, modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.VerifyResult(result, fileHash); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := config.VerifyResult(result, config.CalculateSignature(modified).FileHash); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	result[0] ^= 1
+	if err := config.VerifyResult(result, fileHash); err != ErrChecksumMismatch {
+		t.Errorf("expected %v, found %v", ErrChecksumMismatch, err)
+	}
+}
+
+func Test_HashKey(t *testing.T) {
+	original := randomContent(20000, 1)
+	modified := modifiedContent(original, 5, 2)
+	keyed := &Config{BlockSize: 256, HashKey: []byte("shared secret")}
+
+	for _, config := range []*Config{{BlockSize: 256}, keyed} {
+		sig := config.CalculateSignature(original)
+		opsChannel := make(chan RSyncOp)
+		go config.CalculateSignatureDifferences(context.Background(), modified, sig, opsChannel)
+		result, err := config.ApplyOps(original, opsChannel, len(modified))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.VerifyResult(result, config.FileHash(modified)); err != nil {
+			t.Errorf("key %q: unexpected error: %v", config.HashKey, err)
+		}
+	}
+
+	sig := keyed.CalculateSignature(original)
+	if sig.StrongHash != "hmac-sha256" || len(sig.Hashes[0].StrongHash()) != sha256.Size {
+		t.Errorf("expected HMAC-SHA256 strong hashes, found %q of %d bytes", sig.StrongHash, len(sig.Hashes[0].StrongHash()))
+	}
+	//不知道密钥无法伪造匹配的块，也无法伪造整个文件的hash
+	other := &Config{BlockSize: 256, HashKey: []byte("another secret")}
+	if reflect.DeepEqual(other.CalculateBlockHashes(original), sig.Hashes) {
+		t.Errorf("expected the strong hashes to depend on the key")
+	}
+	plain := &Config{BlockSize: 256, StrongHash: sha256.New, StrongHashName: "sha256"}
+	if bytes.Equal(plain.FileHash(original), sig.FileHash) {
+		t.Errorf("expected the file hash to be keyed")
+	}
+	opsChannel := make(chan RSyncOp)
+	go other.CalculateSignatureDifferences(context.Background(), original, sig, opsChannel)
+	for op := range opsChannel {
+		if op.opCode != DATA {
+			t.Errorf("expected no block to match with another key, found %v", op)
+		}
+	}
+	if err := other.VerifyResult(original, sig.FileHash); err != ErrChecksumMismatch {
+		t.Errorf("expected %v, found %v", ErrChecksumMismatch, err)
+	}
+	//没有密钥的一方拒绝带密钥的签名
+	if err := plain.CalculateSignatureDifferences(context.Background(), modified, sig, make(chan RSyncOp)); err == nil {
+		t.Errorf("expected an error for a keyed signature without a key")
+	}
+}
+
+func Test_VerifyAgainstSignature(t *testing.T) {
+	original := randomContent(10000, 41)
+	modified := editContent(original, insertAt(3000, "inserted"))
+	for _, config := range []*Config{{BlockSize: 256}, {BlockSize: 256, Chunking: ContentDefinedChunking}, {BlockSize: 256, Dedup: true}} {
+		targetSig := config.CalculateSignature(modified)
+		result, err := config.Patch(original, config.Diff(original, modified))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := config.VerifyAgainstSignature(result, targetSig); err != nil {
+			t.Errorf("%+v: unexpected error: %v", config, err)
+		}
+
+		//定位到出错的块
+		corrupted := append([]byte(nil), result...)
+		corrupted[5000] ^= 1
+		err = config.VerifyAgainstSignature(corrupted, targetSig)
+		mismatch, ok := err.(*BlockMismatchError)
+		if !ok || mismatch.Offset > 5000 || mismatch.Offset+config.maxBlockSize() <= 5000 {
+			t.Errorf("%+v: expected a mismatch of the block holding offset 5000, found %v", config, err)
+		}
+
+		for name, output := range map[string][]byte{"truncated": result[:len(result)-1], "extended": append(result, 0)} {
+			if err := config.VerifyAgainstSignature(output, targetSig); err == nil {
+				t.Errorf("%+v: %s: expected an error", config, name)
+			}
+		}
+	}
+
+	//去重时省略的块在最后一个保留的块之后
+	dedup := &Config{BlockSize: 4, Dedup: true}
+	content := []byte("AAAABBBBAAAA")
+	targetSig := dedup.CalculateSignature(content)
+	if len(targetSig.Hashes) != 2 || targetSig.Blocks != 3 {
+		t.Fatalf("expected 2 of 3 blocks, found %d of %d", len(targetSig.Hashes), targetSig.Blocks)
+	}
+	if err := dedup.VerifyAgainstSignature(content, targetSig); err != nil {
+		t.Errorf("unexpected error for deduplicated trailing blocks: %v", err)
+	}
+	if err := dedup.VerifyAgainstSignature([]byte("AAAABBBBAAAAAAAA"), targetSig); err == nil {
+		t.Errorf("expected an error for a block past the recorded count")
+	}
+	//块数未知时，多出的块必须是签名中的块
+	unknown := *targetSig
+	unknown.Blocks, unknown.FileHash = 0, nil
+	if err := dedup.VerifyAgainstSignature(content, &unknown); err != nil {
+		t.Errorf("unexpected error without a block count: %v", err)
+	}
+	if err := dedup.VerifyAgainstSignature([]byte("AAAABBBBCCCC"), &unknown); err == nil {
+		t.Errorf("expected an error for a trailing block missing from the signature")
+	}
+
+	//签名与配置不一致时报错
+	if err := VerifyAgainstSignature(modified, (&Config{BlockSize: 256}).CalculateSignature(modified)); err == nil {
+		t.Errorf("expected an error for a signature with another block size")
+	}
+}
+
+// countingHash Counts the calls to Write of a hash.
+type countingHash struct {
+	hash.Hash
+	writes *int
+}
+
+func (h countingHash) Write(p []byte) (int, error) {
+	*h.writes++
+	return h.Hash.Write(p)
+}
+
+func Test_UpdateSignature(t *testing.T) {
+	original := randomContent(100000, 46)
+	var hashed int
+	config := &Config{BlockSize: 1000, StrongHash: func() hash.Hash {
+		return countingHash{md5.New(), &hashed}
+	}, StrongHashName: "md5"}
+	sig := config.CalculateSignature(original)
+
+	cases := []struct {
+		name    string
+		content []byte
+		ranges  []Range
+		hashed  int
+	}{
+		{"unchanged", original, nil, 0},
+		{"one byte", editContent(original, replaceAt(5500, "x")), []Range{{5500, 1}}, 1},
+		{"across blocks", editContent(original, replaceAt(1990, "across two blocks")), []Range{{1990, 17}}, 2},
+		{"several ranges", editContent(original, replaceAt(0, "a"), replaceAt(50000, "b")), []Range{{0, 1}, {50000, 1}, {99999, 10}}, 3},
+		{"grown", append(append([]byte(nil), original...), "grown"...), []Range{{100000, 5}}, 1},
+		{"truncated", original[:99500], nil, 1},
+		{"empty range", original, []Range{{3000, 0}}, 0},
+	}
+	for _, test := range cases {
+		hashed = 0
+		updated := config.UpdateSignature(sig, test.content, test.ranges)
+		if hashed != test.hashed {
+			t.Errorf("%s: expected %d blocks hashed again, found %d", test.name, test.hashed, hashed)
+		}
+		if expected := config.CalculateSignature(test.content); !reflect.DeepEqual(updated.Hashes, expected.Hashes) {
+			t.Errorf("%s: blocks differ from a full recomputation", test.name)
+		}
+	}
+
+	//无法复用的签名整体重新计算
+	for _, other := range []*Config{{BlockSize: 1000, Dedup: true}, {BlockSize: 500}, {BlockSize: 1000, Chunking: ContentDefinedChunking}} {
+		modified := editContent(original, insertAt(10, "shift"))
+		updated := other.UpdateSignature(sig, modified, []Range{{10, 5}})
+		if !reflect.DeepEqual(updated, other.CalculateSignature(modified)) {
+			t.Errorf("%+v: expected a full recomputation", other)
+		}
+	}
+}
+
+func Test_MergeSignatures(t *testing.T) {
+	config := &Config{BlockSize: 256}
+	//目标文件的前半部分来自 v0，后半部分来自 v2
+	v0 := randomContent(64<<10, 47)
+	v1 := modifiedContent(v0, 50, 48)
+	v2 := randomContent(64<<10, 49)
+	target := append(append([]byte(nil), v0[:32<<10]...), v2[32<<10:]...)
+	bases := [][]byte{v0, v1, v2}
+	literal := func(ops []RSyncOp) (n int) {
+		for _, op := range ops {
+			if op.opCode == DATA {
+				n += len(op.data)
+			}
+		}
+		return n
+	}
+
+	sigs := make([]*Signature, len(bases))
+	for i, basis := range bases {
+		sigs[i] = config.CalculateSignature(basis)
+	}
+	merged, err := MergeSignatures(sigs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateSignatureDifferences(context.Background(), target, merged, opsChannel)
+	ops := drainedOps(opsChannel)
+	if n := literal(ops); n != 0 {
+		t.Errorf("expected every block to match a basis, found %d literal bytes", n)
+	}
+	for i, basis := range bases {
+		if n := literal(config.Diff(basis, target)); n == 0 {
+			t.Errorf("basis %d: expected literal bytes against a single basis", i)
+		}
+	}
+	var parallel []RSyncOp
+	config.calculateDifferencesParallel(context.Background(), target, merged.Hashes, func(op RSyncOp) error {
+		parallel = append(parallel, op)
+		return nil
+	}, 4)
+	if !reflect.DeepEqual(parallel, ops) {
+		t.Errorf("expected the parallel operations to match")
+	}
+
+	//经过编码后仍然保留原数据编号
+	decoded := encodedOps(t, ops)
+	if !reflect.DeepEqual(decoded, ops) {
+		t.Errorf("expected the operations to survive encoding, found %v", decoded)
+	}
+	if result, err := config.ApplyOpsMulti(bases, opsChannelOf(decoded...), len(target)); err != nil || !bytes.Equal(result, target) {
+		t.Errorf("ApplyOpsMulti did not work as expected: %v", err)
+	}
+	if _, err := config.ApplyOpsMulti(bases[:2], opsChannelOf(ops...), len(target)); err == nil {
+		t.Errorf("expected an error for a missing basis")
+	}
+	if _, err := config.ApplyOps(v0, opsChannelOf(ops...), len(target)); err == nil {
+		t.Errorf("ApplyOps: expected an error for operations on other bases")
+	}
+	if err := config.ApplyOpsAt(bytes.NewReader(v0), opsChannelOf(ops...), io.Discard); err == nil {
+		t.Errorf("ApplyOpsAt: expected an error for operations on other bases")
+	}
+
+	//块大小必须一致
+	if _, err := MergeSignatures(sigs[0], (&Config{BlockSize: 512}).CalculateSignature(v1)); err == nil {
+		t.Errorf("expected an error for signatures with different block sizes")
+	}
+	if _, err := MergeSignatures(merged); err == nil {
+		t.Errorf("expected an error for a signature merged twice")
+	}
+	if _, err := merged.MarshalBinary(); err == nil {
+		t.Errorf("expected an error encoding a merged signature")
+	}
+}
+
+func Test_SignatureValidate(t *testing.T) {
+	original := randomContent(10000, 50)
+	config := &Config{BlockSize: 1000}
+	valid := func() *Signature {
+		return config.CalculateSignature(original)
+	}
+	merged, _ := MergeSignatures(valid(), valid())
+	deduped := valid()
+	deduped.Hashes = append(deduped.Hashes[:3:3], deduped.Hashes[5:]...)
+	for name, sig := range map[string]*Signature{
+		"signature":      valid(),
+		"empty":          config.CalculateSignature(nil),
+		"merged":         merged,
+		"deduplicated":   deduped,
+		"version 1":      {Hashes: []BlockHash{{index: 0, weakHash: 1, strongHash: []byte{1}}}},
+		"other modulus":  (&Config{BlockSize: 1000, WeakModulus: 251}).CalculateSignature(original),
+		"truncated hash": (&Config{BlockSize: 1000, StrongHashLen: 8}).CalculateSignature(original),
+		"last short":     config.CalculateSignature(original[:9500]),
+	} {
+		if err := sig.Validate(); err != nil {
+			t.Errorf("%s: expected a valid signature, found %v", name, err)
+		}
+	}
+	cdc := &Config{BlockSize: 1000, Chunking: ContentDefinedChunking}
+	if err := cdc.ValidateSignature(cdc.CalculateSignature(original)); err != nil {
+		t.Errorf("expected valid content-defined chunks, found %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		corrupt func(*Signature)
+		err     error
+	}{
+		{"negative index", func(s *Signature) { s.Hashes[0].index = -1 }, ErrSignatureIndex},
+		{"repeated index", func(s *Signature) { s.Hashes[4].index = 3 }, ErrSignatureIndex},
+		{"swapped blocks", func(s *Signature) { s.Hashes[1], s.Hashes[2] = s.Hashes[2], s.Hashes[1] }, ErrSignatureIndex},
+		{"short strong hash", func(s *Signature) { s.Hashes[6].strongHash = s.Hashes[6].strongHash[:4] }, ErrSignatureStrongHash},
+		{"long strong hash", func(s *Signature) {
+			for i := range s.Hashes {
+				s.Hashes[i].strongHash = append(s.Hashes[i].strongHash, 0)
+			}
+		}, ErrSignatureStrongHash},
+		{"block size", func(s *Signature) { s.BlockSize = -1 }, ErrSignatureLength},
+		{"long block", func(s *Signature) { s.Hashes[3].length = 1001 }, ErrSignatureLength},
+		{"short block", func(s *Signature) { s.Hashes[3].length = 999 }, ErrSignatureLength},
+	}
+	for _, test := range cases {
+		sig := valid()
+		test.corrupt(sig)
+		if err := sig.Validate(); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, found %v", test.name, test.err, err)
+		}
+	}
+	//模数为 251 时每个和只有 8 位
+	sig := (&Config{BlockSize: 1000, WeakModulus: 251}).CalculateSignature(original)
+	sig.Hashes[2].weakHash = 251
+	if err := sig.Validate(); !errors.Is(err, ErrSignatureWeakHash) {
+		t.Errorf("weak hash: expected ErrSignatureWeakHash, found %v", err)
+	}
+}
+
+func Test_HashBucketStats(t *testing.T) {
+	//"abab" 中的两个块相同，落在同一个桶中
+	hashes := (&Config{BlockSize: 2}).CalculateBlockHashes([]byte("ababcdxy"))
+	stats := HashBucketStats(hashes)
+	expected := BucketStats{Blocks: 4, Buckets: 3, MaxDepth: 2, Depths: map[int]int{1: 2, 2: 1}}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected %+v, found %+v", expected, stats)
+	}
+
+	empty := HashBucketStats(nil)
+	if empty.Blocks != 0 || empty.Buckets != 0 || empty.MaxDepth != 0 || len(empty.Depths) != 0 {
+		t.Errorf("expected empty stats, found %+v", empty)
+	}
+}
+
+func Test_SignatureByteOrder(t *testing.T) {
+	hashes := []BlockHash{
+		{index: 0, length: 4, weakHash: 0x01020304, strongHash: []byte{0xa0, 0xa1}},
+		{index: 300, length: 2, weakHash: 0xfffe0001, strongHash: []byte{0xb0, 0xb1}},
+	}
+	//字节序固定：弱hash为大端序，uvarint 逐字节定义
+	golden := []byte{
+		'R', 'S', 'I', 'G', 2, 2, 2,
+		0, 4, 0x01, 0x02, 0x03, 0x04, 0xa0, 0xa1,
+		0xac, 0x02, 2, 0xff, 0xfe, 0x00, 0x01, 0xb0, 0xb1,
+	}
+	data, err := MarshalSignature(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, golden) {
+		t.Errorf("expected % x, found % x", golden, data)
+	}
+	decoded, err := UnmarshalSignature(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, hashes) {
+		t.Errorf("expected %+v, found %+v", hashes, decoded)
+	}
+
+	//SHA-256 的强hash同样是定长的
+	original, _ := os.ReadFile("test-data/text-original.txt")
+	config := &Config{BlockSize: 16, StrongHash: sha256.New}
+	hashes = config.CalculateBlockHashes(original)
+	data, err = MarshalSignature(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[5] != sha256.Size {
+		t.Errorf("expected a strong hash length of %d, found %d", sha256.Size, data[5])
+	}
+	if decoded, err = UnmarshalSignature(data); err != nil || !reflect.DeepEqual(decoded, hashes) {
+		t.Errorf("SHA-256 signature did not survive a round trip: %v", err)
+	}
+}
+
+func Test_SignatureBlockSizeMismatch(t *testing.T) {
+	original, _ := os.ReadFile("test-data/golang-original.bmp")
+	modified, _ := os.ReadFile("test-data/golang-modified.bmp")
+	sig := (&Config{BlockSize: 4096}).CalculateSignature(original)
+	if sig.BlockSize != 4096 {
+		t.Errorf("expected block size 4096, found %d", sig.BlockSize)
+	}
+
+	//签名记录了块大小，直接报告不一致
+	opsChannel := make(chan RSyncOp, 1)
+	err := (&Config{BlockSize: 2048}).CalculateSignatureDifferences(context.Background(), modified, sig, opsChannel)
+	if err == nil {
+		t.Errorf("expected an error for a signature built with another block size")
+	}
+	if _, ok := <-opsChannel; ok {
+		t.Errorf("expected no op for a mismatched signature")
+	}
+
+	opsChannel = make(chan RSyncOp)
+	go func() {
+		if err := (&Config{BlockSize: 4096}).CalculateSignatureDifferences(context.Background(), modified, sig, opsChannel); err != nil {
+			t.Error(err)
+		}
+	}()
+	result, err := (&Config{BlockSize: 4096}).ApplyOps(original, opsChannel, len(modified))
+	if err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("sync did not work as expected: %v", err)
+	}
+}
+
+func Test_SignatureMarshalBinary(t *testing.T) {
+	content := randomContent(1000, 31)
+	config := &Config{BlockSize: 64, WeakModulus: 65521, StrongHash: sha256.New, StrongHashName: "sha256"}
+	sig := config.CalculateSignature(content)
+	if sig.StrongHash != "sha256" {
+		t.Errorf("expected strong hash sha256, found %q", sig.StrongHash)
+	}
+	data, err := sig.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Signature
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, sig) {
+		t.Errorf("signature did not survive a round trip: %+v", decoded)
+	}
+	if hashes, err := UnmarshalSignature(data); err != nil || !reflect.DeepEqual(hashes, sig.Hashes) {
+		t.Errorf("UnmarshalSignature did not decode the block hashes of a signature: %v", err)
+	}
+	for n := 0; n < len(data); n++ {
+		if err := decoded.UnmarshalBinary(data[:n]); err == nil {
+			t.Errorf("expected an error for a signature cut at %d bytes", n)
+		}
+	}
+
+	//只有块哈希的格式解码后配置未知
+	data, _ = MarshalSignature(sig.Hashes)
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.BlockSize != 0 || decoded.WeakModulus != 0 || decoded.StrongHash != "" || !reflect.DeepEqual(decoded.Hashes, sig.Hashes) {
+		t.Errorf("unexpected signature decoded from block hashes: %+v", decoded)
+	}
+
+	//强hash不一致时报告错误
+	for _, other := range []*Config{
+		{BlockSize: 64, WeakModulus: 65521, StrongHash: sha256.New, StrongHashName: "sha224"},
+		{BlockSize: 64, WeakModulus: 65521},
+	} {
+		opsChannel := make(chan RSyncOp, 1)
+		if err := other.CalculateSignatureDifferences(context.Background(), content, sig, opsChannel); err == nil {
+			t.Errorf("expected an error for a signature built with another strong hash")
+		}
+	}
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateSignatureDifferences(context.Background(), content, sig, opsChannel)
+	if result, err := config.ApplyOps(content, opsChannel, len(content)); err != nil || !bytes.Equal(result, content) {
+		t.Errorf("sync with a matching signature did not work as expected: %v", err)
+	}
+}
+
+func Test_SignatureConfig(t *testing.T) {
+	original := randomContent(100000, 91)
+	modified := modifiedContent(original, 10, 92)
+	sha224 := func() hash.Hash { return sha256.New224() }
+
+	for _, config := range []*Config{
+		{BlockSize: 700},
+		{BlockSize: 300, WeakModulus: 65521, StrongHash: sha256.New, StrongHashName: "sha256", StrongHashLen: 8},
+		{BlockSize: 512, StrongHash: md5.New, StrongHashName: "md5", HashKey: []byte("key"), Header: true},
+	} {
+		//接收方只有序列化后的签名，参数都从签名中获得
+		data, err := config.CalculateSignature(original).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sig Signature
+		if err := sig.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		derived, err := sig.Config(&Config{HashKey: config.HashKey, Header: config.Header})
+		if err != nil {
+			t.Fatalf("%+v: %v", config, err)
+		}
+		if derived.blockSize() != config.blockSize() || derived.weakModulus() != config.weakModulus() ||
+			derived.strongHashName() != config.strongHashName() || derived.StrongHashSize() != config.StrongHashSize() {
+			t.Errorf("%+v: derived %+v", config, derived)
+		}
+		opsChannel := make(chan RSyncOp)
+		go derived.CalculateSignatureDifferences(context.Background(), modified, &sig, opsChannel)
+		result, err := config.ApplyOps(original, opsChannel, len(modified))
+		if err != nil || !bytes.Equal(result, modified) {
+			t.Errorf("%+v: sync with the derived configuration did not work as expected: %v", config, err)
+		}
+		if len(config.HashKey) > 0 {
+			continue
+		}
+		//不需要任何配置
+		opsChannel = make(chan RSyncOp)
+		go sig.Differences(context.Background(), modified, opsChannel)
+		result, err = sig.ApplyOps(original, opsChannel, len(modified))
+		if err != nil || !bytes.Equal(result, modified) {
+			t.Errorf("%+v: sync with the signature did not work as expected: %v", config, err)
+		}
+	}
+
+	//没有强hash的签名
+	if derived, err := (&Config{BlockSize: 256, SkipStrongHash: true}).CalculateSignature(original).Config(nil); err != nil || !derived.SkipStrongHash {
+		t.Errorf("expected a configuration skipping strong hashes, found %+v: %v", derived, err)
+	}
+
+	//签名之外的参数仍然来自 base
+	cdc := &Config{BlockSize: 512, Chunking: ContentDefinedChunking}
+	sig := cdc.CalculateSignature(original)
+	if derived, err := sig.Config(&Config{Chunking: ContentDefinedChunking}); err != nil || derived.Chunking != ContentDefinedChunking {
+		t.Errorf("expected the chunking of base, found %+v: %v", derived, err)
+	}
+
+	//只记录了名称的强hash需要 base 提供
+	custom := &Config{BlockSize: 512, StrongHash: sha224, StrongHashName: "sha224"}
+	sig = custom.CalculateSignature(original)
+	if _, err := sig.Config(nil); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected %v for an unknown strong hash, found %v", ErrSignatureMismatch, err)
+	}
+	if _, err := sig.Config(&Config{StrongHash: sha224, StrongHashName: "sha224"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	//HMAC 需要密钥，没有密钥的签名不能加上密钥
+	keyed := (&Config{BlockSize: 512, HashKey: []byte("key")}).CalculateSignature(original)
+	plain := (&Config{BlockSize: 512}).CalculateSignature(original)
+	if _, err := keyed.Config(nil); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected %v without a key, found %v", ErrSignatureMismatch, err)
+	}
+	if _, err := plain.Config(&Config{HashKey: []byte("key")}); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected %v with an unexpected key, found %v", ErrSignatureMismatch, err)
+	}
+	opsChannel := make(chan RSyncOp)
+	if err := keyed.Differences(context.Background(), modified, opsChannel); !errors.Is(err, ErrSignatureMismatch) {
+		t.Errorf("expected %v, found %v", ErrSignatureMismatch, err)
+	}
+	if _, ok := <-opsChannel; ok {
+		t.Errorf("expected a closed channel")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"context"
+)
+
+// Stats How well a delta reuses the basis, to tune the block size or decide
+// whether sending the whole content would be cheaper.
+//差异计算的统计信息
+type Stats struct {
+	// TotalBytes 修改后数据的长度
+	TotalBytes int64
+	// MatchedBytes 从原数据复制的字节数
+	MatchedBytes int64
+	// LiteralBytes 作为 DATA 发送的字节数
+	LiteralBytes int64
+	// CopyBytes 以 COPY 复制已组装数据的字节数
+	CopyBytes int64
+	// BlockHits 匹配的块数，BLOCKRUN 按块计数
+	BlockHits int
+	// Ops 操作体的数量
+	Ops int
+	// DataOps DATA 操作体的数量
+	DataOps int
+}
+
+// LiteralRatio Returns the fraction of the modified content sent as DATA,
+// 0 for empty content.
+//作为 DATA 发送的比例
+func (s Stats) LiteralRatio() float64 {
+	if s.TotalBytes == 0 {
+		return 0
+	}
+	return float64(s.LiteralBytes) / float64(s.TotalBytes)
+}
+
+// Accounts for one operation.
+func (s *Stats) add(op RSyncOp) {
+	s.Ops++
+	switch op.opCode {
+	case BLOCK:
+		s.BlockHits++
+	case BLOCKRUN:
+		s.BlockHits += op.blockCount
+	case DATA:
+		s.DataOps++
+		s.LiteralBytes += int64(len(op.data))
+	case COPY:
+		s.CopyBytes += int64(op.length)
+	}
+}
+
+// CalculateDifferencesStats Computes the operations needed to recreate content
+// like CalculateDifferencesContext, using the default block size, and fills
+// stats as the operations are sent. stats is complete once the channel is
+// closed.
+//计算不同并统计
+func CalculateDifferencesStats(ctx context.Context, content []byte, hashes []BlockHash, opsChannel chan RSyncOp, stats *Stats) error {
+	return defaultConfig.CalculateDifferencesStats(ctx, content, hashes, opsChannel, stats)
+}
+
+// CalculateDifferencesStats Computes the operations needed to recreate content
+// using the configured block size, filling stats as the operations are sent.
+func (c *Config) CalculateDifferencesStats(ctx context.Context, content []byte, hashes []BlockHash, opsChannel chan RSyncOp, stats *Stats) error {
+	*stats = Stats{TotalBytes: int64(len(content))}
+	send := channelEmit(ctx, opsChannel)
+	//通道关闭之前完成统计
+	defer func() {
+		stats.MatchedBytes = stats.TotalBytes - stats.LiteralBytes - stats.CopyBytes
+		close(opsChannel)
+	}()
+	return c.calculateDifferences(ctx, content, hashes, func(op RSyncOp) error {
+		stats.add(op)
+		return send(op)
+	})
+}
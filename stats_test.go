@@ -0,0 +1,38 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for delta statistics
+package rsync
+
+import (
+	"context"
+	"testing"
+)
+
+func Test_CalculateDifferencesStats(t *testing.T) {
+	config := &Config{BlockSize: 4}
+	original := []byte("0000111122223333444455")
+	modified := []byte("11112222--0000--3333444455")
+
+	var stats Stats
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferencesStats(context.Background(), modified, config.CalculateBlockHashes(original), opsChannel, &stats)
+	result, err := config.ApplyOps(original, opsChannel, len(modified))
+	if err != nil || string(result) != string(modified) {
+		t.Fatalf("sync did not work as expected: %v", err)
+	}
+
+	//BLOCKRUN 1-2，DATA，BLOCK 0，DATA，BLOCKRUN 3-5
+	expected := Stats{TotalBytes: 26, MatchedBytes: 22, LiteralBytes: 4, BlockHits: 6, Ops: 5, DataOps: 2}
+	if stats != expected {
+		t.Errorf("expected %+v, found %+v", expected, stats)
+	}
+	if ratio := stats.LiteralRatio(); ratio != 4.0/26 {
+		t.Errorf("expected a literal ratio of %v, found %v", 4.0/26, ratio)
+	}
+	if ratio := (Stats{}).LiteralRatio(); ratio != 0 {
+		t.Errorf("expected a literal ratio of 0 for empty content, found %v", ratio)
+	}
+}
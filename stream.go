@@ -0,0 +1,509 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// GenerateSignature Returns weak and strong hashes for the content of r,
+// reading it one block at a time so the whole content never sits in memory.
+// A blockSize <= 0 selects the default block size.
+//流式计算每个块的哈希值
+//参数：数据源，块大小
+//返回：每个块组成的列表
+func GenerateSignature(r io.Reader, blockSize int) ([]BlockHash, error) {
+	config := &Config{BlockSize: blockSize}
+	return config.GenerateSignature(r)
+}
+
+// GenerateSignature Returns weak and strong hashes for the content of r,
+// using the configured block size.
+// The result is identical to CalculateBlockHashes over the same content.
+func (c *Config) GenerateSignature(r io.Reader) ([]BlockHash, error) {
+	var blockHashes []BlockHash
+	err := c.readBlocks(r, func(block []byte) error {
+		blockHashes = append(blockHashes, c.newBlockHash(len(blockHashes), block))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.dedup(blockHashes), nil
+}
+
+// streamBufferSize Minimum size of the sliding buffer used by ComputeDelta.
+//流式计算差异时缓冲区的最小长度
+const streamBufferSize = 64 * 1024
+
+// ComputeDelta Computes the operations needed to recreate the content of
+// target from the basis described by sig, and writes them encoded to out.
+// The target is scanned through a sliding window, so memory use is bounded by
+// the block size rather than by the size of target. Long unmatched regions are
+// sent as several DATA operations.
+// A blockSize <= 0 selects the default block size.
+//流式计算不同，将编码后的操作写入 out
+//参数：目标数据源，发送方的块哈希数组，块大小，输出
+func ComputeDelta(target io.Reader, sig []BlockHash, blockSize int, out io.Writer) error {
+	config := &Config{BlockSize: blockSize}
+	return config.ComputeDelta(target, sig, out)
+}
+
+// ComputeDelta Computes the operations needed to recreate the content of
+// target using the configured block size, and writes them encoded to out.
+func (c *Config) ComputeDelta(target io.Reader, sig []BlockHash, out io.Writer) error {
+	if err := c.checkBlockHashes(sig); err != nil {
+		return err
+	}
+	return c.streamDifferences(target, sig, func(op RSyncOp) error {
+		return c.writeOp(out, op)
+	})
+}
+
+// CalculateDifferencesReaders Computes the operations needed to recreate the
+// concatenation of targets from the basis described by hashes, using the
+// default block size, without joining targets into one slice first.
+// The channel is always closed on return.
+//计算多个数据源依次拼接后的不同
+func CalculateDifferencesReaders(ctx context.Context, targets []io.Reader, hashes []BlockHash, opsChannel chan RSyncOp) error {
+	return defaultConfig.CalculateDifferencesReaders(ctx, targets, hashes, opsChannel)
+}
+
+// CalculateDifferencesReaders Computes the operations needed to recreate the
+// concatenation of targets using the configured block size, stopping once ctx
+// is cancelled. The targets are read in order through the sliding window of
+// ComputeDelta, so blocks spanning two of them are matched like any other and
+// memory use is bounded by the block size. The payload of every DATA
+// operation is a copy, or a pooled buffer with Config.CopyData. Long
+// unmatched regions are sent as several DATA operations.
+func (c *Config) CalculateDifferencesReaders(ctx context.Context, targets []io.Reader, hashes []BlockHash, opsChannel chan RSyncOp) error {
+	defer close(opsChannel)
+	if err := c.checkBlockHashes(hashes); err != nil {
+		return err
+	}
+	emit := channelEmit(ctx, opsChannel)
+	if c != nil && c.CopyData {
+		emit = copyDataEmit(emit)
+	} else {
+		emit = cloneDataEmit(emit)
+	}
+	return c.streamDifferences(&contextReader{ctx: ctx, r: io.MultiReader(targets...)}, hashes, emit)
+}
+
+// Returns an emit function passing DATA operations to emit with a copy of
+// their payload, since the window buffer they point to is reused.
+func cloneDataEmit(emit func(RSyncOp) error) func(RSyncOp) error {
+	return func(op RSyncOp) error {
+		if op.opCode == DATA {
+			op.data = bytes.Clone(op.data)
+		}
+		return emit(op)
+	}
+}
+
+// contextReader A reader failing with the error of ctx once it is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Scans target for blocks of sig through a sliding window and passes every
+// resulting operation to emit. Payloads point into the window buffer, so they
+// are only valid until emit returns.
+//流式计算不同的核心逻辑，每个操作交给 emit 处理
+func (c *Config) streamDifferences(target io.Reader, sig []BlockHash, emit func(RSyncOp) error) error {
+	if c.chunking() != FixedChunking {
+		return c.computeChunkDelta(target, sig, emit)
+	}
+	blockSize := c.blockSize()
+	stride := c.alignment()
+	matcher := c.newMatcher(sig)
+	//连续的块合并为 BLOCKRUN
+	runs := c.newBlockRuns(c.limitOps(emit))
+	//窗口在整个数据中的偏移量，下一次检查的位置，已匹配的字节数
+	var position, nextCheck, matched int
+
+	window := newSlidingWindow(target, blockSize, streamBufferSize)
+	flush := func(data []byte) error {
+		return runs.add(RSyncOp{opCode: DATA, data: data})
+	}
+	//弱hash
+	rolling := c.newRollingHash()
+	var isRolling bool
+	//上一个窗口匹配的块，没有匹配时为 -1
+	previous := -1
+
+	for {
+		block, err := window.next(isRolling, flush)
+		if err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			break
+		}
+		if position >= nextCheck {
+			if err := c.checkBail(position, matched); err != nil {
+				return err
+			}
+			nextCheck = position + checkInterval
+		}
+		if !isRolling {
+			rolling.Init(block)
+			isRolling = true
+		} else if len(block) == blockSize {
+			//窗口整体右移一个字节
+			rolling.Roll(window.previous(), block[len(block)-1])
+		} else {
+			//到达数据末尾，窗口收缩一个字节
+			rolling.Shrink(window.previous())
+		}
+		//未对齐的位置不查找
+		if stride > 1 && position%stride != 0 {
+			window.advance()
+			position++
+			continue
+		}
+
+		weak := rolling.Sum()
+		if blockHash := matcher.Match(weak, block, previous); blockHash != nil {
+			if data := window.unmatched(); len(data) > 0 {
+				if err := flush(data); err != nil {
+					return err
+				}
+			}
+			if err := runs.add(RSyncOp{opCode: BLOCK, blockIndex: blockHash.index, basis: blockHash.basis, data: block}); err != nil {
+				return err
+			}
+			window.skip(len(block))
+			position += len(block)
+			matched += len(block)
+			previous = blockHash.index
+			isRolling = false
+			continue
+		}
+		previous = -1
+		window.advance()
+		position++
+	}
+	if err := c.checkBail(position, matched); err != nil {
+		return err
+	}
+
+	//剩余未匹配的数据
+	if data := window.rest(); len(data) > 0 {
+		if err := flush(data); err != nil {
+			return err
+		}
+	}
+	return runs.flush()
+}
+
+// DeltaFiles Writes to out the encoded operations recreating the file at
+// target from the file at basis, like rdiff delta without a signature file:
+// the signature of basis is computed block by block and target is streamed
+// through ComputeDelta, so memory use is bounded by the signature and the
+// block size rather than by the size of the files. The delta can be applied
+// with ReadOps and ApplyOpsAt.
+// A blockSize <= 0 selects the default block size.
+//计算两个文件的差异，将编码后的操作写入 out
+func DeltaFiles(basis, target string, blockSize int, out io.Writer) error {
+	config := &Config{BlockSize: blockSize}
+	return config.DeltaFiles(basis, target, out)
+}
+
+// DeltaFiles Writes to out the encoded operations recreating the file at
+// target from the file at basis, using the configured block size.
+func (c *Config) DeltaFiles(basis, target string, out io.Writer) error {
+	sig, err := c.generateFileSignature(basis)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(out)
+	if err := c.ComputeDelta(bufio.NewReader(file), sig, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// SyncFile Recreates the file at targetPath into outPath, reusing the blocks of
+// the file at basisPath, with the whole signature, delta and reconstruction
+// pipeline. Files are streamed, so none of them is loaded into memory.
+// A blockSize <= 0 selects the default block size.
+//文件同步：根据 basisPath 和 targetPath 生成 outPath
+func SyncFile(basisPath, targetPath, outPath string, blockSize int) error {
+	config := &Config{BlockSize: blockSize}
+	return config.SyncFile(basisPath, targetPath, outPath)
+}
+
+// SyncFile Recreates the file at targetPath into outPath from the file at
+// basisPath, using the configured block size.
+func (c *Config) SyncFile(basisPath, targetPath, outPath string) (err error) {
+	basis, err := os.Open(basisPath)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+	//发送方：计算签名
+	sig, err := c.GenerateSignature(bufio.NewReader(basis))
+	if err != nil {
+		return err
+	}
+
+	target, err := os.Open(targetPath)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(outPath)
+		}
+	}()
+
+	w := bufio.NewWriter(out)
+	if err := c.syncThrough(basis, bufio.NewReader(target), sig, w, nil); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Recreates target into out from basis: the operations computed against sig
+// are encoded into a pipe, read back through transport, which stands for the
+// network between both sides and may be nil, decoded and applied.
+//接收方：计算差异并编码，经过管道解码后组装
+func (c *Config) syncThrough(basis io.ReaderAt, target io.Reader, sig []BlockHash, out io.Writer, transport func(io.Reader) io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(c.ComputeDelta(target, sig, pw))
+	}()
+	var r io.Reader = pr
+	if transport != nil {
+		r = transport(pr)
+	}
+	ops := make(chan RSyncOp)
+	readErr := make(chan error, 1)
+	go func() {
+		err := ReadOps(r, ops)
+		//解码失败后不再读取管道，关闭它让计算差异的协程退出
+		pr.CloseWithError(err)
+		readErr <- err
+	}()
+
+	applyErr := c.ApplyOpsAt(basis, ops, out)
+	//组装失败时 ops 已被取完，读取协程会正常结束
+	if err := <-readErr; err != nil {
+		return err
+	}
+	return applyErr
+}
+
+// ApplyOpsAt Applies operations from the channel like ApplyOps, using the
+// default block size, but reads the referenced blocks from basis with ReadAt
+// and streams the modified content to out. Memory use is bounded by the block
+// size instead of the size of the files, and the modified size does not need
+// to be known up front. Read and write errors are returned.
+// A basis opened with OpenMapped is read straight from memory.
+//从 basis 读取块，将组装后的数据写入 out
+func ApplyOpsAt(basis io.ReaderAt, ops chan RSyncOp, out io.Writer) error {
+	return defaultConfig.ApplyOpsAt(basis, ops, out)
+}
+
+// ApplyOpsAt Applies operations from the channel using the configured block
+// size, reading blocks from basis and writing the modified content to out.
+// With a HEADER the output must have the length it announces.
+// On error the remaining operations are drained so the sender is not blocked.
+func (c *Config) ApplyOpsAt(basis io.ReaderAt, ops chan RSyncOp, out io.Writer) error {
+	//映射的文件直接从内存复制
+	if m, ok := basis.(*MappedFile); ok && m.data != nil {
+		return c.ApplyOpsWriter(m.data, ops, out)
+	}
+	bounds, err := c.chunkBoundsAt(basis)
+	if err != nil {
+		drainOps(ops)
+		return err
+	}
+	block := make([]byte, c.blockSize())
+	if c != nil && c.MaxOutputSize > 0 {
+		out = &limitedWriter{w: out, remaining: c.MaxOutputSize, max: c.MaxOutputSize}
+	}
+	//SelfCopy 时保留写入的数据，供 COPY 引用
+	var output *outputWriter
+	if c != nil && c.SelfCopy {
+		output = &outputWriter{w: out}
+		out = output
+	}
+	copyBlocks := func(blockIndex, blockCount int) error {
+		if bounds != nil {
+			return copyChunksAt(basis, bounds, blockIndex, blockCount, block, out)
+		}
+		return copyBlocksAt(basis, blockIndex, blockCount, block, out)
+	}
+	var header *headerWriter
+	var count int
+	for op := range ops {
+		if err := c.countOp(&count); err != nil {
+			drainOps(ops)
+			return err
+		}
+		if op.basis != 0 {
+			drainOps(ops)
+			return otherBasisError(op)
+		}
+		var err error
+		switch op.opCode {
+		case BLOCK:
+			err = copyBlocks(op.blockIndex, 1)
+		case BLOCKRUN:
+			err = copyBlocks(op.blockIndex, op.blockCount)
+		case DATA, FULL:
+			_, err = out.Write(op.data)
+		case IDENTICAL:
+			_, err = io.CopyBuffer(out, io.NewSectionReader(basis, 0, math.MaxInt64), block)
+		case HEADER:
+			if err = c.checkHeader(op, count == 1); err == nil {
+				//之后的输出不能超过 HEADER 中的长度
+				header = &headerWriter{w: out, remaining: int64(op.length), length: int64(op.length)}
+				out = header
+			}
+		case COPY:
+			if output == nil {
+				err = errors.New("rsync: COPY operation without Config.SelfCopy")
+				break
+			}
+			var chunk []byte
+			if chunk, err = copyContent(output.data, op); err == nil {
+				_, err = out.Write(chunk)
+			}
+		default:
+			err = fmt.Errorf("rsync: unknown op code %d", op.opCode)
+		}
+		if err != nil {
+			drainOps(ops)
+			return err
+		}
+	}
+	if header != nil && header.remaining != 0 {
+		return fmt.Errorf("rsync: reconstructed %d bytes, expected %d", header.length-header.remaining, header.length)
+	}
+	return nil
+}
+
+// limitedWriter Fails with ErrOutputTooLarge instead of writing more than max
+// bytes to w in total.
+//限制写入的总长度
+type limitedWriter struct {
+	w              io.Writer
+	remaining, max int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrOutputTooLarge, l.max)
+	}
+	l.remaining -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// headerWriter Fails instead of writing more to w than the length announced
+// by a HEADER operation, and counts what remains to write.
+//限制写入的长度不超过 HEADER 中的长度
+type headerWriter struct {
+	w                 io.Writer
+	remaining, length int64
+}
+
+func (h *headerWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > h.remaining {
+		return 0, fmt.Errorf("rsync: operations exceed file size %d", h.length)
+	}
+	n, err := h.w.Write(p)
+	h.remaining -= int64(n)
+	return n, err
+}
+
+// outputWriter Keeps a copy of everything written to w.
+//保留写入数据的副本
+type outputWriter struct {
+	w    io.Writer
+	data []byte
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.data = append(o.data, p[:n]...)
+	return n, err
+}
+
+// Copies blockCount blocks starting at blockIndex from basis to out, one
+// block at a time through the buffer block.
+//从 basis 逐块复制到 out
+func copyBlocksAt(basis io.ReaderAt, blockIndex, blockCount int, block []byte, out io.Writer) error {
+	if blockIndex < 0 || blockCount < 1 {
+		return fmt.Errorf("%w: blocks %d to %d", ErrBlockIndexOutOfRange, blockIndex, blockIndex+blockCount-1)
+	}
+	for i := blockIndex; i < blockIndex+blockCount; i++ {
+		//最后一个块可能不足 blockSize
+		n, err := basis.ReadAt(block, int64(i)*int64(len(block)))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		//只有最后一个块可以不完整
+		if n == 0 || (n < len(block) && i < blockIndex+blockCount-1) {
+			return fmt.Errorf("%w: block %d", ErrBlockIndexOutOfRange, i)
+		}
+		if _, err := out.Write(block[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies blockCount variable length blocks starting at blockIndex from basis
+// to out through the buffer block, with the block end offsets of basis.
+//按变长块的边界从 basis 复制到 out
+func copyChunksAt(basis io.ReaderAt, bounds []int64, blockIndex, blockCount int, block []byte, out io.Writer) error {
+	if blockIndex < 0 || blockCount < 1 || blockIndex >= len(bounds) || blockCount > len(bounds)-blockIndex {
+		return fmt.Errorf("%w: blocks %d to %d", ErrBlockIndexOutOfRange, blockIndex, blockIndex+blockCount-1)
+	}
+	var offset int64
+	if blockIndex > 0 {
+		offset = bounds[blockIndex-1]
+	}
+	length := bounds[blockIndex+blockCount-1] - offset
+	n, err := io.CopyBuffer(out, io.NewSectionReader(basis, offset, length), block)
+	if err == nil && n < length {
+		//原数据比分块时短
+		err = fmt.Errorf("%w: %d bytes of blocks %d to %d, expected %d", ErrShortRead, n, blockIndex, blockIndex+blockCount-1, length)
+	}
+	return err
+}
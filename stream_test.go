@@ -0,0 +1,362 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the streaming API
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_GenerateSignatureMatchesInMemory(t *testing.T) {
+	original, err := os.ReadFile("test-data/golang-original.bmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, blockSize := range []int{7, 1024} {
+		expected := (&Config{BlockSize: blockSize}).CalculateBlockHashes(original)
+		//每次只读一个字节，检查短读的处理
+		found, err := GenerateSignature(iotest.OneByteReader(bytes.NewReader(original)), blockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, found) {
+			t.Errorf("streaming signature differs from in-memory signature with block size %d", blockSize)
+		}
+	}
+}
+
+func Test_GenerateSignatureEmpty(t *testing.T) {
+	found, err := GenerateSignature(bytes.NewReader(nil), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 0 {
+		t.Errorf("expected no blocks, found %d", len(found))
+	}
+}
+
+func Test_GenerateSignatureReadError(t *testing.T) {
+	errRead := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader([]byte("abcdef")), iotest.ErrReader(errRead))
+
+	if _, err := GenerateSignature(r, 4); !errors.Is(err, errRead) {
+		t.Errorf("expected %v, found %v", errRead, err)
+	}
+}
+
+// Decodes every operation written by ComputeDelta.
+func decodeOps(t *testing.T, delta []byte) []RSyncOp {
+	var ops []RSyncOp
+	r := bufio.NewReader(bytes.NewReader(delta))
+	for {
+		op, err := readOp(r)
+		if err == io.EOF {
+			return ops
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+}
+
+// Applies a slice of operations through the channel API.
+func applyOpsSlice(config *Config, original []byte, ops []RSyncOp, fileSize int) ([]byte, error) {
+	opsChannel := make(chan RSyncOp)
+	go func() {
+		defer close(opsChannel)
+		for _, op := range ops {
+			opsChannel <- op
+		}
+	}()
+	return config.ApplyOps(original, opsChannel, fileSize)
+}
+
+func Test_ComputeDelta(t *testing.T) {
+	pairs := []filePair{{"golang-original.bmp", "golang-modified.bmp"}, {"text-original.txt", "text-modified.txt"}}
+
+	for _, pair := range pairs {
+		original, _ := os.ReadFile("test-data/" + pair.original)
+		modified, _ := os.ReadFile("test-data/" + pair.modified)
+
+		for _, blockSize := range []int{3, 1024, 40000} {
+			config := &Config{BlockSize: blockSize}
+			sig := config.CalculateBlockHashes(original)
+
+			var delta bytes.Buffer
+			if err := ComputeDelta(bytes.NewReader(modified), sig, blockSize, &delta); err != nil {
+				t.Fatal(err)
+			}
+			result, err := applyOpsSlice(config, original, decodeOps(t, delta.Bytes()), len(modified))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result, modified) {
+				t.Errorf("streaming delta did not work as expected for %v with block size %d", pair, blockSize)
+			}
+		}
+	}
+}
+
+func Test_ComputeDeltaShortReads(t *testing.T) {
+	original := []byte("the quick brown fox jumps over the lazy dog")
+	modified := []byte("a quick brown fox jumped over the lazy dog!")
+	config := &Config{BlockSize: 5}
+	sig := config.CalculateBlockHashes(original)
+
+	var delta bytes.Buffer
+	if err := config.ComputeDelta(iotest.OneByteReader(bytes.NewReader(modified)), sig, &delta); err != nil {
+		t.Fatal(err)
+	}
+	ops := decodeOps(t, delta.Bytes())
+	result, err := applyOpsSlice(config, original, ops, len(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, modified) {
+		t.Errorf("expected %q, found %q", modified, result)
+	}
+}
+
+func Test_CalculateDifferencesReaders(t *testing.T) {
+	original := randomContent(64*500, 62)
+	modified := modifiedContent(original, 20, 63)
+	//切分点落在块的中间，也有空的数据源
+	splits := [][]int{nil, {0, 1, 63, 64, 65, 1000, 1000, 20000}, {7, 150, 151, 9999, len(modified)}}
+	for _, chunking := range []ChunkingMode{FixedChunking, ContentDefinedChunking} {
+		config := &Config{BlockSize: 64, Chunking: chunking}
+		hashes := config.CalculateBlockHashes(original)
+		expected := config.Diff(original, modified)
+		for _, split := range splits {
+			var targets []io.Reader
+			var previous int
+			for _, at := range append(split, len(modified)) {
+				targets = append(targets, iotest.OneByteReader(bytes.NewReader(modified[previous:at])))
+				previous = at
+			}
+			opsChannel := make(chan RSyncOp)
+			errs := make(chan error, 1)
+			go func() { errs <- config.CalculateDifferencesReaders(context.Background(), targets, hashes, opsChannel) }()
+			ops := drainedOps(opsChannel)
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ops, expected) {
+				t.Errorf("%v: expected the operations of the concatenation for splits %v", chunking, split)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opsChannel := make(chan RSyncOp, 1)
+	if err := CalculateDifferencesReaders(ctx, []io.Reader{bytes.NewReader(original)}, nil, opsChannel); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, found %v", err)
+	}
+	if _, ok := <-opsChannel; ok {
+		t.Errorf("expected the channel to be closed")
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+func Test_ComputeDeltaErrors(t *testing.T) {
+	errWrite := errors.New("write failed")
+	if err := ComputeDelta(bytes.NewReader([]byte("abcdef")), nil, 4, failingWriter{errWrite}); !errors.Is(err, errWrite) {
+		t.Errorf("expected %v, found %v", errWrite, err)
+	}
+
+	errRead := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader([]byte("abcdef")), iotest.ErrReader(errRead))
+	if err := ComputeDelta(r, nil, 4, io.Discard); !errors.Is(err, errRead) {
+		t.Errorf("expected %v, found %v", errRead, err)
+	}
+}
+
+func Test_SyncFile(t *testing.T) {
+	dir := t.TempDir()
+	outPath := filepath.Join(dir, "out")
+	pairs := []filePair{{"golang-original.bmp", "golang-modified.bmp"}, {"text-original.txt", "text-modified.txt"}}
+
+	for _, pair := range pairs {
+		if err := SyncFile("test-data/"+pair.original, "test-data/"+pair.modified, outPath, 1024); err != nil {
+			t.Fatal(err)
+		}
+		result, _ := os.ReadFile(outPath)
+		modified, _ := os.ReadFile("test-data/" + pair.modified)
+		if !bytes.Equal(result, modified) {
+			t.Errorf("SyncFile did not work as expected for %v", pair)
+		}
+	}
+}
+
+func Test_DeltaFiles(t *testing.T) {
+	pairs := []filePair{{"golang-original.bmp", "golang-modified.bmp"}, {"text-original.txt", "text-modified.txt"}}
+
+	for _, pair := range pairs {
+		var delta bytes.Buffer
+		if err := DeltaFiles("test-data/"+pair.original, "test-data/"+pair.modified, 1024, &delta); err != nil {
+			t.Fatal(err)
+		}
+		basis, err := os.Open("test-data/" + pair.original)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops := make(chan RSyncOp)
+		go ReadOps(&delta, ops)
+		var result bytes.Buffer
+		err = (&Config{BlockSize: 1024}).ApplyOpsAt(basis, ops, &result)
+		basis.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if modified, _ := os.ReadFile("test-data/" + pair.modified); !bytes.Equal(result.Bytes(), modified) {
+			t.Errorf("DeltaFiles did not work as expected for %v", pair)
+		}
+	}
+
+	for _, paths := range [][2]string{{"test-data/missing", "test-data/text-modified.txt"}, {"test-data/text-original.txt", "test-data/missing"}} {
+		if err := DeltaFiles(paths[0], paths[1], 4, io.Discard); err == nil {
+			t.Errorf("expected an error for %v", paths)
+		}
+	}
+}
+
+func Test_SyncCorruptedStream(t *testing.T) {
+	original := randomContent(1<<20, 81)
+	modified := modifiedContent(original, 50, 82)
+	config := &Config{BlockSize: 1024}
+	hashes := config.CalculateBlockHashes(original)
+	before := runtime.NumGoroutine()
+
+	//传输中出现未知的操作类型，解码失败后计算差异的协程也要退出
+	corrupt := func(r io.Reader) io.Reader {
+		return io.MultiReader(strings.NewReader("\xff"), r)
+	}
+	for i := 0; i < 10; i++ {
+		err := config.syncThrough(bytes.NewReader(original), bytes.NewReader(modified), hashes, io.Discard, corrupt)
+		if err == nil {
+			t.Fatalf("expected an error for a corrupted stream")
+		}
+	}
+	checkGoroutines(t, before)
+
+	var result bytes.Buffer
+	if err := config.syncThrough(bytes.NewReader(original), bytes.NewReader(modified), hashes, &result, nil); err != nil || !bytes.Equal(result.Bytes(), modified) {
+		t.Errorf("sync through a pipe did not work as expected: %v", err)
+	}
+	checkGoroutines(t, before)
+}
+
+func Test_SyncFileMissingInput(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "out")
+	if err := SyncFile("test-data/missing", "test-data/text-modified.txt", outPath, 4); err == nil {
+		t.Errorf("expected an error for a missing basis")
+	}
+	if err := SyncFile("test-data/text-original.txt", "test-data/missing", outPath, 4); err == nil {
+		t.Errorf("expected an error for a missing target")
+	}
+	if _, err := os.Stat(outPath); !os.IsNotExist(err) {
+		t.Errorf("expected no output file after a failure")
+	}
+}
+
+// Sends ops through a new channel.
+func opsChannelOf(ops ...RSyncOp) chan RSyncOp {
+	opsChannel := make(chan RSyncOp)
+	go func() {
+		defer close(opsChannel)
+		for _, op := range ops {
+			opsChannel <- op
+		}
+	}()
+	return opsChannel
+}
+
+func Test_ApplyOpsAt(t *testing.T) {
+	original, _ := os.ReadFile("test-data/golang-original.bmp")
+	modified, _ := os.ReadFile("test-data/golang-modified.bmp")
+	config := &Config{BlockSize: 1024}
+
+	opsChannel := make(chan RSyncOp)
+	go config.CalculateDifferences(modified, config.CalculateBlockHashes(original), opsChannel)
+	var out bytes.Buffer
+	if err := config.ApplyOpsAt(bytes.NewReader(original), opsChannel, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), modified) {
+		t.Errorf("ApplyOpsAt did not work as expected")
+	}
+}
+
+func Test_ApplyOpsAtHeaderLength(t *testing.T) {
+	basis := []byte("abcdefghij")
+	config := &Config{BlockSize: 4}
+	header := RSyncOp{opCode: HEADER, length: 6, blockSize: 4}
+
+	var out bytes.Buffer
+	if err := config.ApplyOpsAt(bytes.NewReader(basis), opsChannelOf(header, RSyncOp{opCode: BLOCK}, RSyncOp{opCode: DATA, data: []byte("xy")}), &out); err != nil || out.String() != "abcdxy" {
+		t.Errorf("expected %q, found %q: %v", "abcdxy", out.String(), err)
+	}
+	//输出多于或少于 HEADER 中的长度
+	for name, ops := range map[string][]RSyncOp{
+		"long":  {header, {opCode: BLOCK}, {opCode: DATA, data: []byte("xyz")}, {opCode: DATA}},
+		"short": {header, {opCode: BLOCK}},
+	} {
+		out.Reset()
+		if err := config.ApplyOpsAt(bytes.NewReader(basis), opsChannelOf(ops...), &out); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if out.Len() > header.length {
+			t.Errorf("%s: expected at most %d bytes written, found %d", name, header.length, out.Len())
+		}
+	}
+}
+
+type failingReaderAt struct{ err error }
+
+func (r failingReaderAt) ReadAt(p []byte, off int64) (int, error) { return 0, r.err }
+
+func Test_ApplyOpsAtErrors(t *testing.T) {
+	basis := bytes.NewReader([]byte("abcdefghij"))
+	config := &Config{BlockSize: 4}
+
+	errRead := errors.New("read failed")
+	if err := config.ApplyOpsAt(failingReaderAt{errRead}, opsChannelOf(RSyncOp{opCode: BLOCK}), io.Discard); !errors.Is(err, errRead) {
+		t.Errorf("expected %v, found %v", errRead, err)
+	}
+	errWrite := errors.New("write failed")
+	if err := config.ApplyOpsAt(basis, opsChannelOf(RSyncOp{opCode: DATA, data: []byte("x")}), failingWriter{errWrite}); !errors.Is(err, errWrite) {
+		t.Errorf("expected %v, found %v", errWrite, err)
+	}
+
+	malformed := []RSyncOp{
+		{opCode: BLOCK, blockIndex: 3},
+		{opCode: BLOCK, blockIndex: -1},
+		{opCode: BLOCKRUN, blockIndex: 1, blockCount: 3},
+		{opCode: 42},
+	}
+	for _, op := range malformed {
+		//后面的操作也必须被取完
+		if err := config.ApplyOpsAt(basis, opsChannelOf(op, RSyncOp{opCode: DATA}), io.Discard); err == nil {
+			t.Errorf("expected an error for %+v", op)
+		}
+	}
+}
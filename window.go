@@ -0,0 +1,104 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"io"
+)
+
+// slidingWindow A window of one block sliding over a reader, backed by a
+// buffer of bounded size. The buffer keeps the bytes from the start of the
+// unmatched data, so they can still be sent as a DATA operation, and the byte
+// before the window, which rolling needs. When the buffer is full the kept
+// bytes are moved to its front; if the unmatched data alone fills it, it is
+// handed to flush first.
+//读取数据流的滑动窗口
+type slidingWindow struct {
+	r         io.Reader
+	blockSize int
+	buf       []byte
+	eof       bool
+	//缓冲区内的下标：尚未发送的数据的起点，当前窗口的起点
+	pending, offset int
+}
+
+// Returns a window over r holding blocks of blockSize bytes, with a buffer of
+// at least size bytes.
+func newSlidingWindow(r io.Reader, blockSize, size int) *slidingWindow {
+	//至少能容纳两个块和窗口前的一个字节
+	return &slidingWindow{r: r, blockSize: blockSize, buf: make([]byte, 0, max(size, 2*blockSize+1))}
+}
+
+// Returns the block at the window, reading more of the reader if needed.
+// The block is shorter than blockSize only at the end of the reader, and empty
+// once the window is past it. With rolling the byte before the window is kept.
+// Unmatched data that has to leave the buffer is passed to flush.
+//返回当前窗口中的块
+func (w *slidingWindow) next(rolling bool, flush func(data []byte) error) ([]byte, error) {
+	if !w.eof && len(w.buf)-w.offset < w.blockSize {
+		if cap(w.buf)-w.offset < w.blockSize {
+			keep := w.pending
+			if rolling {
+				keep = min(keep, w.offset-1)
+			}
+			//未匹配的数据太长，先发送
+			if keep == 0 {
+				if err := flush(w.unmatched()); err != nil {
+					return nil, err
+				}
+				keep = w.offset
+				if rolling {
+					keep--
+				}
+			}
+			n := copy(w.buf, w.buf[keep:])
+			w.buf = w.buf[:n]
+			w.offset -= keep
+			w.pending -= keep
+		}
+		n, err := io.ReadAtLeast(w.r, w.buf[len(w.buf):cap(w.buf)], w.blockSize-(len(w.buf)-w.offset))
+		w.buf = w.buf[:len(w.buf)+n]
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			w.eof = true
+		default:
+			return nil, err
+		}
+	}
+	return w.buf[w.offset:min(w.offset+w.blockSize, len(w.buf))], nil
+}
+
+// Returns the byte just before the window.
+func (w *slidingWindow) previous() byte {
+	return w.buf[w.offset-1]
+}
+
+// Returns the data between the end of the last match and the window, and
+// marks it as sent.
+//返回尚未发送的数据
+func (w *slidingWindow) unmatched() []byte {
+	data := w.buf[w.pending:w.offset]
+	w.pending = w.offset
+	return data
+}
+
+// Moves the window one byte forward.
+func (w *slidingWindow) advance() {
+	w.offset++
+}
+
+// Moves the window past a matched block of n bytes.
+func (w *slidingWindow) skip(n int) {
+	w.offset += n
+	w.pending = w.offset
+}
+
+// Returns the unmatched data left once the window is past the end.
+func (w *slidingWindow) rest() []byte {
+	w.offset = len(w.buf)
+	return w.unmatched()
+}
@@ -0,0 +1,61 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the sliding window over a reader
+package rsync
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_SlidingWindow(t *testing.T) {
+	content := randomContent(1000, 11)
+	const blockSize = 7
+
+	//每隔一段匹配一个块，匹配会跨越缓冲区的重新填充
+	for _, matchEvery := range []int{0, 3, 13, 50} {
+		window := newSlidingWindow(iotest.OneByteReader(bytes.NewReader(content)), blockSize, 2*blockSize+1)
+		var out []byte
+		flush := func(data []byte) error {
+			out = append(out, data...)
+			return nil
+		}
+		var offset, steps int
+		rolling := false
+		for {
+			block, err := window.next(rolling, flush)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(block) == 0 {
+				break
+			}
+			if expected := content[offset:min(offset+blockSize, len(content))]; !bytes.Equal(block, expected) {
+				t.Fatalf("match every %d offset %d: expected block %v, found %v", matchEvery, offset, expected, block)
+			}
+			if rolling && window.previous() != content[offset-1] {
+				t.Fatalf("match every %d offset %d: wrong byte before the window", matchEvery, offset)
+			}
+			steps++
+			if matchEvery > 0 && steps%matchEvery == 0 {
+				flush(window.unmatched())
+				out = append(out, block...)
+				window.skip(len(block))
+				offset += len(block)
+				rolling = false
+				continue
+			}
+			window.advance()
+			offset++
+			rolling = true
+		}
+		flush(window.rest())
+		if !bytes.Equal(out, content) {
+			t.Errorf("match every %d: unmatched data and blocks do not add up to the content", matchEvery)
+		}
+	}
+}
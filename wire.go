@@ -0,0 +1,575 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"sync"
+)
+
+// Wire format of an operation:
+//
+//	BLOCK:     1 byte op code, uvarint block index
+//	BLOCKRUN:  1 byte op code, uvarint first block index, uvarint block count
+//	DATA:      1 byte op code, uvarint payload length, payload
+//	IDENTICAL: 1 byte op code
+//	COPY:      1 byte op code, uvarint offset, uvarint length
+//	HEADER:    1 byte op code, uvarint target length, uvarint block size,
+//	           1 byte length, strong hash name
+//	FULL:      1 byte op code, uvarint payload length, payload
+//
+// A FULL payload is compressed and checksummed like a DATA payload, with the
+// same flags.
+//
+// A DATA payload compressed with compress/flate sets compressedFlag in the op
+// code byte:
+//
+//	DATA:      1 byte op code | 0x80, uvarint payload length,
+//	           uvarint compressed length, compressed payload
+//
+// A DATA payload followed by its checksum sets checksumFlag, with or without
+// compressedFlag:
+//
+//	DATA:      1 byte op code | 0x40, uvarint payload length, payload,
+//	           4 bytes big-endian CRC-32 (IEEE) of the payload
+//
+// The checksum always covers the uncompressed payload.
+//
+// A BLOCK or BLOCKRUN operation on another basis than the first one, see
+// MergeSignatures, sets basisFlag and puts the basis before the other fields:
+//
+//	BLOCK:     1 byte op code | 0x20, uvarint basis, uvarint block index
+//
+//操作的编码格式：一个字节的操作类型，BLOCK 跟块下标，DATA 跟长度和数据
+
+const (
+	// compressedFlag 操作类型中表示 DATA 数据经过压缩的标志位
+	compressedFlag = 0x80
+	// checksumFlag 操作类型中表示 DATA 数据后跟校验和的标志位
+	checksumFlag = 0x40
+	// basisFlag 操作类型中表示 BLOCK 和 BLOCKRUN 后跟原数据编号的标志位
+	basisFlag = 0x20
+	// minCompressedData 短于这个长度的 DATA 不压缩，避免变长
+	minCompressedData = 256
+)
+
+// ErrDataChecksum Returned when decoding a DATA or FULL operation whose payload
+// does not match the checksum written with Config.ChecksumData.
+var ErrDataChecksum = errors.New("rsync: DATA payload does not match its checksum")
+
+// flateWriters Reusable compressors for DATA payloads.
+//压缩器缓冲池
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// Writes the encoding of op to w, compressing DATA payloads and appending
+// their checksum when enabled by the configuration. Payloads shorter than
+// minCompressedData, or that do not shrink, are written uncompressed.
+//按配置编码一个操作体，DATA 和 FULL 数据可以压缩，可以附加校验和
+func (c *Config) writeOp(w io.Writer, op RSyncOp) error {
+	if c == nil || (op.opCode != DATA && op.opCode != FULL) || (!c.CompressData && !c.ChecksumData) {
+		return writeOp(w, op)
+	}
+	if err := checkOpFields(op); err != nil {
+		return err
+	}
+	var flags byte
+	payload := op.data
+	if c.CompressData && len(op.data) >= minCompressedData {
+		var compressed bytes.Buffer
+		fw := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(fw)
+		fw.Reset(&compressed)
+		if _, err := fw.Write(op.data); err != nil {
+			return err
+		}
+		if err := fw.Close(); err != nil {
+			return err
+		}
+		if compressed.Len() < len(op.data) {
+			flags |= compressedFlag
+			payload = compressed.Bytes()
+		}
+	}
+	if c.ChecksumData {
+		flags |= checksumFlag
+	}
+	if flags == 0 {
+		return writeOp(w, op)
+	}
+	header := make([]byte, 1, 1+2*binary.MaxVarintLen64)
+	header[0] = byte(op.opCode) | flags
+	header = binary.AppendUvarint(header, uint64(len(op.data)))
+	if flags&compressedFlag != 0 {
+		header = binary.AppendUvarint(header, uint64(len(payload)))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	if flags&checksumFlag != 0 {
+		_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE(op.data)))
+		return err
+	}
+	return nil
+}
+
+// Writes the encoding of op to w.
+//将一个操作体编码后写入
+func writeOp(w io.Writer, op RSyncOp) error {
+	if err := checkOpFields(op); err != nil {
+		return err
+	}
+	header := make([]byte, 1, 1+binary.MaxVarintLen64)
+	header[0] = byte(op.opCode)
+	if op.basis != 0 && (op.opCode == BLOCK || op.opCode == BLOCKRUN) {
+		header[0] |= basisFlag
+		header = binary.AppendUvarint(header, uint64(op.basis))
+	}
+	switch op.opCode {
+	case BLOCK:
+		header = binary.AppendUvarint(header, uint64(op.blockIndex))
+		_, err := w.Write(header)
+		return err
+	case BLOCKRUN:
+		header = binary.AppendUvarint(header, uint64(op.blockIndex))
+		header = binary.AppendUvarint(header, uint64(op.blockCount))
+		_, err := w.Write(header)
+		return err
+	case DATA, FULL:
+		header = binary.AppendUvarint(header, uint64(len(op.data)))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		_, err := w.Write(op.data)
+		return err
+	case IDENTICAL:
+		_, err := w.Write(header)
+		return err
+	case COPY:
+		header = binary.AppendUvarint(header, uint64(op.offset))
+		header = binary.AppendUvarint(header, uint64(op.length))
+		_, err := w.Write(header)
+		return err
+	case HEADER:
+		if len(op.hash) > 255 {
+			return errors.New("rsync: hash name too long")
+		}
+		header = binary.AppendUvarint(header, uint64(op.length))
+		header = binary.AppendUvarint(header, uint64(op.blockSize))
+		header = append(header, byte(len(op.hash)))
+		header = append(header, op.hash...)
+		_, err := w.Write(header)
+		return err
+	default:
+		return fmt.Errorf("rsync: unknown op code %d", op.opCode)
+	}
+}
+
+// Checks that the fields of op are within the range readOp accepts, so every
+// operation writeOp encodes decodes back.
+//检查操作体的字段能否编码
+func checkOpFields(op RSyncOp) error {
+	fits := func(v int) bool {
+		return v >= 0 && v <= math.MaxInt32
+	}
+	ok := true
+	switch op.opCode {
+	case BLOCK:
+		ok = fits(op.basis) && fits(op.blockIndex)
+	case BLOCKRUN:
+		ok = fits(op.basis) && fits(op.blockIndex) && fits(op.blockCount)
+	case DATA, FULL:
+		ok = fits(len(op.data))
+	case COPY:
+		ok = fits(op.offset) && fits(op.length)
+	case HEADER:
+		ok = op.length >= 0 && fits(op.blockSize)
+	}
+	if !ok {
+		return fmt.Errorf("rsync: %v has a field out of range of the encoding", op)
+	}
+	return nil
+}
+
+// Returns the length of the encoding of op by writeOp, with the checksum of
+// Config.ChecksumData but without compression.
+//操作体编码后的长度，不计压缩
+func (c *Config) encodedLen(op RSyncOp) int {
+	n := 1
+	if op.basis != 0 {
+		n += uvarintLen(uint64(op.basis))
+	}
+	switch op.opCode {
+	case BLOCK:
+		n += uvarintLen(uint64(op.blockIndex))
+	case BLOCKRUN:
+		n += uvarintLen(uint64(op.blockIndex)) + uvarintLen(uint64(op.blockCount))
+	case DATA, FULL:
+		n += uvarintLen(uint64(len(op.data))) + len(op.data)
+		if c != nil && c.ChecksumData {
+			n += crc32.Size
+		}
+	case COPY:
+		n += uvarintLen(uint64(op.offset)) + uvarintLen(uint64(op.length))
+	case HEADER:
+		n += uvarintLen(uint64(op.length)) + uvarintLen(uint64(op.blockSize)) + 1 + len(op.hash)
+	}
+	return n
+}
+
+// Reads the fields of a HEADER operation, after its op code.
+//解码 HEADER 的参数
+func readHeader(r opReader) (RSyncOp, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return RSyncOp{}, unexpectedEOF(err)
+	}
+	blockSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return RSyncOp{}, unexpectedEOF(err)
+	}
+	if length > math.MaxInt || blockSize > math.MaxInt32 {
+		return RSyncOp{}, fmt.Errorf("rsync: header length %d or block size %d too large", length, blockSize)
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return RSyncOp{}, ErrShortRead
+	}
+	hash := make([]byte, n)
+	if _, err := io.ReadFull(r, hash); err != nil {
+		return RSyncOp{}, unexpectedEOF(err)
+	}
+	return RSyncOp{opCode: HEADER, length: int(length), blockSize: int(blockSize), hash: string(hash)}, nil
+}
+
+// Returns the length of the uvarint encoding of v.
+func uvarintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// opReader The reader needed to decode operations without reading ahead.
+type opReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Reads the next encoded operation from r.
+// Returns io.EOF when r is exhausted exactly at an operation boundary.
+//从数据流中解码下一个操作体
+func readOp(r opReader) (RSyncOp, error) {
+	opCode, err := r.ReadByte()
+	if err != nil {
+		return RSyncOp{}, err
+	}
+	//IDENTICAL 没有参数
+	if opCode == IDENTICAL {
+		return RSyncOp{opCode: IDENTICAL}, nil
+	}
+	if opCode == HEADER {
+		return readHeader(r)
+	}
+	var basis uint64
+	if opCode == BLOCK|basisFlag || opCode == BLOCKRUN|basisFlag {
+		if basis, err = binary.ReadUvarint(r); err != nil {
+			return RSyncOp{}, unexpectedEOF(err)
+		}
+		if basis > math.MaxInt32 {
+			return RSyncOp{}, fmt.Errorf("rsync: basis %d too large", basis)
+		}
+		opCode &^= basisFlag
+	}
+	value, err := binary.ReadUvarint(r)
+	if err != nil {
+		return RSyncOp{}, unexpectedEOF(err)
+	}
+	if value > math.MaxInt32 {
+		return RSyncOp{}, fmt.Errorf("rsync: op value %d too large", value)
+	}
+	switch int(opCode) {
+	case BLOCK:
+		return RSyncOp{opCode: BLOCK, blockIndex: int(value), basis: int(basis)}, nil
+	case BLOCKRUN:
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return RSyncOp{}, unexpectedEOF(err)
+		}
+		if count > math.MaxInt32 {
+			return RSyncOp{}, fmt.Errorf("rsync: block count %d too large", count)
+		}
+		return RSyncOp{opCode: BLOCKRUN, blockIndex: int(value), blockCount: int(count), basis: int(basis)}, nil
+	case COPY:
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return RSyncOp{}, unexpectedEOF(err)
+		}
+		if length > math.MaxInt32 {
+			return RSyncOp{}, fmt.Errorf("rsync: copy length %d too large", length)
+		}
+		return RSyncOp{opCode: COPY, offset: int(value), length: int(length)}, nil
+	case DATA, DATA | checksumFlag, DATA | compressedFlag, DATA | compressedFlag | checksumFlag,
+		FULL, FULL | checksumFlag, FULL | compressedFlag, FULL | compressedFlag | checksumFlag:
+		var data []byte
+		if opCode&compressedFlag != 0 {
+			data, err = readCompressedData(r, value)
+		} else {
+			//不信任声明的长度，按实际读到的数据分配内存
+			data, err = io.ReadAll(io.LimitReader(r, int64(value)))
+			if err == nil && uint64(len(data)) != value {
+				err = ErrShortRead
+			}
+		}
+		if err == nil && opCode&checksumFlag != 0 {
+			err = checkDataChecksum(r, data)
+		}
+		if err != nil {
+			return RSyncOp{}, err
+		}
+		return RSyncOp{opCode: int(opCode &^ (compressedFlag | checksumFlag)), data: data}, nil
+	default:
+		return RSyncOp{}, fmt.Errorf("rsync: unknown op code %d", opCode)
+	}
+}
+
+// Reads a compressed DATA payload of length bytes once inflated.
+//读取并解压 DATA 数据
+func readCompressedData(r opReader, length uint64) ([]byte, error) {
+	compressedLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if compressedLen > math.MaxInt32 {
+		return nil, fmt.Errorf("rsync: compressed length %d too large", compressedLen)
+	}
+	compressed, err := io.ReadAll(io.LimitReader(r, int64(compressedLen)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(compressed)) != compressedLen {
+		return nil, ErrShortRead
+	}
+	//多读一个字节以发现比声明更长的数据
+	fr := flate.NewReader(bytes.NewReader(compressed))
+	defer fr.Close()
+	data, err := io.ReadAll(io.LimitReader(fr, int64(length)+1))
+	if err != nil {
+		return nil, fmt.Errorf("rsync: corrupt compressed data: %w", err)
+	}
+	if uint64(len(data)) != length {
+		return nil, fmt.Errorf("rsync: compressed data holds %d bytes, expected %d", len(data), length)
+	}
+	return data, nil
+}
+
+// Reads the checksum following a DATA payload and checks it against data.
+//读取 DATA 数据后的校验和并校验
+func checkDataChecksum(r opReader, data []byte) error {
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc32.ChecksumIEEE(data) {
+		return ErrDataChecksum
+	}
+	return nil
+}
+
+// Reports an operation cut short as ErrShortRead.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return ErrShortRead
+	}
+	return err
+}
+
+// GobEncode Encodes the operation for encoding/gob with the wire format, so
+// operations can be sent with gob or net/rpc despite their unexported fields.
+//gob 编码
+func (op RSyncOp) GobEncode() ([]byte, error) {
+	return op.MarshalBinary()
+}
+
+// GobDecode Decodes an operation encoded by GobEncode.
+//gob 解码
+func (op *RSyncOp) GobDecode(data []byte) error {
+	return op.UnmarshalBinary(data)
+}
+
+// MarshalBinary Encodes the operation with the wire format.
+//将操作体编码为字节
+func (op RSyncOp) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeOp(&buf, op); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary Decodes an operation encoded by MarshalBinary.
+// data must hold exactly one operation.
+//从字节解码一个操作体
+func (op *RSyncOp) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	decoded, err := readOp(r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if r.Len() > 0 {
+		return fmt.Errorf("rsync: %d trailing bytes after op", r.Len())
+	}
+	*op = decoded
+	return nil
+}
+
+// WriteOps Encodes every operation received from the channel to w, so the
+// output of CalculateDifferences can be sent across the network.
+// On error the remaining operations are drained so the sender is not blocked.
+//将通道中的操作编码后写入 w
+func WriteOps(w io.Writer, opsChannel chan RSyncOp) error {
+	return defaultConfig.WriteOps(w, opsChannel)
+}
+
+// WriteOps Encodes every operation received from the channel to w,
+// compressing DATA payloads when Config.CompressData is set and appending
+// their checksum when Config.ChecksumData is set.
+func (c *Config) WriteOps(w io.Writer, opsChannel chan RSyncOp) error {
+	bw := bufio.NewWriter(w)
+	for op := range opsChannel {
+		if err := c.writeOp(bw, op); err != nil {
+			drainOps(opsChannel)
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// ReadOps Decodes the operations encoded in r, as written by ComputeDelta or
+// WriteOps, and sends them through the channel, which is closed on return.
+// The channel can be consumed by ApplyOps.
+//从数据流解码操作并放入通道
+func ReadOps(r io.Reader, opsChannel chan RSyncOp) error {
+	defer close(opsChannel)
+	br := bufio.NewReader(r)
+	for {
+		op, err := readOp(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		opsChannel <- op
+	}
+}
+
+// Format of a delta encoded by MarshalDelta: deltaMagic, 1 byte version,
+// uvarint number of operations, every operation as a uvarint length followed
+// by its wire format, then 4 bytes big-endian CRC-32 (IEEE) of all the bytes
+// before.
+//单个字节数组中的差异格式：头部，每个操作体前加长度，最后是校验和
+const (
+	deltaMagic = "RDLT"
+	// deltaVersion 当前的差异格式版本
+	deltaVersion = 1
+)
+
+// ErrDeltaChecksum Returned by UnmarshalDelta when the delta does not match
+// the checksum MarshalDelta appended to it, because it was corrupted or cut
+// short.
+var ErrDeltaChecksum = errors.New("rsync: delta does not match its checksum")
+
+// MarshalDelta Encodes ops into a single self-framing buffer, to store or
+// send a delta held in memory as one blob instead of streaming it with
+// WriteOps: a small header, every operation prefixed with the length of its
+// encoding, and a checksum of the whole, checked by UnmarshalDelta.
+//将操作体编码到一个字节数组中
+func MarshalDelta(ops []RSyncOp) ([]byte, error) {
+	return defaultConfig.MarshalDelta(ops)
+}
+
+// MarshalDelta Encodes ops into a single buffer, compressing DATA payloads
+// when Config.CompressData is set and appending their checksum when
+// Config.ChecksumData is set.
+func (c *Config) MarshalDelta(ops []RSyncOp) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(deltaMagic)+1+binary.MaxVarintLen64+crc32.Size))
+	buf.WriteString(deltaMagic)
+	buf.WriteByte(deltaVersion)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(ops))))
+	var encoded bytes.Buffer
+	for _, op := range ops {
+		encoded.Reset()
+		if err := c.writeOp(&encoded, op); err != nil {
+			return nil, err
+		}
+		buf.Write(binary.AppendUvarint(nil, uint64(encoded.Len())))
+		buf.Write(encoded.Bytes())
+	}
+	return binary.BigEndian.AppendUint32(buf.Bytes(), crc32.ChecksumIEEE(buf.Bytes())), nil
+}
+
+// UnmarshalDelta Decodes the operations encoded by MarshalDelta. It fails
+// with ErrDeltaChecksum when data was corrupted or truncated, before decoding
+// any operation.
+//从字节数组解码操作体
+func UnmarshalDelta(data []byte) ([]RSyncOp, error) {
+	if !bytes.HasPrefix(data, []byte(deltaMagic)) {
+		return nil, errors.New("rsync: not a delta")
+	}
+	if len(data) < len(deltaMagic)+1+crc32.Size {
+		return nil, ErrShortRead
+	}
+	body := data[:len(data)-crc32.Size]
+	if binary.BigEndian.Uint32(data[len(body):]) != crc32.ChecksumIEEE(body) {
+		return nil, ErrDeltaChecksum
+	}
+	r := bytes.NewReader(body[len(deltaMagic):])
+	if version, _ := r.ReadByte(); version != deltaVersion {
+		return nil, fmt.Errorf("rsync: unsupported delta version %d", version)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	//每个操作体至少占用两个字节，防止伪造的数量导致过量分配
+	if count > uint64(r.Len()/2) {
+		return nil, ErrShortRead
+	}
+	ops := make([]RSyncOp, count)
+	for i := range ops {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if length > uint64(r.Len()) {
+			return nil, ErrShortRead
+		}
+		start := len(body) - r.Len()
+		r.Seek(int64(length), io.SeekCurrent)
+		if err := ops[i].UnmarshalBinary(body[start : start+int(length)]); err != nil {
+			return nil, fmt.Errorf("rsync: operation %d: %w", i, err)
+		}
+	}
+	if r.Len() > 0 {
+		return nil, fmt.Errorf("rsync: %d trailing bytes after delta", r.Len())
+	}
+	return ops, nil
+}
@@ -0,0 +1,403 @@
+// Copyright 2012 Julian Gutierrez Oschmann (github.com/julian-gutierrez-o).
+// All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Unit tests for the wire format
+package rsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"flag"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_OpMarshalRoundTrip(t *testing.T) {
+	ops := []RSyncOp{
+		{opCode: BLOCK, blockIndex: 0},
+		{opCode: BLOCK, blockIndex: 300000},
+		{opCode: BLOCKRUN, blockIndex: 7, blockCount: 1200},
+		{opCode: DATA, data: []byte("some extra text")},
+		{opCode: DATA, data: []byte{}},
+		{opCode: IDENTICAL},
+		{opCode: COPY, offset: 4096, length: 300},
+		{opCode: HEADER, length: 1 << 40, blockSize: 4096, hash: "md5"},
+		{opCode: HEADER},
+	}
+
+	for _, op := range ops {
+		encoded, err := op.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded RSyncOp
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(op, decoded) {
+			t.Errorf("expected %+v, found %+v", op, decoded)
+		}
+	}
+}
+
+func Test_MarshalDelta(t *testing.T) {
+	ops := []RSyncOp{
+		{opCode: HEADER, length: 1 << 20, blockSize: 4096, hash: "md5"},
+		{opCode: BLOCK, blockIndex: 3},
+		{opCode: BLOCKRUN, blockIndex: 7, blockCount: 1200, basis: 2},
+		{opCode: DATA, data: []byte("some extra text")},
+		{opCode: DATA, data: []byte{}},
+		{opCode: COPY, offset: 4096, length: 300},
+		{opCode: IDENTICAL},
+	}
+	for _, ops := range [][]RSyncOp{ops, nil} {
+		data, err := MarshalDelta(ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := UnmarshalDelta(data)
+		if err != nil || len(decoded) != len(ops) || (len(ops) > 0 && !reflect.DeepEqual(decoded, ops)) {
+			t.Errorf("expected %+v, found %+v: %v", ops, decoded, err)
+		}
+	}
+
+	//压缩和校验和的 DATA 同样可以还原
+	original := randomContent(64*100, 76)
+	modified := append(bytes.Repeat([]byte("compressible "), 100), original[1000:]...)
+	config := &Config{BlockSize: 64, CompressData: true, ChecksumData: true}
+	data, err := config.MarshalDelta(config.Diff(original, modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(modified)-len(original)+1000 {
+		t.Errorf("expected compressed DATA, found %d bytes", len(data))
+	}
+	decoded, err := UnmarshalDelta(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := config.Patch(original, decoded); err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("expected the decoded delta to apply: %v", err)
+	}
+
+	//任何一个字节被修改或截断都能发现
+	for i := range data {
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0x10
+		if _, err := UnmarshalDelta(corrupted); err == nil {
+			t.Fatalf("expected an error for byte %d corrupted", i)
+		} else if i >= len(deltaMagic) && !errors.Is(err, ErrDeltaChecksum) {
+			t.Errorf("expected ErrDeltaChecksum for byte %d corrupted, found %v", i, err)
+		}
+		if _, err := UnmarshalDelta(data[:i]); err == nil {
+			t.Fatalf("expected an error for the delta cut at %d bytes", i)
+		}
+	}
+	//校验和正确但数量是伪造的
+	forged := binary.AppendUvarint([]byte(deltaMagic+"\x01"), 1<<40)
+	forged = binary.BigEndian.AppendUint32(forged, crc32.ChecksumIEEE(forged))
+	if _, err := UnmarshalDelta(forged); !errors.Is(err, ErrShortRead) {
+		t.Errorf("expected ErrShortRead for a forged count, found %v", err)
+	}
+}
+
+func Test_OpUnmarshalMalformed(t *testing.T) {
+	data, _ := RSyncOp{opCode: DATA, data: []byte("payload")}.MarshalBinary()
+	cases := map[string][]byte{
+		"empty":          {},
+		"truncated":      data[:len(data)-1],
+		"trailing bytes": append(data, 0),
+		"unknown op":     {42, 0},
+	}
+
+	for name, encoded := range cases {
+		var op RSyncOp
+		if err := op.UnmarshalBinary(encoded); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func Test_MarshalOutOfRange(t *testing.T) {
+	//解码时会被拒绝的字段在编码时就报错
+	ops := []RSyncOp{
+		{opCode: BLOCK, blockIndex: -1},
+		{opCode: BLOCK, blockIndex: 1, basis: -1},
+		{opCode: BLOCKRUN, blockIndex: 1, blockCount: -2},
+		{opCode: BLOCKRUN, blockIndex: math.MaxInt32 + 1, blockCount: 1},
+		{opCode: COPY, offset: -1, length: 4},
+		{opCode: COPY, offset: 0, length: -4},
+		{opCode: HEADER, length: -1, blockSize: BlockSize},
+	}
+	for _, op := range ops {
+		if _, err := op.MarshalBinary(); err == nil {
+			t.Errorf("%v: expected an error from MarshalBinary", op)
+		}
+		if _, err := MarshalDelta([]RSyncOp{op}); err == nil {
+			t.Errorf("%v: expected an error from MarshalDelta", op)
+		}
+		if err := (&Config{ChecksumData: true}).WriteOps(io.Discard, opsChannelOf(op)); err == nil {
+			t.Errorf("%v: expected an error from WriteOps", op)
+		}
+	}
+	//边界值可以往返
+	for _, op := range []RSyncOp{{opCode: BLOCK, blockIndex: math.MaxInt32}, {opCode: COPY, offset: 0, length: math.MaxInt32}} {
+		delta, err := MarshalDelta([]RSyncOp{op})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err := UnmarshalDelta(delta); err != nil || !reflect.DeepEqual(decoded, []RSyncOp{op}) {
+			t.Errorf("%v: expected the operation back: %v", op, err)
+		}
+	}
+}
+
+func Test_WriteOpsReadOps(t *testing.T) {
+	original, _ := os.ReadFile("test-data/text-original.txt")
+	modified, _ := os.ReadFile("test-data/text-modified.txt")
+	hashes := CalculateBlockHashes(original)
+
+	//发送方：计算不同并编码
+	opsChannel := make(chan RSyncOp)
+	go CalculateDifferences(modified, hashes, opsChannel)
+	var wire bytes.Buffer
+	if err := WriteOps(&wire, opsChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	//接收方：解码并组装
+	received := make(chan RSyncOp)
+	errs := make(chan error, 1)
+	go func() { errs <- ReadOps(&wire, received) }()
+	result, err := ApplyOps(original, received, len(modified))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, modified) {
+		t.Errorf("expected %q, found %q", modified, result)
+	}
+}
+
+func Test_ReadOpsTruncated(t *testing.T) {
+	data, _ := RSyncOp{opCode: DATA, data: []byte("payload")}.MarshalBinary()
+	opsChannel := make(chan RSyncOp, 1)
+	if err := ReadOps(bytes.NewReader(data[:4]), opsChannel); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected %v, found %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func Test_OpGobRoundTrip(t *testing.T) {
+	ops := []RSyncOp{
+		{opCode: BLOCK, blockIndex: 3},
+		{opCode: DATA, data: []byte("some extra text")},
+		{opCode: BLOCKRUN, blockIndex: 4, blockCount: 20},
+		{opCode: DATA, data: []byte{0, 1, 2}},
+		{opCode: BLOCK, blockIndex: 0},
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(ops); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []RSyncOp
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, ops) {
+		t.Errorf("expected %+v, found %+v", ops, decoded)
+	}
+}
+
+func Test_CompressedData(t *testing.T) {
+	compressible := bytes.Repeat([]byte("compressible text "), 100)
+	random := make([]byte, 1000)
+	rand.New(rand.NewSource(7)).Read(random)
+	ops := []RSyncOp{
+		{opCode: DATA, data: compressible},
+		{opCode: BLOCK, blockIndex: 2},
+		//太短，不压缩
+		{opCode: DATA, data: []byte("short")},
+		//压缩后不会变短，不压缩
+		{opCode: DATA, data: random},
+	}
+
+	config := &Config{CompressData: true}
+	var compressed, raw bytes.Buffer
+	if err := config.WriteOps(&compressed, opsChannelOf(ops...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteOps(&raw, opsChannelOf(ops...)); err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Len() >= raw.Len()-len(compressible)/2 {
+		t.Errorf("expected compressed encoding to shrink, found %d bytes against %d", compressed.Len(), raw.Len())
+	}
+	if compressed.Bytes()[0] != DATA|compressedFlag {
+		t.Errorf("expected the first payload to be flagged as compressed")
+	}
+
+	for name, wire := range map[string][]byte{"compressed": compressed.Bytes(), "raw": raw.Bytes()} {
+		decoded := decodeOps(t, wire)
+		if !reflect.DeepEqual(decoded, ops) {
+			t.Errorf("%s: expected %+v, found %+v", name, ops, decoded)
+		}
+	}
+
+	//流式计算差异同样可以压缩
+	original := bytes.Repeat([]byte("0123456789"), 100)
+	modified := append(append([]byte(nil), original...), compressible...)
+	config.BlockSize = 16
+	var delta bytes.Buffer
+	if err := config.ComputeDelta(bytes.NewReader(modified), config.CalculateBlockHashes(original), &delta); err != nil {
+		t.Fatal(err)
+	}
+	result, err := config.Patch(original, decodeOps(t, delta.Bytes()))
+	if err != nil || !bytes.Equal(result, modified) {
+		t.Errorf("sync with compressed data did not work as expected: %v", err)
+	}
+	if delta.Len() >= len(compressible) {
+		t.Errorf("expected a compressed delta, found %d bytes", delta.Len())
+	}
+}
+
+func Test_CompressedDataMalformed(t *testing.T) {
+	var encoded bytes.Buffer
+	config := &Config{CompressData: true}
+	if err := config.writeOp(&encoded, RSyncOp{opCode: DATA, data: bytes.Repeat([]byte("x"), 1000)}); err != nil {
+		t.Fatal(err)
+	}
+	data := encoded.Bytes()
+
+	//声明的长度与解压后的长度不符
+	wrongLength := append([]byte{data[0]}, binary.AppendUvarint(nil, 999)...)
+	wrongLength = append(wrongLength, data[1+uvarintLen(1000):]...)
+	//压缩数据损坏
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	for name, data := range map[string][]byte{"truncated": data[:len(data)-1], "wrong length": wrongLength, "corrupt": corrupt} {
+		var op RSyncOp
+		if err := op.UnmarshalBinary(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func Test_ChecksumData(t *testing.T) {
+	compressible := bytes.Repeat([]byte("compressible text "), 100)
+	ops := []RSyncOp{
+		{opCode: DATA, data: []byte("short")},
+		{opCode: BLOCKRUN, blockIndex: 1, blockCount: 3},
+		{opCode: DATA, data: compressible},
+	}
+
+	for _, config := range []*Config{{ChecksumData: true}, {ChecksumData: true, CompressData: true}} {
+		var wire bytes.Buffer
+		if err := config.WriteOps(&wire, opsChannelOf(ops...)); err != nil {
+			t.Fatal(err)
+		}
+		if wire.Bytes()[0] != DATA|checksumFlag {
+			t.Errorf("expected the first payload to be flagged with a checksum")
+		}
+		if decoded := decodeOps(t, wire.Bytes()); !reflect.DeepEqual(decoded, ops) {
+			t.Errorf("%+v: expected %+v, found %+v", config, ops, decoded)
+		}
+
+		//任何一个字节出错都能发现，包括压缩的数据和校验和本身
+		data := wire.Bytes()
+		for _, i := range []int{2, 6, len(data) - 8, len(data) - 1} {
+			corrupted := append([]byte(nil), data...)
+			corrupted[i] ^= 0x10
+			if err := ReadOps(bytes.NewReader(corrupted), make(chan RSyncOp, len(ops))); err == nil {
+				t.Errorf("%+v: expected an error for a corrupted byte at %d", config, i)
+			}
+		}
+		if err := ReadOps(bytes.NewReader(data[:len(data)-2]), make(chan RSyncOp, len(ops))); err != io.ErrUnexpectedEOF {
+			t.Errorf("%+v: expected io.ErrUnexpectedEOF for a truncated checksum, found %v", config, err)
+		}
+	}
+
+	corrupted := []byte{DATA | checksumFlag, 3, 'a', 'b', 'c', 0, 0, 0, 0}
+	if err := ReadOps(bytes.NewReader(corrupted), make(chan RSyncOp, 1)); err != ErrDataChecksum {
+		t.Errorf("expected ErrDataChecksum, found %v", err)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in test-data/golden")
+
+// Returns the golden deltas, built from explicit operations rather than
+// computed, so only a change of the encoding changes them.
+func goldenDeltas() map[string]struct {
+	config *Config
+	ops    []RSyncOp
+} {
+	var blocks []RSyncOp
+	for i := 0; i < 200; i += 10 {
+		blocks = append(blocks, RSyncOp{opCode: BLOCK, blockIndex: i}, RSyncOp{opCode: BLOCKRUN, blockIndex: i + 1, blockCount: 8})
+		if i%50 == 0 {
+			blocks = append(blocks, RSyncOp{opCode: DATA, data: []byte("edit")})
+		}
+	}
+	blocks = append(blocks, RSyncOp{opCode: BLOCK, blockIndex: 300000})
+	data := []RSyncOp{
+		{opCode: DATA, data: randomContent(3000, 44)},
+		{opCode: BLOCK, blockIndex: 7},
+		{opCode: DATA, data: randomContent(200, 45)},
+		{opCode: DATA, data: []byte{}},
+	}
+	all := []RSyncOp{
+		{opCode: HEADER, length: 70000, blockSize: 1024, hash: "md5"},
+		{opCode: IDENTICAL},
+		{opCode: DATA, data: []byte("checksummed")},
+		{opCode: COPY, offset: 5, length: 130},
+		{opCode: BLOCKRUN, blockIndex: 2, blockCount: 3},
+	}
+	return map[string]struct {
+		config *Config
+		ops    []RSyncOp
+	}{
+		"blocks": {nil, blocks},
+		"data":   {nil, data},
+		"all":    {&Config{ChecksumData: true}, all},
+	}
+}
+
+func Test_GoldenDeltas(t *testing.T) {
+	for name, golden := range goldenDeltas() {
+		path := "test-data/golden/" + name + ".delta"
+		var encoded bytes.Buffer
+		if err := golden.config.WriteOps(&encoded, opsChannelOf(golden.ops...)); err != nil {
+			t.Fatal(err)
+		}
+		if *updateGolden {
+			if err := os.MkdirAll("test-data/golden", 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, encoded.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//编码格式改变时失败，确实需要改变时用 -update 重写
+		if !bytes.Equal(encoded.Bytes(), expected) {
+			t.Errorf("%s: encoding differs from %s", name, path)
+		}
+		if decoded := decodeOps(t, expected); !reflect.DeepEqual(decoded, golden.ops) {
+			t.Errorf("%s: expected %v, found %v", name, golden.ops, decoded)
+		}
+	}
+}